@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/storage"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/health"
+	"github.com/similadayo/pkg/lifecycle"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/metrics"
+	"github.com/similadayo/pkg/migrate"
+	"github.com/similadayo/pkg/ratelimit"
+	"github.com/similadayo/pkg/tracing"
+	"github.com/similadayo/pkg/utils"
+)
+
+func main() {
+	logger := logging.NewLogger()
+
+	//settings come from defaults, configs/collab-service.yaml, the environment and flags
+	loader := config.NewLoader("collab-service")
+	cfg, args, err := loader.Load()
+	if err != nil {
+		logger.Fatal("failed to load configuration", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	logger.SetLevel(cfg.Log.Level)
+
+	//SIGINT and SIGTERM drain the server, then the shutdown hooks run in reverse
+	app := lifecycle.New(logger, cfg.Server.ShutdownTimeout)
+	app.DrainDelay = cfg.Server.DrainDelay
+
+	//SIGHUP reloads the log level and rate limits
+	reloader := config.NewReloader(loader, cfg)
+	reloader.OnReload(func(cfg *config.Config) {
+		logger.SetLevel(cfg.Log.Level)
+	})
+	reloader.Watch(app.Stopping(), func(ignored []string, err error) {
+		if err != nil {
+			logger.Error("failed to reload configuration", map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		if len(ignored) > 0 {
+			logger.Warn("configuration changes need a restart", map[string]interface{}{
+				"settings": ignored,
+			})
+		}
+	})
+
+	//spans go to the tracing exporter; the hook runs last so every span is flushed
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "collab-service")
+	if err != nil {
+		logger.Fatal("failed to set up tracing", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
+	//database.driver selects sqlite, postgres or memory
+	backend, err := storage.Open(cfg.Database.Driver, cfg.Database.URL)
+	if err != nil {
+		logger.Fatal("failed to connect database", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	app.OnShutdown("database", func(context.Context) error {
+		return backend.Close()
+	})
+
+	//readiness fails while a dependency is down and once shutdown begins
+	checks := health.NewRegistry()
+	checks.ShutdownOn(app.Stopping())
+	for _, check := range backend.HealthChecks(uint64(cfg.Database.MinFreeDiskMB) << 20) {
+		checks.Register(check)
+	}
+	checks.Register(health.Check{
+		Name:     "user-service",
+		Run:      health.HTTP(http.DefaultClient, cfg.Auth.JWKSURL),
+		Optional: true,
+	})
+
+	//"migrate status|up|down|to <version>" manages the schema and exits
+	if len(args) > 0 && args[0] == "migrate" {
+		migrator, err := backend.Migrator()
+		if err == nil {
+			err = migrate.Run(migrator, args[1:], os.Stdout)
+		}
+		if err != nil {
+			logger.Fatal("migration failed", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	//apply pending migrations on boot unless the schema is managed separately
+	err = backend.Prepare(cfg.Database.MigrateOnStart)
+	if err != nil {
+		logger.Fatal("failed to migrate database", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	//tokens are issued by the user service; verify them with its public keys
+	utils.SetKeySource(utils.NewRemoteKeySet(cfg.Auth.JWKSURL))
+	utils.SetRevocationChecker(backend.Users)
+
+	//Initialize gin router, without gin's logger: it writes query strings,
+	//which can hold tokens, so requests are logged by auth.LoggerMiddleWare
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	//client addresses are rate limited, so only listed proxies may set them
+	err = r.SetTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Fatal("invalid trusted proxies", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	r.Use(auth.RequestIDMiddleware(), metrics.Middleware(metrics.Default))
+	r.GET("/healthz", health.LivenessHandler())
+	r.GET("/readyz", checks.ReadinessHandler())
+	r.GET("/metrics", metrics.Default.Handler())
+
+	//probes and scrapes above are not traced
+	r.Use(tracing.Middleware(), apierror.Middleware(logger))
+
+	//Initialize collaboration repository
+	collabRepo := backend.Collaborations
+	collabService := collaboration.NewService(collabRepo)
+	collabHandler := collaboration.NewHandler(collabService)
+
+	//requests are limited per user once authenticated
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(cfg.RateLimit.MaxKeys), cfg.RateLimit)
+	if err != nil {
+		logger.Fatal("invalid rate limits", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	limiter.Logger = logger
+	reloader.OnReload(func(cfg *config.Config) {
+		err := limiter.Configure(cfg.RateLimit)
+		if err != nil {
+			logger.Error("failed to apply rate limits", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	})
+
+	//API Routes; users who have not verified their email are limited by verification.unverified_access
+	r.Use(auth.LoggerMiddleWare(logger), auth.AuthMiddleware(), auth.VerifiedEmailMiddleware(cfg.Verification.UnverifiedAccess), limiter.Middleware())
+	api := r.Group("/api")
+	{
+		collabRoutes := api.Group("/collaborations")
+		{
+			collabRoutes.POST("/", collabHandler.CreateCollaborationHandler)
+			collabRoutes.GET("/", collabHandler.GetMyCollaborationsHandler)
+			collabRoutes.GET("/:id", collabHandler.GetCollaborationByIDHandler)
+			collabRoutes.GET("/project/:projectId", collabHandler.GetCollaborationsByProjectIDHandler)
+			collabRoutes.GET("/:id/users", collabHandler.GetMembersHandler)
+			collabRoutes.POST("/:id/users", collabHandler.InviteUserHandler)
+			collabRoutes.PUT("/:id/users/:userId", collabHandler.ChangeRoleHandler)
+			collabRoutes.DELETE("/:id/users/:userId", collabHandler.RemoveUserHandler)
+			collabRoutes.POST("/:id/transfer", collabHandler.TransferOwnershipHandler)
+			collabRoutes.POST("/:id/documents", collabHandler.CreateDocumentHandler)
+			collabRoutes.PUT("/:id/documents/:documentId", collabHandler.UpdateDocumentHandler)
+			collabRoutes.GET("/:id/documents/:documentId/versions", collabHandler.ListDocumentVersionsHandler)
+			collabRoutes.GET("/:id/documents/:documentId/versions/:version", collabHandler.GetDocumentVersionHandler)
+			collabRoutes.POST("/:id/documents/:documentId/versions/:version/restore", collabHandler.RestoreDocumentVersionHandler)
+			collabRoutes.GET("/:id/documents/:documentId/diff", collabHandler.DiffDocumentVersionsHandler)
+			collabRoutes.POST("/:id/crdt-documents", collabHandler.CreateCRDTDocumentHandler)
+			collabRoutes.GET("/:id/crdt-documents/:documentId", collabHandler.GetCRDTDocumentHandler)
+			collabRoutes.POST("/:id/crdt-documents/:documentId/sync", collabHandler.SyncCRDTDocumentHandler)
+		}
+	}
+
+	err = app.Run(context.Background(), lifecycle.NewServer(cfg.Server, r))
+	if err != nil {
+		logger.Fatal("server stopped", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
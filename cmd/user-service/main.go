@@ -1,69 +1,292 @@
 package main
 
 import (
+	"context"
+	"os"
+
 	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/storage"
 	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
 	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/health"
+	"github.com/similadayo/pkg/lifecycle"
 	"github.com/similadayo/pkg/logging"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/metrics"
+	"github.com/similadayo/pkg/migrate"
+	"github.com/similadayo/pkg/ratelimit"
+	"github.com/similadayo/pkg/tracing"
+	"github.com/similadayo/pkg/utils"
 )
 
 func main() {
 	logger := logging.NewLogger()
 
-	//initialize sqlite database
-	db, err := gorm.Open(sqlite.Open("User.db"), &gorm.Config{})
+	//settings come from defaults, configs/user-service.yaml, the environment and flags
+	loader := config.NewLoader("user-service")
+	cfg, args, err := loader.Load()
+	if err != nil {
+		logger.Fatal("failed to load configuration", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	logger.SetLevel(cfg.Log.Level)
+
+	//SIGINT and SIGTERM drain the server, then the shutdown hooks run in reverse
+	app := lifecycle.New(logger, cfg.Server.ShutdownTimeout)
+	app.DrainDelay = cfg.Server.DrainDelay
+
+	//SIGHUP reloads the log level and rate limits
+	reloader := config.NewReloader(loader, cfg)
+	reloader.OnReload(func(cfg *config.Config) {
+		logger.SetLevel(cfg.Log.Level)
+	})
+	reloader.Watch(app.Stopping(), func(ignored []string, err error) {
+		if err != nil {
+			logger.Error("failed to reload configuration", map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		if len(ignored) > 0 {
+			logger.Warn("configuration changes need a restart", map[string]interface{}{
+				"settings": ignored,
+			})
+		}
+	})
+
+	//spans go to the tracing exporter; the hook runs last so every span is flushed
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "user-service")
+	if err != nil {
+		logger.Fatal("failed to set up tracing", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
+	//database.driver selects sqlite, postgres or memory
+	backend, err := storage.Open(cfg.Database.Driver, cfg.Database.URL)
 	if err != nil {
 		logger.Fatal("failed to connect database", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
+	app.OnShutdown("database", func(context.Context) error {
+		return backend.Close()
+	})
+
+	//readiness fails while a dependency is down and once shutdown begins
+	checks := health.NewRegistry()
+	checks.ShutdownOn(app.Stopping())
+	for _, check := range backend.HealthChecks(uint64(cfg.Database.MinFreeDiskMB) << 20) {
+		checks.Register(check)
+	}
 
-	//auto migrate db
-	err = db.AutoMigrate(&user.User{})
+	//"migrate status|up|down|to <version>" manages the schema and exits
+	if len(args) > 0 && args[0] == "migrate" {
+		migrator, err := backend.Migrator()
+		if err == nil {
+			err = migrate.Run(migrator, args[1:], os.Stdout)
+		}
+		if err != nil {
+			logger.Fatal("migration failed", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+
+	//apply pending migrations on boot unless the schema is managed separately
+	err = backend.Prepare(cfg.Database.MigrateOnStart)
 	if err != nil {
 		logger.Fatal("failed to migrate database", map[string]interface{}{
 			"error": err.Error(),
 		})
 	}
 
-	//Initialize gin router
-	r := gin.Default()
+	utils.AccessTokenTTL = cfg.Auth.AccessTokenTTL
+	utils.RefreshTokenTTL = cfg.Auth.RefreshTokenTTL
+	utils.SetSecretKey(cfg.Auth.SecretKey)
+
+	//initialize signing keys, rotating them in the background
+	keyRing, err := utils.NewKeyRing(cfg.Auth.SigningAlgorithm, cfg.Auth.KeyDir)
+	if err != nil {
+		logger.Fatal("failed to initialize signing keys", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	utils.SetKeyRing(keyRing)
+
+	keyRing.StartRotation(cfg.Auth.KeyRotationInterval, app.Stopping(), func(err error) {
+		logger.Error("failed to rotate signing key", map[string]interface{}{
+			"error": err.Error(),
+		})
+	})
+
+	//Initialize gin router, without gin's logger: it writes query strings,
+	//which can hold tokens, so requests are logged by auth.LoggerMiddleWare
+	r := gin.New()
+	r.Use(gin.Recovery())
+
+	//client addresses count failed logins, so only listed proxies may set them
+	err = r.SetTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Fatal("invalid trusted proxies", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	r.Use(auth.RequestIDMiddleware(), metrics.Middleware(metrics.Default))
+	r.GET("/healthz", health.LivenessHandler())
+	r.GET("/readyz", checks.ReadinessHandler())
+	r.GET("/metrics", metrics.Default.Handler())
+
+	//probes and scrapes above are not traced
+	r.Use(tracing.Middleware(), apierror.Middleware(logger))
 
 	//Initialize user repository
-	userRepo := user.NewRepository(db)
+	userRepo := backend.Users
 	userService := user.NewService(userRepo, logger)
+	userService.BcryptCost = cfg.Auth.BcryptCost
 	userHandler := user.NewHandler(userService)
 
+	//verification, password reset and lockout emails are sent through mail.driver
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		logger.Fatal("failed to set up mail", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	userService.PasswordReset = &user.PasswordReset{
+		Mailer:   mailer,
+		LinkURL:  cfg.PasswordReset.LinkURL,
+		TokenTTL: cfg.PasswordReset.TokenTTL,
+	}
+
+	//new accounts verify their email through a signed link
+	if cfg.Verification.Enabled {
+		userService.Verification = &user.Verification{
+			Mailer:         mailer,
+			Signer:         newSigner(logger, cfg.Verification.Secret, "verification.secret"),
+			LinkURL:        cfg.Verification.LinkURL,
+			TokenTTL:       cfg.Verification.TokenTTL,
+			ResendInterval: cfg.Verification.ResendInterval,
+			Access:         cfg.Verification.UnverifiedAccess,
+		}
+	}
+	verified := auth.VerifiedEmailMiddleware(cfg.Verification.UnverifiedAccess)
+
+	//users may add an authenticator app; admins may remove it for them
+	userService.MFA = &user.MFA{
+		Issuer:       cfg.MFA.Issuer,
+		Signer:       newSigner(logger, cfg.MFA.ChallengeSecret, "mfa.challenge_secret"),
+		ChallengeTTL: cfg.MFA.ChallengeTTL,
+	}
+	userService.Admins = cfg.Auth.Admins
+
+	//failed logins slow down and then lock the account and client address
+	userService.Lockout = &user.Lockout{
+		MaxFailures:   cfg.Lockout.MaxFailures,
+		MaxIPFailures: cfg.Lockout.MaxIPFailures,
+		Duration:      cfg.Lockout.Duration,
+		Window:        cfg.Lockout.Window,
+		BaseDelay:     cfg.Lockout.BaseDelay,
+		MaxDelay:      cfg.Lockout.MaxDelay,
+		Mailer:        mailer,
+	}
+
+	//access tokens are checked against the revocation list on every request
+	utils.SetRevocationChecker(userRepo)
+
 	// initialize auth package
 	authService := auth.AuthMiddleware()
 
+	//requests are limited per client, more tightly on the routes worth guessing at
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(cfg.RateLimit.MaxKeys), cfg.RateLimit)
+	if err != nil {
+		logger.Fatal("invalid rate limits", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	limiter.Logger = logger
+	reloader.OnReload(func(cfg *config.Config) {
+		err := limiter.Configure(cfg.RateLimit)
+		if err != nil {
+			logger.Error("failed to apply rate limits", map[string]interface{}{
+				"error": err.Error(),
+			})
+		}
+	})
+
 	//API Routes
 	r.Use(auth.LoggerMiddleWare(logger))
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler(keyRing))
 	api := r.Group("/api")
+	api.Use(limiter.Middleware())
 	{
 		userRoutes := api.Group("/users")
 		{
 			userRoutes.POST("/", userHandler.Register)
 			userRoutes.POST("/login", userHandler.Login)
+			userRoutes.POST("/login/mfa", userHandler.LoginMFA)
+			userRoutes.POST("/refresh", userHandler.Refresh)
+			userRoutes.GET("/verify", userHandler.VerifyEmail)
+			userRoutes.POST("/verify", userHandler.VerifyEmail)
+			userRoutes.POST("/verify/resend", userHandler.ResendVerification)
+			userRoutes.POST("/password/forgot", userHandler.ForgotPassword)
+			userRoutes.POST("/password/reset", userHandler.ResetPassword)
 		}
 	}
 
 	//apply middleware with the logger and auth
 	r.Use(auth.LoggerMiddleWare(logger), authService)
 	apiAuth := r.Group("/api/auth")
+	apiAuth.Use(limiter.Middleware())
 	{
 		userRoutes := apiAuth.Group("/users")
 		{
 			userRoutes.GET("/user/:username", userHandler.GetUserByUserNameHandler)
 			userRoutes.GET("/:id", userHandler.GetUserByIDHandler)
-			userRoutes.PUT("/:id", userHandler.UpdateUserHandler)
-			userRoutes.DELETE("/:id", userHandler.DeleteUserHandler)
+			userRoutes.PUT("/:id", verified, userHandler.UpdateUserHandler)
+			userRoutes.DELETE("/:id", verified, userHandler.DeleteUserHandler)
 			userRoutes.GET("/profile", userHandler.GetUserProfileHandler)
 			userRoutes.GET("/filter/:user", userHandler.FilterUserByNameHandler)
+			userRoutes.POST("/logout", userHandler.Logout)
+			userRoutes.POST("/password", userHandler.ChangePassword)
+			userRoutes.POST("/mfa/totp", userHandler.EnrollTOTP)
+			userRoutes.POST("/mfa/totp/confirm", userHandler.ConfirmTOTP)
+			userRoutes.POST("/mfa/recovery-codes", userHandler.RegenerateRecoveryCodes)
+			userRoutes.POST("/mfa/disable", userHandler.DisableTOTP)
+			userRoutes.DELETE("/:id/mfa", userHandler.AdminDisableTOTP)
+			userRoutes.DELETE("/:id/lockout", userHandler.AdminUnlockUser)
 		}
 	}
 
-	r.Run(":8081")
+	err = app.Run(context.Background(), lifecycle.NewServer(cfg.Server, r))
+	if err != nil {
+		logger.Fatal("server stopped", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
+
+// newSigner signs links and challenges with secret. Without one, a random
+// secret is used, so what was signed before a restart stops working.
+func newSigner(logger *logging.Logger, secret string, setting string) *utils.Signer {
+	if secret != "" {
+		return utils.NewSigner([]byte(secret))
+	}
+
+	logger.Warn("using a random signing secret", map[string]interface{}{
+		"setting": setting,
+	})
+	signer, err := utils.NewRandomSigner()
+	if err != nil {
+		logger.Fatal("failed to create signing secret", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+
+	return signer
 }
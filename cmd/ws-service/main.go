@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/realtime"
+	"github.com/similadayo/internal/storage"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/health"
+	"github.com/similadayo/pkg/lifecycle"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/metrics"
+	"github.com/similadayo/pkg/tracing"
+	"github.com/similadayo/pkg/utils"
+)
+
+func main() {
+	logger := logging.NewLogger()
+
+	//settings come from defaults, configs/ws-service.yaml, the environment and flags
+	loader := config.NewLoader("ws-service")
+	cfg, _, err := loader.Load()
+	if err != nil {
+		logger.Fatal("failed to load configuration", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	logger.SetLevel(cfg.Log.Level)
+
+	//SIGINT and SIGTERM drain the server, then the shutdown hooks run in reverse
+	app := lifecycle.New(logger, cfg.Server.ShutdownTimeout)
+	app.DrainDelay = cfg.Server.DrainDelay
+
+	//SIGHUP reloads the log level and rate limits
+	reloader := config.NewReloader(loader, cfg)
+	reloader.OnReload(func(cfg *config.Config) {
+		logger.SetLevel(cfg.Log.Level)
+	})
+	reloader.Watch(app.Stopping(), func(ignored []string, err error) {
+		if err != nil {
+			logger.Error("failed to reload configuration", map[string]interface{}{
+				"error": err.Error(),
+			})
+			return
+		}
+		if len(ignored) > 0 {
+			logger.Warn("configuration changes need a restart", map[string]interface{}{
+				"settings": ignored,
+			})
+		}
+	})
+
+	//spans go to the tracing exporter; the hook runs last so every span is flushed
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, "ws-service")
+	if err != nil {
+		logger.Fatal("failed to set up tracing", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	app.OnShutdown("tracing", shutdownTracing)
+
+	//membership is checked against the shared collaboration database
+	backend, err := storage.Open(cfg.Database.Driver, cfg.Database.URL)
+	if err != nil {
+		logger.Fatal("failed to connect database", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+	app.OnShutdown("database", func(context.Context) error {
+		return backend.Close()
+	})
+
+	//readiness fails while a dependency is down and once shutdown begins
+	checks := health.NewRegistry()
+	checks.ShutdownOn(app.Stopping())
+	for _, check := range backend.HealthChecks(uint64(cfg.Database.MinFreeDiskMB) << 20) {
+		checks.Register(check)
+	}
+	checks.Register(health.Check{
+		Name:     "user-service",
+		Run:      health.HTTP(http.DefaultClient, cfg.Auth.JWKSURL),
+		Optional: true,
+	})
+
+	//tokens are issued by the user service; verify them with its public keys
+	utils.SetKeySource(utils.NewRemoteKeySet(cfg.Auth.JWKSURL))
+	userRepo := backend.Users
+	utils.SetRevocationChecker(userRepo)
+
+	//Initialize gin router, without gin's logger: it writes query strings,
+	//which can hold tokens, so requests are logged by auth.LoggerMiddleWare
+	r := gin.New()
+	r.Use(gin.Recovery())
+	r.Use(auth.RequestIDMiddleware(), metrics.Middleware(metrics.Default))
+	r.GET("/healthz", health.LivenessHandler())
+	r.GET("/readyz", checks.ReadinessHandler())
+	r.GET("/metrics", metrics.Default.Handler())
+
+	//probes and scrapes above are not traced
+	r.Use(tracing.Middleware(), apierror.Middleware(logger))
+
+	collabService := collaboration.NewService(backend.Collaborations)
+
+	hub := realtime.NewHub(logger)
+	app.OnShutdown("websocket rooms", hub.Shutdown)
+	presence := realtime.NewPresence(hub, userRepo)
+	go presence.Run(15*time.Second, app.Stopping())
+
+	realtime.RegisterDocumentHandlers(hub, collabService, presence)
+	realtime.RegisterCRDTHandlers(hub, collabService)
+	wsHandler := realtime.NewHandler(hub, collabService, cfg.WebSocket.AllowedOrigins)
+	wsHandler.Presence = presence
+	wsHandler.UnverifiedAccess = cfg.Verification.UnverifiedAccess
+
+	r.Use(auth.LoggerMiddleWare(logger))
+	r.GET("/ws/collaborations/:id", wsHandler.ServeWS)
+
+	presenceRoutes := r.Group("/api/collaborations")
+	presenceRoutes.Use(auth.AuthMiddleware())
+	{
+		presenceRoutes.GET("/:id/presence", wsHandler.PresenceHandler)
+	}
+
+	err = app.Run(context.Background(), lifecycle.NewServer(cfg.Server, r))
+	if err != nil {
+		logger.Fatal("server stopped", map[string]interface{}{
+			"error": err.Error(),
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package collaboration
+
+import (
+	"errors"
+
+	"github.com/similadayo/pkg/apierror"
+	"gorm.io/gorm"
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleEditor    = "editor"
+	RoleCommenter = "commenter"
+	RoleViewer    = "viewer"
+)
+
+// Action is something a member may attempt within a collaboration.
+type Action int
+
+const (
+	ActionView Action = iota
+	ActionComment
+	ActionEditDocument
+	ActionAddDocument
+	ActionManageMembers
+	ActionTransferOwnership
+)
+
+var (
+	ErrNotMember = apierror.Forbidden("not_member", "user is not a member of this collaboration")
+
+	ErrForbidden = apierror.Forbidden("insufficient_role", "insufficient role for this action")
+
+	ErrLastOwner = apierror.Conflict("last_owner", "a collaboration must keep at least one owner")
+
+	ErrAlreadyMember = apierror.Conflict("already_member", "user is already a member of this collaboration, change their role instead")
+
+	ErrInvalidRole = apierror.BadRequest("invalid_role", "invalid role")
+)
+
+var roleRank = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+var requiredRole = map[Action]string{
+	ActionView:              RoleViewer,
+	ActionComment:           RoleCommenter,
+	ActionEditDocument:      RoleEditor,
+	ActionAddDocument:       RoleEditor,
+	ActionManageMembers:     RoleOwner,
+	ActionTransferOwnership: RoleOwner,
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRank[role]
+	return ok
+}
+
+// RoleAllows reports whether role is sufficient to perform action.
+func RoleAllows(role string, action Action) bool {
+	required, ok := requiredRole[action]
+	if !ok {
+		return false
+	}
+
+	return roleRank[role] >= roleRank[required]
+}
+
+// Authorize returns nil if userID may perform action in the collaboration,
+// ErrNotMember if they do not belong to it and ErrForbidden if their role is too low.
+func (s *Service) Authorize(collaborationID string, userID string, action Action) error {
+	membership, err := s.Repo.GetMembership(collaborationID, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+
+	if !RoleAllows(membership.Role, action) {
+		return ErrForbidden
+	}
+
+	return nil
+}
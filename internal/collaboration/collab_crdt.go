@@ -0,0 +1,202 @@
+package collaboration
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/crdt"
+	"github.com/similadayo/internal/user"
+	"gorm.io/gorm"
+)
+
+// crdtCompactThreshold is the number of stored updates after which a
+// document's updates are merged into one row.
+const crdtCompactThreshold = 100
+
+// CRDTSyncResult is the server's half of a sync handshake: the updates the
+// client is missing and the server's state vector, so the client can reply
+// with whatever the server is missing.
+type CRDTSyncResult struct {
+	DocumentID  string `json:"documentId"`
+	Update      []byte `json:"update"`
+	StateVector []byte `json:"stateVector"`
+}
+
+func (r *SQLRepository) CreateCRDTDocument(document *user.CRDTDocument) error {
+	return r.DB.Create(document).Error
+}
+
+func (r *SQLRepository) GetCRDTDocument(collaborationID string, documentID string) (*user.CRDTDocument, error) {
+	var document user.CRDTDocument
+	err := r.DB.Where("collaboration_id = ? AND id = ?", collaborationID, documentID).First(&document).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &document, nil
+}
+
+func (r *SQLRepository) GetCRDTUpdates(documentID string) ([]user.CRDTUpdate, error) {
+	var updates []user.CRDTUpdate
+	err := r.DB.Where("document_id = ?", documentID).Order("id").Find(&updates).Error
+	return updates, err
+}
+
+// AppendCRDTUpdate stores an update and refreshes the document's cached content.
+func (r *SQLRepository) AppendCRDTUpdate(documentID string, update []byte, content string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		err := tx.Create(&user.CRDTUpdate{
+			DocumentID: documentID,
+			Update:     update,
+			Created:    now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&user.CRDTDocument{}).Where("id = ?", documentID).
+			Updates(map[string]interface{}{"content": content, "updated": now}).Error
+	})
+}
+
+// CompactCRDTUpdates replaces the given stored updates with merged.
+func (r *SQLRepository) CompactCRDTUpdates(documentID string, replaced []uint, merged []byte) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("document_id = ? AND id IN ?", documentID, replaced).Delete(&user.CRDTUpdate{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&user.CRDTUpdate{
+			DocumentID: documentID,
+			Update:     merged,
+			Created:    time.Now(),
+		}).Error
+	})
+}
+
+func (s *Service) CreateCRDTDocument(actorID string, collaborationID string, name string, title string) (*user.CRDTDocument, error) {
+	err := s.Authorize(collaborationID, actorID, ActionAddDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	document := &user.CRDTDocument{
+		ID:              uuid.New().String(),
+		CollaborationID: collaborationID,
+		Name:            name,
+		Title:           title,
+		Created:         time.Now(),
+		Updated:         time.Now(),
+	}
+
+	err = s.Repo.CreateCRDTDocument(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+func (s *Service) GetCRDTDocument(actorID string, collaborationID string, documentID string) (*user.CRDTDocument, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Repo.GetCRDTDocument(collaborationID, documentID)
+}
+
+// SyncCRDTDocument runs one step of the sync handshake. The client sends its
+// state vector and, optionally, updates the server has not seen; the server
+// stores the updates and answers with everything the client is missing.
+func (s *Service) SyncCRDTDocument(actorID string, collaborationID string, documentID string, stateVector []byte, update []byte) (*CRDTSyncResult, error) {
+	action := ActionView
+	if len(update) > 0 {
+		action = ActionEditDocument
+	}
+
+	err := s.Authorize(collaborationID, actorID, action)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Repo.GetCRDTDocument(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stateVector) > 0 {
+		_, err = crdt.DecodeStateVector(stateVector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the stored content is computed from the updates read here, so a
+	// concurrent writer must not append in between
+	if len(update) > 0 {
+		unlock := s.crdtLocks.Lock(documentID)
+		defer unlock()
+	}
+
+	stored, err := s.Repo.GetCRDTUpdates(documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := crdt.NewDoc(0)
+	for _, u := range stored {
+		err = doc.ApplyUpdate(u.Update)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(update) > 0 {
+		err = doc.ApplyUpdate(update)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.Repo.AppendCRDTUpdate(documentID, update, doc.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if len(stored) >= crdtCompactThreshold {
+			s.compactCRDTDocument(documentID, stored)
+		}
+	}
+
+	missing, err := doc.EncodeStateAsUpdate(stateVector)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CRDTSyncResult{
+		DocumentID:  documentID,
+		Update:      missing,
+		StateVector: doc.StateVector(),
+	}, nil
+}
+
+// compactCRDTDocument merges the stored updates. It is best effort: merging
+// is idempotent, so a failed or concurrent compaction loses nothing.
+func (s *Service) compactCRDTDocument(documentID string, stored []user.CRDTUpdate) {
+	updates := make([][]byte, 0, len(stored))
+	ids := make([]uint, 0, len(stored))
+	for _, u := range stored {
+		updates = append(updates, u.Update)
+		ids = append(ids, u.ID)
+	}
+
+	merged, err := crdt.MergeUpdates(updates...)
+	if err != nil {
+		return
+	}
+
+	s.Repo.CompactCRDTUpdates(documentID, ids, merged)
+}
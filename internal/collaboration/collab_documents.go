@@ -0,0 +1,126 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+	"gorm.io/gorm"
+)
+
+func (r *SQLRepository) Snapshot(documentID string) (string, int, error) {
+	var document user.Document
+	err := r.DB.Select("content", "revision").First(&document, "id = ?", documentID).Error
+	if err != nil {
+		return "", 0, err
+	}
+
+	return document.Content, document.Revision, nil
+}
+
+func (r *SQLRepository) OperationsSince(documentID string, revision int) ([]ot.Operation, error) {
+	var rows []user.DocumentOperation
+	err := r.DB.Where("document_id = ? AND revision >= ?", documentID, revision).Order("revision").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ops := make([]ot.Operation, 0, len(rows))
+	for i, row := range rows {
+		if row.Revision != revision+i {
+			return nil, ot.ErrHistoryUnavailable
+		}
+
+		var op ot.Operation
+		err = json.Unmarshal([]byte(row.Operation), &op)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+func (r *SQLRepository) Append(documentID string, userID string, revision int, op ot.Operation, content string) error {
+	encoded, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		result := tx.Model(&user.Document{}).
+			Where("id = ? AND revision = ?", documentID, revision).
+			Updates(map[string]interface{}{
+				"content":  content,
+				"revision": revision + 1,
+				"updated":  now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ot.ErrRevisionConflict
+		}
+
+		err := tx.Create(&user.DocumentOperation{
+			DocumentID: documentID,
+			Revision:   revision,
+			UserID:     userID,
+			Operation:  string(encoded),
+			Created:    now,
+		}).Error
+		if err != nil || (revision+1)%snapshotInterval != 0 {
+			return err
+		}
+
+		return tx.Create(&user.DocumentSnapshot{
+			DocumentID: documentID,
+			Revision:   revision + 1,
+			Content:    content,
+			Created:    now,
+		}).Error
+	})
+}
+
+// OpenDocument returns a document of the collaboration with its current revision.
+func (s *Service) OpenDocument(actorID string, collaborationID string, documentID string) (*user.Document, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+}
+
+// ApplyOperation submits an edit the client made against revision. The
+// returned operation has been transformed against any edits the client had
+// not yet seen; applied is invoked with it before the next edit to the same
+// document is processed.
+func (s *Service) ApplyOperation(actorID string, collaborationID string, documentID string, revision int, op ot.Operation, applied func(ot.Operation, int)) (ot.Operation, int, error) {
+	err := s.Authorize(collaborationID, actorID, ActionEditDocument)
+	if err != nil {
+		return ot.Operation{}, 0, err
+	}
+
+	_, err = s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return ot.Operation{}, 0, err
+	}
+
+	op, revision, err = s.Documents.Receive(documentID, actorID, revision, op, applied)
+	if err != nil {
+		return ot.Operation{}, 0, err
+	}
+
+	// realtime edits are too fine-grained to version individually; the
+	// edit itself has been applied, so a failure here is not reported
+	if revision%versionInterval == 0 {
+		s.recordVersion(documentID, actorID, revision, 0)
+	}
+
+	return op, revision, nil
+}
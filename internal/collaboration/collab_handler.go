@@ -0,0 +1,425 @@
+package collaboration
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/crdt"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/validation"
+)
+
+type Handler struct {
+	Service *Service
+}
+
+type CreateCollaborationRequest struct {
+	ProjectID uint64   `json:"projectId"`
+	Name      string   `json:"name" binding:"required,max=128"`
+	UserIDs   []string `json:"userIds" binding:"max=100,dive,required,max=36"`
+}
+
+func (r *CreateCollaborationRequest) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+}
+
+type InviteUserRequest struct {
+	UserID string `json:"userId" binding:"required,max=36"`
+	Role   string `json:"role" binding:"omitempty,oneof=owner editor commenter viewer"`
+}
+
+type ChangeRoleRequest struct {
+	Role string `json:"role" binding:"required,oneof=owner editor commenter viewer"`
+}
+
+type TransferOwnershipRequest struct {
+	UserID string `json:"userId" binding:"required,max=36"`
+}
+
+type UpdateDocumentRequest struct {
+	Title   string `json:"title" binding:"max=255"`
+	Content string `json:"content"`
+}
+
+type SyncCRDTRequest struct {
+	StateVector []byte `json:"stateVector"`
+	Update      []byte `json:"update"`
+}
+
+type CreateDocumentRequest struct {
+	Name    string `json:"name" binding:"required,max=255"`
+	Title   string `json:"title" binding:"max=255"`
+	Content string `json:"content"`
+}
+
+func (r *CreateDocumentRequest) Normalize() {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Title = strings.TrimSpace(r.Title)
+}
+
+// CollaborationResponse is how a collaboration is shown through the API.
+// Its members are shown as user.UserResponse, so password hashes and other
+// users' email addresses are never included.
+type CollaborationResponse struct {
+	ID        string              `json:"id"`
+	ProjectID uint64              `json:"projectId"`
+	Name      string              `json:"name"`
+	CreatedBy string              `json:"createdBy"`
+	Created   time.Time           `json:"created"`
+	Updated   time.Time           `json:"updated"`
+	Users     []user.UserResponse `json:"user"`
+	Documents []user.Document     `json:"documents"`
+}
+
+// NewCollaborationResponse shows collaboration to the user viewerID.
+func NewCollaborationResponse(collaboration *user.Collaboration, viewerID string) CollaborationResponse {
+	documents := make([]user.Document, 0, len(collaboration.Documents))
+	for _, document := range collaboration.Documents {
+		document.Users = nil
+		documents = append(documents, document)
+	}
+
+	return CollaborationResponse{
+		ID:        collaboration.ID,
+		ProjectID: collaboration.ProjectID,
+		Name:      collaboration.Name,
+		CreatedBy: collaboration.CreatedBy,
+		Created:   collaboration.Created,
+		Updated:   collaboration.Updated,
+		Users:     user.NewUserResponses(collaboration.Users, viewerID),
+		Documents: documents,
+	}
+}
+
+func NewCollaborationResponses(collaborations []*user.Collaboration, viewerID string) []CollaborationResponse {
+	resp := make([]CollaborationResponse, 0, len(collaborations))
+	for _, collaboration := range collaborations {
+		resp = append(resp, NewCollaborationResponse(collaboration, viewerID))
+	}
+
+	return resp
+}
+
+func NewHandler(service *Service) *Handler {
+	return &Handler{
+		Service: service,
+	}
+}
+
+// Operational transform and CRDT errors come from packages that know
+// nothing of HTTP, so they are given their codes here.
+func init() {
+	apierror.Register(ot.ErrInvalidRevision, apierror.BadRequest("invalid_revision", "revision is ahead of the document"))
+	apierror.Register(ot.ErrRevisionConflict, apierror.Conflict("revision_conflict", "document revision changed concurrently"))
+	apierror.Register(ot.ErrHistoryUnavailable, apierror.Conflict("history_unavailable", "operation history is incomplete"))
+	apierror.Register(crdt.ErrMalformed, apierror.BadRequest("malformed_update", "malformed crdt update"))
+	apierror.Register(crdt.ErrInvalidClock, apierror.BadRequest("invalid_update", "crdt insert clock does not follow its origin"))
+}
+
+// CreateCollaborationHandler creates a collaboration with the authenticated user as its creator.
+func (h *Handler) CreateCollaborationHandler(c *gin.Context) {
+	var req CreateCollaborationRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	collaboration, err := h.Service.CreateCollaboration(c.GetString("user_id"), req.ProjectID, req.Name, req.UserIDs)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": NewCollaborationResponse(collaboration, c.GetString("user_id")),
+	})
+}
+
+func (h *Handler) GetCollaborationByIDHandler(c *gin.Context) {
+	collaboration, err := h.Service.GetCollaborationByID(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": NewCollaborationResponse(collaboration, c.GetString("user_id")),
+	})
+}
+
+// GetMyCollaborationsHandler lists the collaborations the authenticated user belongs to.
+func (h *Handler) GetMyCollaborationsHandler(c *gin.Context) {
+	collaborations, err := h.Service.GetCollaborationsByUserID(c.GetString("user_id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": NewCollaborationResponses(collaborations, c.GetString("user_id")),
+	})
+}
+
+// GetCollaborationsByProjectIDHandler lists the collaborations in a project
+// that the authenticated user belongs to.
+func (h *Handler) GetCollaborationsByProjectIDHandler(c *gin.Context) {
+	collaborations, err := h.Service.GetCollaborationsByProjectID(c.Param("projectId"), c.GetString("user_id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": NewCollaborationResponses(collaborations, c.GetString("user_id")),
+	})
+}
+
+func (h *Handler) InviteUserHandler(c *gin.Context) {
+	var req InviteUserRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = RoleEditor
+	}
+
+	err = h.Service.InviteUserToCollaboration(c.GetString("user_id"), c.Param("id"), req.UserID, req.Role)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) RemoveUserHandler(c *gin.Context) {
+	err := h.Service.RemoveUserFromCollaboration(c.GetString("user_id"), c.Param("id"), c.Param("userId"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) CreateDocumentHandler(c *gin.Context) {
+	var req CreateDocumentRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	document, err := h.Service.CreateDocumentInCollaboration(c.GetString("user_id"), c.Param("id"), req.Name, req.Title, req.Content)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": document,
+	})
+}
+
+func (h *Handler) GetMembersHandler(c *gin.Context) {
+	members, err := h.Service.GetMembers(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": members,
+	})
+}
+
+func (h *Handler) ChangeRoleHandler(c *gin.Context) {
+	var req ChangeRoleRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.Service.ChangeMemberRole(c.GetString("user_id"), c.Param("id"), c.Param("userId"), req.Role)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) TransferOwnershipHandler(c *gin.Context) {
+	var req TransferOwnershipRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.Service.TransferOwnership(c.GetString("user_id"), c.Param("id"), req.UserID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *Handler) UpdateDocumentHandler(c *gin.Context) {
+	var req UpdateDocumentRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	document, err := h.Service.UpdateDocumentInCollaboration(c.GetString("user_id"), c.Param("id"), c.Param("documentId"), req.Title, req.Content)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": document,
+	})
+}
+
+func (h *Handler) CreateCRDTDocumentHandler(c *gin.Context) {
+	var req CreateDocumentRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	document, err := h.Service.CreateCRDTDocument(c.GetString("user_id"), c.Param("id"), req.Name, req.Title)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": document,
+	})
+}
+
+func (h *Handler) GetCRDTDocumentHandler(c *gin.Context) {
+	document, err := h.Service.GetCRDTDocument(c.GetString("user_id"), c.Param("id"), c.Param("documentId"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": document,
+	})
+}
+
+// SyncCRDTDocumentHandler runs the state vector exchange over HTTP. Binary
+// fields travel base64-encoded in JSON.
+func (h *Handler) SyncCRDTDocumentHandler(c *gin.Context) {
+	var req SyncCRDTRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	result, err := h.Service.SyncCRDTDocument(c.GetString("user_id"), c.Param("id"), c.Param("documentId"), req.StateVector, req.Update)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": result,
+	})
+}
+
+func (h *Handler) ListDocumentVersionsHandler(c *gin.Context) {
+	versions, err := h.Service.ListDocumentVersions(c.GetString("user_id"), c.Param("id"), c.Param("documentId"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": versions,
+	})
+}
+
+func (h *Handler) GetDocumentVersionHandler(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.Error(ErrInvalidVersion.Wrap(err))
+		return
+	}
+
+	version, err := h.Service.GetDocumentVersion(c.GetString("user_id"), c.Param("id"), c.Param("documentId"), number)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": version,
+	})
+}
+
+// DiffDocumentVersionsHandler compares the versions given by the from and to
+// query parameters. mode is line (the default) or char.
+func (h *Handler) DiffDocumentVersionsHandler(c *gin.Context) {
+	from, fromErr := strconv.Atoi(c.Query("from"))
+	to, toErr := strconv.Atoi(c.Query("to"))
+	if fromErr != nil || toErr != nil {
+		c.Error(ErrInvalidVersion.WithMessage("from and to must be version numbers"))
+		return
+	}
+
+	diff, err := h.Service.DiffDocumentVersions(c.GetString("user_id"), c.Param("id"), c.Param("documentId"), from, to, c.DefaultQuery("mode", DiffModeLine))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": diff,
+	})
+}
+
+func (h *Handler) RestoreDocumentVersionHandler(c *gin.Context) {
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.Error(ErrInvalidVersion.Wrap(err))
+		return
+	}
+
+	version, err := h.Service.RestoreDocumentVersion(c.GetString("user_id"), c.Param("id"), c.Param("documentId"), number)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"data": version,
+	})
+}
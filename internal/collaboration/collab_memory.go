@@ -0,0 +1,569 @@
+package collaboration
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+	"gorm.io/gorm"
+)
+
+// MemoryRepository is a Repository held in process memory. It behaves like
+// SQLRepository and is meant for tests and single-process development.
+// Members are looked up in Users, just as the SQL backend joins the users table.
+type MemoryRepository struct {
+	Users user.Repository
+
+	mu             sync.RWMutex
+	collaborations []user.Collaboration
+	members        map[string][]user.Membership
+	documents      map[string]user.Document
+	collabDocs     map[string][]string
+	operations     map[string][]user.DocumentOperation
+	versions       map[string][]user.DocumentVersion
+	snapshots      map[string][]user.DocumentSnapshot
+	crdtDocuments  map[string]user.CRDTDocument
+	crdtUpdates    map[string][]user.CRDTUpdate
+	nextID         uint
+}
+
+func NewMemoryRepository(users user.Repository) *MemoryRepository {
+	return &MemoryRepository{
+		Users:         users,
+		members:       map[string][]user.Membership{},
+		documents:     map[string]user.Document{},
+		collabDocs:    map[string][]string{},
+		operations:    map[string][]user.DocumentOperation{},
+		versions:      map[string][]user.DocumentVersion{},
+		snapshots:     map[string][]user.DocumentSnapshot{},
+		crdtDocuments: map[string]user.CRDTDocument{},
+		crdtUpdates:   map[string][]user.CRDTUpdate{},
+	}
+}
+
+func (r *MemoryRepository) CreateCollaboration(collaboration *user.Collaboration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collaboration(collaboration.ID); ok {
+		return gorm.ErrDuplicatedKey
+	}
+
+	stored := *collaboration
+	stored.Users = nil
+	stored.Documents = nil
+	r.collaborations = append(r.collaborations, stored)
+
+	return nil
+}
+
+func (r *MemoryRepository) GetCollaborationByID(collaborationID string) (*user.Collaboration, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	collaboration, ok := r.collaboration(collaborationID)
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	loaded := r.withUsers(collaboration)
+	loaded.Documents = []user.Document{}
+	for _, id := range r.collabDocs[collaborationID] {
+		loaded.Documents = append(loaded.Documents, r.documents[id])
+	}
+
+	return loaded, nil
+}
+
+func (r *MemoryRepository) GetCollaborationsByUserID(userID string) ([]*user.Collaboration, error) {
+	return r.findCollaborations(func(c user.Collaboration) bool {
+		return r.memberIndex(c.ID, userID) >= 0
+	}), nil
+}
+
+func (r *MemoryRepository) GetCollaborationsByProjectID(projectID string, userID string) ([]*user.Collaboration, error) {
+	return r.findCollaborations(func(c user.Collaboration) bool {
+		return strconv.FormatUint(c.ProjectID, 10) == projectID && r.memberIndex(c.ID, userID) >= 0
+	}), nil
+}
+
+func (r *MemoryRepository) GetCollaborationsByUsers(users []string) ([]*user.Collaboration, error) {
+	return r.findCollaborations(func(c user.Collaboration) bool {
+		for _, userID := range users {
+			if r.memberIndex(c.ID, userID) >= 0 {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+func (r *MemoryRepository) AddUserToCollaboration(collaborationID string, userID string, role string) error {
+	_, err := r.Users.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collaboration(collaborationID); !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	if r.memberIndex(collaborationID, userID) >= 0 {
+		return ErrAlreadyMember
+	}
+
+	r.members[collaborationID] = append(r.members[collaborationID], user.Membership{
+		UserID:          userID,
+		CollaborationID: collaborationID,
+		Role:            role,
+		Created:         time.Now(),
+	})
+
+	return nil
+}
+
+func (r *MemoryRepository) RemoveUserFromCollaboration(collaborationID string, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.memberIndex(collaborationID, userID)
+	if i < 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	members := r.members[collaborationID]
+	remaining := append(append([]user.Membership{}, members[:i]...), members[i+1:]...)
+	if !hasOwner(remaining) {
+		return ErrLastOwner
+	}
+
+	r.members[collaborationID] = remaining
+	return nil
+}
+
+func (r *MemoryRepository) GetMembership(collaborationID string, userID string) (user.Membership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i := r.memberIndex(collaborationID, userID)
+	if i < 0 {
+		return user.Membership{}, gorm.ErrRecordNotFound
+	}
+
+	return r.members[collaborationID][i], nil
+}
+
+func (r *MemoryRepository) GetMembers(collaborationID string) ([]user.Membership, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]user.Membership{}, r.members[collaborationID]...), nil
+}
+
+func (r *MemoryRepository) UpdateMemberRole(collaborationID string, userID string, role string) error {
+	return r.updateRoles(collaborationID, map[string]string{userID: role})
+}
+
+func (r *MemoryRepository) TransferOwnership(collaborationID string, currentOwnerID string, newOwnerID string) error {
+	return r.updateRoles(collaborationID, map[string]string{
+		newOwnerID:     RoleOwner,
+		currentOwnerID: RoleEditor,
+	})
+}
+
+func (r *MemoryRepository) AddDocumentToCollaboration(collaborationID string, document *user.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.collaboration(collaborationID); !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	if document.ID == "" {
+		document.ID = uuid.New().String()
+	}
+
+	stored := *document
+	stored.Users = nil
+	r.documents[document.ID] = stored
+	r.collabDocs[collaborationID] = append(r.collabDocs[collaborationID], document.ID)
+
+	return nil
+}
+
+func (r *MemoryRepository) GetDocumentInCollaboration(collaborationID string, documentID string) (*user.Document, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, id := range r.collabDocs[collaborationID] {
+		if id == documentID {
+			document := r.documents[id]
+			return &document, nil
+		}
+	}
+
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRepository) UpdateDocumentTitle(document *user.Document) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.documents[document.ID]
+	if !ok {
+		return nil
+	}
+
+	stored.Title = document.Title
+	stored.Updated = document.Updated
+	r.documents[document.ID] = stored
+
+	return nil
+}
+
+func (r *MemoryRepository) Snapshot(documentID string) (string, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	document, ok := r.documents[documentID]
+	if !ok {
+		return "", 0, gorm.ErrRecordNotFound
+	}
+
+	return document.Content, document.Revision, nil
+}
+
+func (r *MemoryRepository) OperationsSince(documentID string, revision int) ([]ot.Operation, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.operationsSince(documentID, revision)
+}
+
+func (r *MemoryRepository) Append(documentID string, userID string, revision int, op ot.Operation, content string) error {
+	encoded, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	document, ok := r.documents[documentID]
+	if !ok || document.Revision != revision {
+		return ot.ErrRevisionConflict
+	}
+
+	now := time.Now()
+	document.Content = content
+	document.Revision = revision + 1
+	document.Updated = now
+	r.documents[documentID] = document
+
+	r.nextID++
+	r.operations[documentID] = append(r.operations[documentID], user.DocumentOperation{
+		ID:         r.nextID,
+		DocumentID: documentID,
+		Revision:   revision,
+		UserID:     userID,
+		Operation:  string(encoded),
+		Created:    now,
+	})
+
+	if (revision+1)%snapshotInterval == 0 {
+		r.snapshots[documentID] = append(r.snapshots[documentID], user.DocumentSnapshot{
+			DocumentID: documentID,
+			Revision:   revision + 1,
+			Content:    content,
+			Created:    now,
+		})
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) CreateDocumentVersion(version *user.DocumentVersion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	versions := r.versions[version.DocumentID]
+	version.Number = 1
+	version.ParentID = ""
+	if len(versions) > 0 {
+		head := versions[len(versions)-1]
+		version.Number = head.Number + 1
+		version.ParentID = head.ID
+	}
+
+	r.versions[version.DocumentID] = append(versions, *version)
+	return nil
+}
+
+func (r *MemoryRepository) GetDocumentVersions(documentID string) ([]user.DocumentVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.versions[documentID]
+	newestFirst := make([]user.DocumentVersion, len(versions))
+	for i, v := range versions {
+		newestFirst[len(versions)-1-i] = v
+	}
+
+	return newestFirst, nil
+}
+
+func (r *MemoryRepository) GetDocumentVersion(documentID string, number int) (*user.DocumentVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, v := range r.versions[documentID] {
+		if v.Number == number {
+			return &v, nil
+		}
+	}
+
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRepository) EnsureDocumentSnapshot(documentID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.snapshots[documentID]) > 0 {
+		return nil
+	}
+
+	document, ok := r.documents[documentID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	r.snapshots[documentID] = []user.DocumentSnapshot{{
+		DocumentID: documentID,
+		Revision:   document.Revision,
+		Content:    document.Content,
+		Created:    time.Now(),
+	}}
+
+	return nil
+}
+
+func (r *MemoryRepository) ContentAt(documentID string, revision int) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var snapshot *user.DocumentSnapshot
+	for i, s := range r.snapshots[documentID] {
+		if s.Revision <= revision && (snapshot == nil || s.Revision > snapshot.Revision) {
+			snapshot = &r.snapshots[documentID][i]
+		}
+	}
+	if snapshot == nil {
+		return "", ot.ErrHistoryUnavailable
+	}
+
+	ops, err := r.operationsSince(documentID, snapshot.Revision)
+	if err != nil {
+		return "", err
+	}
+
+	return replay(*snapshot, ops, revision)
+}
+
+func (r *MemoryRepository) CreateCRDTDocument(document *user.CRDTDocument) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.crdtDocuments[document.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+
+	r.crdtDocuments[document.ID] = *document
+	return nil
+}
+
+func (r *MemoryRepository) GetCRDTDocument(collaborationID string, documentID string) (*user.CRDTDocument, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	document, ok := r.crdtDocuments[documentID]
+	if !ok || document.CollaborationID != collaborationID {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return &document, nil
+}
+
+func (r *MemoryRepository) GetCRDTUpdates(documentID string) ([]user.CRDTUpdate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([]user.CRDTUpdate{}, r.crdtUpdates[documentID]...), nil
+}
+
+func (r *MemoryRepository) AppendCRDTUpdate(documentID string, update []byte, content string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	r.nextID++
+	r.crdtUpdates[documentID] = append(r.crdtUpdates[documentID], user.CRDTUpdate{
+		ID:         r.nextID,
+		DocumentID: documentID,
+		Update:     append([]byte(nil), update...),
+		Created:    now,
+	})
+
+	if document, ok := r.crdtDocuments[documentID]; ok {
+		document.Content = content
+		document.Updated = now
+		r.crdtDocuments[documentID] = document
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) CompactCRDTUpdates(documentID string, replaced []uint, merged []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	drop := make(map[uint]bool, len(replaced))
+	for _, id := range replaced {
+		drop[id] = true
+	}
+
+	var kept []user.CRDTUpdate
+	for _, u := range r.crdtUpdates[documentID] {
+		if !drop[u.ID] {
+			kept = append(kept, u)
+		}
+	}
+
+	r.nextID++
+	kept = append(kept, user.CRDTUpdate{
+		ID:         r.nextID,
+		DocumentID: documentID,
+		Update:     append([]byte(nil), merged...),
+		Created:    time.Now(),
+	})
+
+	// keep updates ordered by ID, as the SQL backend returns them
+	sort.Slice(kept, func(i, j int) bool { return kept[i].ID < kept[j].ID })
+	r.crdtUpdates[documentID] = kept
+
+	return nil
+}
+
+// collaboration finds a stored collaboration. r.mu must be held.
+func (r *MemoryRepository) collaboration(collaborationID string) (user.Collaboration, bool) {
+	for _, c := range r.collaborations {
+		if c.ID == collaborationID {
+			return c, true
+		}
+	}
+
+	return user.Collaboration{}, false
+}
+
+// memberIndex returns the position of userID among the collaboration's
+// members, or -1. r.mu must be held.
+func (r *MemoryRepository) memberIndex(collaborationID string, userID string) int {
+	for i, m := range r.members[collaborationID] {
+		if m.UserID == userID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (r *MemoryRepository) findCollaborations(match func(user.Collaboration) bool) []*user.Collaboration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	collaborations := []*user.Collaboration{}
+	for _, c := range r.collaborations {
+		if match(c) {
+			collaborations = append(collaborations, r.withUsers(c))
+		}
+	}
+
+	return collaborations
+}
+
+// withUsers copies a collaboration with its members loaded, like gorm's
+// Preload("Users"). r.mu must be held.
+func (r *MemoryRepository) withUsers(collaboration user.Collaboration) *user.Collaboration {
+	collaboration.Users = []user.User{}
+	for _, m := range r.members[collaboration.ID] {
+		u, err := r.Users.GetUserByID(m.UserID)
+		if err == nil {
+			collaboration.Users = append(collaboration.Users, u)
+		}
+	}
+
+	return &collaboration
+}
+
+// operationsSince decodes the logged operations from revision on. r.mu must be held.
+func (r *MemoryRepository) operationsSince(documentID string, revision int) ([]ot.Operation, error) {
+	ops := []ot.Operation{}
+	for _, row := range r.operations[documentID] {
+		if row.Revision < revision {
+			continue
+		}
+		if row.Revision != revision+len(ops) {
+			return nil, ot.ErrHistoryUnavailable
+		}
+
+		var op ot.Operation
+		err := json.Unmarshal([]byte(row.Operation), &op)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+// updateRoles applies role changes atomically, refusing to leave the
+// collaboration without an owner.
+func (r *MemoryRepository) updateRoles(collaborationID string, roles map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	members := append([]user.Membership{}, r.members[collaborationID]...)
+	for userID, role := range roles {
+		i := r.memberIndex(collaborationID, userID)
+		if i < 0 {
+			return gorm.ErrRecordNotFound
+		}
+		members[i].Role = role
+	}
+
+	if !hasOwner(members) {
+		return ErrLastOwner
+	}
+
+	r.members[collaborationID] = members
+	return nil
+}
+
+func hasOwner(members []user.Membership) bool {
+	for _, m := range members {
+		if m.Role == RoleOwner {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,88 +1,277 @@
 package collaboration
 
 import (
+	"time"
+
 	"github.com/google/uuid"
+	"github.com/similadayo/internal/ot"
 	"github.com/similadayo/internal/user"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-type Repository struct {
+// Repository stores collaborations, their members and their documents,
+// including each document's operation log, so it also serves as the
+// ot.Store behind Service.Documents. Every backend reports a missing record
+// as gorm.ErrRecordNotFound.
+type Repository interface {
+	ot.Store
+
+	CreateCollaboration(collaboration *user.Collaboration) error
+	GetCollaborationByID(collaborationID string) (*user.Collaboration, error)
+	GetCollaborationsByUserID(userID string) ([]*user.Collaboration, error)
+	GetCollaborationsByProjectID(projectID string, userID string) ([]*user.Collaboration, error)
+	GetCollaborationsByUsers(users []string) ([]*user.Collaboration, error)
+
+	AddUserToCollaboration(collaborationID string, userID string, role string) error
+	RemoveUserFromCollaboration(collaborationID string, userID string) error
+	GetMembership(collaborationID string, userID string) (user.Membership, error)
+	GetMembers(collaborationID string) ([]user.Membership, error)
+	UpdateMemberRole(collaborationID string, userID string, role string) error
+	TransferOwnership(collaborationID string, currentOwnerID string, newOwnerID string) error
+
+	AddDocumentToCollaboration(collaborationID string, document *user.Document) error
+	GetDocumentInCollaboration(collaborationID string, documentID string) (*user.Document, error)
+	UpdateDocumentTitle(document *user.Document) error
+
+	CreateDocumentVersion(version *user.DocumentVersion) error
+	GetDocumentVersions(documentID string) ([]user.DocumentVersion, error)
+	GetDocumentVersion(documentID string, number int) (*user.DocumentVersion, error)
+	EnsureDocumentSnapshot(documentID string) error
+	ContentAt(documentID string, revision int) (string, error)
+
+	CreateCRDTDocument(document *user.CRDTDocument) error
+	GetCRDTDocument(collaborationID string, documentID string) (*user.CRDTDocument, error)
+	GetCRDTUpdates(documentID string) ([]user.CRDTUpdate, error)
+	AppendCRDTUpdate(documentID string, update []byte, content string) error
+	CompactCRDTUpdates(documentID string, replaced []uint, merged []byte) error
+}
+
+// SQLRepository is the Repository backed by a SQL database through gorm.
+type SQLRepository struct {
 	DB *gorm.DB
 }
 
-func NewRepository(db *gorm.DB) *Repository {
-	return &Repository{
+func NewSQLRepository(db *gorm.DB) *SQLRepository {
+	return &SQLRepository{
 		DB: db,
 	}
 }
 
-func (r *Repository) CreateCollaboration(collaboration *user.Collaboration) error {
+func (r *SQLRepository) CreateCollaboration(collaboration *user.Collaboration) error {
 	return r.DB.Create(collaboration).Error
 }
 
-func (r *Repository) GetCollaborationByID(collaborationID string) (*user.Collaboration, error) {
-	var collaboration *user.Collaboration
-	err := r.DB.Preload("Users").First(&collaboration, "id = ?", collaborationID).Error
-	return &user.Collaboration{}, err
+func (r *SQLRepository) GetCollaborationByID(collaborationID string) (*user.Collaboration, error) {
+	var collaboration user.Collaboration
+	err := r.DB.Preload("Users").Preload("Documents").First(&collaboration, "id = ?", collaborationID).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &collaboration, nil
 }
 
-func (r *Repository) GetCollaborationsByUserID(userID string) ([]*user.Collaboration, error) {
+func (r *SQLRepository) GetCollaborationsByUserID(userID string) ([]*user.Collaboration, error) {
 	var collaborations []*user.Collaboration
-	err := r.DB.Preload("Users").Find(&collaborations, "id = ?", userID).Error
+	err := r.DB.Preload("Users").
+		Joins("JOIN user_collaborations ON user_collaborations.collaboration_id = collaborations.id").
+		Where("user_collaborations.user_id = ?", userID).
+		Find(&collaborations).Error
 	return collaborations, err
 }
 
-func (r *Repository) GetCollaborationsByProjectID(projectID string) ([]*user.Collaboration, error) {
+// GetCollaborationsByProjectID returns the collaborations in the project
+// that the user belongs to.
+func (r *SQLRepository) GetCollaborationsByProjectID(projectID string, userID string) ([]*user.Collaboration, error) {
 	var collaborations []*user.Collaboration
-	err := r.DB.Preload("Users").Find(&collaborations, "id = ?", projectID).Error
+	err := r.DB.Preload("Users").
+		Joins("JOIN user_collaborations ON user_collaborations.collaboration_id = collaborations.id").
+		Where("collaborations.project_id = ? AND user_collaborations.user_id = ?", projectID, userID).
+		Find(&collaborations).Error
 	return collaborations, err
 }
 
-func (r *Repository) GetCollaborationsByUsers(users []string) ([]*user.Collaboration, error) {
+func (r *SQLRepository) GetCollaborationsByUsers(users []string) ([]*user.Collaboration, error) {
 	var collaborations []*user.Collaboration
-	err := r.DB.Preload("Users").Find(&collaborations, "id = ?", users).Error
+	err := r.DB.Preload("Users").
+		Distinct("collaborations.*").
+		Joins("JOIN user_collaborations ON user_collaborations.collaboration_id = collaborations.id").
+		Where("user_collaborations.user_id IN ?", users).
+		Find(&collaborations).Error
 	return collaborations, err
 }
 
-func (r *Repository) AddUserToCollaboration(collaborationID string, UserID string) error {
-	var collaboration *user.Collaboration
-	err := r.DB.Preload("Users").First(&collaboration, "id = ?", collaborationID).Error
+// AddUserToCollaboration adds the user as a member with the given role. A
+// user who already belongs to the collaboration keeps their role and
+// ErrAlreadyMember is returned; roles change through UpdateMemberRole, which
+// keeps the last owner.
+func (r *SQLRepository) AddUserToCollaboration(collaborationID string, UserID string, role string) error {
+	var collaboration user.Collaboration
+	err := r.DB.First(&collaboration, "id = ?", collaborationID).Error
 	if err != nil {
 		return err
 	}
 
-	var user user.User
-	err = r.DB.First(&user, UserID).Error
+	var member user.User
+	err = r.DB.First(&member, "id = ?", UserID).Error
 	if err != nil {
 		return err
 	}
 
-	return r.DB.Model(&collaboration).Association("Users").Append(&user)
+	result := r.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "collaboration_id"}},
+		DoNothing: true,
+	}).Create(&user.Membership{
+		UserID:          UserID,
+		CollaborationID: collaborationID,
+		Role:            role,
+		Created:         time.Now(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAlreadyMember
+	}
+
+	return nil
+}
+
+// RemoveUserFromCollaboration deletes a membership, refusing to remove the last owner.
+func (r *SQLRepository) RemoveUserFromCollaboration(collaborationID string, UserID string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := lockMembers(tx, collaborationID)
+		if err != nil {
+			return err
+		}
+
+		result := tx.Where("collaboration_id = ? AND user_id = ?", collaborationID, UserID).Delete(&user.Membership{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		return ensureOwner(tx, collaborationID)
+	})
 }
 
-func (r *Repository) RemoveUserFromCollaboration(collaborationID string, UserID string) error {
-	var collaboration *user.Collaboration
-	err := r.DB.Preload("Users").First(&collaboration, "id = ?", collaborationID).Error
+func (r *SQLRepository) GetMembership(collaborationID string, userID string) (user.Membership, error) {
+	var membership user.Membership
+	err := r.DB.Where("collaboration_id = ? AND user_id = ?", collaborationID, userID).First(&membership).Error
+	return membership, err
+}
+
+func (r *SQLRepository) GetMembers(collaborationID string) ([]user.Membership, error) {
+	var memberships []user.Membership
+	err := r.DB.Where("collaboration_id = ?", collaborationID).Order("created").Find(&memberships).Error
+	return memberships, err
+}
+
+// UpdateMemberRole changes a member's role, refusing to demote the last owner.
+func (r *SQLRepository) UpdateMemberRole(collaborationID string, userID string, role string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := lockMembers(tx, collaborationID)
+		if err != nil {
+			return err
+		}
+
+		err = updateRole(tx, collaborationID, userID, role)
+		if err != nil {
+			return err
+		}
+
+		return ensureOwner(tx, collaborationID)
+	})
+}
+
+// TransferOwnership makes newOwnerID an owner and demotes currentOwnerID to editor atomically.
+func (r *SQLRepository) TransferOwnership(collaborationID string, currentOwnerID string, newOwnerID string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := lockMembers(tx, collaborationID)
+		if err != nil {
+			return err
+		}
+
+		err = updateRole(tx, collaborationID, newOwnerID, RoleOwner)
+		if err != nil {
+			return err
+		}
+
+		return updateRole(tx, collaborationID, currentOwnerID, RoleEditor)
+	})
+}
+
+func updateRole(tx *gorm.DB, collaborationID string, userID string, role string) error {
+	result := tx.Model(&user.Membership{}).
+		Where("collaboration_id = ? AND user_id = ?", collaborationID, userID).
+		Update("role", role)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// lockMembers locks the collaboration's memberships until tx ends. Without
+// it two transactions demoting or removing different owners could each
+// still count the other and leave the collaboration with none. SQLite,
+// which runs one writer at a time, ignores the lock.
+func lockMembers(tx *gorm.DB, collaborationID string) error {
+	var userIDs []string
+	return tx.Model(&user.Membership{}).
+		Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("collaboration_id = ?", collaborationID).
+		Pluck("user_id", &userIDs).Error
+}
+
+func ensureOwner(tx *gorm.DB, collaborationID string) error {
+	var owners int64
+	err := tx.Model(&user.Membership{}).
+		Where("collaboration_id = ? AND role = ?", collaborationID, RoleOwner).
+		Count(&owners).Error
 	if err != nil {
 		return err
 	}
+	if owners == 0 {
+		return ErrLastOwner
+	}
+
+	return nil
+}
 
-	var user user.User
-	err = r.DB.First(&user, UserID).Error
+func (r *SQLRepository) AddDocumentToCollaboration(collaborationID string, document *user.Document) error {
+	var collaboration user.Collaboration
+	err := r.DB.First(&collaboration, "id = ?", collaborationID).Error
 	if err != nil {
 		return err
 	}
 
-	return r.DB.Model(&collaboration).Association("Users").Delete(&user)
+	if document.ID == "" {
+		document.ID = uuid.New().String()
+	}
+
+	return r.DB.Model(&collaboration).Association("Documents").Append(document)
 }
 
-func (r *Repository) AddDocumentToCollaboration(collaborationID string, document *user.Document) error {
-	var collaboration *user.Collaboration
-	err := r.DB.Preload("Documents").First(&collaboration, "id = ?", collaborationID).Error
+func (r *SQLRepository) GetDocumentInCollaboration(collaborationID string, documentID string) (*user.Document, error) {
+	var document user.Document
+	err := r.DB.
+		Joins("JOIN collaboration_documents ON collaboration_documents.document_id = documents.id").
+		Where("collaboration_documents.collaboration_id = ? AND documents.id = ?", collaborationID, documentID).
+		First(&document).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	document.ID = uuid.New().String()
-	return r.DB.Create(document).Error
+	return &document, nil
+}
+
+func (r *SQLRepository) UpdateDocumentTitle(document *user.Document) error {
+	return r.DB.Model(document).Select("title", "updated").Updates(document).Error
 }
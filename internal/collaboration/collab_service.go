@@ -1,27 +1,37 @@
 package collaboration
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/similadayo/internal/ot"
 	"github.com/similadayo/internal/user"
 )
 
 type Service struct {
-	Repo *Repository
+	Repo      Repository
+	Documents *ot.Server
+
+	// crdtLocks serialises the writing syncs of each CRDT document.
+	crdtLocks ot.DocumentLocks
 }
 
-func NewService(repo *Repository) *Service {
+func NewService(repo Repository) *Service {
 	return &Service{
-		Repo: repo,
+		Repo:      repo,
+		Documents: ot.NewServer(repo),
 	}
 }
 
-func (s *Service) CreateCollaboration(projectId uint64, name string, userIDs []string) (*user.Collaboration, error) {
+// CreateCollaboration creates a collaboration owned by creatorID and adds the
+// given users as editors.
+func (s *Service) CreateCollaboration(creatorID string, projectId uint64, name string, userIDs []string) (*user.Collaboration, error) {
 	collaboration := &user.Collaboration{
 		ID:        uuid.New().String(),
 		ProjectID: projectId,
 		Name:      name,
+		CreatedBy: creatorID,
 		Created:   time.Now(),
 		Updated:   time.Now(),
 	}
@@ -30,27 +40,136 @@ func (s *Service) CreateCollaboration(projectId uint64, name string, userIDs []s
 	if err != nil {
 		return nil, err
 	}
+	collaborationsCreated.With().Inc()
+
+	err = s.Repo.AddUserToCollaboration(collaboration.ID, creatorID, RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	membershipChanges.With("added").Inc()
 
 	for _, userID := range userIDs {
-		err = s.Repo.AddUserToCollaboration(collaboration.ID, userID)
+		if userID == creatorID {
+			continue
+		}
+
+		err = s.Repo.AddUserToCollaboration(collaboration.ID, userID, RoleEditor)
+		if errors.Is(err, ErrAlreadyMember) {
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		membershipChanges.With("added").Inc()
 	}
 
-	return collaboration, nil
+	return s.Repo.GetCollaborationByID(collaboration.ID)
 }
 
-func (s *Service) GetCollaborationByID(collaborationID string) (*user.Collaboration, error) {
+func (s *Service) GetCollaborationByID(actorID string, collaborationID string) (*user.Collaboration, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
 	return s.Repo.GetCollaborationByID(collaborationID)
 }
 
-func (s *Service) InviteUserToCollaboration(collaborationID string, userID string) error {
-	return s.Repo.AddUserToCollaboration(collaborationID, userID)
+// InviteUserToCollaboration adds userID with the given role. Only owners may
+// invite. Existing members are refused with ErrAlreadyMember; their role is
+// changed with ChangeMemberRole.
+func (s *Service) InviteUserToCollaboration(actorID string, collaborationID string, userID string, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+
+	err := s.Authorize(collaborationID, actorID, ActionManageMembers)
+	if err != nil {
+		return err
+	}
+
+	err = s.Repo.AddUserToCollaboration(collaborationID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	membershipChanges.With("added").Inc()
+	return nil
 }
 
-func (s *Service) RemoveUserFromCollaboration(collaborationID string, userID string) error {
-	return s.Repo.RemoveUserFromCollaboration(collaborationID, userID)
+// RemoveUserFromCollaboration removes userID. Members may always remove
+// themselves; removing anyone else requires ownership. The last owner cannot leave.
+func (s *Service) RemoveUserFromCollaboration(actorID string, collaborationID string, userID string) error {
+	action := ActionManageMembers
+	if actorID == userID {
+		action = ActionView
+	}
+
+	err := s.Authorize(collaborationID, actorID, action)
+	if err != nil {
+		return err
+	}
+
+	err = s.Repo.RemoveUserFromCollaboration(collaborationID, userID)
+	if err != nil {
+		return err
+	}
+
+	membershipChanges.With("removed").Inc()
+	return nil
+}
+
+func (s *Service) GetMembers(actorID string, collaborationID string) ([]user.Membership, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Repo.GetMembers(collaborationID)
+}
+
+func (s *Service) ChangeMemberRole(actorID string, collaborationID string, userID string, role string) error {
+	if !ValidRole(role) {
+		return ErrInvalidRole
+	}
+
+	err := s.Authorize(collaborationID, actorID, ActionManageMembers)
+	if err != nil {
+		return err
+	}
+
+	err = s.Repo.UpdateMemberRole(collaborationID, userID, role)
+	if err != nil {
+		return err
+	}
+
+	membershipChanges.With("role_changed").Inc()
+	return nil
+}
+
+// TransferOwnership hands ownership to another member; the current owner becomes an editor.
+func (s *Service) TransferOwnership(actorID string, collaborationID string, newOwnerID string) error {
+	err := s.Authorize(collaborationID, actorID, ActionTransferOwnership)
+	if err != nil {
+		return err
+	}
+
+	if actorID == newOwnerID {
+		return nil
+	}
+
+	_, err = s.Repo.GetMembership(collaborationID, newOwnerID)
+	if err != nil {
+		return ErrNotMember
+	}
+
+	err = s.Repo.TransferOwnership(collaborationID, actorID, newOwnerID)
+	if err != nil {
+		return err
+	}
+
+	membershipChanges.With("ownership_transferred").Inc()
+	return nil
 }
 
 func (s *Service) GetCollaborationsByUsers(users []string) ([]*user.Collaboration, error) {
@@ -61,11 +180,18 @@ func (s *Service) GetCollaborationsByUserID(userID string) ([]*user.Collaboratio
 	return s.Repo.GetCollaborationsByUserID(userID)
 }
 
-func (s *Service) GetCollaborationsByProjectID(projectID string) ([]*user.Collaboration, error) {
-	return s.Repo.GetCollaborationsByProjectID(projectID)
+// GetCollaborationsByProjectID returns the collaborations in the project
+// that the user belongs to; the others are not theirs to see.
+func (s *Service) GetCollaborationsByProjectID(projectID string, userID string) ([]*user.Collaboration, error) {
+	return s.Repo.GetCollaborationsByProjectID(projectID, userID)
 }
 
-func (s *Service) CreateDocumentInCollaboration(collaborationID string, name string, title string, content string) (*user.Document, error) {
+func (s *Service) CreateDocumentInCollaboration(actorID string, collaborationID string, name string, title string, content string) (*user.Document, error) {
+	err := s.Authorize(collaborationID, actorID, ActionAddDocument)
+	if err != nil {
+		return nil, err
+	}
+
 	document := &user.Document{
 		ID:      uuid.New().String(),
 		Name:    name,
@@ -75,10 +201,51 @@ func (s *Service) CreateDocumentInCollaboration(collaborationID string, name str
 		Updated: time.Now(),
 	}
 
-	err := s.Repo.AddDocumentToCollaboration(collaborationID, document)
+	err = s.Repo.AddDocumentToCollaboration(collaborationID, document)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.recordVersion(document.ID, actorID, document.Revision, 0)
 	if err != nil {
 		return nil, err
 	}
 
 	return document, nil
 }
+
+func (s *Service) UpdateDocumentInCollaboration(actorID string, collaborationID string, documentID string, title string, content string) (*user.Document, error) {
+	err := s.Authorize(collaborationID, actorID, ActionEditDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	//whole-content saves go through the operation log like any other edit
+	if content != document.Content {
+		op := ot.Diff(document.Content, content)
+		_, revision, err := s.Documents.Receive(documentID, actorID, document.Revision, op, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = s.recordVersion(documentID, actorID, revision, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	document.Title = title
+	document.Updated = time.Now()
+
+	err = s.Repo.UpdateDocumentTitle(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+}
@@ -0,0 +1,274 @@
+package collaboration
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/textdiff"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"gorm.io/gorm"
+)
+
+const (
+	// snapshotInterval is the number of operations between stored snapshots,
+	// which bounds how much of the log is replayed to rebuild a version.
+	snapshotInterval = 100
+
+	// versionInterval is the number of realtime operations between automatic
+	// versions. Saves through UpdateDocumentInCollaboration always create one.
+	versionInterval = 50
+)
+
+const (
+	DiffModeLine = "line"
+	DiffModeChar = "char"
+)
+
+var (
+	ErrInvalidDiffMode = apierror.BadRequest("invalid_diff_mode", "diff mode must be line or char")
+
+	ErrInvalidVersion = apierror.BadRequest("invalid_version", "invalid version number")
+)
+
+// DocumentVersionDetail is a version together with the document content it captures.
+type DocumentVersionDetail struct {
+	user.DocumentVersion
+	Content string `json:"content"`
+}
+
+// VersionDiff lists the edits that turn version From into version To.
+type VersionDiff struct {
+	From  int             `json:"from"`
+	To    int             `json:"to"`
+	Mode  string          `json:"mode"`
+	Edits []textdiff.Edit `json:"edits"`
+}
+
+// CreateDocumentVersion stores version as the document's new head, numbering
+// it and linking it to the previous head.
+func (r *SQLRepository) CreateDocumentVersion(version *user.DocumentVersion) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		var head user.DocumentVersion
+		err := tx.Where("document_id = ?", version.DocumentID).Order("number desc").First(&head).Error
+		switch {
+		case err == nil:
+			version.Number = head.Number + 1
+			version.ParentID = head.ID
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			version.Number = 1
+		default:
+			return err
+		}
+
+		return tx.Create(version).Error
+	})
+}
+
+func (r *SQLRepository) GetDocumentVersions(documentID string) ([]user.DocumentVersion, error) {
+	var versions []user.DocumentVersion
+	err := r.DB.Where("document_id = ?", documentID).Order("number desc").Find(&versions).Error
+	return versions, err
+}
+
+func (r *SQLRepository) GetDocumentVersion(documentID string, number int) (*user.DocumentVersion, error) {
+	var version user.DocumentVersion
+	err := r.DB.Where("document_id = ? AND number = ?", documentID, number).First(&version).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+// EnsureDocumentSnapshot snapshots the current content of a document that
+// has none yet, such as one created before history was kept.
+func (r *SQLRepository) EnsureDocumentSnapshot(documentID string) error {
+	var count int64
+	err := r.DB.Model(&user.DocumentSnapshot{}).Where("document_id = ?", documentID).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+
+	var document user.Document
+	err = r.DB.Select("content", "revision").First(&document, "id = ?", documentID).Error
+	if err != nil {
+		return err
+	}
+
+	return r.DB.Create(&user.DocumentSnapshot{
+		DocumentID: documentID,
+		Revision:   document.Revision,
+		Content:    document.Content,
+		Created:    time.Now(),
+	}).Error
+}
+
+// ContentAt rebuilds a document as of revision from the closest earlier
+// snapshot and the operations logged after it.
+func (r *SQLRepository) ContentAt(documentID string, revision int) (string, error) {
+	var snapshot user.DocumentSnapshot
+	err := r.DB.Where("document_id = ? AND revision <= ?", documentID, revision).Order("revision desc").First(&snapshot).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ot.ErrHistoryUnavailable
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ops, err := r.OperationsSince(documentID, snapshot.Revision)
+	if err != nil {
+		return "", err
+	}
+
+	return replay(snapshot, ops, revision)
+}
+
+// replay applies to a snapshot the logged operations that follow it, up to revision.
+func replay(snapshot user.DocumentSnapshot, ops []ot.Operation, revision int) (string, error) {
+	if len(ops) < revision-snapshot.Revision {
+		return "", ot.ErrHistoryUnavailable
+	}
+
+	content := snapshot.Content
+	for _, op := range ops[:revision-snapshot.Revision] {
+		var err error
+		content, err = op.Apply(content)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return content, nil
+}
+
+// recordVersion makes revision of a document its new head version.
+func (s *Service) recordVersion(documentID string, authorID string, revision int, restoredFrom int) (*user.DocumentVersion, error) {
+	err := s.Repo.EnsureDocumentSnapshot(documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	version := &user.DocumentVersion{
+		ID:           uuid.New().String(),
+		DocumentID:   documentID,
+		Revision:     revision,
+		AuthorID:     authorID,
+		RestoredFrom: restoredFrom,
+		Created:      time.Now(),
+	}
+
+	err = s.Repo.CreateDocumentVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+func (s *Service) ListDocumentVersions(actorID string, collaborationID string, documentID string) ([]user.DocumentVersion, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Repo.GetDocumentVersions(documentID)
+}
+
+func (s *Service) GetDocumentVersion(actorID string, collaborationID string, documentID string, number int) (*DocumentVersionDetail, error) {
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.versionDetail(documentID, number)
+}
+
+// DiffDocumentVersions compares two versions line by line or character by character.
+func (s *Service) DiffDocumentVersions(actorID string, collaborationID string, documentID string, from int, to int, mode string) (*VersionDiff, error) {
+	if mode != DiffModeLine && mode != DiffModeChar {
+		return nil, ErrInvalidDiffMode
+	}
+
+	err := s.Authorize(collaborationID, actorID, ActionView)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	older, err := s.versionDetail(documentID, from)
+	if err != nil {
+		return nil, err
+	}
+
+	newer, err := s.versionDetail(documentID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	edits := textdiff.Lines(older.Content, newer.Content)
+	if mode == DiffModeChar {
+		edits = textdiff.Runes(older.Content, newer.Content)
+	}
+
+	return &VersionDiff{From: from, To: to, Mode: mode, Edits: edits}, nil
+}
+
+// RestoreDocumentVersion brings back the content of an old version as a new
+// head version. History is never rewritten: the restore is itself an edit.
+func (s *Service) RestoreDocumentVersion(actorID string, collaborationID string, documentID string, number int) (*user.DocumentVersion, error) {
+	err := s.Authorize(collaborationID, actorID, ActionEditDocument)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := s.Repo.GetDocumentInCollaboration(collaborationID, documentID)
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := s.versionDetail(documentID, number)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := document.Revision
+	if old.Content != document.Content {
+		_, revision, err = s.Documents.Receive(documentID, actorID, document.Revision, ot.Diff(document.Content, old.Content), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s.recordVersion(documentID, actorID, revision, number)
+}
+
+func (s *Service) versionDetail(documentID string, number int) (*DocumentVersionDetail, error) {
+	version, err := s.Repo.GetDocumentVersion(documentID, number)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.Repo.ContentAt(documentID, version.Revision)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DocumentVersionDetail{DocumentVersion: *version, Content: content}, nil
+}
@@ -0,0 +1,12 @@
+package collaboration
+
+import "github.com/similadayo/pkg/metrics"
+
+var (
+	collaborationsCreated = metrics.Default.Counter("collaborations_created_total",
+		"Collaborations created.")
+
+	membershipChanges = metrics.Default.Counter("collaboration_membership_changes_total",
+		"Changes to collaboration membership, by change: added, removed, role_changed or ownership_transferred.",
+		"change")
+)
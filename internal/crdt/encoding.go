@@ -0,0 +1,189 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// encodingVersion prefixes every encoded update and state vector.
+const encodingVersion byte = 1
+
+var ErrMalformed = errors.New("malformed crdt encoding")
+
+// EncodeUpdate serialises operations as:
+//
+//	version | count | op*
+//	insert: 1 | client | seq | clock | origin client | origin seq | rune
+//	delete: 2 | client | seq | target client | target seq
+//
+// with every integer written as an unsigned varint.
+func EncodeUpdate(ops []Op) []byte {
+	buf := []byte{encodingVersion}
+	buf = binary.AppendUvarint(buf, uint64(len(ops)))
+
+	for _, op := range ops {
+		buf = append(buf, op.Kind)
+		buf = binary.AppendUvarint(buf, op.ID.Client)
+		buf = binary.AppendUvarint(buf, op.ID.Seq)
+
+		switch op.Kind {
+		case kindInsert:
+			buf = binary.AppendUvarint(buf, op.Clock)
+			buf = binary.AppendUvarint(buf, op.Origin.Client)
+			buf = binary.AppendUvarint(buf, op.Origin.Seq)
+			buf = binary.AppendUvarint(buf, uint64(op.Value))
+		case kindDelete:
+			buf = binary.AppendUvarint(buf, op.Target.Client)
+			buf = binary.AppendUvarint(buf, op.Target.Seq)
+		}
+	}
+
+	return buf
+}
+
+func DecodeUpdate(data []byte) ([]Op, error) {
+	r, err := newReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []Op
+	for i := uint64(0); i < count; i++ {
+		kind, err := r.ReadByte()
+		if err != nil {
+			return nil, ErrMalformed
+		}
+
+		op := Op{Kind: kind}
+		if op.ID, err = r.id(); err != nil {
+			return nil, err
+		}
+		if op.ID.Seq == 0 {
+			return nil, ErrMalformed
+		}
+
+		switch kind {
+		case kindInsert:
+			if op.Clock, err = r.uvarint(); err != nil {
+				return nil, err
+			}
+			if op.Origin, err = r.id(); err != nil {
+				return nil, err
+			}
+			value, err := r.uvarint()
+			if err != nil {
+				return nil, err
+			}
+			op.Value = rune(value)
+			if value > utf8.MaxRune || !utf8.ValidRune(op.Value) {
+				return nil, ErrMalformed
+			}
+		case kindDelete:
+			if op.Target, err = r.id(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrMalformed
+		}
+
+		ops = append(ops, op)
+	}
+
+	if r.Len() != 0 {
+		return nil, ErrMalformed
+	}
+
+	return ops, nil
+}
+
+// EncodeStateVector serialises version | count | (client | seq)* sorted by client.
+func EncodeStateVector(vector map[uint64]uint64) []byte {
+	clients := make([]uint64, 0, len(vector))
+	for client := range vector {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i] < clients[j] })
+
+	buf := []byte{encodingVersion}
+	buf = binary.AppendUvarint(buf, uint64(len(clients)))
+	for _, client := range clients {
+		buf = binary.AppendUvarint(buf, client)
+		buf = binary.AppendUvarint(buf, vector[client])
+	}
+
+	return buf
+}
+
+func DecodeStateVector(data []byte) (map[uint64]uint64, error) {
+	r, err := newReader(data)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	vector := map[uint64]uint64{}
+	for i := uint64(0); i < count; i++ {
+		id, err := r.id()
+		if err != nil {
+			return nil, err
+		}
+		vector[id.Client] = id.Seq
+	}
+
+	if r.Len() != 0 {
+		return nil, ErrMalformed
+	}
+
+	return vector, nil
+}
+
+type reader struct {
+	*bytes.Reader
+}
+
+func newReader(data []byte) (*reader, error) {
+	r := &reader{bytes.NewReader(data)}
+
+	version, err := r.ReadByte()
+	if err != nil || version != encodingVersion {
+		return nil, ErrMalformed
+	}
+
+	return r, nil
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, ErrMalformed
+	}
+
+	return v, err
+}
+
+func (r *reader) id() (ID, error) {
+	client, err := r.uvarint()
+	if err != nil {
+		return ID{}, err
+	}
+
+	seq, err := r.uvarint()
+	if err != nil {
+		return ID{}, err
+	}
+
+	return ID{Client: client, Seq: seq}, nil
+}
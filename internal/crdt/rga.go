@@ -0,0 +1,406 @@
+package crdt
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrOutOfRange = errors.New("position out of range")
+
+// ErrInvalidClock rejects an insert whose clock does not exceed its
+// origin's. Sibling ordering relies on every element having a larger clock
+// than the one it was inserted after.
+var ErrInvalidClock = errors.New("insert clock does not follow its origin")
+
+// ID identifies an operation: the Seq-th operation authored by Client.
+// Sequence numbers start at 1, so the zero ID means "no element".
+type ID struct {
+	Client uint64
+	Seq    uint64
+}
+
+func (id ID) isZero() bool {
+	return id.Client == 0 && id.Seq == 0
+}
+
+const (
+	kindInsert byte = 1
+	kindDelete byte = 2
+)
+
+// Op is a single insert or delete. An insert places Value immediately after
+// Origin (or at the start when Origin is zero); concurrent inserts after the
+// same origin are ordered by descending (Clock, Client). A delete tombstones
+// the element inserted by Target.
+type Op struct {
+	Kind   byte
+	ID     ID
+	Clock  uint64
+	Origin ID
+	Value  rune
+	Target ID
+}
+
+type item struct {
+	id      ID
+	clock   uint64
+	value   rune
+	deleted bool
+
+	// pos caches the element's index in Doc.items; see Doc.position.
+	pos int
+}
+
+// precedes reports whether a is ordered before b among siblings.
+func (a *item) precedes(b Op) bool {
+	if a.clock != b.Clock {
+		return a.clock > b.Clock
+	}
+
+	return a.id.Client > b.ID.Client
+}
+
+// Doc is a replicated growable array of runes. Applying the same set of
+// operations in any order, any number of times, yields the same document.
+type Doc struct {
+	mu sync.Mutex
+
+	client uint64
+	seq    uint64
+	clock  uint64
+
+	items []*item
+	index map[ID]*item
+
+	// indexed is the number of leading items whose cached pos is known to
+	// be current. Inserting shifts the items after it, so it shrinks.
+	indexed int
+
+	log     []Op
+	applied map[ID]bool
+	vector  map[uint64]uint64
+	pending []Op
+}
+
+// NewDoc creates an empty document whose local edits are authored by
+// client. Each replica must use a distinct, non-zero client ID.
+func NewDoc(client uint64) *Doc {
+	return &Doc{
+		client:  client,
+		index:   map[ID]*item{},
+		applied: map[ID]bool{},
+		vector:  map[uint64]uint64{},
+	}
+}
+
+// String returns the visible text.
+func (d *Doc) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var b strings.Builder
+	for _, it := range d.items {
+		if !it.deleted {
+			b.WriteRune(it.value)
+		}
+	}
+
+	return b.String()
+}
+
+// Insert adds text before the rune at visible position pos and returns the
+// encoded update to send to other replicas.
+func (d *Doc) Insert(pos int, text string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	origin := ID{}
+	if pos > 0 {
+		it := d.visibleAt(pos - 1)
+		if it == nil {
+			return nil, ErrOutOfRange
+		}
+		origin = it.id
+	} else if pos < 0 {
+		return nil, ErrOutOfRange
+	}
+
+	var ops []Op
+	for _, r := range text {
+		d.seq++
+		d.clock++
+		op := Op{
+			Kind:   kindInsert,
+			ID:     ID{Client: d.client, Seq: d.seq},
+			Clock:  d.clock,
+			Origin: origin,
+			Value:  r,
+		}
+		d.integrate(op)
+		ops = append(ops, op)
+		origin = op.ID
+	}
+
+	return EncodeUpdate(ops), nil
+}
+
+// Delete removes n runes starting at visible position pos and returns the
+// encoded update to send to other replicas.
+func (d *Doc) Delete(pos int, n int) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var targets []ID
+	visible := 0
+	for _, it := range d.items {
+		if it.deleted {
+			continue
+		}
+		if visible >= pos && visible < pos+n {
+			targets = append(targets, it.id)
+		}
+		visible++
+	}
+	if pos < 0 || len(targets) != n {
+		return nil, ErrOutOfRange
+	}
+
+	var ops []Op
+	for _, target := range targets {
+		d.seq++
+		op := Op{
+			Kind:   kindDelete,
+			ID:     ID{Client: d.client, Seq: d.seq},
+			Target: target,
+		}
+		d.integrate(op)
+		ops = append(ops, op)
+	}
+
+	return EncodeUpdate(ops), nil
+}
+
+// ApplyUpdate merges a remote update. Operations already seen are ignored
+// and operations whose dependencies are missing wait until they arrive. An
+// insert whose clock does not exceed its origin's stops it with
+// ErrInvalidClock, leaving the operations before it applied; one that is
+// only found invalid once its origin arrives is dropped.
+func (d *Doc) ApplyUpdate(update []byte) error {
+	ops, err := DecodeUpdate(update)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, op := range ops {
+		if op.ID.Client == d.client && op.ID.Seq > d.seq {
+			d.seq = op.ID.Seq
+		}
+		err = d.integrate(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StateVector encodes, per client, the highest sequence number up to which
+// every operation has been applied.
+func (d *Doc) StateVector() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return EncodeStateVector(d.vector)
+}
+
+// EncodeStateAsUpdate returns every applied operation the holder of the
+// given state vector is missing. A nil vector yields the whole document.
+func (d *Doc) EncodeStateAsUpdate(stateVector []byte) ([]byte, error) {
+	remote := map[uint64]uint64{}
+	if len(stateVector) > 0 {
+		var err error
+		remote, err = DecodeStateVector(stateVector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var missing []Op
+	for _, op := range d.log {
+		if op.ID.Seq > remote[op.ID.Client] {
+			missing = append(missing, op)
+		}
+	}
+
+	return EncodeUpdate(missing), nil
+}
+
+// MergeUpdates combines updates into one equivalent update. The result
+// does not depend on argument order and duplicates are dropped.
+func MergeUpdates(updates ...[]byte) ([]byte, error) {
+	seen := map[ID]Op{}
+	for _, update := range updates {
+		ops, err := DecodeUpdate(update)
+		if err != nil {
+			return nil, err
+		}
+		for _, op := range ops {
+			seen[op.ID] = op
+		}
+	}
+
+	merged := make([]Op, 0, len(seen))
+	for _, op := range seen {
+		merged = append(merged, op)
+	}
+
+	// sorting only makes the encoding deterministic; Doc buffers any
+	// operation that arrives before the ones it depends on
+	sort.Slice(merged, func(i, j int) bool {
+		if merged[i].ID.Seq != merged[j].ID.Seq {
+			return merged[i].ID.Seq < merged[j].ID.Seq
+		}
+		return merged[i].ID.Client < merged[j].ID.Client
+	})
+
+	return EncodeUpdate(merged), nil
+}
+
+func (d *Doc) visibleAt(pos int) *item {
+	visible := 0
+	for _, it := range d.items {
+		if it.deleted {
+			continue
+		}
+		if visible == pos {
+			return it
+		}
+		visible++
+	}
+
+	return nil
+}
+
+func (d *Doc) integrate(op Op) error {
+	if d.applied[op.ID] {
+		return nil
+	}
+
+	ok, err := d.tryIntegrate(op)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		d.pending = append(d.pending, op)
+		return nil
+	}
+
+	// applying one operation may unblock others that were waiting on it
+	for progress := true; progress; {
+		progress = false
+		waiting := d.pending[:0]
+		for _, p := range d.pending {
+			if d.applied[p.ID] {
+				continue
+			}
+			ok, err := d.tryIntegrate(p)
+			if err != nil {
+				// every replica drops it the same way
+				continue
+			}
+			if ok {
+				progress = true
+				continue
+			}
+			waiting = append(waiting, p)
+		}
+		d.pending = waiting
+	}
+
+	return nil
+}
+
+// tryIntegrate applies op, reporting false when something it depends on
+// has not arrived yet.
+func (d *Doc) tryIntegrate(op Op) (bool, error) {
+	switch op.Kind {
+	case kindInsert:
+		pos := 0
+		var originClock uint64
+		if !op.Origin.isZero() {
+			origin, ok := d.index[op.Origin]
+			if !ok {
+				return false, nil
+			}
+			pos = d.position(origin) + 1
+			originClock = origin.clock
+		}
+		if op.Clock <= originClock {
+			return false, ErrInvalidClock
+		}
+
+		// skip siblings that win against op, along with their subtrees,
+		// whose clocks are necessarily larger still
+		for pos < len(d.items) && d.items[pos].precedes(op) {
+			pos++
+		}
+
+		it := &item{id: op.ID, clock: op.Clock, value: op.Value, pos: pos}
+		d.items = append(d.items, nil)
+		copy(d.items[pos+1:], d.items[pos:])
+		d.items[pos] = it
+		d.index[op.ID] = it
+		d.indexed = min(d.indexed, pos)
+
+		if op.Clock > d.clock {
+			d.clock = op.Clock
+		}
+	case kindDelete:
+		target, ok := d.index[op.Target]
+		if !ok {
+			return false, nil
+		}
+		target.deleted = true
+	default:
+		return false, nil
+	}
+
+	d.applied[op.ID] = true
+	d.log = append(d.log, op)
+	d.advance(op.ID)
+
+	return true, nil
+}
+
+// position returns target's index in d.items. Edits mostly continue from
+// the element inserted last, whose cached pos is still right, so only the
+// items shifted since they were last indexed are ever renumbered.
+func (d *Doc) position(target *item) int {
+	if target.pos < len(d.items) && d.items[target.pos] == target {
+		return target.pos
+	}
+
+	for i := d.indexed; i < len(d.items); i++ {
+		d.items[i].pos = i
+	}
+	d.indexed = len(d.items)
+
+	return target.pos
+}
+
+// advance moves the client's state vector entry past every contiguous applied seq.
+func (d *Doc) advance(id ID) {
+	next := d.vector[id.Client] + 1
+	for d.applied[ID{Client: id.Client, Seq: next}] {
+		d.vector[id.Client] = next
+		next++
+	}
+}
@@ -0,0 +1,84 @@
+package migrations
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// adoptions bring tables that gorm's AutoMigrate created before a migration
+// into the shape it creates, keyed by the migration's version.
+var adoptions = map[int]func(tx *gorm.DB) error{
+	3: adoptCollaborations,
+}
+
+// baselineColumn is a column a migration defines that AutoMigrate did not
+// create, with its definition in each dialect.
+type baselineColumn struct {
+	table    string
+	name     string
+	sqlite   string
+	postgres string
+}
+
+var collaborationColumns = []baselineColumn{
+	{"collaborations", "created_by", "text", "text"},
+	{"user_collaborations", "role", "text NOT NULL DEFAULT 'viewer'", "text NOT NULL DEFAULT 'viewer'"},
+	{"user_collaborations", "created", "datetime", "timestamptz"},
+}
+
+// adoptCollaborations adds the columns that collaborations and memberships
+// gained with roles. Before roles every member could do anything, so the
+// existing members become owners, and their memberships date from the
+// collaboration's creation.
+func adoptCollaborations(tx *gorm.DB) error {
+	added, err := addMissingColumns(tx, collaborationColumns)
+	if err != nil {
+		return err
+	}
+
+	if added["user_collaborations.role"] {
+		err = tx.Exec("UPDATE user_collaborations SET role = 'owner'").Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if added["user_collaborations.created"] {
+		err = tx.Exec(`UPDATE user_collaborations SET created = (
+			SELECT collaborations.created FROM collaborations
+			WHERE collaborations.id = user_collaborations.collaboration_id
+		)`).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addMissingColumns adds those of columns that their existing tables lack,
+// and reports which it added as "table.column". Tables that do not exist
+// yet are left for the migration to create.
+func addMissingColumns(tx *gorm.DB, columns []baselineColumn) (map[string]bool, error) {
+	migrator := tx.Migrator()
+	added := map[string]bool{}
+	for _, column := range columns {
+		if !migrator.HasTable(column.table) || migrator.HasColumn(column.table, column.name) {
+			continue
+		}
+
+		definition := column.sqlite
+		if tx.Dialector.Name() == "postgres" {
+			definition = column.postgres
+		}
+
+		err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", column.table, column.name, definition)).Error
+		if err != nil {
+			return nil, err
+		}
+		added[column.table+"."+column.name] = true
+	}
+
+	return added, nil
+}
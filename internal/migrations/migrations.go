@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+
+	"github.com/similadayo/pkg/migrate"
+	"gorm.io/gorm"
+)
+
+// The scripts use CREATE ... IF NOT EXISTS so that databases created by
+// gorm's AutoMigrate before versioned migrations existed can adopt them.
+// That leaves the tables AutoMigrate made as they were, so the columns added
+// since are filled in by the adoptions below before the scripts run. Each
+// dialect has its own copy of every migration, with the same versions.
+//
+//go:embed sqlite/*.sql postgres/*.sql
+var scripts embed.FS
+
+// NewMigrator returns a migrator over the schema shared by the services,
+// using the scripts written for db's dialect.
+func NewMigrator(db *gorm.DB) (*migrate.Migrator, error) {
+	dialect := db.Dialector.Name()
+	switch dialect {
+	case "sqlite", "postgres":
+	default:
+		return nil, fmt.Errorf("no migrations for %s databases", dialect)
+	}
+
+	dialectScripts, err := fs.Sub(scripts, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	set, err := migrate.Load(dialectScripts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range set {
+		set[i].Before = adoptions[set[i].Version]
+	}
+
+	return migrate.New(db, set), nil
+}
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS collaborations (
+    id text PRIMARY KEY,
+    project_id bigint,
+    name text,
+    created_by text,
+    created timestamptz,
+    updated timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS user_collaborations (
+    user_id varchar(36),
+    collaboration_id text,
+    role text NOT NULL DEFAULT 'viewer',
+    created timestamptz,
+    PRIMARY KEY (user_id, collaboration_id)
+);
+
+CREATE TABLE IF NOT EXISTS documents (
+    id text PRIMARY KEY,
+    name text,
+    title text,
+    content text,
+    revision bigint,
+    created timestamptz,
+    updated timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS collaboration_documents (
+    collaboration_id text REFERENCES collaborations (id),
+    document_id text REFERENCES documents (id),
+    PRIMARY KEY (collaboration_id, document_id)
+);
+
+CREATE TABLE IF NOT EXISTS document_users (
+    document_id text REFERENCES documents (id),
+    user_id varchar(36) REFERENCES users (id),
+    PRIMARY KEY (document_id, user_id)
+);
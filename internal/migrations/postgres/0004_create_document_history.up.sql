@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS document_operations (
+    id bigserial PRIMARY KEY,
+    document_id text,
+    revision bigint,
+    user_id text,
+    operation text,
+    created timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_document_revision ON document_operations (document_id, revision);
+
+CREATE TABLE IF NOT EXISTS document_versions (
+    id varchar(36) PRIMARY KEY,
+    document_id text,
+    number bigint,
+    parent_id text,
+    revision bigint,
+    author_id text,
+    restored_from bigint,
+    created timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_document_version ON document_versions (document_id, number);
+
+CREATE TABLE IF NOT EXISTS document_snapshots (
+    document_id text,
+    revision bigint,
+    content text,
+    created timestamptz,
+    PRIMARY KEY (document_id, revision)
+);
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS crdt_documents (
+    id varchar(36) PRIMARY KEY,
+    collaboration_id text,
+    name text,
+    title text,
+    content text,
+    created timestamptz,
+    updated timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS idx_crdt_documents_collaboration_id ON crdt_documents (collaboration_id);
+
+CREATE TABLE IF NOT EXISTS crdt_updates (
+    id bigserial PRIMARY KEY,
+    document_id text,
+    "update" bytea,
+    created timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS idx_crdt_updates_document_id ON crdt_updates (document_id);
@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified boolean DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at timestamptz;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS verification_sent_at timestamptz;
+
+-- accounts created before verification existed stay usable
+UPDATE users SET email_verified = true, email_verified_at = created;
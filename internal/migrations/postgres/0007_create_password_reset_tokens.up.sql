@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    id varchar(36) PRIMARY KEY,
+    user_id text,
+    token_hash text,
+    expires_at timestamptz,
+    used_at timestamptz,
+    created timestamptz
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_password_reset_tokens_token_hash ON password_reset_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens (user_id);
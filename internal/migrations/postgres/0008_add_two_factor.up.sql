@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled boolean DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_counter bigint DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id varchar(36) PRIMARY KEY,
+    user_id text,
+    code_hash text,
+    used_at timestamptz,
+    created timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes (user_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS users (
+    id varchar(36) PRIMARY KEY,
+    user_name text,
+    password text,
+    email text,
+    first_name text,
+    last_name text,
+    avatar_url text,
+    created datetime,
+    updated datetime
+);
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id varchar(36) PRIMARY KEY,
+    user_id text,
+    family_id text,
+    token_hash text,
+    access_jti text,
+    replaced_by text,
+    revoked numeric,
+    expires_at datetime,
+    created datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti varchar(36) PRIMARY KEY,
+    expires_at datetime,
+    created datetime
+);
+
+CREATE INDEX IF NOT EXISTS idx_revoked_tokens_expires_at ON revoked_tokens (expires_at);
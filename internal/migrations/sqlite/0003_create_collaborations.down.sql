@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS document_users;
+DROP TABLE IF EXISTS collaboration_documents;
+DROP TABLE IF EXISTS documents;
+DROP TABLE IF EXISTS user_collaborations;
+DROP TABLE IF EXISTS collaborations;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS document_snapshots;
+DROP TABLE IF EXISTS document_versions;
+DROP TABLE IF EXISTS document_operations;
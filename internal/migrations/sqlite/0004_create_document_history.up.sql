@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS document_operations (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    document_id text,
+    revision integer,
+    user_id text,
+    operation text,
+    created datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_document_revision ON document_operations (document_id, revision);
+
+CREATE TABLE IF NOT EXISTS document_versions (
+    id varchar(36) PRIMARY KEY,
+    document_id text,
+    number integer,
+    parent_id text,
+    revision integer,
+    author_id text,
+    restored_from integer,
+    created datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_document_version ON document_versions (document_id, number);
+
+CREATE TABLE IF NOT EXISTS document_snapshots (
+    document_id text,
+    revision integer,
+    content text,
+    created datetime,
+    PRIMARY KEY (document_id, revision)
+);
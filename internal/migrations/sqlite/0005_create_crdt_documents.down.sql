@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS crdt_updates;
+DROP TABLE IF EXISTS crdt_documents;
@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS crdt_documents (
+    id varchar(36) PRIMARY KEY,
+    collaboration_id text,
+    name text,
+    title text,
+    content text,
+    created datetime,
+    updated datetime
+);
+
+CREATE INDEX IF NOT EXISTS idx_crdt_documents_collaboration_id ON crdt_documents (collaboration_id);
+
+CREATE TABLE IF NOT EXISTS crdt_updates (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    document_id text,
+    "update" blob,
+    created datetime
+);
+
+CREATE INDEX IF NOT EXISTS idx_crdt_updates_document_id ON crdt_updates (document_id);
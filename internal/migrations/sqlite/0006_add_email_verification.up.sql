@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN email_verified numeric DEFAULT false;
+ALTER TABLE users ADD COLUMN email_verified_at datetime;
+ALTER TABLE users ADD COLUMN verification_sent_at datetime;
+
+-- accounts created before verification existed stay usable
+UPDATE users SET email_verified = true, email_verified_at = created;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key text PRIMARY KEY,
+    failures integer DEFAULT 0,
+    last_failure datetime,
+    locked_until datetime
+);
@@ -0,0 +1,5 @@
+-- Accounts registered twice before these indexes existed must be merged or
+-- renamed by hand first; this migration fails while any remain.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_user_name ON users (user_name);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users (lower(email)) WHERE email <> '';
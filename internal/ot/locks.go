@@ -0,0 +1,53 @@
+package ot
+
+import "sync"
+
+// DocumentLocks serialises work on each document. A document's lock exists
+// only while someone holds or waits for it, so the set does not grow with
+// every document ever edited. The zero value is ready to use.
+type DocumentLocks struct {
+	mu    sync.Mutex
+	locks map[string]*documentLock
+}
+
+type documentLock struct {
+	sync.Mutex
+
+	// refs counts the holder and the waiters.
+	refs int
+}
+
+// Lock blocks until documentID is free and returns the function releasing it.
+func (l *DocumentLocks) Lock(documentID string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*documentLock{}
+	}
+	lock, ok := l.locks[documentID]
+	if !ok {
+		lock = &documentLock{}
+		l.locks[documentID] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(l.locks, documentID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Len returns the number of documents currently locked or waited for.
+func (l *DocumentLocks) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.locks)
+}
@@ -0,0 +1,432 @@
+package ot
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+var (
+	ErrBaseLengthMismatch = errors.New("operation base length does not match document")
+
+	ErrIncompatible = errors.New("operations are not compatible")
+
+	ErrInvalidComponent = errors.New("invalid operation component")
+)
+
+// Component is one step of an Operation. Exactly one field is set: Retain
+// skips characters, Insert adds text and Delete removes characters. Lengths
+// are counted in runes, not bytes.
+type Component struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+func (c Component) isRetain() bool { return c.Retain > 0 }
+func (c Component) isInsert() bool { return c.Insert != "" }
+func (c Component) isDelete() bool { return c.Delete > 0 }
+
+// Operation is a sequence of components that transforms a document of
+// BaseLength runes into one of TargetLength runes. Builders keep it in
+// canonical form: adjacent components of the same kind are merged and an
+// insert always precedes a delete at the same position.
+type Operation struct {
+	Ops          []Component
+	BaseLength   int
+	TargetLength int
+}
+
+// New returns an empty operation for chaining builder calls.
+func New() *Operation {
+	return &Operation{}
+}
+
+func (o *Operation) last(offset int) *Component {
+	i := len(o.Ops) - 1 - offset
+	if i < 0 {
+		return nil
+	}
+
+	return &o.Ops[i]
+}
+
+// Retain skips over n characters.
+func (o *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+
+	o.BaseLength += n
+	o.TargetLength += n
+
+	if last := o.last(0); last != nil && last.isRetain() {
+		last.Retain += n
+		return o
+	}
+
+	o.Ops = append(o.Ops, Component{Retain: n})
+	return o
+}
+
+// Insert adds s at the current position.
+func (o *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return o
+	}
+
+	o.TargetLength += utf8.RuneCountInString(s)
+
+	last := o.last(0)
+	switch {
+	case last != nil && last.isInsert():
+		last.Insert += s
+	case last != nil && last.isDelete():
+		if prev := o.last(1); prev != nil && prev.isInsert() {
+			prev.Insert += s
+		} else {
+			del := *last
+			*last = Component{Insert: s}
+			o.Ops = append(o.Ops, del)
+		}
+	default:
+		o.Ops = append(o.Ops, Component{Insert: s})
+	}
+
+	return o
+}
+
+// Delete removes n characters at the current position.
+func (o *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return o
+	}
+
+	o.BaseLength += n
+
+	if last := o.last(0); last != nil && last.isDelete() {
+		last.Delete += n
+		return o
+	}
+
+	o.Ops = append(o.Ops, Component{Delete: n})
+	return o
+}
+
+// IsNoop reports whether applying the operation leaves any document unchanged.
+func (o Operation) IsNoop() bool {
+	return len(o.Ops) == 0 || (len(o.Ops) == 1 && o.Ops[0].isRetain())
+}
+
+// Apply runs the operation against doc.
+func (o Operation) Apply(doc string) (string, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLength {
+		return "", ErrBaseLengthMismatch
+	}
+
+	out := make([]rune, 0, o.TargetLength)
+	index := 0
+	for _, c := range o.Ops {
+		switch {
+		case c.isRetain():
+			if index+c.Retain > len(runes) {
+				return "", ErrBaseLengthMismatch
+			}
+			out = append(out, runes[index:index+c.Retain]...)
+			index += c.Retain
+		case c.isInsert():
+			out = append(out, []rune(c.Insert)...)
+		case c.isDelete():
+			index += c.Delete
+		}
+	}
+
+	if index != len(runes) {
+		return "", ErrBaseLengthMismatch
+	}
+
+	return string(out), nil
+}
+
+// TransformIndex maps a position in the document before o to the matching
+// position after it. Text inserted exactly at index pushes it forward, so a
+// cursor stays after what was typed in front of it.
+func (o Operation) TransformIndex(index int) int {
+	newIndex := index
+	for _, c := range o.Ops {
+		switch {
+		case c.isRetain():
+			index -= c.Retain
+		case c.Insert != "":
+			newIndex += utf8.RuneCountInString(c.Insert)
+		default:
+			newIndex -= min(index, c.Delete)
+			index -= c.Delete
+		}
+		if index < 0 {
+			break
+		}
+	}
+
+	return newIndex
+}
+
+// Invert returns the operation that undoes o when applied to the result of
+// applying o to doc.
+func (o Operation) Invert(doc string) (Operation, error) {
+	runes := []rune(doc)
+	if len(runes) != o.BaseLength {
+		return Operation{}, ErrBaseLengthMismatch
+	}
+
+	inverse := New()
+	index := 0
+	for _, c := range o.Ops {
+		switch {
+		case c.isRetain():
+			inverse.Retain(c.Retain)
+			index += c.Retain
+		case c.isInsert():
+			inverse.Delete(utf8.RuneCountInString(c.Insert))
+		case c.isDelete():
+			inverse.Insert(string(runes[index : index+c.Delete]))
+			index += c.Delete
+		}
+	}
+
+	return *inverse, nil
+}
+
+// Compose merges a and b into a single operation with the same effect as
+// applying a followed by b.
+func Compose(a, b Operation) (Operation, error) {
+	if a.TargetLength != b.BaseLength {
+		return Operation{}, ErrIncompatible
+	}
+
+	result := New()
+	ops1, ops2 := newCursor(a.Ops), newCursor(b.Ops)
+	op1, op2 := ops1.next(), ops2.next()
+
+	for op1 != nil || op2 != nil {
+		if op1 != nil && op1.isDelete() {
+			result.Delete(op1.Delete)
+			op1 = ops1.next()
+			continue
+		}
+		if op2 != nil && op2.isInsert() {
+			result.Insert(op2.Insert)
+			op2 = ops2.next()
+			continue
+		}
+		if op1 == nil || op2 == nil {
+			return Operation{}, ErrIncompatible
+		}
+
+		switch {
+		case op1.isRetain() && op2.isRetain():
+			n := min(op1.Retain, op2.Retain)
+			result.Retain(n)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isInsert() && op2.isDelete():
+			n := min(utf8.RuneCountInString(op1.Insert), op2.Delete)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isInsert() && op2.isRetain():
+			n := min(utf8.RuneCountInString(op1.Insert), op2.Retain)
+			result.Insert(string([]rune(op1.Insert)[:n]))
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isRetain() && op2.isDelete():
+			n := min(op1.Retain, op2.Delete)
+			result.Delete(n)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		default:
+			return Operation{}, ErrInvalidComponent
+		}
+	}
+
+	return *result, nil
+}
+
+// Transform takes two operations made concurrently against the same
+// document and returns (a', b') such that applying a then b' yields the same
+// document as applying b then a'. When both insert at the same position a's
+// insert is placed first.
+func Transform(a, b Operation) (Operation, Operation, error) {
+	if a.BaseLength != b.BaseLength {
+		return Operation{}, Operation{}, ErrIncompatible
+	}
+
+	aPrime, bPrime := New(), New()
+	ops1, ops2 := newCursor(a.Ops), newCursor(b.Ops)
+	op1, op2 := ops1.next(), ops2.next()
+
+	for op1 != nil || op2 != nil {
+		if op1 != nil && op1.isInsert() {
+			aPrime.Insert(op1.Insert)
+			bPrime.Retain(utf8.RuneCountInString(op1.Insert))
+			op1 = ops1.next()
+			continue
+		}
+		if op2 != nil && op2.isInsert() {
+			aPrime.Retain(utf8.RuneCountInString(op2.Insert))
+			bPrime.Insert(op2.Insert)
+			op2 = ops2.next()
+			continue
+		}
+		if op1 == nil || op2 == nil {
+			return Operation{}, Operation{}, ErrIncompatible
+		}
+
+		switch {
+		case op1.isRetain() && op2.isRetain():
+			n := min(op1.Retain, op2.Retain)
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isDelete() && op2.isDelete():
+			n := min(op1.Delete, op2.Delete)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isDelete() && op2.isRetain():
+			n := min(op1.Delete, op2.Retain)
+			aPrime.Delete(n)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		case op1.isRetain() && op2.isDelete():
+			n := min(op1.Retain, op2.Delete)
+			bPrime.Delete(n)
+			op1 = ops1.consume(op1, n)
+			op2 = ops2.consume(op2, n)
+		default:
+			return Operation{}, Operation{}, ErrInvalidComponent
+		}
+	}
+
+	return *aPrime, *bPrime, nil
+}
+
+// Diff returns an operation turning from into to, retaining their common
+// prefix and suffix and replacing the middle.
+func Diff(from, to string) Operation {
+	a, b := []rune(from), []rune(to)
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	op := New().
+		Retain(prefix).
+		Insert(string(b[prefix : len(b)-suffix])).
+		Delete(len(a) - prefix - suffix).
+		Retain(suffix)
+
+	return *op
+}
+
+// cursor walks a component list, letting partially consumed components be split.
+type cursor struct {
+	ops []Component
+	i   int
+}
+
+func newCursor(ops []Component) *cursor {
+	return &cursor{ops: ops}
+}
+
+func (c *cursor) next() *Component {
+	if c.i >= len(c.ops) {
+		return nil
+	}
+
+	op := c.ops[c.i]
+	c.i++
+	return &op
+}
+
+// consume removes n characters from the front of op, returning the remainder
+// or the next component once op is exhausted.
+func (c *cursor) consume(op *Component, n int) *Component {
+	switch {
+	case op.isRetain():
+		op.Retain -= n
+		if op.Retain > 0 {
+			return op
+		}
+	case op.isDelete():
+		op.Delete -= n
+		if op.Delete > 0 {
+			return op
+		}
+	case op.isInsert():
+		rest := []rune(op.Insert)[n:]
+		if len(rest) > 0 {
+			op.Insert = string(rest)
+			return op
+		}
+	}
+
+	return c.next()
+}
+
+// MarshalJSON encodes the operation in the compact form used by ot.js:
+// positive integers retain, negative integers delete and strings insert.
+func (o Operation) MarshalJSON() ([]byte, error) {
+	out := make([]interface{}, 0, len(o.Ops))
+	for _, c := range o.Ops {
+		switch {
+		case c.isRetain():
+			out = append(out, c.Retain)
+		case c.isInsert():
+			out = append(out, c.Insert)
+		case c.isDelete():
+			out = append(out, -c.Delete)
+		}
+	}
+
+	return json.Marshal(out)
+}
+
+func (o *Operation) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	op := New()
+	for _, item := range raw {
+		var s string
+		if json.Unmarshal(item, &s) == nil {
+			op.Insert(s)
+			continue
+		}
+
+		var n int
+		err := json.Unmarshal(item, &n)
+		if err != nil || n == 0 {
+			return fmt.Errorf("%w: %s", ErrInvalidComponent, item)
+		}
+
+		if n > 0 {
+			op.Retain(n)
+		} else {
+			op.Delete(-n)
+		}
+	}
+
+	*o = *op
+	return nil
+}
@@ -0,0 +1,103 @@
+package ot
+
+import "errors"
+
+// maxConflictRetries bounds how often Receive retries after another writer
+// advanced the document between reading and appending.
+const maxConflictRetries = 5
+
+var (
+	ErrInvalidRevision = errors.New("revision is ahead of the document")
+
+	ErrRevisionConflict = errors.New("document revision changed concurrently")
+
+	ErrHistoryUnavailable = errors.New("operation history is incomplete")
+)
+
+// Store persists documents together with their operation log. Revision r
+// is the state after r operations; the operation stored at revision r
+// turns revision r into r+1.
+type Store interface {
+	// Snapshot returns the current content and revision of a document.
+	Snapshot(documentID string) (string, int, error)
+
+	// OperationsSince returns the operations at revisions >= revision, in order.
+	OperationsSince(documentID string, revision int) ([]Operation, error)
+
+	// Append stores op at revision and sets the document content, failing
+	// with ErrRevisionConflict if the document is no longer at revision.
+	Append(documentID string, userID string, revision int, op Operation, content string) error
+}
+
+// Server holds the authoritative revision of each document and transforms
+// incoming client operations against the history the client had not seen.
+type Server struct {
+	store Store
+	locks DocumentLocks
+}
+
+func NewServer(store Store) *Server {
+	return &Server{
+		store: store,
+	}
+}
+
+// Receive applies op, which the client based on revision, to the current
+// document. It returns the operation as actually applied and the new
+// revision. When applied is not nil it is called with the same values before
+// the document is unlocked, so callers can broadcast in revision order.
+func (s *Server) Receive(documentID string, userID string, revision int, op Operation, applied func(Operation, int)) (Operation, int, error) {
+	unlock := s.locks.Lock(documentID)
+	defer unlock()
+
+	for attempt := 0; ; attempt++ {
+		result, next, err := s.receive(documentID, userID, revision, op)
+		if errors.Is(err, ErrRevisionConflict) && attempt < maxConflictRetries {
+			continue
+		}
+
+		if err == nil && applied != nil {
+			applied(result, next)
+		}
+
+		return result, next, err
+	}
+}
+
+func (s *Server) receive(documentID string, userID string, revision int, op Operation) (Operation, int, error) {
+	content, current, err := s.store.Snapshot(documentID)
+	if err != nil {
+		return Operation{}, 0, err
+	}
+
+	if revision < 0 || revision > current {
+		return Operation{}, 0, ErrInvalidRevision
+	}
+
+	history, err := s.store.OperationsSince(documentID, revision)
+	if err != nil {
+		return Operation{}, 0, err
+	}
+	if len(history) != current-revision {
+		return Operation{}, 0, ErrHistoryUnavailable
+	}
+
+	for _, concurrent := range history {
+		op, _, err = Transform(op, concurrent)
+		if err != nil {
+			return Operation{}, 0, err
+		}
+	}
+
+	next, err := op.Apply(content)
+	if err != nil {
+		return Operation{}, 0, err
+	}
+
+	err = s.store.Append(documentID, userID, current, op, next)
+	if err != nil {
+		return Operation{}, 0, err
+	}
+
+	return op, current + 1, nil
+}
@@ -0,0 +1,278 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/utils"
+)
+
+const (
+	// writeWait is the time allowed to write a frame to the peer.
+	writeWait = 10 * time.Second
+
+	// pongWait is how long the peer may stay silent before it is considered dead.
+	pongWait = 60 * time.Second
+
+	// pingPeriod must be shorter than pongWait so a healthy peer always answers in time.
+	pingPeriod = (pongWait * 9) / 10
+
+	// maxMessageSize bounds a single inbound frame.
+	maxMessageSize = 64 * 1024
+
+	// sendBufferSize bounds the frames queued for a slow client before it is dropped.
+	sendBufferSize = 256
+)
+
+// Client is one authenticated WebSocket connection joined to a room.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	userID string
+	room   string
+	send   chan []byte
+
+	// logger carries the request ID and user of the upgrade request.
+	logger *logging.Logger
+
+	// readOnly clients may follow the collaboration but not change it.
+	readOnly bool
+
+	// token is the access token the connection was opened with. It is
+	// validated again before every change, so that revoking it takes
+	// effect, and the connection is closed when it expires.
+	token   string
+	expires time.Time
+
+	authorizer Authorizer
+
+	closeOnce sync.Once
+	done      chan struct{}
+	closeCode int
+	closeText string
+}
+
+func newClient(ctx context.Context, hub *Hub, conn *websocket.Conn, userID string, room string) *Client {
+	return &Client{
+		hub:    hub,
+		conn:   conn,
+		userID: userID,
+		room:   room,
+		send:   make(chan []byte, sendBufferSize),
+		logger: hub.logger.WithContext(logging.WithUserID(ctx, userID)),
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *Client) UserID() string {
+	return c.userID
+}
+
+func (c *Client) Room() string {
+	return c.room
+}
+
+// Send queues an envelope for this client only.
+func (c *Client) Send(env Envelope) error {
+	env.Version = ProtocolVersion
+	if env.Room == "" {
+		env.Room = c.room
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	c.enqueue(data)
+	return nil
+}
+
+// SendError reports a problem with an inbound message back to its sender.
+func (c *Client) SendError(message string) {
+	env, err := NewEnvelope(TypeError, c.room, ErrorPayload{Message: message})
+	if err != nil {
+		return
+	}
+
+	c.Send(env)
+}
+
+// mayEdit reports whether the client may change the collaboration, and
+// tells it why not when it may not. Handlers of edits call it first. A
+// client whose access token has been revoked or has expired is closed.
+func (c *Client) mayEdit() bool {
+	if c.token != "" {
+		_, err := utils.ValidateToken(c.token)
+		if err != nil {
+			c.closeWith(websocket.ClosePolicyViolation, auth.ErrInvalidToken.Error())
+			return false
+		}
+	}
+
+	if c.readOnly {
+		c.SendError(auth.ErrEmailNotVerified.Error())
+		return false
+	}
+
+	return true
+}
+
+// fail reports err, returned while handling the client's message, back to
+// it. A user who is no longer a member of the collaboration is disconnected.
+func (c *Client) fail(err error) {
+	if errors.Is(err, collaboration.ErrNotMember) {
+		c.closeWith(websocket.ClosePolicyViolation, err.Error())
+		return
+	}
+
+	c.SendError(err.Error())
+}
+
+// enqueue never blocks: a client whose buffer is full is too slow to keep up
+// and is disconnected rather than stalling the room.
+func (c *Client) enqueue(data []byte) {
+	select {
+	case <-c.done:
+	case c.send <- data:
+	default:
+		c.logger.Warn("dropping slow realtime client", map[string]interface{}{
+			"room": c.room,
+		})
+		c.close()
+	}
+}
+
+func (c *Client) close() {
+	c.closeWith(websocket.CloseNormalClosure, "")
+}
+
+// closeWith disconnects the client, sending the peer a close frame with the
+// given code once its queued frames have been written.
+func (c *Client) closeWith(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// run registers the client with its room and pumps messages until the connection ends.
+func (c *Client) run() {
+	if !c.hub.join(c) {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownMessage),
+			time.Now().Add(writeWait))
+		c.conn.Close()
+		return
+	}
+	defer c.hub.clients.Done()
+
+	if !c.expires.IsZero() {
+		expiry := time.AfterFunc(time.Until(c.expires), func() {
+			c.closeWith(websocket.ClosePolicyViolation, "access token expired")
+		})
+		defer expiry.Stop()
+	}
+
+	go c.writePump()
+	c.readPump()
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.leave(c)
+		c.close()
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		env, err := decodeEnvelope(data)
+		if err != nil {
+			c.SendError(err.Error())
+			continue
+		}
+
+		if env.Room != "" && env.Room != c.room {
+			c.SendError("envelope room does not match connection")
+			continue
+		}
+		env.Room = c.room
+
+		handler, ok := c.hub.handler(env.Type)
+		if !ok {
+			messagesReceived.With("unknown").Inc()
+			c.SendError("unknown message type " + env.Type)
+			continue
+		}
+		messagesReceived.With(env.Type).Inc()
+
+		handler(c, env)
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText),
+				time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// flush writes the frames still queued, all within one writeWait so that a
+// client dropped for being slow cannot hold the connection open.
+func (c *Client) flush() {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	for {
+		select {
+		case data := <-c.send:
+			err := c.conn.WriteMessage(websocket.TextMessage, data)
+			if err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/similadayo/internal/collaboration"
+)
+
+const (
+	TypeCRDTSync   = "crdt.sync"
+	TypeCRDTUpdate = "crdt.update"
+)
+
+// CRDTSyncer runs the crdt sync handshake for a member.
+// collaboration.Service satisfies it.
+type CRDTSyncer interface {
+	SyncCRDTDocument(actorID string, collaborationID string, documentID string, stateVector []byte, update []byte) (*collaboration.CRDTSyncResult, error)
+}
+
+// CRDTSyncPayload carries one side of the handshake. Binary fields are
+// base64-encoded by encoding/json.
+type CRDTSyncPayload struct {
+	DocumentID  string `json:"documentId"`
+	StateVector []byte `json:"stateVector,omitempty"`
+	Update      []byte `json:"update,omitempty"`
+}
+
+// RegisterCRDTHandlers lets clients sync crdt documents over the hub. A
+// crdt.sync from a client is answered with the updates it is missing, and
+// any update it carried is relayed to the rest of the room as crdt.update.
+func RegisterCRDTHandlers(hub *Hub, syncer CRDTSyncer) {
+	hub.Handle(TypeCRDTSync, func(c *Client, env Envelope) {
+		var req CRDTSyncPayload
+		if err := json.Unmarshal(env.Payload, &req); err != nil {
+			c.SendError(err.Error())
+			return
+		}
+
+		// a sync without an update only reads
+		if len(req.Update) > 0 && !c.mayEdit() {
+			return
+		}
+
+		result, err := syncer.SyncCRDTDocument(c.UserID(), c.Room(), req.DocumentID, req.StateVector, req.Update)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		reply, err := NewEnvelope(TypeCRDTSync, c.Room(), CRDTSyncPayload{
+			DocumentID:  result.DocumentID,
+			StateVector: result.StateVector,
+			Update:      result.Update,
+		})
+		if err != nil {
+			return
+		}
+		c.Send(reply)
+
+		if len(req.Update) > 0 {
+			hub.Broadcast(c.Room(), TypeCRDTUpdate, c.UserID(), CRDTSyncPayload{
+				DocumentID: req.DocumentID,
+				Update:     req.Update,
+			}, c)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package realtime
+
+import (
+	"encoding/json"
+
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+)
+
+const (
+	TypeOpen      = "open"
+	TypeSnapshot  = "snapshot"
+	TypeOperation = "op"
+	TypeAck       = "ack"
+)
+
+// DocumentEditor opens documents and applies edits on behalf of a member.
+// collaboration.Service satisfies it.
+type DocumentEditor interface {
+	OpenDocument(actorID string, collaborationID string, documentID string) (*user.Document, error)
+	ApplyOperation(actorID string, collaborationID string, documentID string, revision int, op ot.Operation, applied func(ot.Operation, int)) (ot.Operation, int, error)
+}
+
+// OperationObserver is told about every edit applied through the hub, in
+// revision order for each document.
+type OperationObserver interface {
+	OperationApplied(c *Client, documentID string, op ot.Operation)
+}
+
+type OpenPayload struct {
+	DocumentID string `json:"documentId"`
+}
+
+type SnapshotPayload struct {
+	DocumentID string `json:"documentId"`
+	Revision   int    `json:"revision"`
+	Content    string `json:"content"`
+}
+
+// OperationPayload carries an edit. From a client, Revision is the revision
+// the edit was made against. From the server, it is the revision the edit produced.
+type OperationPayload struct {
+	DocumentID string       `json:"documentId"`
+	Revision   int          `json:"revision"`
+	Operation  ot.Operation `json:"operation"`
+}
+
+type AckPayload struct {
+	DocumentID string `json:"documentId"`
+	Revision   int    `json:"revision"`
+}
+
+// RegisterDocumentHandlers lets clients open documents and exchange
+// operational-transform edits over the hub. Observers see each edit after it
+// has been applied.
+func RegisterDocumentHandlers(hub *Hub, editor DocumentEditor, observers ...OperationObserver) {
+	hub.Handle(TypeOpen, func(c *Client, env Envelope) {
+		var req OpenPayload
+		if err := json.Unmarshal(env.Payload, &req); err != nil {
+			c.SendError(err.Error())
+			return
+		}
+
+		document, err := editor.OpenDocument(c.UserID(), c.Room(), req.DocumentID)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		reply, err := NewEnvelope(TypeSnapshot, c.Room(), SnapshotPayload{
+			DocumentID: document.ID,
+			Revision:   document.Revision,
+			Content:    document.Content,
+		})
+		if err != nil {
+			return
+		}
+		c.Send(reply)
+	})
+
+	hub.Handle(TypeOperation, func(c *Client, env Envelope) {
+		if !c.mayEdit() {
+			return
+		}
+
+		var req OperationPayload
+		if err := json.Unmarshal(env.Payload, &req); err != nil {
+			c.SendError(err.Error())
+			return
+		}
+
+		_, _, err := editor.ApplyOperation(c.UserID(), c.Room(), req.DocumentID, req.Revision, req.Operation, func(op ot.Operation, revision int) {
+			ack, err := NewEnvelope(TypeAck, c.Room(), AckPayload{DocumentID: req.DocumentID, Revision: revision})
+			if err == nil {
+				c.Send(ack)
+			}
+
+			hub.Broadcast(c.Room(), TypeOperation, c.UserID(), OperationPayload{
+				DocumentID: req.DocumentID,
+				Revision:   revision,
+				Operation:  op,
+			}, c)
+
+			for _, o := range observers {
+				o.OperationApplied(c, req.DocumentID, op)
+			}
+		})
+		if err != nil {
+			c.fail(err)
+		}
+	})
+}
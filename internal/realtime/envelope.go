@@ -0,0 +1,77 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// ProtocolVersion is the envelope version spoken by this server.
+const ProtocolVersion = 1
+
+const (
+	TypeWelcome = "welcome"
+	TypeJoin    = "join"
+	TypeLeave   = "leave"
+	TypeMessage = "message"
+	TypeError   = "error"
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Envelope is the frame exchanged over every realtime connection. Seq is
+// assigned by the server per room and increases by one for every broadcast,
+// so clients can detect gaps.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Room    string          `json:"room"`
+	Seq     uint64          `json:"seq,omitempty"`
+	Sender  string          `json:"sender,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+type MemberPayload struct {
+	UserID string `json:"userId"`
+}
+
+type WelcomePayload struct {
+	UserID  string   `json:"userId"`
+	Members []string `json:"members"`
+}
+
+// NewEnvelope builds an envelope with payload marshalled to JSON.
+func NewEnvelope(msgType string, room string, payload interface{}) (Envelope, error) {
+	env := Envelope{
+		Version: ProtocolVersion,
+		Type:    msgType,
+		Room:    room,
+	}
+
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return env, err
+		}
+		env.Payload = raw
+	}
+
+	return env, nil
+}
+
+func decodeEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	err := json.Unmarshal(data, &env)
+	if err != nil {
+		return env, err
+	}
+
+	if env.Version != ProtocolVersion {
+		return env, ErrUnsupportedVersion
+	}
+
+	return env, nil
+}
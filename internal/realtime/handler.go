@@ -0,0 +1,156 @@
+package realtime
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/utils"
+)
+
+// Authorizer decides whether a user may perform an action in a collaboration.
+// collaboration.Service satisfies it.
+type Authorizer interface {
+	Authorize(collaborationID string, userID string, action collaboration.Action) error
+}
+
+type Handler struct {
+	Hub        *Hub
+	Authorizer Authorizer
+	Presence   *Presence
+
+	// UnverifiedAccess is what users who have not verified their email
+	// address may do, as for auth.VerifiedEmailMiddleware: auth.UnverifiedNone
+	// turns them away and auth.UnverifiedReadOnly lets them follow but not
+	// edit. Empty means auth.UnverifiedFull.
+	UnverifiedAccess string
+
+	upgrader websocket.Upgrader
+}
+
+// NewHandler creates the upgrade handler. allowedOrigins lists the Origin
+// values accepted during the handshake; an empty list accepts only pages
+// served from the same host as the socket.
+func NewHandler(hub *Hub, authorizer Authorizer, allowedOrigins []string) *Handler {
+	return &Handler{
+		Hub:        hub,
+		Authorizer: authorizer,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  4096,
+			WriteBufferSize: 4096,
+			CheckOrigin:     checkOrigin(allowedOrigins),
+		},
+	}
+}
+
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(allowed) == 0 {
+			return sameOrigin(origin, r.Host)
+		}
+
+		for _, o := range allowed {
+			if o == origin {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// sameOrigin reports whether origin is on host. Requests without an Origin
+// do not come from a browser page, so there is no cross-site page to refuse.
+func sameOrigin(origin string, host string) bool {
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, host)
+}
+
+// bearerToken reads the access token from the Authorization header or, since
+// browsers cannot set headers on WebSocket requests, the access_token query parameter.
+func bearerToken(c *gin.Context) string {
+	parts := strings.Fields(c.GetHeader("Authorization"))
+	if len(parts) == 2 && parts[0] == "Bearer" {
+		return parts[1]
+	}
+
+	return c.Query("access_token")
+}
+
+// ServeWS authenticates the caller, checks they belong to the collaboration
+// in the :id path parameter and upgrades the connection into its room.
+func (h *Handler) ServeWS(c *gin.Context) {
+	tokenString := bearerToken(c)
+	if tokenString == "" {
+		c.Error(auth.ErrMissingToken)
+		return
+	}
+
+	claims, err := utils.ValidateToken(tokenString)
+	if err != nil {
+		c.Error(auth.ErrInvalidToken.Wrap(err))
+		return
+	}
+
+	if claims.Unverified && h.UnverifiedAccess == auth.UnverifiedNone {
+		c.Error(auth.ErrEmailNotVerified)
+		return
+	}
+
+	collaborationID := c.Param("id")
+
+	err = h.Authorizer.Authorize(collaborationID, claims.UserID, collaboration.ActionView)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+
+	client := newClient(c.Request.Context(), h.Hub, conn, claims.UserID, collaborationID)
+	client.readOnly = claims.Unverified && h.UnverifiedAccess == auth.UnverifiedReadOnly
+	client.token = tokenString
+	client.authorizer = h.Authorizer
+	if claims.ExpiresAt != 0 {
+		client.expires = time.Unix(claims.ExpiresAt, 0)
+	}
+	client.run()
+}
+
+// PresenceHandler lists who is connected to the collaboration in the :id
+// path parameter. It expects AuthMiddleware to have set user_id.
+func (h *Handler) PresenceHandler(c *gin.Context) {
+	collaborationID := c.Param("id")
+
+	err := h.Authorizer.Authorize(collaborationID, c.GetString("user_id"), collaboration.ActionView)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	participants := []Participant{}
+	if h.Presence != nil {
+		participants = h.Presence.Participants(collaborationID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": participants,
+	})
+}
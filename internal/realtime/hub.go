@@ -0,0 +1,285 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/pkg/logging"
+)
+
+// shutdownMessage is the reason sent in the close frame when the server stops.
+const shutdownMessage = "server shutting down"
+
+// MessageHandler processes an inbound envelope of a registered type.
+type MessageHandler func(c *Client, env Envelope)
+
+// Hub tracks the open rooms, one per collaboration, and the clients joined to each.
+type Hub struct {
+	mu       sync.RWMutex
+	rooms    map[string]*Room
+	handlers map[string]MessageHandler
+	onJoin   []func(c *Client)
+	onLeave  []func(c *Client)
+	logger   *logging.Logger
+
+	// clients counts the connections that have joined and not yet finished.
+	clients sync.WaitGroup
+	closed  bool
+}
+
+// Room is the set of clients connected to one collaboration.
+type Room struct {
+	ID string
+
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+	seq     uint64
+}
+
+func NewHub(logger *logging.Logger) *Hub {
+	h := &Hub{
+		rooms:    map[string]*Room{},
+		handlers: map[string]MessageHandler{},
+		logger:   logger,
+	}
+
+	// chat is for members who may at least comment
+	h.Handle(TypeMessage, func(c *Client, env Envelope) {
+		if !c.mayEdit() {
+			return
+		}
+
+		err := c.authorizer.Authorize(c.Room(), c.UserID(), collaboration.ActionComment)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		h.Broadcast(c.Room(), env.Type, c.UserID(), env.Payload, c)
+	})
+
+	return h
+}
+
+// Handle registers the handler for inbound envelopes of msgType, replacing any previous one.
+func (h *Hub) Handle(msgType string, handler MessageHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.handlers[msgType] = handler
+}
+
+// OnJoin registers a function called after a client has joined its room
+// and been welcomed.
+func (h *Hub) OnJoin(fn func(c *Client)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.onJoin = append(h.onJoin, fn)
+}
+
+// OnLeave registers a function called after a client has left its room.
+func (h *Hub) OnLeave(fn func(c *Client)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.onLeave = append(h.onLeave, fn)
+}
+
+func (h *Hub) handler(msgType string) (MessageHandler, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	handler, ok := h.handlers[msgType]
+	return handler, ok
+}
+
+// join adds the client to its room. It reports false once the hub has been
+// shut down, in which case the client must disconnect.
+func (h *Hub) join(c *Client) bool {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return false
+	}
+	h.clients.Add(1)
+
+	room, ok := h.rooms[c.room]
+	if !ok {
+		room = &Room{ID: c.room, clients: map[*Client]struct{}{}}
+		h.rooms[c.room] = room
+		activeRooms.Inc()
+	}
+
+	room.mu.Lock()
+	room.clients[c] = struct{}{}
+	room.mu.Unlock()
+	connectedClients.Inc()
+	hooks := h.onJoin
+	h.mu.Unlock()
+
+	welcome, err := NewEnvelope(TypeWelcome, c.room, WelcomePayload{
+		UserID:  c.userID,
+		Members: h.Clients(c.room),
+	})
+	if err == nil {
+		c.Send(welcome)
+	}
+
+	h.Broadcast(c.room, TypeJoin, c.userID, MemberPayload{UserID: c.userID}, c)
+
+	for _, fn := range hooks {
+		fn(c)
+	}
+
+	return true
+}
+
+func (h *Hub) leave(c *Client) {
+	h.mu.Lock()
+	room, ok := h.rooms[c.room]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+
+	room.mu.Lock()
+	_, present := room.clients[c]
+	delete(room.clients, c)
+	empty := len(room.clients) == 0
+	room.mu.Unlock()
+
+	if empty {
+		delete(h.rooms, c.room)
+		activeRooms.Dec()
+	}
+	hooks := h.onLeave
+	h.mu.Unlock()
+
+	if !present {
+		return
+	}
+	connectedClients.Dec()
+
+	if !empty {
+		h.Broadcast(c.room, TypeLeave, c.userID, MemberPayload{UserID: c.userID}, nil)
+	}
+
+	for _, fn := range hooks {
+		fn(c)
+	}
+}
+
+// Broadcast sends an envelope to every client in roomID except the given
+// one, stamping it with the room's next sequence number. The sequence
+// number is returned, or zero if the room has no clients.
+func (h *Hub) Broadcast(roomID string, msgType string, sender string, payload interface{}, except *Client) uint64 {
+	h.mu.RLock()
+	room, ok := h.rooms[roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return 0
+	}
+
+	var raw json.RawMessage
+	switch p := payload.(type) {
+	case nil:
+	case json.RawMessage:
+		raw = p
+	default:
+		data, err := json.Marshal(p)
+		if err != nil {
+			h.logger.Error("failed to encode realtime payload", map[string]interface{}{
+				"error": err.Error(),
+				"room":  roomID,
+			})
+			return 0
+		}
+		raw = data
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	room.seq++
+	env := Envelope{
+		Version: ProtocolVersion,
+		Type:    msgType,
+		Room:    roomID,
+		Seq:     room.seq,
+		Sender:  sender,
+		Payload: raw,
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return 0
+	}
+
+	for client := range room.clients {
+		if client == except {
+			continue
+		}
+		client.enqueue(data)
+	}
+	messagesBroadcast.With(msgType).Inc()
+
+	return room.seq
+}
+
+// Clients returns the user IDs connected to roomID, one entry per connection.
+func (h *Hub) Clients(roomID string) []string {
+	h.mu.RLock()
+	room, ok := h.rooms[roomID]
+	h.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	users := make([]string, 0, len(room.clients))
+	for client := range room.clients {
+		users = append(users, client.userID)
+	}
+
+	return users
+}
+
+// Shutdown sends every connected client a going-away close frame and waits
+// until their connections have ended or ctx is done. Clients connecting
+// afterwards are turned away.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closed = true
+	var clients []*Client
+	for _, room := range h.rooms {
+		room.mu.Lock()
+		for client := range room.clients {
+			clients = append(clients, client)
+		}
+		room.mu.Unlock()
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		client.closeWith(websocket.CloseGoingAway, shutdownMessage)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		h.clients.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
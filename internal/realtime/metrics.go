@@ -0,0 +1,19 @@
+package realtime
+
+import "github.com/similadayo/pkg/metrics"
+
+var (
+	connectedClients = metrics.Default.Gauge("realtime_connections",
+		"WebSocket clients currently joined to a room.").With()
+
+	activeRooms = metrics.Default.Gauge("realtime_rooms",
+		"Rooms with at least one connected client.").With()
+
+	messagesReceived = metrics.Default.Counter("realtime_messages_received_total",
+		"Envelopes received from clients, by message type; unregistered types count as unknown.",
+		"type")
+
+	messagesBroadcast = metrics.Default.Counter("realtime_broadcasts_total",
+		"Envelopes broadcast to rooms, by message type.",
+		"type")
+)
@@ -0,0 +1,361 @@
+package realtime
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+)
+
+const (
+	TypePresence         = "presence"
+	TypePresenceUpdate   = "presence.update"
+	TypePresenceSnapshot = "presence.snapshot"
+	TypePresenceLeave    = "presence.leave"
+)
+
+const (
+	StateActive = "active"
+	StateIdle   = "idle"
+	StateAway   = "away"
+)
+
+const (
+	defaultIdleAfter = time.Minute
+	defaultAwayAfter = 5 * time.Minute
+)
+
+var errInvalidPresence = errors.New("invalid presence update")
+
+var stateRank = map[string]int{
+	StateActive: 0,
+	StateIdle:   1,
+	StateAway:   2,
+}
+
+// palette holds the participant colours. A user always gets the same one.
+var palette = []string{
+	"#e6194b", "#3cb44b", "#4363d8", "#f58231", "#911eb4", "#42d4f4",
+	"#f032e6", "#469990", "#9a6324", "#800000", "#808000", "#000075",
+}
+
+// UserLookup resolves the user behind a connection. user.Repository satisfies it.
+type UserLookup interface {
+	GetUserByID(userID string) (user.User, error)
+}
+
+// Range is a selection in runes. Head is where the caret is; it may come
+// before Anchor for a backwards selection.
+type Range struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+// Participant is the awareness state of one connection. A user with several
+// tabs open appears once per session.
+type Participant struct {
+	SessionID  string    `json:"sessionId"`
+	UserID     string    `json:"userId"`
+	Name       string    `json:"name"`
+	Color      string    `json:"color"`
+	DocumentID string    `json:"documentId,omitempty"`
+	Cursor     *int      `json:"cursor,omitempty"`
+	Selections []Range   `json:"selections,omitempty"`
+	State      string    `json:"state"`
+	LastActive time.Time `json:"lastActive"`
+}
+
+// PresenceUpdatePayload replaces the sender's cursor, selections and focused
+// document. State may be left empty, meaning active, or set to idle or away
+// by a client that knows better, such as one whose tab was hidden.
+type PresenceUpdatePayload struct {
+	DocumentID string  `json:"documentId"`
+	Cursor     *int    `json:"cursor"`
+	Selections []Range `json:"selections"`
+	State      string  `json:"state"`
+}
+
+type PresenceLeavePayload struct {
+	SessionID string `json:"sessionId"`
+	UserID    string `json:"userId"`
+}
+
+// Presence tracks who is connected to each room and where they are in
+// the documents. Cursors are kept in step with edits applied through the
+// hub, so a snapshot sent to a newcomer is always current.
+type Presence struct {
+	hub   *Hub
+	users UserLookup
+
+	// IdleAfter and AwayAfter are how long a session may go without activity
+	// before it is reported idle or away.
+	IdleAfter time.Duration
+	AwayAfter time.Duration
+
+	mu    sync.Mutex
+	rooms map[string]map[*Client]*Participant
+}
+
+// NewPresence registers the awareness channel on hub. users may be nil, in
+// which case participants have no display name.
+func NewPresence(hub *Hub, users UserLookup) *Presence {
+	p := &Presence{
+		hub:       hub,
+		users:     users,
+		IdleAfter: defaultIdleAfter,
+		AwayAfter: defaultAwayAfter,
+		rooms:     map[string]map[*Client]*Participant{},
+	}
+
+	hub.OnJoin(p.join)
+	hub.OnLeave(p.leave)
+	hub.Handle(TypePresenceUpdate, p.update)
+
+	return p
+}
+
+// ColorFor returns the colour used to show a user's cursor and selections.
+func ColorFor(u user.User) string {
+	h := fnv.New32a()
+	h.Write([]byte(u.ID))
+
+	return palette[h.Sum32()%uint32(len(palette))]
+}
+
+func displayName(u user.User) string {
+	name := strings.TrimSpace(u.FirstName + " " + u.LastName)
+	if name == "" {
+		return u.UserName
+	}
+
+	return name
+}
+
+// Participants lists the sessions currently connected to roomID.
+func (p *Presence) Participants(roomID string) []Participant {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.snapshot(roomID)
+}
+
+// Run marks sessions idle or away as they go quiet, checking every
+// interval until stop is closed.
+func (p *Presence) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			p.sweep(now)
+		}
+	}
+}
+
+// OperationApplied moves cursors and selections in the edited document past
+// the edit and counts the edit as activity by its author.
+func (p *Presence) OperationApplied(c *Client, documentID string, op ot.Operation) {
+	p.mu.Lock()
+
+	var woke *Participant
+	for client, participant := range p.rooms[c.Room()] {
+		if participant.DocumentID != documentID {
+			continue
+		}
+
+		if participant.Cursor != nil {
+			cursor := op.TransformIndex(*participant.Cursor)
+			participant.Cursor = &cursor
+		}
+		for i, r := range participant.Selections {
+			participant.Selections[i] = Range{Anchor: op.TransformIndex(r.Anchor), Head: op.TransformIndex(r.Head)}
+		}
+
+		if client == c {
+			participant.LastActive = time.Now()
+			if participant.State != StateActive {
+				participant.State = StateActive
+				copied := participant.copy()
+				woke = &copied
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if woke != nil {
+		p.hub.Broadcast(c.Room(), TypePresence, c.UserID(), woke, nil)
+	}
+}
+
+func (p *Presence) join(c *Client) {
+	participant := &Participant{
+		SessionID:  uuid.New().String(),
+		UserID:     c.UserID(),
+		Color:      ColorFor(user.User{ID: c.UserID()}),
+		State:      StateActive,
+		LastActive: time.Now(),
+	}
+
+	if p.users != nil {
+		u, err := p.users.GetUserByID(c.UserID())
+		if err == nil {
+			participant.Name = displayName(u)
+			participant.Color = ColorFor(u)
+		}
+	}
+
+	p.mu.Lock()
+	room, ok := p.rooms[c.Room()]
+	if !ok {
+		room = map[*Client]*Participant{}
+		p.rooms[c.Room()] = room
+	}
+	room[c] = participant
+	snapshot := p.snapshot(c.Room())
+	joined := participant.copy()
+	p.mu.Unlock()
+
+	env, err := NewEnvelope(TypePresenceSnapshot, c.Room(), snapshot)
+	if err == nil {
+		c.Send(env)
+	}
+
+	p.hub.Broadcast(c.Room(), TypePresence, c.UserID(), joined, c)
+}
+
+func (p *Presence) leave(c *Client) {
+	p.mu.Lock()
+	participant, ok := p.rooms[c.Room()][c]
+	delete(p.rooms[c.Room()], c)
+	if len(p.rooms[c.Room()]) == 0 {
+		delete(p.rooms, c.Room())
+	}
+	p.mu.Unlock()
+
+	if ok {
+		p.hub.Broadcast(c.Room(), TypePresenceLeave, c.UserID(), PresenceLeavePayload{
+			SessionID: participant.SessionID,
+			UserID:    participant.UserID,
+		}, nil)
+	}
+}
+
+func (p *Presence) update(c *Client, env Envelope) {
+	var req PresenceUpdatePayload
+	if err := json.Unmarshal(env.Payload, &req); err != nil {
+		c.SendError(err.Error())
+		return
+	}
+
+	if !validUpdate(req) {
+		c.SendError(errInvalidPresence.Error())
+		return
+	}
+
+	p.mu.Lock()
+	participant, ok := p.rooms[c.Room()][c]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+
+	participant.DocumentID = req.DocumentID
+	participant.Cursor = req.Cursor
+	participant.Selections = req.Selections
+	if req.State == "" || req.State == StateActive {
+		participant.State = StateActive
+		participant.LastActive = time.Now()
+	} else {
+		participant.State = req.State
+	}
+	updated := participant.copy()
+	p.mu.Unlock()
+
+	p.hub.Broadcast(c.Room(), TypePresence, c.UserID(), updated, c)
+}
+
+func validUpdate(req PresenceUpdatePayload) bool {
+	if _, ok := stateRank[req.State]; !ok && req.State != "" {
+		return false
+	}
+	if req.Cursor != nil && *req.Cursor < 0 {
+		return false
+	}
+	for _, r := range req.Selections {
+		if r.Anchor < 0 || r.Head < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sweep demotes quiet sessions. It never promotes: only activity does that.
+func (p *Presence) sweep(now time.Time) {
+	type change struct {
+		room        string
+		participant Participant
+	}
+	var changes []change
+
+	p.mu.Lock()
+	for roomID, room := range p.rooms {
+		for _, participant := range room {
+			state := StateActive
+			switch quiet := now.Sub(participant.LastActive); {
+			case quiet >= p.AwayAfter:
+				state = StateAway
+			case quiet >= p.IdleAfter:
+				state = StateIdle
+			}
+
+			if stateRank[state] > stateRank[participant.State] {
+				participant.State = state
+				changes = append(changes, change{room: roomID, participant: participant.copy()})
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	for _, ch := range changes {
+		p.hub.Broadcast(ch.room, TypePresence, ch.participant.UserID, ch.participant, nil)
+	}
+}
+
+// snapshot copies the participants of a room. p.mu must be held.
+func (p *Presence) snapshot(roomID string) []Participant {
+	participants := make([]Participant, 0, len(p.rooms[roomID]))
+	for _, participant := range p.rooms[roomID] {
+		participants = append(participants, participant.copy())
+	}
+
+	sort.Slice(participants, func(i, j int) bool {
+		if participants[i].UserID != participants[j].UserID {
+			return participants[i].UserID < participants[j].UserID
+		}
+		return participants[i].SessionID < participants[j].SessionID
+	})
+
+	return participants
+}
+
+func (p *Participant) copy() Participant {
+	c := *p
+	if p.Cursor != nil {
+		cursor := *p.Cursor
+		c.Cursor = &cursor
+	}
+	c.Selections = append([]Range(nil), p.Selections...)
+
+	return c
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/migrations"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/health"
+	"github.com/similadayo/pkg/metrics"
+	"github.com/similadayo/pkg/migrate"
+	"github.com/similadayo/pkg/tracing"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMemory   = "memory"
+)
+
+var (
+	ErrUnknownDriver = errors.New("storage driver must be sqlite, postgres or memory")
+
+	ErrNoSchema = errors.New("memory storage has no schema to migrate")
+)
+
+// Backend is the set of repositories the services persist through. DB is
+// nil for the memory driver, whose data lives only as long as the process.
+type Backend struct {
+	Driver         string
+	DB             *gorm.DB
+	Users          user.Repository
+	Collaborations collaboration.Repository
+
+	// dsn is the connection string Open was given.
+	dsn string
+}
+
+// Open connects to the backend selected by driver. dsn is a file path for
+// sqlite, a connection string for postgres and ignored for memory.
+func Open(driver string, dsn string) (*Backend, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case DriverMemory:
+		users := user.NewMemoryRepository()
+		return &Backend{
+			Driver:         driver,
+			Users:          user.NewTracedRepository(users),
+			Collaborations: collaboration.NewMemoryRepository(users),
+		}, nil
+	case DriverSQLite:
+		dialector = sqlite.Open(dsn)
+	case DriverPostgres:
+		dialector = postgres.Open(dsn)
+	default:
+		return nil, fmt.Errorf("%w, got %q", ErrUnknownDriver, driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{TranslateError: true})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Use(metrics.NewGormPlugin(metrics.Default))
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Use(tracing.NewGormPlugin())
+	if err != nil {
+		return nil, err
+	}
+
+	backend := FromDB(db)
+	backend.dsn = dsn
+	return backend, nil
+}
+
+// FromDB wraps an already open database in a Backend.
+func FromDB(db *gorm.DB) *Backend {
+	return &Backend{
+		Driver:         db.Dialector.Name(),
+		DB:             db,
+		Users:          user.NewTracedRepository(user.NewSQLRepository(db)),
+		Collaborations: collaboration.NewSQLRepository(db),
+	}
+}
+
+// Migrator returns the schema migrator of a SQL backend.
+func (b *Backend) Migrator() (*migrate.Migrator, error) {
+	if b.DB == nil {
+		return nil, ErrNoSchema
+	}
+
+	return migrations.NewMigrator(b.DB)
+}
+
+// Prepare readies the schema when a service starts: pending migrations are
+// applied if apply is set, otherwise the schema must already be current.
+// The memory backend needs no preparation.
+func (b *Backend) Prepare(apply bool) error {
+	if b.DB == nil {
+		return nil
+	}
+
+	migrator, err := b.Migrator()
+	if err != nil {
+		return err
+	}
+
+	if apply {
+		_, err = migrator.Up()
+		return err
+	}
+
+	return migrator.Verify()
+}
+
+// Close releases the database connections of a SQL backend.
+func (b *Backend) Close() error {
+	if b.DB == nil {
+		return nil
+	}
+
+	sqlDB, err := b.DB.DB()
+	if err != nil {
+		return err
+	}
+
+	return sqlDB.Close()
+}
+
+// HealthChecks returns the readiness checks of a SQL backend: the database
+// answers, its schema is the one this binary expects and, for a sqlite
+// file, its filesystem has at least minFreeBytes available.
+func (b *Backend) HealthChecks(minFreeBytes uint64) []health.Check {
+	if b.DB == nil {
+		return nil
+	}
+
+	checks := []health.Check{
+		{
+			Name: "database",
+			Run: func(ctx context.Context) error {
+				sqlDB, err := b.DB.DB()
+				if err != nil {
+					return err
+				}
+				return sqlDB.PingContext(ctx)
+			},
+		},
+		{
+			Name: "migrations",
+			Run: func(ctx context.Context) error {
+				migrator, err := migrations.NewMigrator(b.DB.WithContext(ctx))
+				if err != nil {
+					return err
+				}
+				return migrator.CheckCurrent()
+			},
+		},
+	}
+
+	if path := sqliteFile(b.dsn); b.Driver == DriverSQLite && path != "" {
+		checks = append(checks, health.Check{
+			Name: "disk",
+			Run:  health.DiskSpace(filepath.Dir(path), minFreeBytes),
+		})
+	}
+
+	return checks
+}
+
+// sqliteFile extracts the file path from a sqlite DSN, or returns "" for an
+// in-memory database.
+func sqliteFile(dsn string) string {
+	path, _, _ := strings.Cut(strings.TrimPrefix(dsn, "file:"), "?")
+	if path == "" || strings.HasPrefix(path, ":memory:") {
+		return ""
+	}
+
+	return path
+}
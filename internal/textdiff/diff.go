@@ -0,0 +1,203 @@
+package textdiff
+
+import "strings"
+
+const (
+	OpEqual  = "equal"
+	OpInsert = "insert"
+	OpDelete = "delete"
+)
+
+// maxEditDistance bounds the work done by the Myers search. Texts that
+// differ by more are reported as one replacement of the differing middle.
+const maxEditDistance = 2000
+
+// Edit is a run of text that is unchanged, inserted or deleted when going
+// from the old text to the new one.
+type Edit struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Runes diffs two texts character by character.
+func Runes(from, to string) []Edit {
+	return diff(splitRunes(from), splitRunes(to))
+}
+
+// Lines diffs two texts line by line. Each line keeps its trailing newline,
+// so joining the Text of the equal and insert edits yields the new text.
+func Lines(from, to string) []Edit {
+	return diff(splitLines(from), splitLines(to))
+}
+
+func splitRunes(s string) []string {
+	tokens := make([]string, 0, len(s))
+	for _, r := range s {
+		tokens = append(tokens, string(r))
+	}
+
+	return tokens
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+func diff(a, b []string) []Edit {
+	var edits []Edit
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits = appendRun(edits, OpEqual, a[:prefix])
+	edits = append(edits, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	edits = appendRun(edits, OpEqual, a[len(a)-suffix:])
+
+	return merge(edits)
+}
+
+// myers finds a shortest edit script between a and b, as described in
+// "An O(ND) Difference Algorithm and Its Variations".
+func myers(a, b []string) []Edit {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return append(appendRun(nil, OpDelete, a), appendRun(nil, OpInsert, b)...)
+	}
+
+	max := n + m
+	offset := max
+	v := make([]int, 2*max+2)
+
+	// trace[d] holds the furthest x reached on diagonals -d..d before step d
+	var trace [][]int
+	for d := 0; d <= max && d <= maxEditDistance; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, a, b)
+			}
+		}
+	}
+
+	return append(appendRun(nil, OpDelete, a), appendRun(nil, OpInsert, b)...)
+}
+
+func backtrack(trace [][]int, a, b []string) []Edit {
+	var reversed []Edit
+
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		k := x - y
+
+		prev := trace[d]
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			reversed = append(reversed, Edit{Op: OpEqual, Text: a[x-1]})
+			x--
+			y--
+		}
+
+		if x == prevX {
+			reversed = append(reversed, Edit{Op: OpInsert, Text: b[y-1]})
+		} else {
+			reversed = append(reversed, Edit{Op: OpDelete, Text: a[x-1]})
+		}
+		x, y = prevX, prevY
+	}
+
+	for x > 0 {
+		reversed = append(reversed, Edit{Op: OpEqual, Text: a[x-1]})
+		x--
+	}
+
+	edits := make([]Edit, len(reversed))
+	for i, e := range reversed {
+		edits[len(reversed)-1-i] = e
+	}
+
+	return edits
+}
+
+func appendRun(edits []Edit, op string, tokens []string) []Edit {
+	if len(tokens) == 0 {
+		return edits
+	}
+
+	return append(edits, Edit{Op: op, Text: strings.Join(tokens, "")})
+}
+
+// merge joins adjacent edits of the same kind and puts deletions before
+// insertions within each changed run.
+func merge(edits []Edit) []Edit {
+	var out []Edit
+	var deleted, inserted strings.Builder
+
+	flush := func() {
+		if deleted.Len() > 0 {
+			out = append(out, Edit{Op: OpDelete, Text: deleted.String()})
+			deleted.Reset()
+		}
+		if inserted.Len() > 0 {
+			out = append(out, Edit{Op: OpInsert, Text: inserted.String()})
+			inserted.Reset()
+		}
+	}
+
+	for _, e := range edits {
+		switch e.Op {
+		case OpDelete:
+			deleted.WriteString(e.Text)
+		case OpInsert:
+			inserted.WriteString(e.Text)
+		default:
+			flush()
+			if len(out) > 0 && out[len(out)-1].Op == OpEqual {
+				out[len(out)-1].Text += e.Text
+				continue
+			}
+			out = append(out, e)
+		}
+	}
+	flush()
+
+	return out
+}
@@ -1,17 +1,12 @@
 package user
 
 import (
-	"errors"
-	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-)
-
-var (
-	ErrUserNotFound = errors.New("user not found")
-
-	ErrInvalidPassword = errors.New("invalid password")
+	"github.com/similadayo/pkg/validation"
 )
 
 type Handler struct {
@@ -19,7 +14,174 @@ type Handler struct {
 }
 
 type LoginResponse struct {
-	AccessToken string `json:"access_token"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// MFAChallengeResponse answers the password step of a login for users with
+// two-factor authentication. The token is sent back with their code.
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// RegisterRequest is the body of a sign-up. Passwords are capped at 72
+// bytes, beyond which bcrypt ignores them.
+type RegisterRequest struct {
+	UserName  string `json:"userName" binding:"required,username,notreserved"`
+	Password  string `json:"password" binding:"required,min=8,max=72" redact:"secret"`
+	Email     string `json:"email" binding:"required,email,max=254" redact:"pii"`
+	FirstName string `json:"firstName" binding:"max=64"`
+	LastName  string `json:"lastName" binding:"max=64"`
+	AvatarURL string `json:"avatarURL" binding:"omitempty,max=2048,httpurl"`
+}
+
+func (r *RegisterRequest) Normalize() {
+	r.UserName = strings.TrimSpace(r.UserName)
+	r.Email = validation.NormalizeEmail(r.Email)
+	r.FirstName = strings.TrimSpace(r.FirstName)
+	r.LastName = strings.TrimSpace(r.LastName)
+	r.AvatarURL = strings.TrimSpace(r.AvatarURL)
+}
+
+// LoginRequest is checked only for presence, so accounts named before the
+// username rules existed can still sign in.
+type LoginRequest struct {
+	UserName string `json:"userName" binding:"required,max=64"`
+	Password string `json:"password" binding:"required,max=72" redact:"secret"`
+}
+
+func (r *LoginRequest) Normalize() {
+	r.UserName = strings.TrimSpace(r.UserName)
+}
+
+// UpdateUserRequest holds the profile fields a user may change. Fields
+// left empty keep their current value.
+type UpdateUserRequest struct {
+	FirstName string `json:"firstName" binding:"max=64"`
+	LastName  string `json:"lastName" binding:"max=64"`
+	AvatarURL string `json:"avatarURL" binding:"omitempty,max=2048,httpurl"`
+}
+
+func (r *UpdateUserRequest) Normalize() {
+	r.FirstName = strings.TrimSpace(r.FirstName)
+	r.LastName = strings.TrimSpace(r.LastName)
+	r.AvatarURL = strings.TrimSpace(r.AvatarURL)
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required" redact:"secret"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token" redact:"secret"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required,max=512" redact:"secret"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email,max=254" redact:"pii"`
+}
+
+func (r *ResendVerificationRequest) Normalize() {
+	r.Email = validation.NormalizeEmail(r.Email)
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email,max=254" redact:"pii"`
+}
+
+func (r *ForgotPasswordRequest) Normalize() {
+	r.Email = validation.NormalizeEmail(r.Email)
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required,max=128" redact:"secret"`
+	Password string `json:"password" binding:"required,min=8,max=72" redact:"secret"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" binding:"required,max=72" redact:"secret"`
+	NewPassword     string `json:"newPassword" binding:"required,min=8,max=72" redact:"secret"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required,max=512" redact:"secret"`
+	Code     string `json:"code" binding:"required,max=32" redact:"secret"`
+}
+
+// MFACodeRequest carries a TOTP code or, where accepted, a recovery code.
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required,max=32" redact:"secret"`
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// UserResponse is how a user is shown through the API. It never carries
+// the fields of User tagged secret, and carries those tagged PII only to
+// the user themself.
+type UserResponse struct {
+	ID        string    `json:"id"`
+	UserName  string    `json:"userName"`
+	Email     string    `json:"email,omitempty"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	AvatarURL string    `json:"avatarURL"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+
+	EmailVerified *bool `json:"emailVerified,omitempty"`
+	TOTPEnabled   *bool `json:"totpEnabled,omitempty"`
+}
+
+// NewUserResponse shows u to the user viewerID.
+func NewUserResponse(u User, viewerID string) UserResponse {
+	resp := UserResponse{
+		ID:        u.ID,
+		UserName:  u.UserName,
+		FirstName: u.FirstName,
+		LastName:  u.LastName,
+		AvatarURL: u.AvatarURL,
+		Created:   u.Created,
+		Updated:   u.Updated,
+	}
+	if viewerID != "" && viewerID == u.ID {
+		resp.Email = u.Email
+		resp.EmailVerified = &u.EmailVerified
+		resp.TOTPEnabled = &u.TOTPEnabled
+	}
+
+	return resp
+}
+
+func NewUserResponses(users []User, viewerID string) []UserResponse {
+	resp := make([]UserResponse, 0, len(users))
+	for _, u := range users {
+		resp = append(resp, NewUserResponse(u, viewerID))
+	}
+
+	return resp
+}
+
+func newLoginResponse(pair TokenPair) LoginResponse {
+	return LoginResponse{
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    pair.ExpiresIn,
+	}
 }
 
 func NewHandler(service *Service) *Handler {
@@ -28,83 +190,350 @@ func NewHandler(service *Service) *Handler {
 	}
 }
 
+// service returns the service bound to the request, so its work is traced
+// beneath the request's span.
+func (h *Handler) service(c *gin.Context) *Service {
+	return h.Service.WithContext(c.Request.Context()).WithClientIP(c.ClientIP())
+}
+
 func (h *Handler) Register(c *gin.Context) {
-	var user User
+	var req RegisterRequest
 
-	err := c.ShouldBindJSON(&user)
+	err := validation.BindJSON(c, &req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errors": err.Error(),
-		})
+		c.Error(err)
+		return
+	}
 
+	userInput, err := h.service(c).CreateUser(req.UserName, req.Password, req.Email, req.FirstName, req.LastName, req.AvatarURL)
+	if err != nil {
+		c.Error(err)
 		return
 	}
 
-	userInput, err := h.Service.CreateUser(user.UserName, user.Password, user.Email, user.FirstName, user.LastName, user.AvatarURL)
+	c.JSON(http.StatusOK, gin.H{
+		"data": NewUserResponse(userInput, userInput.ID),
+	})
+}
+
+func (h *Handler) Login(c *gin.Context) {
+	var req LoginRequest
+
+	err := validation.BindJSON(c, &req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errors": err.Error(),
+		c.Error(err)
+		return
+	}
+
+	result, err := h.service(c).AuthenticateUser(req.UserName, req.Password)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	if result.MFAToken != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"data": MFAChallengeResponse{
+				MFARequired: true,
+				MFAToken:    result.MFAToken,
+				ExpiresIn:   int64(h.Service.MFA.ChallengeTTL.Seconds()),
+			},
 		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": newLoginResponse(result.TokenPair),
+	})
+}
+
+// LoginMFA finishes a login with the challenge from Login and a TOTP or
+// recovery code.
+func (h *Handler) LoginMFA(c *gin.Context) {
+	var req MFALoginRequest
 
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	tokens, err := h.service(c).CompleteMFALogin(req.MFAToken, req.Code)
+	if err != nil {
+		c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": userInput,
+		"data": newLoginResponse(tokens),
 	})
 }
 
-func (h *Handler) Login(c *gin.Context) {
-	var userInput User
+// Refresh rotates a refresh token and returns a new token pair.
+func (h *Handler) Refresh(c *gin.Context) {
+	var req RefreshRequest
 
-	err := c.ShouldBindJSON(&userInput)
+	err := validation.BindJSON(c, &req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errors": err.Error(),
-		})
+		c.Error(err)
+		return
+	}
 
+	tokens, err := h.service(c).RefreshTokens(req.RefreshToken)
+	if err != nil {
+		c.Error(err)
 		return
 	}
 
-	token, err := h.Service.AuthenticateUser(userInput.UserName, userInput.Password)
-	{
-		if errors.Is(err, ErrUserNotFound) {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"errors": err.Error(),
-			})
+	c.JSON(http.StatusOK, gin.H{
+		"data": newLoginResponse(tokens),
+	})
+}
 
-			return
-		}
-		if errors.Is(err, ErrInvalidPassword) {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"errors": err.Error(),
-			})
+// Logout revokes the caller's access token and, if supplied, its refresh token family.
+func (h *Handler) Logout(c *gin.Context) {
+	var req LogoutRequest
 
+	if c.Request.ContentLength > 0 {
+		err := validation.BindJSON(c, &req)
+		if err != nil {
+			c.Error(err)
 			return
 		}
 	}
 
+	expiresAt := time.Unix(c.GetInt64("token_expires_at"), 0)
+
+	err := h.service(c).Logout(c.GetString("user_id"), c.GetString("token_id"), expiresAt, req.RefreshToken)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// VerifyEmail verifies the address a link was sent to. The token is taken
+// from the token query parameter, so the link works when opened, or from a
+// JSON body.
+func (h *Handler) VerifyEmail(c *gin.Context) {
+	req := VerifyEmailRequest{Token: c.Query("token")}
+
+	var err error
+	if req.Token == "" && c.Request.Method == http.MethodPost {
+		err = validation.BindJSON(c, &req)
+	} else {
+		err = validation.Struct(&req)
+	}
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	user, err := h.service(c).VerifyEmail(req.Token)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": NewUserResponse(user, user.ID),
+	})
+}
+
+// ResendVerification sends another verification email. It is accepted
+// whether or not the address belongs to an unverified user.
+func (h *Handler) ResendVerification(c *gin.Context) {
+	var req ResendVerificationRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.service(c).ResendVerification(req.Email)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// ForgotPassword emails a password reset link. It is accepted whether or
+// not the address belongs to a user.
+func (h *Handler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.service(c).RequestPasswordReset(req.Email)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// ResetPassword sets a new password with the token from a reset link.
+func (h *Handler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.service(c).ResetPassword(req.Token, req.Password)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ChangePassword replaces the caller's password and returns a new token
+// pair, as every earlier session is signed out.
+func (h *Handler) ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	tokens, err := h.service(c).ChangePassword(c.GetString("user_id"), req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": newLoginResponse(tokens),
+	})
+}
+
+// EnrollTOTP starts setting up an authenticator app for the caller.
+func (h *Handler) EnrollTOTP(c *gin.Context) {
+	enrollment, err := h.service(c).EnrollTOTP(c.GetString("user_id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{
-		"data": LoginResponse{
-			AccessToken: token,
+		"data": TOTPEnrollmentResponse{
+			Secret: enrollment.Secret,
+			URI:    enrollment.URI,
 		},
 	})
+}
+
+// ConfirmTOTP turns on two-factor authentication with a code from the
+// enrolled app, and returns the caller's recovery codes.
+func (h *Handler) ConfirmTOTP(c *gin.Context) {
+	var req MFACodeRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	codes, err := h.service(c).ConfirmTOTP(c.GetString("user_id"), req.Code)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes.
+func (h *Handler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req MFACodeRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	codes, err := h.service(c).RegenerateRecoveryCodes(c.GetString("user_id"), req.Code)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data": RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// DisableTOTP turns off the caller's two-factor authentication.
+func (h *Handler) DisableTOTP(c *gin.Context) {
+	var req MFACodeRequest
+
+	err := validation.BindJSON(c, &req)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	err = h.service(c).DisableTOTP(c.GetString("user_id"), req.Code)
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AdminDisableTOTP lets an administrator turn off another user's two-factor
+// authentication.
+func (h *Handler) AdminDisableTOTP(c *gin.Context) {
+	err := h.service(c).AdminDisableTOTP(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
 
+	c.Status(http.StatusNoContent)
+}
+
+// AdminUnlockUser lets an administrator lift the lockout of another user's
+// account.
+func (h *Handler) AdminUnlockUser(c *gin.Context) {
+	err := h.service(c).AdminUnlockUser(c.GetString("user_id"), c.Param("id"))
+	if err != nil {
+		c.Error(err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
 
 // GetUser returns the user and checks authentication.
 func (h *Handler) GetUserByIDHandler(c *gin.Context) {
-	user, err := h.Service.GetUserByID(c.Param("id"))
+	user, err := h.service(c).GetUserByID(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-		fmt.Println(err)
+		c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": user,
+		"data": NewUserResponse(user, c.GetString("user_id")),
 	})
 }
 
@@ -112,88 +541,79 @@ func (h *Handler) GetUserByIDHandler(c *gin.Context) {
 func (h *Handler) GetUserByUserNameHandler(c *gin.Context) {
 	userName := c.Param("username")
 
-	user, err := h.Service.GetUserByUserName(userName)
+	user, err := h.service(c).GetUserByUserName(userName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
-	user.Password = ""
-
 	c.JSON(http.StatusOK, gin.H{
-		"data": user,
+		"data": NewUserResponse(user, c.GetString("user_id")),
 	})
 
 }
 
 func (h *Handler) GetUserProfileHandler(c *gin.Context) {
-	user, err := h.Service.GetUserProfile(c.Param("id"))
+	user, err := h.service(c).GetUserProfile(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": user,
+		"data": NewUserResponse(user, c.GetString("user_id")),
 	})
 }
 
 func (h *Handler) UpdateUserHandler(c *gin.Context) {
-	var user User
+	var req UpdateUserRequest
 
-	err := c.ShouldBindJSON(&user)
+	err := validation.BindJSON(c, &req)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
-	existingUser, err := h.Service.GetUserByID(c.Param("id"))
+	existingUser, err := h.service(c).GetUserByID(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
-	user.ID = existingUser.ID
-	user.Email = existingUser.Email
-	user.UserName = existingUser.UserName
-	user.Password = existingUser.Password
-	user.Created = existingUser.Created
+	user := User{
+		ID:        existingUser.ID,
+		UserName:  existingUser.UserName,
+		Password:  existingUser.Password,
+		Email:     existingUser.Email,
+		FirstName: req.FirstName,
+		LastName:  req.LastName,
+		AvatarURL: req.AvatarURL,
+		Created:   existingUser.Created,
+		Updated:   time.Now(),
+	}
 
-	updatedUser, err := h.Service.UpdateUser(user)
+	_, err = h.service(c).UpdateUser(user)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
-	existingUser.Password = ""
+	// Updates skips zero values, so respond with what was stored
+	updatedUser, err := h.service(c).GetUserByID(user.ID)
+	if err != nil {
+		c.Error(err)
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": updatedUser,
+		"data": NewUserResponse(updatedUser, c.GetString("user_id")),
 	})
 }
 
 func (h *Handler) DeleteUserHandler(c *gin.Context) {
-	err := h.Service.DeleteUser(c.Param("id"))
+	err := h.service(c).DeleteUser(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-
+		c.Error(err)
 		return
 	}
 
@@ -203,16 +623,13 @@ func (h *Handler) DeleteUserHandler(c *gin.Context) {
 func (h *Handler) FilterUserByNameHandler(c *gin.Context) {
 	userName := c.Query("username")
 
-	users, err := h.Service.FilterUserByName(userName)
+	users, err := h.service(c).FilterUserByName(userName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"errors": err.Error(),
-		})
-		fmt.Println(err)
+		c.Error(err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"data": users,
+		"data": NewUserResponses(users, c.GetString("user_id")),
 	})
 }
@@ -0,0 +1,245 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/mail"
+	"gorm.io/gorm"
+)
+
+const (
+	accountThrottle = "account:"
+	ipThrottle      = "ip:"
+)
+
+var (
+	ErrLoginThrottled = apierror.TooManyRequests("login_throttled", "too many failed logins, try again later")
+
+	ErrAccountLocked = apierror.TooManyRequests("account_locked", "too many failed logins, the account is locked for a while")
+)
+
+// Lockout slows down password guessing. Failed logins are counted against
+// the username and the client address; each one makes both wait twice as
+// long as the last, and too many lock them outright. Unknown usernames are
+// counted like real ones, so a lockout reveals nothing about which exist.
+type Lockout struct {
+	// MaxFailures and MaxIPFailures are how many failed logins within
+	// Window lock a username or a client address for Duration.
+	MaxFailures   int
+	MaxIPFailures int
+	Duration      time.Duration
+	Window        time.Duration
+
+	// BaseDelay is the wait after the first failure, doubled after each
+	// one since, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Mailer tells users their account was locked. When nil, no one is told.
+	Mailer mail.Mailer
+}
+
+// WithClientIP returns a copy of the service that counts failed logins
+// against the client address ip as well as the username.
+func (s *Service) WithClientIP(ip string) *Service {
+	clone := *s
+	clone.clientIP = ip
+	return &clone
+}
+
+// AdminUnlockUser lifts the lockout of a user's account before it runs out.
+// Only the users in Admins may do so.
+func (s *Service) AdminUnlockUser(adminID string, userID string) error {
+	ctx, span, repo := s.start("AdminUnlockUser")
+	defer span.End()
+
+	if !s.isAdmin(adminID) {
+		return ErrNotAdmin
+	}
+
+	user, err := repo.GetUserByID(userID)
+	if err != nil {
+		return userError(err)
+	}
+
+	err = repo.ClearLoginThrottle(accountThrottle + user.UserName)
+	if err != nil {
+		return err
+	}
+
+	s.logger.WithContext(ctx).Warn("account unlocked by an administrator", map[string]interface{}{
+		"admin_id": adminID,
+		"user_id":  user.ID,
+	})
+	return nil
+}
+
+// throttleKeys are the keys failed logins as username are counted against.
+func (s *Service) throttleKeys(username string) []string {
+	keys := []string{accountThrottle + username}
+	if s.clientIP != "" {
+		keys = append(keys, ipThrottle+s.clientIP)
+	}
+
+	return keys
+}
+
+// checkLoginThrottle refuses a login while any of keys is locked.
+func (s *Service) checkLoginThrottle(repo Repository, keys []string) error {
+	if s.Lockout == nil {
+		return nil
+	}
+
+	now := s.now()
+	for _, key := range keys {
+		throttle, err := repo.GetLoginThrottle(key)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if now.Before(throttle.LockedUntil) {
+			refusal := ErrLoginThrottled
+			if strings.HasPrefix(key, accountThrottle) && throttle.Failures >= s.Lockout.MaxFailures {
+				refusal = ErrAccountLocked
+			}
+
+			return refusal.WithRetryAfter(throttle.LockedUntil.Sub(now))
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failed login against keys and locks each for
+// as long as its count calls for. user is who the login was for, or nil if
+// the username is unknown; they are told when their account becomes locked.
+func (s *Service) recordLoginFailure(ctx context.Context, repo Repository, keys []string, user *User) error {
+	if s.Lockout == nil {
+		return nil
+	}
+
+	now := s.now()
+	for _, key := range keys {
+		throttle, err := repo.RecordLoginFailure(key, now, s.Lockout.Window)
+		if err != nil {
+			return err
+		}
+
+		account := strings.HasPrefix(key, accountThrottle)
+		lockFor := s.Lockout.delay(account, throttle.Failures)
+		err = repo.LockLogin(key, now.Add(lockFor))
+		if err != nil {
+			return err
+		}
+
+		if account && user != nil && throttle.Failures == s.Lockout.MaxFailures {
+			s.notifyLockout(ctx, *user, lockFor)
+		}
+	}
+
+	return nil
+}
+
+// clearLoginThrottle forgets the failed logins for username once someone
+// proves they hold the account. Those from the client address still count,
+// so an attacker cannot reset them by signing in to an account of their own.
+func (s *Service) clearLoginThrottle(repo Repository, username string) error {
+	if s.Lockout == nil {
+		return nil
+	}
+
+	return repo.ClearLoginThrottle(accountThrottle + username)
+}
+
+// delay is how long logins wait after the given number of failures.
+func (l *Lockout) delay(account bool, failures int) time.Duration {
+	limit := l.MaxIPFailures
+	if account {
+		limit = l.MaxFailures
+	}
+	if failures >= limit {
+		return l.Duration
+	}
+
+	delay := l.BaseDelay
+	for i := 1; i < failures && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+
+	return delay
+}
+
+// notifyLockout emails user that their account was locked. It does not
+// wait for the mail to go out, so a login for a real account takes no
+// longer than one for an unknown username.
+func (s *Service) notifyLockout(ctx context.Context, user User, lockFor time.Duration) {
+	if s.Lockout.Mailer == nil || user.Email == "" {
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := s.Lockout.Mailer.Send(ctx, mail.Message{
+			To:      user.Email,
+			Subject: "Your account has been locked",
+			Body: fmt.Sprintf("Hello %s,\n\nThere were %d failed attempts to sign in to your account, so sign-ins are blocked for the next %s.\n\nIf this was not you, someone may be trying to guess your password. Consider choosing a stronger one once you can sign in again, and turning on two-factor authentication.\n",
+				user.UserName, s.Lockout.MaxFailures, describeWait(lockFor)),
+		})
+		if err != nil {
+			s.logger.WithContext(ctx).Error("failed to send lockout email", map[string]interface{}{
+				"user_id": user.ID,
+				"error":   err.Error(),
+			})
+		}
+	}()
+}
+
+// describeWait says how long d is in words, to the minute once it is one.
+func describeWait(d time.Duration) string {
+	unit, count := "second", int((d+time.Second-1)/time.Second)
+	if d >= time.Minute {
+		unit, count = "minute", int(d.Round(time.Minute)/time.Minute)
+	}
+	if count != 1 {
+		unit += "s"
+	}
+
+	return fmt.Sprintf("%d %s", count, unit)
+}
+
+var (
+	dummyHashesMu sync.Mutex
+	dummyHashes   = map[int]string{}
+)
+
+// dummyPasswordHash returns a hash of the given cost to check passwords
+// against when the username is unknown, so that takes as long as a wrong
+// password does.
+func dummyPasswordHash(ctx context.Context, cost int) (string, error) {
+	dummyHashesMu.Lock()
+	defer dummyHashesMu.Unlock()
+
+	if hash, ok := dummyHashes[cost]; ok {
+		return hash, nil
+	}
+
+	hash, err := hashedPassword(ctx, "not the password of any user", cost)
+	if err != nil {
+		return "", err
+	}
+
+	dummyHashes[cost] = hash
+	return hash, nil
+}
@@ -0,0 +1,547 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/similadayo/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// MemoryRepository is a Repository held in process memory. It behaves like
+// SQLRepository and is meant for tests and single-process development.
+type MemoryRepository struct {
+	mu            sync.RWMutex
+	users         map[string]User
+	refreshTokens map[string]RefreshToken
+	revokedTokens map[string]RevokedToken
+	resetTokens   map[string]PasswordResetToken
+	recoveryCodes map[string]RecoveryCode
+	throttles     map[string]LoginThrottle
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:         map[string]User{},
+		refreshTokens: map[string]RefreshToken{},
+		revokedTokens: map[string]RevokedToken{},
+		resetTokens:   map[string]PasswordResetToken{},
+		recoveryCodes: map[string]RecoveryCode{},
+		throttles:     map[string]LoginThrottle{},
+	}
+}
+
+// WithContext returns r; memory operations are neither cancelled nor traced.
+func (r *MemoryRepository) WithContext(ctx context.Context) Repository {
+	return r
+}
+
+func (r *MemoryRepository) Register(user User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[user.ID]; ok || r.taken(user) {
+		return user, gorm.ErrDuplicatedKey
+	}
+
+	r.users[user.ID] = user
+	return user, nil
+}
+
+// taken reports whether another user has user's username or, ignoring case,
+// email address, as the unique indexes on users do.
+func (r *MemoryRepository) taken(user User) bool {
+	for _, other := range r.users {
+		if other.ID == user.ID {
+			continue
+		}
+		if user.UserName != "" && other.UserName == user.UserName {
+			return true
+		}
+		if user.Email != "" && strings.EqualFold(other.Email, user.Email) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *MemoryRepository) Login(user User) (User, error) {
+	return r.GetUser(user)
+}
+
+func (r *MemoryRepository) GetUser(user User) (User, error) {
+	return r.find(func(u User) bool {
+		return u.Email == user.Email && u.Password == user.Password
+	})
+}
+
+func (r *MemoryRepository) GetUserByID(userID string) (User, error) {
+	return r.find(func(u User) bool {
+		return u.ID == userID
+	})
+}
+
+func (r *MemoryRepository) GetUserByUserName(userName string) (User, error) {
+	return r.find(func(u User) bool {
+		return u.UserName == userName
+	})
+}
+
+func (r *MemoryRepository) GetUserByEmail(email string) (User, error) {
+	return r.find(func(u User) bool {
+		return strings.EqualFold(u.Email, email)
+	})
+}
+
+func (r *MemoryRepository) GetUserProfile(userID string) (User, error) {
+	return r.GetUserByID(userID)
+}
+
+// UpdateUser copies the non-zero fields of user onto the stored record, as
+// gorm's Updates does for structs.
+func (r *MemoryRepository) UpdateUser(user User) (User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[user.ID]
+	if !ok {
+		return user, nil
+	}
+	if r.taken(user) {
+		return user, gorm.ErrDuplicatedKey
+	}
+
+	for _, field := range []struct {
+		from string
+		to   *string
+	}{
+		{user.UserName, &stored.UserName},
+		{user.Password, &stored.Password},
+		{user.Email, &stored.Email},
+		{user.FirstName, &stored.FirstName},
+		{user.LastName, &stored.LastName},
+		{user.AvatarURL, &stored.AvatarURL},
+	} {
+		if field.from != "" {
+			*field.to = field.from
+		}
+	}
+	if !user.Created.IsZero() {
+		stored.Created = user.Created
+	}
+	if !user.Updated.IsZero() {
+		stored.Updated = user.Updated
+	}
+
+	r.users[user.ID] = stored
+	return user, nil
+}
+
+func (r *MemoryRepository) DeleteUser(userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.users[userID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	delete(r.users, userID)
+	return nil
+}
+
+func (r *MemoryRepository) FilterUserByName(userName string) ([]User, error) {
+	users := r.filter(func(u User) bool {
+		return strings.Contains(strings.ToLower(u.UserName), strings.ToLower(userName))
+	})
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+
+	return users, nil
+}
+
+func (r *MemoryRepository) PaginationUser(page int, limit int) ([]User, error) {
+	users := r.filter(func(User) bool { return true })
+
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].Created.Equal(users[j].Created) {
+			return users[i].Created.Before(users[j].Created)
+		}
+		return users[i].ID < users[j].ID
+	})
+
+	offset := max((page-1)*limit, 0)
+	if offset >= len(users) {
+		return []User{}, nil
+	}
+
+	return users[offset:min(offset+limit, len(users))], nil
+}
+
+func (r *MemoryRepository) MarkEmailVerified(userID string, at time.Time) error {
+	return r.updateUser(userID, func(u *User) {
+		u.EmailVerified = true
+		u.EmailVerifiedAt = &at
+	})
+}
+
+func (r *MemoryRepository) RecordVerificationSent(userID string, at time.Time) error {
+	return r.updateUser(userID, func(u *User) {
+		u.VerificationSentAt = &at
+	})
+}
+
+func (r *MemoryRepository) UpdatePassword(userID string, hashedPassword string, at time.Time) error {
+	return r.updateUser(userID, func(u *User) {
+		u.Password = hashedPassword
+		u.Updated = at
+	})
+}
+
+func (r *MemoryRepository) updateUser(userID string, update func(*User)) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[userID]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	update(&stored)
+	r.users[userID] = stored
+	return nil
+}
+
+func (r *MemoryRepository) CreateRefreshToken(token RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.insertRefreshToken(token)
+}
+
+func (r *MemoryRepository) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, token := range r.refreshTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+
+	return RefreshToken{}, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRepository) RotateRefreshToken(current RefreshToken, next RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.refreshTokens[current.ID]
+	if !ok || stored.Revoked {
+		return ErrTokenAlreadyRotated
+	}
+
+	err := r.insertRefreshToken(next)
+	if err != nil {
+		return err
+	}
+
+	stored.Revoked = true
+	stored.ReplacedBy = next.ID
+	r.refreshTokens[current.ID] = stored
+
+	return nil
+}
+
+func (r *MemoryRepository) CreatePasswordResetToken(token PasswordResetToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.resetTokens {
+		if existing.ID == token.ID || existing.TokenHash == token.TokenHash {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+	for id, existing := range r.resetTokens {
+		if existing.UserID == token.UserID && existing.UsedAt == nil {
+			delete(r.resetTokens, id)
+		}
+	}
+
+	r.resetTokens[token.ID] = token
+	return nil
+}
+
+func (r *MemoryRepository) ConsumePasswordResetToken(tokenHash string, now time.Time) (PasswordResetToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, token := range r.resetTokens {
+		if token.TokenHash != tokenHash || token.UsedAt != nil || !token.ExpiresAt.After(now) {
+			continue
+		}
+
+		token.UsedAt = &now
+		r.resetTokens[id] = token
+		return token, nil
+	}
+
+	return PasswordResetToken{}, gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRepository) SetTOTPSecret(userID string, secret string) error {
+	return r.updateUser(userID, func(u *User) {
+		u.TOTPSecret = secret
+		u.TOTPEnabled = false
+		u.TOTPLastCounter = 0
+	})
+}
+
+func (r *MemoryRepository) EnableTOTP(userID string, counter int64, codes []RecoveryCode) error {
+	err := r.updateUser(userID, func(u *User) {
+		u.TOTPEnabled = true
+		u.TOTPLastCounter = counter
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.ReplaceRecoveryCodes(userID, codes)
+}
+
+func (r *MemoryRepository) UseTOTPCounter(userID string, counter int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.users[userID]
+	if !ok || stored.TOTPLastCounter >= counter {
+		return ErrTOTPCodeReused
+	}
+
+	stored.TOTPLastCounter = counter
+	r.users[userID] = stored
+	return nil
+}
+
+func (r *MemoryRepository) DisableTOTP(userID string) error {
+	err := r.updateUser(userID, func(u *User) {
+		u.TOTPSecret = ""
+		u.TOTPEnabled = false
+		u.TOTPLastCounter = 0
+	})
+	if err != nil {
+		return err
+	}
+
+	return r.ReplaceRecoveryCodes(userID, nil)
+}
+
+func (r *MemoryRepository) ReplaceRecoveryCodes(userID string, codes []RecoveryCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, code := range r.recoveryCodes {
+		if code.UserID == userID {
+			delete(r.recoveryCodes, id)
+		}
+	}
+	for _, code := range codes {
+		r.recoveryCodes[code.ID] = code
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) ConsumeRecoveryCode(userID string, codeHash string, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, code := range r.recoveryCodes {
+		if code.UserID != userID || code.CodeHash != codeHash || code.UsedAt != nil {
+			continue
+		}
+
+		code.UsedAt = &now
+		r.recoveryCodes[id] = code
+		return nil
+	}
+
+	return gorm.ErrRecordNotFound
+}
+
+func (r *MemoryRepository) RevokeTokenFamily(familyID string) error {
+	return r.revokeRefreshTokens(func(token RefreshToken) bool {
+		return token.FamilyID == familyID
+	})
+}
+
+func (r *MemoryRepository) RevokeUserTokens(userID string) error {
+	return r.revokeRefreshTokens(func(token RefreshToken) bool {
+		return token.UserID == userID
+	})
+}
+
+func (r *MemoryRepository) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.revokeAccessToken(jti, expiresAt)
+	return nil
+}
+
+func (r *MemoryRepository) IsTokenRevoked(jti string) (bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.revokedTokens[jti]
+	return ok, nil
+}
+
+func (r *MemoryRepository) GetLoginThrottle(key string) (LoginThrottle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	throttle, ok := r.throttles[key]
+	if !ok {
+		return LoginThrottle{}, gorm.ErrRecordNotFound
+	}
+
+	return throttle, nil
+}
+
+func (r *MemoryRepository) RecordLoginFailure(key string, at time.Time, window time.Duration) (LoginThrottle, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	throttle, ok := r.throttles[key]
+	if !ok || throttle.LastFailure.Before(at.Add(-window)) {
+		throttle.Key = key
+		throttle.Failures = 0
+	}
+
+	throttle.Failures++
+	throttle.LastFailure = at
+	r.throttles[key] = throttle
+	return throttle, nil
+}
+
+func (r *MemoryRepository) LockLogin(key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	throttle, ok := r.throttles[key]
+	if !ok {
+		return gorm.ErrRecordNotFound
+	}
+
+	throttle.LockedUntil = until
+	r.throttles[key] = throttle
+	return nil
+}
+
+func (r *MemoryRepository) ClearLoginThrottle(key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.throttles, key)
+	return nil
+}
+
+func (r *MemoryRepository) DeleteExpiredTokens(now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jti, token := range r.revokedTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(r.revokedTokens, jti)
+		}
+	}
+	for id, token := range r.refreshTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(r.refreshTokens, id)
+		}
+	}
+	for id, token := range r.resetTokens {
+		if token.ExpiresAt.Before(now) {
+			delete(r.resetTokens, id)
+		}
+	}
+
+	return nil
+}
+
+func (r *MemoryRepository) find(match func(User) bool) (User, error) {
+	users := r.filter(match)
+	if len(users) == 0 {
+		return User{}, gorm.ErrRecordNotFound
+	}
+
+	return users[0], nil
+}
+
+func (r *MemoryRepository) filter(match func(User) bool) []User {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := []User{}
+	for _, u := range r.users {
+		if match(u) {
+			users = append(users, u)
+		}
+	}
+
+	return users
+}
+
+// insertRefreshToken enforces the same keys as the refresh_tokens table. r.mu must be held.
+func (r *MemoryRepository) insertRefreshToken(token RefreshToken) error {
+	if _, ok := r.refreshTokens[token.ID]; ok {
+		return gorm.ErrDuplicatedKey
+	}
+	for _, existing := range r.refreshTokens {
+		if existing.TokenHash == token.TokenHash {
+			return gorm.ErrDuplicatedKey
+		}
+	}
+
+	r.refreshTokens[token.ID] = token
+	return nil
+}
+
+func (r *MemoryRepository) revokeRefreshTokens(match func(RefreshToken) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, token := range r.refreshTokens {
+		if !match(token) {
+			continue
+		}
+
+		if token.AccessJTI != "" {
+			r.revokeAccessToken(token.AccessJTI, now.Add(utils.AccessTokenTTL))
+		}
+		token.Revoked = true
+		r.refreshTokens[id] = token
+	}
+
+	return nil
+}
+
+// revokeAccessToken keeps the first revocation of a jti. r.mu must be held.
+func (r *MemoryRepository) revokeAccessToken(jti string, expiresAt time.Time) {
+	if _, ok := r.revokedTokens[jti]; ok {
+		return
+	}
+
+	r.revokedTokens[jti] = RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+		Created:   time.Now(),
+	}
+}
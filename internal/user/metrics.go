@@ -0,0 +1,13 @@
+package user
+
+import "github.com/similadayo/pkg/metrics"
+
+var (
+	passwordHashDuration = metrics.Default.Histogram("password_hash_duration_seconds",
+		"Time spent in bcrypt, by operation: hash or compare.",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5}, "operation")
+
+	loginAttempts = metrics.Default.Counter("user_login_attempts_total",
+		"Logins, by result: success, failure, throttled when refused for too many failures, or mfa_required when the password was right and a second factor is due.",
+		"result")
+)
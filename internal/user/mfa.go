@@ -0,0 +1,385 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/totp"
+	"github.com/similadayo/pkg/utils"
+	"gorm.io/gorm"
+)
+
+const (
+	// mfaChallengePurpose keeps challenge tokens from being accepted by any
+	// other use of the signer.
+	mfaChallengePurpose = "mfa-challenge"
+
+	recoveryCodeCount = 10
+
+	// totpSkew is how many 30 second steps a code may be early or late, to
+	// allow for the phone's clock drifting.
+	totpSkew = 1
+)
+
+var (
+	ErrInvalidMFACode = apierror.Unauthorized("invalid_mfa_code", "invalid two-factor authentication code")
+
+	ErrInvalidMFAToken = apierror.Unauthorized("invalid_mfa_token", "invalid or expired two-factor login, sign in again")
+
+	ErrMFAAlreadyEnabled = apierror.Conflict("mfa_already_enabled", "two-factor authentication is already enabled")
+
+	ErrMFANotEnabled = apierror.Conflict("mfa_not_enabled", "two-factor authentication is not enabled")
+
+	ErrNotAdmin = apierror.Forbidden("not_admin", "only administrators may do this")
+
+	errMFANotConfigured = errors.New("two-factor authentication is not configured")
+)
+
+// MFA configures two-factor authentication with authenticator apps.
+type MFA struct {
+	// Issuer names the service in authenticator apps.
+	Issuer string
+
+	// Signer signs the challenge tokens that carry a login from the
+	// password step to the code step.
+	Signer       *utils.Signer
+	ChallengeTTL time.Duration
+}
+
+// TOTPEnrollment is what an authenticator app needs to generate a user's
+// codes. URI is usually shown as a QR code, Secret for typing in by hand.
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
+}
+
+// LoginResult is the outcome of the password step of a login. Users with
+// two-factor authentication get an MFAToken to present with their code in
+// place of a token pair.
+type LoginResult struct {
+	TokenPair
+	MFAToken string
+}
+
+// CompleteMFALogin finishes a login started by AuthenticateUser, given the
+// challenge token it returned and a TOTP or recovery code.
+func (s *Service) CompleteMFALogin(mfaToken string, code string) (TokenPair, error) {
+	ctx, span, repo := s.start("CompleteMFALogin")
+	defer span.End()
+
+	if s.MFA == nil {
+		return TokenPair{}, ErrInvalidMFAToken
+	}
+
+	userID, err := s.MFA.Signer.Subject(mfaToken)
+	if err != nil {
+		return TokenPair{}, ErrInvalidMFAToken.Wrap(err)
+	}
+
+	user, err := repo.GetUserByID(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return TokenPair{}, ErrInvalidMFAToken.Wrap(err)
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	_, err = s.MFA.Signer.Verify(mfaToken, mfaChallengePurpose, challengeBinding(user))
+	if err != nil || !user.TOTPEnabled {
+		return TokenPair{}, ErrInvalidMFAToken.Wrap(err)
+	}
+
+	// codes can be guessed like passwords, so they are throttled alike
+	keys := s.throttleKeys(user.UserName)
+	err = s.checkLoginThrottle(repo, keys)
+	if err != nil {
+		loginAttempts.With("throttled").Inc()
+		return TokenPair{}, err
+	}
+
+	err = s.checkSecondFactor(repo, user, code)
+	if err != nil {
+		loginAttempts.With("failure").Inc()
+		if recordErr := s.recordLoginFailure(ctx, repo, keys, &user); recordErr != nil {
+			return TokenPair{}, recordErr
+		}
+		return TokenPair{}, err
+	}
+
+	err = s.clearLoginThrottle(repo, user.UserName)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	loginAttempts.With("success").Inc()
+	return s.issueTokens(repo, user, generateUUID())
+}
+
+// EnrollTOTP gives a user a new TOTP secret. It takes effect once the user
+// proves their app has it with ConfirmTOTP.
+func (s *Service) EnrollTOTP(userID string) (TOTPEnrollment, error) {
+	_, span, repo := s.start("EnrollTOTP")
+	defer span.End()
+
+	if s.MFA == nil {
+		return TOTPEnrollment{}, errMFANotConfigured
+	}
+
+	user, err := repo.GetUserByID(userID)
+	if err != nil {
+		return TOTPEnrollment{}, userError(err)
+	}
+	if user.TOTPEnabled {
+		return TOTPEnrollment{}, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	err = repo.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.URI(s.MFA.Issuer, user.UserName, secret),
+	}, nil
+}
+
+// ConfirmTOTP turns on two-factor authentication once code shows the user's
+// app generates codes for the secret from EnrollTOTP. It returns the user's
+// recovery codes, which are not shown again.
+func (s *Service) ConfirmTOTP(userID string, code string) ([]string, error) {
+	_, span, repo := s.start("ConfirmTOTP")
+	defer span.End()
+
+	user, err := repo.GetUserByID(userID)
+	if err != nil {
+		return nil, userError(err)
+	}
+	if user.TOTPEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrMFANotEnabled.WithMessage("start two-factor enrollment first")
+	}
+
+	counter, ok := totp.Validate(user.TOTPSecret, normalizeCode(code), s.now(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, records, err := newRecoveryCodes(user.ID, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.EnableTOTP(user.ID, counter, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces a user's recovery codes, given a current
+// TOTP or recovery code.
+func (s *Service) RegenerateRecoveryCodes(userID string, code string) ([]string, error) {
+	ctx, span, repo := s.start("RegenerateRecoveryCodes")
+	defer span.End()
+
+	user, err := s.mfaUser(repo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.confirmSecondFactor(ctx, repo, user, code)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, records, err := newRecoveryCodes(user.ID, s.now())
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.ReplaceRecoveryCodes(user.ID, records)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTOTP turns off a user's two-factor authentication, given a current
+// TOTP or recovery code.
+func (s *Service) DisableTOTP(userID string, code string) error {
+	ctx, span, repo := s.start("DisableTOTP")
+	defer span.End()
+
+	user, err := s.mfaUser(repo, userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.confirmSecondFactor(ctx, repo, user, code)
+	if err != nil {
+		return err
+	}
+
+	return repo.DisableTOTP(user.ID)
+}
+
+// AdminDisableTOTP turns off the two-factor authentication of a user who
+// has lost both their authenticator and their recovery codes. Only the
+// users in Admins may do so.
+func (s *Service) AdminDisableTOTP(adminID string, userID string) error {
+	ctx, span, repo := s.start("AdminDisableTOTP")
+	defer span.End()
+
+	if !s.isAdmin(adminID) {
+		return ErrNotAdmin
+	}
+
+	user, err := s.mfaUser(repo, userID)
+	if err != nil {
+		return err
+	}
+
+	err = repo.DisableTOTP(user.ID)
+	if err != nil {
+		return err
+	}
+
+	s.logger.WithContext(ctx).Warn("two-factor authentication disabled by an administrator", map[string]interface{}{
+		"admin_id": adminID,
+		"user_id":  user.ID,
+	})
+	return nil
+}
+
+// mfaChallenge returns the token a user with two-factor authentication
+// presents with their code to finish logging in.
+func (s *Service) mfaChallenge(user User) (string, error) {
+	if s.MFA == nil {
+		return "", errMFANotConfigured
+	}
+
+	return s.MFA.Signer.Sign(mfaChallengePurpose, user.ID, challengeBinding(user), s.MFA.ChallengeTTL), nil
+}
+
+// challengeBinding voids a challenge if the user's password or TOTP secret
+// changes before it is used.
+func challengeBinding(user User) string {
+	return user.Password + "|" + user.TOTPSecret
+}
+
+func (s *Service) mfaUser(repo Repository, userID string) (User, error) {
+	user, err := repo.GetUserByID(userID)
+	if err != nil {
+		return User{}, userError(err)
+	}
+	if !user.TOTPEnabled {
+		return User{}, ErrMFANotEnabled
+	}
+
+	return user, nil
+}
+
+// checkSecondFactor accepts a TOTP code not used before or an unused
+// recovery code, which is then used up.
+func (s *Service) checkSecondFactor(repo Repository, user User, code string) error {
+	code = normalizeCode(code)
+
+	if len(code) == totp.Digits {
+		counter, ok := totp.Validate(user.TOTPSecret, code, s.now(), totpSkew)
+		if !ok {
+			return ErrInvalidMFACode
+		}
+
+		err := repo.UseTOTPCounter(user.ID, counter)
+		if errors.Is(err, ErrTOTPCodeReused) {
+			return ErrInvalidMFACode.Wrap(err)
+		}
+		return err
+	}
+
+	err := repo.ConsumeRecoveryCode(user.ID, utils.HashToken(code), s.now())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidMFACode.Wrap(err)
+	}
+	return err
+}
+
+// confirmSecondFactor checks a code a signed-in user gives to change their
+// two-factor settings. Wrong codes count as failed logins against the
+// account, so a stolen session cannot guess them any faster than a login.
+func (s *Service) confirmSecondFactor(ctx context.Context, repo Repository, user User, code string) error {
+	keys := s.throttleKeys(user.UserName)
+	err := s.checkLoginThrottle(repo, keys)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkSecondFactor(repo, user, code)
+	if errors.Is(err, ErrInvalidMFACode) {
+		if recordErr := s.recordLoginFailure(ctx, repo, keys, &user); recordErr != nil {
+			return recordErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.clearLoginThrottle(repo, user.UserName)
+}
+
+func (s *Service) isAdmin(userID string) bool {
+	for _, admin := range s.Admins {
+		if admin != "" && admin == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// normalizeCode drops the spaces and dashes users type or paste into codes,
+// and lower-cases recovery codes.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+}
+
+// newRecoveryCodes returns fresh recovery codes, formatted for the user, and
+// their records for the repository.
+func newRecoveryCodes(userID string, now time.Time) ([]string, []RecoveryCode, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]RecoveryCode, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		// 10 base32 characters carry 50 random bits
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		records = append(records, RecoveryCode{
+			ID:       generateUUID(),
+			UserID:   userID,
+			CodeHash: utils.HashToken(code),
+			Created:  now,
+		})
+	}
+
+	return codes, records, nil
+}
@@ -7,20 +7,37 @@ import (
 type User struct {
 	ID             string          `json:"id" gorm:"primary_key;type:varchar(36)"`
 	UserName       string          `json:"userName"`
-	Password       string          `json:"password"`
-	Email          string          `json:"email"`
+	Password       string          `json:"password" redact:"secret"`
+	Email          string          `json:"email" redact:"pii"`
 	FirstName      string          `json:"firstName"`
 	LastName       string          `json:"lastName"`
 	AvatarURL      string          `json:"avatarURL"`
 	Created        time.Time       `json:"created"`
 	Updated        time.Time       `json:"updated"`
 	Collaborations []Collaboration `json:"collaborations" gorm:"many2many:user_collaborations;"`
+
+	EmailVerified   bool       `json:"emailVerified"`
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt,omitempty"`
+
+	// VerificationSentAt is when the last verification email was sent, so
+	// resends can be throttled.
+	VerificationSentAt *time.Time `json:"-"`
+
+	// TOTPSecret is set when the user starts enrolling an authenticator
+	// app; TOTPEnabled once they confirm it with a code.
+	TOTPSecret  string `json:"-" redact:"secret"`
+	TOTPEnabled bool   `json:"totpEnabled"`
+
+	// TOTPLastCounter is the time step of the last code accepted, so the
+	// same code cannot be used twice.
+	TOTPLastCounter int64 `json:"-"`
 }
 
 type Collaboration struct {
 	ID        string     `json:"id"`
 	ProjectID uint64     `json:"projectId"`
 	Name      string     `json:"name"`
+	CreatedBy string     `json:"createdBy"`
 	Created   time.Time  `json:"created"`
 	Updated   time.Time  `json:"updated"`
 	Users     []User     `json:"user" gorm:"many2many:user_collaborations;"`
@@ -28,11 +45,132 @@ type Collaboration struct {
 }
 
 type Document struct {
-	ID      string    `json:"id"`
-	Name    string    `json:"name"`
-	Title   string    `json:"title"`
-	Content string    `json:"content"`
-	Created time.Time `json:"created"`
-	Updated time.Time `json:"updated"`
-	Users   []User    `json:"user" gorm:"many2many:collaboration_documents;"`
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Title    string    `json:"title"`
+	Content  string    `json:"content"`
+	Revision int       `json:"revision"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Users    []User    `json:"user" gorm:"many2many:document_users;"`
+}
+
+// RefreshToken is a single-use refresh token. Tokens obtained by rotating one
+// another share a FamilyID so that reuse of a rotated token can revoke the
+// whole chain.
+type RefreshToken struct {
+	ID         string    `json:"id" gorm:"primary_key;type:varchar(36)"`
+	UserID     string    `json:"userId" gorm:"index"`
+	FamilyID   string    `json:"familyId" gorm:"index"`
+	TokenHash  string    `json:"-" gorm:"uniqueIndex" redact:"secret"`
+	AccessJTI  string    `json:"-"`
+	ReplacedBy string    `json:"replacedBy"`
+	Revoked    bool      `json:"revoked"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Created    time.Time `json:"created"`
+}
+
+// RevokedToken records the jti of an access token that must no longer be accepted.
+type RevokedToken struct {
+	JTI       string    `json:"jti" gorm:"primary_key;type:varchar(36)"`
+	ExpiresAt time.Time `json:"expiresAt" gorm:"index"`
+	Created   time.Time `json:"created"`
+}
+
+// PasswordResetToken is a single-use token emailed to a user who has
+// forgotten their password. Only its hash is stored.
+type PasswordResetToken struct {
+	ID        string     `json:"id" gorm:"primary_key;type:varchar(36)"`
+	UserID    string     `json:"userId" gorm:"index"`
+	TokenHash string     `json:"-" gorm:"uniqueIndex" redact:"secret"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	Created   time.Time  `json:"created"`
+}
+
+// RecoveryCode is a single-use code that stands in for a TOTP code when the
+// user has lost their authenticator. Only its hash is stored.
+type RecoveryCode struct {
+	ID       string     `json:"id" gorm:"primary_key;type:varchar(36)"`
+	UserID   string     `json:"userId" gorm:"index"`
+	CodeHash string     `json:"-" redact:"secret"`
+	UsedAt   *time.Time `json:"usedAt"`
+	Created  time.Time  `json:"created"`
+}
+
+// LoginThrottle counts the failed logins for a username or a client
+// address. Key is "account:" or "ip:" followed by which. Logins for the key
+// are refused until LockedUntil.
+type LoginThrottle struct {
+	Key         string    `json:"key" gorm:"primaryKey"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// Membership is a user's role within a collaboration. It backs the
+// user_collaborations join table used by Collaboration.Users.
+type Membership struct {
+	UserID          string    `json:"userId" gorm:"primaryKey;type:varchar(36)"`
+	CollaborationID string    `json:"collaborationId" gorm:"primaryKey"`
+	Role            string    `json:"role" gorm:"not null;default:viewer"`
+	Created         time.Time `json:"created"`
+}
+
+func (Membership) TableName() string {
+	return "user_collaborations"
+}
+
+// DocumentOperation is one entry of a document's operation log. Operation
+// holds the JSON-encoded ot.Operation that turned Revision into Revision+1.
+type DocumentOperation struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DocumentID string    `json:"documentId" gorm:"uniqueIndex:idx_document_revision"`
+	Revision   int       `json:"revision" gorm:"uniqueIndex:idx_document_revision"`
+	UserID     string    `json:"userId"`
+	Operation  string    `json:"operation"`
+	Created    time.Time `json:"created"`
+}
+
+// CRDTDocument is a document edited through a sequence CRDT rather than the
+// operation log, so replicas can edit offline and merge later. Content is
+// the text as of the last stored update.
+type CRDTDocument struct {
+	ID              string    `json:"id" gorm:"primary_key;type:varchar(36)"`
+	CollaborationID string    `json:"collaborationId" gorm:"index"`
+	Name            string    `json:"name"`
+	Title           string    `json:"title"`
+	Content         string    `json:"content"`
+	Created         time.Time `json:"created"`
+	Updated         time.Time `json:"updated"`
+}
+
+// CRDTUpdate is one binary-encoded crdt update stored for a CRDTDocument.
+type CRDTUpdate struct {
+	ID         uint      `json:"id" gorm:"primaryKey"`
+	DocumentID string    `json:"documentId" gorm:"index"`
+	Update     []byte    `json:"update"`
+	Created    time.Time `json:"created"`
+}
+
+// DocumentVersion is an immutable point in a document's history. Its content
+// is the document as of Revision in the operation log.
+type DocumentVersion struct {
+	ID           string    `json:"id" gorm:"primary_key;type:varchar(36)"`
+	DocumentID   string    `json:"documentId" gorm:"uniqueIndex:idx_document_version"`
+	Number       int       `json:"number" gorm:"uniqueIndex:idx_document_version"`
+	ParentID     string    `json:"parentId,omitempty"`
+	Revision     int       `json:"revision"`
+	AuthorID     string    `json:"authorId"`
+	RestoredFrom int       `json:"restoredFrom,omitempty"`
+	Created      time.Time `json:"created"`
+}
+
+// DocumentSnapshot is the full content of a document at a revision, so old
+// versions can be rebuilt without replaying the whole operation log.
+type DocumentSnapshot struct {
+	DocumentID string    `json:"documentId" gorm:"primaryKey"`
+	Revision   int       `json:"revision" gorm:"primaryKey;autoIncrement:false"`
+	Content    string    `json:"content"`
+	Created    time.Time `json:"created"`
 }
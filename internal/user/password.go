@@ -0,0 +1,196 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/utils"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidResetToken = apierror.BadRequest("invalid_reset_token", "invalid, expired or already used password reset link")
+
+	// ErrIncorrectPassword is returned when a signed-in user gets their
+	// current password wrong. It is not a 401, as their session is valid.
+	ErrIncorrectPassword = apierror.Forbidden("incorrect_password", "current password is incorrect")
+)
+
+// PasswordReset configures the emails sent to users who forgot their password.
+type PasswordReset struct {
+	Mailer mail.Mailer
+
+	// LinkURL is the page where users choose a new password; the token is
+	// added as the token query parameter.
+	LinkURL  string
+	TokenTTL time.Duration
+}
+
+// RequestPasswordReset emails a single-use reset link to the user registered
+// with email, replacing any link sent before. Nothing is sent, and no error
+// returned, for an unknown address, so callers cannot learn which addresses
+// have accounts; for the same reason the email is sent in the background and
+// a failure to send it is logged rather than returned.
+func (s *Service) RequestPasswordReset(email string) error {
+	ctx, span, repo := s.start("RequestPasswordReset")
+	defer span.End()
+
+	if s.PasswordReset == nil {
+		return nil
+	}
+
+	user, err := repo.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.GenerateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = repo.CreatePasswordResetToken(PasswordResetToken{
+		ID:        generateUUID(),
+		UserID:    user.ID,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: now.Add(s.PasswordReset.TokenTTL),
+		Created:   now,
+	})
+	if err != nil {
+		return err
+	}
+
+	link, err := url.Parse(s.PasswordReset.LinkURL)
+	if err != nil {
+		return err
+	}
+
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	s.sendPasswordReset(ctx, user, link.String())
+	return nil
+}
+
+// sendPasswordReset emails user the reset link. It does not wait for the mail
+// to go out, and only logs a failure, so a request for a registered address
+// neither takes longer nor fails where one for an unknown address would not.
+func (s *Service) sendPasswordReset(ctx context.Context, user User, link string) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := s.PasswordReset.Mailer.Send(ctx, mail.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hello %s,\n\nA password reset was requested for your account. Open the link below to choose a new password. It can be used once.\n\n%s\n\nIf you did not ask to reset your password, you can ignore this email.\n",
+				user.UserName, link),
+		})
+		if err != nil {
+			s.logger.WithContext(ctx).Error("failed to send password reset email", map[string]interface{}{
+				"user_id": user.ID,
+				"error":   err.Error(),
+			})
+		}
+	}()
+}
+
+// ResetPassword sets a new password for the user a reset token was sent to,
+// using up the token, and signs the user out everywhere.
+func (s *Service) ResetPassword(token string, password string) error {
+	ctx, span, repo := s.start("ResetPassword")
+	defer span.End()
+
+	// a weak password leaves the token unused, so the user can try again
+	if err := validatePasswordStrength(password); err != nil {
+		return err
+	}
+
+	hashedPassword, err := hashedPassword(ctx, password, s.BcryptCost)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	reset, err := repo.ConsumePasswordResetToken(utils.HashToken(token), now)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	err = repo.UpdatePassword(reset.UserID, hashedPassword, now)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrInvalidResetToken.Wrap(err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return repo.RevokeUserTokens(reset.UserID)
+}
+
+// ChangePassword replaces the password of a signed-in user who knows their
+// current one. Every session, including the caller's, is revoked, and a new
+// token pair is returned in its place.
+func (s *Service) ChangePassword(userID string, currentPassword string, newPassword string) (TokenPair, error) {
+	ctx, span, repo := s.start("ChangePassword")
+	defer span.End()
+
+	user, err := repo.GetUserByID(userID)
+	if err != nil {
+		return TokenPair{}, userError(err)
+	}
+
+	// a hijacked session must not guess the password faster than a login
+	keys := s.throttleKeys(user.UserName)
+	err = s.checkLoginThrottle(repo, keys)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = compareHashedPassword(ctx, currentPassword, user.Password)
+	if err != nil {
+		if recordErr := s.recordLoginFailure(ctx, repo, keys, &user); recordErr != nil {
+			return TokenPair{}, recordErr
+		}
+		return TokenPair{}, ErrIncorrectPassword.Wrap(err)
+	}
+
+	if !user.TOTPEnabled {
+		err = s.clearLoginThrottle(repo, user.UserName)
+		if err != nil {
+			return TokenPair{}, err
+		}
+	}
+
+	if err := validatePasswordStrength(newPassword); err != nil {
+		return TokenPair{}, err
+	}
+
+	hashedPassword, err := hashedPassword(ctx, newPassword, s.BcryptCost)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = repo.UpdatePassword(user.ID, hashedPassword, time.Now())
+	if err != nil {
+		return TokenPair{}, userError(err)
+	}
+
+	err = repo.RevokeUserTokens(user.ID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return s.issueTokens(repo, user, generateUUID())
+}
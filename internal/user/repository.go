@@ -1,18 +1,101 @@
 package user
 
-import "gorm.io/gorm"
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
 
-type Repository struct {
+	"github.com/similadayo/pkg/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrTokenAlreadyRotated = errors.New("refresh token already rotated")
+
+var ErrTOTPCodeReused = errors.New("totp code already used")
+
+// Repository stores users and their tokens. Every backend reports a missing
+// record as gorm.ErrRecordNotFound, so callers need not know which one is in use.
+type Repository interface {
+	// WithContext returns the repository bound to ctx, so its queries are
+	// cancelled with ctx and traced as part of the request it belongs to.
+	WithContext(ctx context.Context) Repository
+
+	Register(user User) (User, error)
+	Login(user User) (User, error)
+	GetUser(user User) (User, error)
+	GetUserByID(userID string) (User, error)
+	GetUserByUserName(userName string) (User, error)
+	GetUserByEmail(email string) (User, error)
+	GetUserProfile(userID string) (User, error)
+	UpdateUser(user User) (User, error)
+	DeleteUser(userID string) error
+	FilterUserByName(userName string) ([]User, error)
+	PaginationUser(page int, limit int) ([]User, error)
+
+	MarkEmailVerified(userID string, at time.Time) error
+	RecordVerificationSent(userID string, at time.Time) error
+	UpdatePassword(userID string, hashedPassword string, at time.Time) error
+
+	// CreatePasswordResetToken stores token in place of any reset tokens the
+	// user has not used yet.
+	CreatePasswordResetToken(token PasswordResetToken) error
+	// ConsumePasswordResetToken marks the unused, unexpired token with
+	// tokenHash as used and returns it, or gorm.ErrRecordNotFound.
+	ConsumePasswordResetToken(tokenHash string, now time.Time) (PasswordResetToken, error)
+
+	// SetTOTPSecret starts enrollment with a secret that is not yet enabled.
+	SetTOTPSecret(userID string, secret string) error
+	// EnableTOTP turns on the enrolled secret, accepting the code of step
+	// counter, and replaces the user's recovery codes with codes.
+	EnableTOTP(userID string, counter int64, codes []RecoveryCode) error
+	// UseTOTPCounter records that a code of step counter was accepted, or
+	// returns ErrTOTPCodeReused if one of that step or later already was.
+	UseTOTPCounter(userID string, counter int64) error
+	DisableTOTP(userID string) error
+	ReplaceRecoveryCodes(userID string, codes []RecoveryCode) error
+	// ConsumeRecoveryCode marks the user's unused code with codeHash as
+	// used, or returns gorm.ErrRecordNotFound.
+	ConsumeRecoveryCode(userID string, codeHash string, now time.Time) error
+
+	// GetLoginThrottle returns the failed logins counted against key, or
+	// gorm.ErrRecordNotFound if there are none.
+	GetLoginThrottle(key string) (LoginThrottle, error)
+	// RecordLoginFailure counts a failed login at time at against key and
+	// returns the new count. Failures more than window before at are
+	// forgotten first.
+	RecordLoginFailure(key string, at time.Time, window time.Duration) (LoginThrottle, error)
+	// LockLogin refuses logins for key until the given time.
+	LockLogin(key string, until time.Time) error
+	ClearLoginThrottle(key string) error
+
+	CreateRefreshToken(token RefreshToken) error
+	GetRefreshTokenByHash(tokenHash string) (RefreshToken, error)
+	RotateRefreshToken(current RefreshToken, next RefreshToken) error
+	RevokeTokenFamily(familyID string) error
+	RevokeUserTokens(userID string) error
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	IsTokenRevoked(jti string) (bool, error)
+	DeleteExpiredTokens(now time.Time) error
+}
+
+// SQLRepository is the Repository backed by a SQL database through gorm.
+type SQLRepository struct {
 	DB *gorm.DB
 }
 
-func NewRepository(db *gorm.DB) *Repository {
-	return &Repository{
+func NewSQLRepository(db *gorm.DB) *SQLRepository {
+	return &SQLRepository{
 		DB: db,
 	}
 }
 
-func (r *Repository) Register(user User) (User, error) {
+func (r *SQLRepository) WithContext(ctx context.Context) Repository {
+	return &SQLRepository{DB: r.DB.WithContext(ctx)}
+}
+
+func (r *SQLRepository) Register(user User) (User, error) {
 	err := r.DB.Create(&user).Error
 	if err != nil {
 		return user, err
@@ -21,7 +104,7 @@ func (r *Repository) Register(user User) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) Login(user User) (User, error) {
+func (r *SQLRepository) Login(user User) (User, error) {
 	err := r.DB.Where("email = ? AND password = ?", user.Email, user.Password).First(&user).Error
 	if err != nil {
 		return user, err
@@ -30,7 +113,7 @@ func (r *Repository) Login(user User) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) GetUser(user User) (User, error) {
+func (r *SQLRepository) GetUser(user User) (User, error) {
 	err := r.DB.Where("email = ? AND password = ?", user.Email, user.Password).First(&user).Error
 	if err != nil {
 		return user, err
@@ -39,7 +122,7 @@ func (r *Repository) GetUser(user User) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) GetUserByID(userID string) (User, error) {
+func (r *SQLRepository) GetUserByID(userID string) (User, error) {
 	var user User
 	err := r.DB.Where("id = ?", userID).First(&user).Error
 	if err != nil {
@@ -49,7 +132,7 @@ func (r *Repository) GetUserByID(userID string) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) GetUserByUserName(userName string) (User, error) {
+func (r *SQLRepository) GetUserByUserName(userName string) (User, error) {
 	var user User
 	err := r.DB.Where("user_name = ?", userName).First(&user).Error
 	if err != nil {
@@ -59,7 +142,20 @@ func (r *Repository) GetUserByUserName(userName string) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) GetUserProfile(userID string) (User, error) {
+// GetUserByEmail ignores case, so addresses stored before they were
+// normalized are found too; the unique index on lower(email) makes the
+// match unambiguous.
+func (r *SQLRepository) GetUserByEmail(email string) (User, error) {
+	var user User
+	err := r.DB.Where("lower(email) = lower(?)", email).First(&user).Error
+	if err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+func (r *SQLRepository) GetUserProfile(userID string) (User, error) {
 	var user User
 	err := r.DB.Where("id = ?", userID).First(&user).Error
 	if err != nil {
@@ -69,7 +165,7 @@ func (r *Repository) GetUserProfile(userID string) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) UpdateUser(user User) (User, error) {
+func (r *SQLRepository) UpdateUser(user User) (User, error) {
 	err := r.DB.Model(&user).Where("id = ?", user.ID).Updates(user).Error
 	if err != nil {
 		return user, err
@@ -78,18 +174,21 @@ func (r *Repository) UpdateUser(user User) (User, error) {
 	return user, nil
 }
 
-func (r *Repository) DeleteUser(userID string) error {
-	err := r.DB.Where("id = ?", userID).Delete(&User{}).Error
-	if err != nil {
-		return err
+func (r *SQLRepository) DeleteUser(userID string) error {
+	result := r.DB.Where("id = ?", userID).Delete(&User{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
 	}
 
 	return nil
 }
 
-func (r *Repository) FilterUserByName(userName string) ([]User, error) {
+func (r *SQLRepository) FilterUserByName(userName string) ([]User, error) {
 	var users []User
-	err := r.DB.Where("user_name LIKE ?", "%"+userName+"%").Find(&users).Error
+	err := r.DB.Where("LOWER(user_name) LIKE ?", "%"+strings.ToLower(userName)+"%").Order("user_name").Find(&users).Error
 	if err != nil {
 		return users, err
 	}
@@ -97,12 +196,310 @@ func (r *Repository) FilterUserByName(userName string) ([]User, error) {
 	return users, nil
 }
 
-func (r *Repository) PaginationUser(page int, limit int) ([]User, error) {
+func (r *SQLRepository) PaginationUser(page int, limit int) ([]User, error) {
 	var users []User
-	err := r.DB.Offset((page - 1) * limit).Limit(limit).Find(&users).Error
+	err := r.DB.Order("created, id").Offset((page - 1) * limit).Limit(limit).Find(&users).Error
 	if err != nil {
 		return users, err
 	}
 
 	return users, nil
 }
+
+func (r *SQLRepository) CreateRefreshToken(token RefreshToken) error {
+	return r.DB.Create(&token).Error
+}
+
+func (r *SQLRepository) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	var token RefreshToken
+	err := r.DB.Where("token_hash = ?", tokenHash).First(&token).Error
+	if err != nil {
+		return token, err
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken marks current as replaced by next and stores next. It
+// returns ErrTokenAlreadyRotated if current was revoked concurrently.
+func (r *SQLRepository) RotateRefreshToken(current RefreshToken, next RefreshToken) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND revoked = ?", current.ID, false).
+			Updates(map[string]interface{}{"revoked": true, "replaced_by": next.ID})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTokenAlreadyRotated
+		}
+
+		return tx.Create(&next).Error
+	})
+}
+
+// RevokeTokenFamily revokes every refresh token in a family along with the
+// access tokens that were issued with them.
+func (r *SQLRepository) RevokeTokenFamily(familyID string) error {
+	return r.revokeRefreshTokens("family_id = ?", familyID)
+}
+
+func (r *SQLRepository) MarkEmailVerified(userID string, at time.Time) error {
+	return r.updateUserColumns(userID, map[string]interface{}{
+		"email_verified":    true,
+		"email_verified_at": at,
+	})
+}
+
+func (r *SQLRepository) RecordVerificationSent(userID string, at time.Time) error {
+	return r.updateUserColumns(userID, map[string]interface{}{
+		"verification_sent_at": at,
+	})
+}
+
+func (r *SQLRepository) UpdatePassword(userID string, hashedPassword string, at time.Time) error {
+	return r.updateUserColumns(userID, map[string]interface{}{
+		"password": hashedPassword,
+		"updated":  at,
+	})
+}
+
+func (r *SQLRepository) updateUserColumns(userID string, columns map[string]interface{}) error {
+	result := r.DB.Model(&User{}).Where("id = ?", userID).Updates(columns)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) CreatePasswordResetToken(token PasswordResetToken) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ? AND used_at IS NULL", token.UserID).Delete(&PasswordResetToken{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&token).Error
+	})
+}
+
+func (r *SQLRepository) ConsumePasswordResetToken(tokenHash string, now time.Time) (PasswordResetToken, error) {
+	var token PasswordResetToken
+	err := r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).First(&token).Error
+		if err != nil {
+			return err
+		}
+
+		// the used_at check makes a concurrent consumer of the same token lose
+		result := tx.Model(&PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		token.UsedAt = &now
+		return nil
+	})
+	if err != nil {
+		return PasswordResetToken{}, err
+	}
+
+	return token, nil
+}
+
+func (r *SQLRepository) SetTOTPSecret(userID string, secret string) error {
+	return r.updateUserColumns(userID, map[string]interface{}{
+		"totp_secret":       secret,
+		"totp_enabled":      false,
+		"totp_last_counter": 0,
+	})
+}
+
+func (r *SQLRepository) EnableTOTP(userID string, counter int64, codes []RecoveryCode) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		repo := &SQLRepository{DB: tx}
+		err := repo.updateUserColumns(userID, map[string]interface{}{
+			"totp_enabled":      true,
+			"totp_last_counter": counter,
+		})
+		if err != nil {
+			return err
+		}
+
+		return repo.ReplaceRecoveryCodes(userID, codes)
+	})
+}
+
+func (r *SQLRepository) UseTOTPCounter(userID string, counter int64) error {
+	result := r.DB.Model(&User{}).
+		Where("id = ? AND totp_last_counter < ?", userID, counter).
+		Update("totp_last_counter", counter)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) DisableTOTP(userID string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		repo := &SQLRepository{DB: tx}
+		err := repo.updateUserColumns(userID, map[string]interface{}{
+			"totp_secret":       "",
+			"totp_enabled":      false,
+			"totp_last_counter": 0,
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+func (r *SQLRepository) ReplaceRecoveryCodes(userID string, codes []RecoveryCode) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+		if err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *SQLRepository) ConsumeRecoveryCode(userID string, codeHash string, now time.Time) error {
+	result := r.DB.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// RevokeUserTokens revokes every refresh and access token issued to a user.
+func (r *SQLRepository) RevokeUserTokens(userID string) error {
+	return r.revokeRefreshTokens("user_id = ?", userID)
+}
+
+func (r *SQLRepository) revokeRefreshTokens(query string, arg string) error {
+	return r.DB.Transaction(func(tx *gorm.DB) error {
+		var tokens []RefreshToken
+		err := tx.Where(query, arg).Find(&tokens).Error
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, token := range tokens {
+			if token.AccessJTI == "" {
+				continue
+			}
+			err = revokeAccessToken(tx, token.AccessJTI, now.Add(utils.AccessTokenTTL))
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&RefreshToken{}).Where(query, arg).Update("revoked", true).Error
+	})
+}
+
+func (r *SQLRepository) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	return revokeAccessToken(r.DB, jti, expiresAt)
+}
+
+func revokeAccessToken(db *gorm.DB, jti string, expiresAt time.Time) error {
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedToken{
+		JTI:       jti,
+		ExpiresAt: expiresAt,
+		Created:   time.Now(),
+	}).Error
+}
+
+// IsTokenRevoked implements utils.RevocationChecker.
+func (r *SQLRepository) IsTokenRevoked(jti string) (bool, error) {
+	var count int64
+	err := r.DB.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (r *SQLRepository) GetLoginThrottle(key string) (LoginThrottle, error) {
+	var throttle LoginThrottle
+	err := r.DB.Where("key = ?", key).First(&throttle).Error
+	return throttle, err
+}
+
+func (r *SQLRepository) RecordLoginFailure(key string, at time.Time, window time.Duration) (LoginThrottle, error) {
+	// times are compared as stored, which for sqlite is as text
+	at = at.UTC()
+
+	err := r.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":     gorm.Expr("CASE WHEN login_throttles.last_failure < ? THEN 1 ELSE login_throttles.failures + 1 END", at.Add(-window)),
+			"last_failure": at,
+		}),
+	}).Create(&LoginThrottle{Key: key, Failures: 1, LastFailure: at}).Error
+	if err != nil {
+		return LoginThrottle{}, err
+	}
+
+	return r.GetLoginThrottle(key)
+}
+
+func (r *SQLRepository) LockLogin(key string, until time.Time) error {
+	result := r.DB.Model(&LoginThrottle{}).Where("key = ?", key).Update("locked_until", until.UTC())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (r *SQLRepository) ClearLoginThrottle(key string) error {
+	return r.DB.Where("key = ?", key).Delete(&LoginThrottle{}).Error
+}
+
+// DeleteExpiredTokens removes revocation, refresh and password reset records
+// that can no longer be presented.
+func (r *SQLRepository) DeleteExpiredTokens(now time.Time) error {
+	err := r.DB.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	err = r.DB.Where("expires_at < ?", now).Delete(&PasswordResetToken{}).Error
+	if err != nil {
+		return err
+	}
+
+	return r.DB.Where("expires_at < ?", now).Delete(&RefreshToken{}).Error
+}
@@ -1,42 +1,124 @@
 package user
 
 import (
+	"context"
 	"errors"
 	"time"
 	"unicode"
 
 	"github.com/google/uuid"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
 	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/tracing"
 	"github.com/similadayo/pkg/utils"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
+var (
+	ErrUserNotFound = apierror.NotFound("user_not_found", "user not found")
+
+	// ErrInvalidPassword is returned for an unknown username as well as a
+	// wrong password, so logins do not reveal which accounts exist.
+	ErrInvalidPassword = apierror.Unauthorized("invalid_credentials", "invalid username or password")
+
+	ErrWeakPassword = apierror.BadRequest("weak_password", "password is too weak")
+
+	ErrUserExists = apierror.Conflict("user_exists", "username or email address is already registered")
+
+	ErrInvalidRefreshToken = apierror.Unauthorized("invalid_refresh_token", "invalid refresh token")
+
+	ErrRefreshTokenReused = apierror.Unauthorized("refresh_token_reused", "refresh token reuse detected")
+)
+
+// TokenPair is the set of credentials handed to a client after authentication.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int64
+}
+
 type Service struct {
-	Repository *Repository
+	Repository Repository
 	logger     *logging.Logger
+
+	// BcryptCost is the work factor for new password hashes; zero means bcrypt.DefaultCost.
+	BcryptCost int
+
+	// Verification makes new users verify their email address. When nil,
+	// users are verified as soon as they are created.
+	Verification *Verification
+
+	// PasswordReset sends forgotten-password emails. When nil, none are sent.
+	PasswordReset *PasswordReset
+
+	// MFA enables two-factor authentication. Users who have turned it on
+	// cannot sign in while it is nil.
+	MFA *MFA
+
+	// Lockout throttles failed logins. When nil, they are not limited.
+	Lockout *Lockout
+
+	// Admins are the IDs of users who may manage other users' accounts.
+	Admins []string
+
+	// Clock tells the time TOTP codes are checked at; nil means time.Now.
+	Clock func() time.Time
+
+	ctx      context.Context
+	clientIP string
 }
 
 func generateUUID() string {
 	return uuid.New().String()
 }
 
-func NewService(repository *Repository, logger *logging.Logger) *Service {
+func NewService(repository Repository, logger *logging.Logger) *Service {
 	return &Service{
 		Repository: repository,
 		logger:     logger,
 	}
 }
 
+// WithContext returns a copy of the service whose calls are traced as part
+// of the request in ctx and whose queries are cancelled with it.
+func (s *Service) WithContext(ctx context.Context) *Service {
+	clone := *s
+	clone.ctx = ctx
+	return &clone
+}
+
+func (s *Service) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+
+	return time.Now()
+}
+
+// start begins the span for one service call and returns the repository
+// bound to it.
+func (s *Service) start(method string) (context.Context, trace.Span, Repository) {
+	ctx, span := tracing.Start(s.ctx, tracer, "user.Service/"+method)
+	return ctx, span, s.Repository.WithContext(ctx)
+}
+
 func (s *Service) CreateUser(username, password, email, firstname, lastname, avaterurl string) (User, error) {
+	ctx, span, repo := s.start("CreateUser")
+	defer span.End()
+
 	if err := validatePasswordStrength(password); err != nil {
 		return User{}, err
 	}
 
-	hashedPassword, err := hashedPassword(password)
+	hashedPassword, err := hashedPassword(ctx, password, s.BcryptCost)
 	if err != nil {
 		return User{}, err
 	}
 
+	now := time.Now()
 	user := User{
 		ID:        generateUUID(),
 		UserName:  username,
@@ -45,42 +127,246 @@ func (s *Service) CreateUser(username, password, email, firstname, lastname, ava
 		FirstName: firstname,
 		LastName:  lastname,
 		AvatarURL: avaterurl,
-		Created:   time.Now(),
-		Updated:   time.Now(),
+		Created:   now,
+		Updated:   now,
+	}
+	if s.Verification == nil {
+		user.EmailVerified = true
+		user.EmailVerifiedAt = &now
 	}
 
-	createdUser, err := s.Repository.Register(user)
+	createdUser, err := repo.Register(user)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return user, ErrUserExists.Wrap(err)
+	}
 	if err != nil {
 		return user, err
 	}
 
+	if s.Verification != nil {
+		// the account exists either way; a lost email can be resent
+		err = s.sendVerification(ctx, repo, &createdUser)
+		if err != nil {
+			s.logger.WithContext(ctx).Error("failed to send verification email", map[string]interface{}{
+				"user_id": createdUser.ID,
+				"error":   err.Error(),
+			})
+		}
+	}
+
 	return createdUser, nil
 }
 
-func (s *Service) AuthenticateUser(username, password string) (string, error) {
-	user, err := s.Repository.GetUserByUserName(username)
+// AuthenticateUser checks a username and password. Users with two-factor
+// authentication get a challenge to finish with CompleteMFALogin; everyone
+// else gets a token pair.
+func (s *Service) AuthenticateUser(username, password string) (LoginResult, error) {
+	ctx, span, repo := s.start("AuthenticateUser")
+	defer span.End()
+
+	keys := s.throttleKeys(username)
+	err := s.checkLoginThrottle(repo, keys)
 	if err != nil {
-		return "", err
+		loginAttempts.With("throttled").Inc()
+		return LoginResult{}, err
 	}
 
-	err = CompareHashedPassword(password, user.Password)
+	user, err := repo.GetUserByUserName(username)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// check the password anyway, so unknown usernames take as long
+		hash, err := dummyPasswordHash(ctx, s.BcryptCost)
+		if err == nil {
+			compareHashedPassword(ctx, password, hash)
+			err = s.recordLoginFailure(ctx, repo, keys, nil)
+		}
+		if err != nil {
+			return LoginResult{}, err
+		}
+
+		loginAttempts.With("failure").Inc()
+		return LoginResult{}, ErrInvalidPassword
+	}
 	if err != nil {
-		return "", err
+		loginAttempts.With("failure").Inc()
+		return LoginResult{}, err
 	}
 
-	token, err := utils.GenerateToken(user.ID)
+	err = compareHashedPassword(ctx, password, user.Password)
 	if err != nil {
-		return "", err
+		loginAttempts.With("failure").Inc()
+		if recordErr := s.recordLoginFailure(ctx, repo, keys, &user); recordErr != nil {
+			return LoginResult{}, recordErr
+		}
+		return LoginResult{}, err
+	}
+
+	// with a second factor, the password alone does not prove the user holds
+	// the account: CompleteMFALogin clears the count once the code is right,
+	// so alternating logins cannot reset it between guesses at the code
+	if !user.TOTPEnabled {
+		err = s.clearLoginThrottle(repo, user.UserName)
+		if err != nil {
+			return LoginResult{}, err
+		}
+	}
+
+	if !user.EmailVerified && s.Verification != nil && s.Verification.Access == auth.UnverifiedNone {
+		loginAttempts.With("failure").Inc()
+		return LoginResult{}, auth.ErrEmailNotVerified
 	}
 
-	return token, nil
+	if user.TOTPEnabled {
+		challenge, err := s.mfaChallenge(user)
+		if err != nil {
+			return LoginResult{}, err
+		}
+
+		loginAttempts.With("mfa_required").Inc()
+		return LoginResult{MFAToken: challenge}, nil
+	}
 
+	pair, err := s.issueTokens(repo, user, generateUUID())
+	if err != nil {
+		return LoginResult{}, err
+	}
+
+	loginAttempts.With("success").Inc()
+	return LoginResult{TokenPair: pair}, nil
+}
+
+// RefreshTokens exchanges a refresh token for a new access/refresh pair. The
+// presented token is rotated out; presenting it again revokes its whole family.
+func (s *Service) RefreshTokens(refreshToken string) (TokenPair, error) {
+	ctx, span, repo := s.start("RefreshTokens")
+	defer span.End()
+
+	current, err := repo.GetRefreshTokenByHash(utils.HashToken(refreshToken))
+	if err != nil {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	if current.Revoked {
+		s.logger.WithContext(ctx).Warn("refresh token reuse detected", map[string]interface{}{
+			"user_id":   current.UserID,
+			"family_id": current.FamilyID,
+		})
+		if err := repo.RevokeTokenFamily(current.FamilyID); err != nil {
+			return TokenPair{}, err
+		}
+
+		return TokenPair{}, ErrRefreshTokenReused
+	}
+
+	if time.Now().After(current.ExpiresAt) {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	// the new access token carries the user's current verification state
+	user, err := repo.GetUserByID(current.UserID)
+	if err != nil {
+		return TokenPair{}, ErrInvalidRefreshToken
+	}
+
+	pair, next, err := s.newTokenPair(user, current.FamilyID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = repo.RotateRefreshToken(current, next)
+	if errors.Is(err, ErrTokenAlreadyRotated) {
+		if err := repo.RevokeTokenFamily(current.FamilyID); err != nil {
+			return TokenPair{}, err
+		}
+
+		return TokenPair{}, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return pair, nil
+}
+
+// Logout revokes the access token identified by jti and, when given, the
+// family of the refresh token issued alongside it.
+func (s *Service) Logout(userID, jti string, expiresAt time.Time, refreshToken string) error {
+	_, span, repo := s.start("Logout")
+	defer span.End()
+
+	if jti != "" {
+		err := repo.RevokeAccessToken(jti, expiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if refreshToken == "" {
+		return nil
+	}
+
+	token, err := repo.GetRefreshTokenByHash(utils.HashToken(refreshToken))
+	if err != nil || token.UserID != userID {
+		return ErrInvalidRefreshToken
+	}
+
+	return repo.RevokeTokenFamily(token.FamilyID)
+}
+
+func (s *Service) issueTokens(repo Repository, user User, familyID string) (TokenPair, error) {
+	pair, refresh, err := s.newTokenPair(user, familyID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	err = repo.CreateRefreshToken(refresh)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return pair, nil
+}
+
+func (s *Service) newTokenPair(user User, familyID string) (TokenPair, RefreshToken, error) {
+	accessToken, claims, err := utils.IssueAccessToken(&utils.Claims{
+		UserID:     user.ID,
+		Unverified: !user.EmailVerified,
+	})
+	if err != nil {
+		return TokenPair{}, RefreshToken{}, err
+	}
+
+	refreshToken, err := utils.GenerateRefreshToken()
+	if err != nil {
+		return TokenPair{}, RefreshToken{}, err
+	}
+
+	now := time.Now()
+	refresh := RefreshToken{
+		ID:        generateUUID(),
+		UserID:    user.ID,
+		FamilyID:  familyID,
+		TokenHash: utils.HashToken(refreshToken),
+		AccessJTI: claims.Id,
+		ExpiresAt: now.Add(utils.RefreshTokenTTL),
+		Created:   now,
+	}
+
+	pair := TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(utils.AccessTokenTTL.Seconds()),
+	}
+
+	return pair, refresh, nil
 }
 
 func (s *Service) GetUserProfile(userID string) (User, error) {
-	user, err := s.Repository.GetUserProfile(userID)
+	_, span, repo := s.start("GetUserProfile")
+	defer span.End()
+
+	user, err := repo.GetUserProfile(userID)
 	if err != nil {
-		return user, err
+		return user, userError(err)
 	}
 
 	return user, nil
@@ -88,9 +374,12 @@ func (s *Service) GetUserProfile(userID string) (User, error) {
 
 // Get user by ID and return user after checking authentication
 func (s *Service) GetUserByID(userID string) (User, error) {
-	user, err := s.Repository.GetUserByID(userID)
+	_, span, repo := s.start("GetUserByID")
+	defer span.End()
+
+	user, err := repo.GetUserByID(userID)
 	if err != nil {
-		return user, err
+		return user, userError(err)
 	}
 
 	return user, nil
@@ -98,9 +387,12 @@ func (s *Service) GetUserByID(userID string) (User, error) {
 
 // Get user by username and return user after checking authentication
 func (s *Service) GetUserByUserName(userName string) (User, error) {
-	user, err := s.Repository.GetUserByUserName(userName)
+	_, span, repo := s.start("GetUserByUserName")
+	defer span.End()
+
+	user, err := repo.GetUserByUserName(userName)
 	if err != nil {
-		return user, err
+		return user, userError(err)
 	}
 
 	return user, nil
@@ -108,7 +400,13 @@ func (s *Service) GetUserByUserName(userName string) (User, error) {
 
 // Update User
 func (s *Service) UpdateUser(user User) (User, error) {
-	user, err := s.Repository.UpdateUser(user)
+	_, span, repo := s.start("UpdateUser")
+	defer span.End()
+
+	user, err := repo.UpdateUser(user)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return user, ErrUserExists.Wrap(err)
+	}
 	if err != nil {
 		return user, err
 	}
@@ -118,9 +416,12 @@ func (s *Service) UpdateUser(user User) (User, error) {
 
 // Delete User
 func (s *Service) DeleteUser(userID string) error {
-	err := s.Repository.DeleteUser(userID)
+	_, span, repo := s.start("DeleteUser")
+	defer span.End()
+
+	err := repo.DeleteUser(userID)
 	if err != nil {
-		return err
+		return userError(err)
 	}
 
 	return nil
@@ -128,7 +429,10 @@ func (s *Service) DeleteUser(userID string) error {
 
 // Filter User by name
 func (s *Service) FilterUserByName(userName string) ([]User, error) {
-	users, err := s.Repository.FilterUserByName(userName)
+	_, span, repo := s.start("FilterUserByName")
+	defer span.End()
+
+	users, err := repo.FilterUserByName(userName)
 	if err != nil {
 		return users, err
 	}
@@ -136,8 +440,26 @@ func (s *Service) FilterUserByName(userName string) ([]User, error) {
 	return users, nil
 }
 
-func hashedPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+// userError reports a missing user as ErrUserNotFound.
+func userError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrUserNotFound.Wrap(err)
+	}
+
+	return err
+}
+
+func hashedPassword(ctx context.Context, password string, cost int) (string, error) {
+	_, span := tracing.Start(ctx, tracer, "bcrypt.hash")
+	defer span.End()
+
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	start := time.Now()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	passwordHashDuration.With("hash").Observe(time.Since(start).Seconds())
 	if err != nil {
 		return "", errors.New("failed to hash password")
 	}
@@ -146,9 +468,18 @@ func hashedPassword(password string) (string, error) {
 }
 
 func CompareHashedPassword(password string, hashedPassword string) error {
+	return compareHashedPassword(context.Background(), password, hashedPassword)
+}
+
+func compareHashedPassword(ctx context.Context, password string, hashedPassword string) error {
+	_, span := tracing.Start(ctx, tracer, "bcrypt.compare")
+	defer span.End()
+
+	start := time.Now()
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	passwordHashDuration.With("compare").Observe(time.Since(start).Seconds())
 	if err != nil {
-		return errors.New("incorrect password")
+		return ErrInvalidPassword.Wrap(err)
 	}
 
 	return nil
@@ -156,27 +487,27 @@ func CompareHashedPassword(password string, hashedPassword string) error {
 
 func validatePasswordStrength(password string) error {
 	if len(password) < 8 {
-		return errors.New("password must be at least 8 characters")
+		return ErrWeakPassword.WithMessage("password must be at least 8 characters")
 	}
 
 	//At least 1 upper case
 	if !containsUpperCase(password) {
-		return errors.New("password must contain at least 1 uppercase character")
+		return ErrWeakPassword.WithMessage("password must contain at least 1 uppercase character")
 	}
 
 	// must contain at least 1 lower case
 	if !containsLowerCase(password) {
-		return errors.New("password must contain at least 1 lowercase character")
+		return ErrWeakPassword.WithMessage("password must contain at least 1 lowercase character")
 	}
 
 	// must contain at least 1 number
 	if !containsNumber(password) {
-		return errors.New("password must contain at least 1 number")
+		return ErrWeakPassword.WithMessage("password must contain at least 1 number")
 	}
 
 	// must contain at least 1 special character
 	if !containsSpecial(password) {
-		return errors.New("password must contain at least 1 special character")
+		return ErrWeakPassword.WithMessage("password must contain at least 1 special character")
 	}
 
 	return nil
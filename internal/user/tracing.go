@@ -0,0 +1,352 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/similadayo/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var tracer = otel.Tracer("github.com/similadayo/internal/user")
+
+// TracedRepository records a span for every call to the repository it
+// wraps. Like the repository itself it must be bound to a request with
+// WithContext; calls on an unbound one are not traced.
+type TracedRepository struct {
+	repo Repository
+	ctx  context.Context
+}
+
+func NewTracedRepository(repo Repository) *TracedRepository {
+	return &TracedRepository{repo: repo, ctx: context.Background()}
+}
+
+func (r *TracedRepository) WithContext(ctx context.Context) Repository {
+	return &TracedRepository{repo: r.repo, ctx: ctx}
+}
+
+// start begins the span for one call and returns the wrapped repository
+// bound to it, so the queries the call makes are traced beneath it.
+func (r *TracedRepository) start(method string) (Repository, trace.Span) {
+	ctx, span := tracing.Start(r.ctx, tracer, "user.Repository/"+method)
+	return r.repo.WithContext(ctx), span
+}
+
+// fail marks span as failed unless err is nil or a lookup that found nothing.
+func fail(span trace.Span, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+
+	tracing.Fail(span, err)
+}
+
+func (r *TracedRepository) Register(user User) (User, error) {
+	repo, span := r.start("Register")
+	defer span.End()
+
+	result, err := repo.Register(user)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) Login(user User) (User, error) {
+	repo, span := r.start("Login")
+	defer span.End()
+
+	result, err := repo.Login(user)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetUser(user User) (User, error) {
+	repo, span := r.start("GetUser")
+	defer span.End()
+
+	result, err := repo.GetUser(user)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetUserByID(userID string) (User, error) {
+	repo, span := r.start("GetUserByID")
+	defer span.End()
+
+	result, err := repo.GetUserByID(userID)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetUserByUserName(userName string) (User, error) {
+	repo, span := r.start("GetUserByUserName")
+	defer span.End()
+
+	result, err := repo.GetUserByUserName(userName)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetUserByEmail(email string) (User, error) {
+	repo, span := r.start("GetUserByEmail")
+	defer span.End()
+
+	result, err := repo.GetUserByEmail(email)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetUserProfile(userID string) (User, error) {
+	repo, span := r.start("GetUserProfile")
+	defer span.End()
+
+	result, err := repo.GetUserProfile(userID)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) UpdateUser(user User) (User, error) {
+	repo, span := r.start("UpdateUser")
+	defer span.End()
+
+	result, err := repo.UpdateUser(user)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) DeleteUser(userID string) error {
+	repo, span := r.start("DeleteUser")
+	defer span.End()
+
+	err := repo.DeleteUser(userID)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) FilterUserByName(userName string) ([]User, error) {
+	repo, span := r.start("FilterUserByName")
+	defer span.End()
+
+	result, err := repo.FilterUserByName(userName)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) PaginationUser(page int, limit int) ([]User, error) {
+	repo, span := r.start("PaginationUser")
+	defer span.End()
+
+	result, err := repo.PaginationUser(page, limit)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) MarkEmailVerified(userID string, at time.Time) error {
+	repo, span := r.start("MarkEmailVerified")
+	defer span.End()
+
+	err := repo.MarkEmailVerified(userID, at)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) RecordVerificationSent(userID string, at time.Time) error {
+	repo, span := r.start("RecordVerificationSent")
+	defer span.End()
+
+	err := repo.RecordVerificationSent(userID, at)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) UpdatePassword(userID string, hashedPassword string, at time.Time) error {
+	repo, span := r.start("UpdatePassword")
+	defer span.End()
+
+	err := repo.UpdatePassword(userID, hashedPassword, at)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) CreatePasswordResetToken(token PasswordResetToken) error {
+	repo, span := r.start("CreatePasswordResetToken")
+	defer span.End()
+
+	err := repo.CreatePasswordResetToken(token)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) ConsumePasswordResetToken(tokenHash string, now time.Time) (PasswordResetToken, error) {
+	repo, span := r.start("ConsumePasswordResetToken")
+	defer span.End()
+
+	result, err := repo.ConsumePasswordResetToken(tokenHash, now)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) SetTOTPSecret(userID string, secret string) error {
+	repo, span := r.start("SetTOTPSecret")
+	defer span.End()
+
+	err := repo.SetTOTPSecret(userID, secret)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) EnableTOTP(userID string, counter int64, codes []RecoveryCode) error {
+	repo, span := r.start("EnableTOTP")
+	defer span.End()
+
+	err := repo.EnableTOTP(userID, counter, codes)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) UseTOTPCounter(userID string, counter int64) error {
+	repo, span := r.start("UseTOTPCounter")
+	defer span.End()
+
+	err := repo.UseTOTPCounter(userID, counter)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) DisableTOTP(userID string) error {
+	repo, span := r.start("DisableTOTP")
+	defer span.End()
+
+	err := repo.DisableTOTP(userID)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) ReplaceRecoveryCodes(userID string, codes []RecoveryCode) error {
+	repo, span := r.start("ReplaceRecoveryCodes")
+	defer span.End()
+
+	err := repo.ReplaceRecoveryCodes(userID, codes)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) ConsumeRecoveryCode(userID string, codeHash string, now time.Time) error {
+	repo, span := r.start("ConsumeRecoveryCode")
+	defer span.End()
+
+	err := repo.ConsumeRecoveryCode(userID, codeHash, now)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) CreateRefreshToken(token RefreshToken) error {
+	repo, span := r.start("CreateRefreshToken")
+	defer span.End()
+
+	err := repo.CreateRefreshToken(token)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) GetRefreshTokenByHash(tokenHash string) (RefreshToken, error) {
+	repo, span := r.start("GetRefreshTokenByHash")
+	defer span.End()
+
+	result, err := repo.GetRefreshTokenByHash(tokenHash)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) RotateRefreshToken(current RefreshToken, next RefreshToken) error {
+	repo, span := r.start("RotateRefreshToken")
+	defer span.End()
+
+	err := repo.RotateRefreshToken(current, next)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) RevokeTokenFamily(familyID string) error {
+	repo, span := r.start("RevokeTokenFamily")
+	defer span.End()
+
+	err := repo.RevokeTokenFamily(familyID)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) RevokeUserTokens(userID string) error {
+	repo, span := r.start("RevokeUserTokens")
+	defer span.End()
+
+	err := repo.RevokeUserTokens(userID)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	repo, span := r.start("RevokeAccessToken")
+	defer span.End()
+
+	err := repo.RevokeAccessToken(jti, expiresAt)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) IsTokenRevoked(jti string) (bool, error) {
+	repo, span := r.start("IsTokenRevoked")
+	defer span.End()
+
+	result, err := repo.IsTokenRevoked(jti)
+	fail(span, err)
+	return result, err
+}
+
+func (r *TracedRepository) GetLoginThrottle(key string) (LoginThrottle, error) {
+	repo, span := r.start("GetLoginThrottle")
+	defer span.End()
+
+	throttle, err := repo.GetLoginThrottle(key)
+	fail(span, err)
+	return throttle, err
+}
+
+func (r *TracedRepository) RecordLoginFailure(key string, at time.Time, window time.Duration) (LoginThrottle, error) {
+	repo, span := r.start("RecordLoginFailure")
+	defer span.End()
+
+	throttle, err := repo.RecordLoginFailure(key, at, window)
+	fail(span, err)
+	return throttle, err
+}
+
+func (r *TracedRepository) LockLogin(key string, until time.Time) error {
+	repo, span := r.start("LockLogin")
+	defer span.End()
+
+	err := repo.LockLogin(key, until)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) ClearLoginThrottle(key string) error {
+	repo, span := r.start("ClearLoginThrottle")
+	defer span.End()
+
+	err := repo.ClearLoginThrottle(key)
+	fail(span, err)
+	return err
+}
+
+func (r *TracedRepository) DeleteExpiredTokens(now time.Time) error {
+	repo, span := r.start("DeleteExpiredTokens")
+	defer span.End()
+
+	err := repo.DeleteExpiredTokens(now)
+	fail(span, err)
+	return err
+}
@@ -0,0 +1,163 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/utils"
+	"gorm.io/gorm"
+)
+
+// verificationPurpose keeps verification tokens from being accepted by any
+// other use of the signer.
+const verificationPurpose = "email-verification"
+
+var ErrInvalidVerificationToken = apierror.BadRequest("invalid_verification_token", "invalid or expired verification link")
+
+// Verification configures how new users verify their email address.
+type Verification struct {
+	Mailer mail.Mailer
+	Signer *utils.Signer
+
+	// LinkURL is where verification links point; the token is added as
+	// the token query parameter.
+	LinkURL  string
+	TokenTTL time.Duration
+
+	// ResendInterval is the least time between two verification emails to
+	// the same user.
+	ResendInterval time.Duration
+
+	// Access is what unverified users may do, one of auth.UnverifiedFull,
+	// auth.UnverifiedReadOnly and auth.UnverifiedNone.
+	Access string
+}
+
+// VerifyEmail marks the user a verification token was sent to as verified.
+// The token is bound to the address it was sent to, so it stops working if
+// the user's email changes.
+func (s *Service) VerifyEmail(token string) (User, error) {
+	_, span, repo := s.start("VerifyEmail")
+	defer span.End()
+
+	if s.Verification == nil {
+		return User{}, ErrInvalidVerificationToken
+	}
+
+	userID, err := s.Verification.Signer.Subject(token)
+	if err != nil {
+		return User{}, ErrInvalidVerificationToken.Wrap(err)
+	}
+
+	user, err := repo.GetUserByID(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return User{}, ErrInvalidVerificationToken.Wrap(err)
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = s.Verification.Signer.Verify(token, verificationPurpose, user.Email)
+	if err != nil {
+		return User{}, ErrInvalidVerificationToken.Wrap(err)
+	}
+
+	if user.EmailVerified {
+		return user, nil
+	}
+
+	now := time.Now()
+	err = repo.MarkEmailVerified(user.ID, now)
+	if err != nil {
+		return User{}, err
+	}
+
+	user.EmailVerified = true
+	user.EmailVerifiedAt = &now
+	return user, nil
+}
+
+// ResendVerification sends a new verification email to the unverified user
+// registered with email. Nothing is sent, and no error returned, for an
+// unknown or verified address or within ResendInterval of the last email,
+// so callers cannot learn which addresses have accounts; for the same reason
+// the email is sent in the background and a failure to send it is logged
+// rather than returned.
+func (s *Service) ResendVerification(email string) error {
+	ctx, span, repo := s.start("ResendVerification")
+	defer span.End()
+
+	if s.Verification == nil {
+		return nil
+	}
+
+	user, err := repo.GetUserByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if user.EmailVerified {
+		return nil
+	}
+
+	if user.VerificationSentAt != nil && time.Since(*user.VerificationSentAt) < s.Verification.ResendInterval {
+		s.logger.WithContext(ctx).Info("verification resend throttled", map[string]interface{}{
+			"user_id": user.ID,
+		})
+		return nil
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	repo = repo.WithContext(ctx)
+	go func() {
+		err := s.sendVerification(ctx, repo, &user)
+		if err != nil {
+			s.logger.WithContext(ctx).Error("failed to send verification email", map[string]interface{}{
+				"user_id": user.ID,
+				"error":   err.Error(),
+			})
+		}
+	}()
+
+	return nil
+}
+
+// sendVerification emails user a link to verify their address and records
+// when it was sent.
+func (s *Service) sendVerification(ctx context.Context, repo Repository, user *User) error {
+	link, err := url.Parse(s.Verification.LinkURL)
+	if err != nil {
+		return err
+	}
+
+	query := link.Query()
+	query.Set("token", s.Verification.Signer.Sign(verificationPurpose, user.ID, user.Email, s.Verification.TokenTTL))
+	link.RawQuery = query.Encode()
+
+	err = s.Verification.Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease verify your email address by opening the link below.\n\n%s\n\nIf you did not create this account, you can ignore this email.\n",
+			user.UserName, link.String()),
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = repo.RecordVerificationSent(user.ID, now)
+	if err != nil {
+		return err
+	}
+
+	user.VerificationSentAt = &now
+	return nil
+}
@@ -0,0 +1,261 @@
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// Codes shared by every service. Packages define their own codes for
+// domain errors alongside the errors themselves.
+const (
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeValidationFailed = "validation_failed"
+	CodeMalformedRequest = "malformed_request"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeInternal         = "internal_error"
+)
+
+// Error is an error with a stable code that clients can match on, the HTTP
+// status it is answered with and optional details. The message is shown
+// to clients; the cause, if any, is only logged.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []FieldError
+	Details map[string]interface{}
+
+	// RetryAfter tells clients how long to wait before trying again. It is
+	// sent as the Retry-After header.
+	RetryAfter time.Duration
+
+	cause error
+}
+
+// FieldError describes one invalid field of a request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func NotFound(code string, message string) *Error {
+	return New(http.StatusNotFound, code, message)
+}
+
+func BadRequest(code string, message string) *Error {
+	return New(http.StatusBadRequest, code, message)
+}
+
+func Unauthorized(code string, message string) *Error {
+	return New(http.StatusUnauthorized, code, message)
+}
+
+func Forbidden(code string, message string) *Error {
+	return New(http.StatusForbidden, code, message)
+}
+
+func TooManyRequests(code string, message string) *Error {
+	return New(http.StatusTooManyRequests, code, message)
+}
+
+func Conflict(code string, message string) *Error {
+	return New(http.StatusConflict, code, message)
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return e.Message + ": " + e.cause.Error()
+	}
+
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is matches errors by code, so an error built from a sentinel with Wrap
+// or WithDetails still satisfies errors.Is against the sentinel.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code && t.Status == e.Status
+}
+
+// Wrap returns a copy of e caused by cause.
+func (e *Error) Wrap(cause error) *Error {
+	clone := *e
+	clone.cause = cause
+	return &clone
+}
+
+// WithMessage returns a copy of e shown with a more specific message.
+func (e *Error) WithMessage(format string, args ...interface{}) *Error {
+	clone := *e
+	clone.Message = fmt.Sprintf(format, args...)
+	return &clone
+}
+
+// WithRetryAfter returns a copy of e asking clients to wait d before trying
+// again.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	clone := *e
+	clone.RetryAfter = d
+	return &clone
+}
+
+// WithDetails returns a copy of e carrying details for clients.
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	clone := *e
+	clone.Details = details
+	return &clone
+}
+
+var (
+	mu         sync.RWMutex
+	registered []registration
+)
+
+type registration struct {
+	target error
+	err    *Error
+}
+
+// Register makes From answer err wherever target is found in an error's
+// chain. It is for packages such as ot and crdt whose errors are plain
+// sentinels that know nothing of HTTP.
+func Register(target error, err *Error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registered = append(registered, registration{target: target, err: err})
+}
+
+// From converts any error into an *Error. Errors that are or wrap an
+// *Error keep it; missing records, unique constraint violations, request
+// validation and malformed bodies get their own codes; everything else is
+// an internal error whose cause is not shown to clients.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	mu.RLock()
+	for _, r := range registered {
+		if errors.Is(err, r.target) {
+			mu.RUnlock()
+			return r.err.Wrap(err)
+		}
+	}
+	mu.RUnlock()
+
+	var validationErrs validator.ValidationErrors
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return NotFound(CodeNotFound, "resource not found").Wrap(err)
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		return Conflict(CodeConflict, "resource already exists").Wrap(err)
+	case errors.As(err, &validationErrs):
+		return validation(validationErrs).Wrap(err)
+	case errors.As(err, &typeErr):
+		return BadRequest(CodeMalformedRequest, fmt.Sprintf("%s must be a %s", typeErr.Field, typeErr.Type)).Wrap(err)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return BadRequest(CodeMalformedRequest, "request body is not valid JSON").Wrap(err)
+	}
+
+	return New(http.StatusInternalServerError, CodeInternal, "internal server error").Wrap(err)
+}
+
+func validation(errs validator.ValidationErrors) *Error {
+	fields := make([]FieldError, 0, len(errs))
+	for _, fe := range errs {
+		fields = append(fields, FieldError{
+			Field:   fieldName(fe.Namespace()),
+			Rule:    fe.Tag(),
+			Message: fieldMessage(fe),
+		})
+	}
+
+	apiErr := BadRequest(CodeValidationFailed, "request validation failed")
+	apiErr.Fields = fields
+	return apiErr
+}
+
+// fieldName drops the struct name from a namespace such as
+// "CreateCollaborationRequest.name".
+func fieldName(namespace string) string {
+	_, field, ok := strings.Cut(namespace, ".")
+	if !ok {
+		return namespace
+	}
+
+	return field
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be an email address"
+	case "min":
+		return "must be at least " + fe.Param() + unit(fe)
+	case "max":
+		return "must be at most " + fe.Param() + unit(fe)
+	case "oneof":
+		return "must be one of " + fe.Param()
+	case "uuid":
+		return "must be a UUID"
+	case "username":
+		return "must be 3 to 32 letters, digits, dots, dashes or underscores, starting with a letter or digit"
+	case "notreserved":
+		return "is reserved"
+	case "httpurl":
+		return "must be an http or https URL"
+	}
+
+	return "failed the " + fe.Tag() + " rule"
+}
+
+// unit names what min and max count for the kind of field that failed.
+func unit(fe validator.FieldError) string {
+	switch fe.Kind() {
+	case reflect.String:
+		return " characters long"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return " items"
+	}
+
+	return ""
+}
+
+// Bind converts an error from binding a request body. Bodies that fail
+// validation keep their field errors; anything else wrong with the body
+// is the client's fault, never a server error.
+func Bind(err error) *Error {
+	apiErr := From(err)
+	if apiErr.Status >= http.StatusInternalServerError {
+		return BadRequest(CodeMalformedRequest, "request body could not be read").Wrap(err)
+	}
+
+	return apiErr
+}
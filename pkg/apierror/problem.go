@@ -0,0 +1,103 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/logging"
+)
+
+// ContentType is the media type of RFC 7807 problem details.
+const ContentType = "application/problem+json"
+
+// Problem is the body of every error response. Code is stable and meant
+// for clients to match on; Title and Detail are for people.
+type Problem struct {
+	Type      string                 `json:"type"`
+	Title     string                 `json:"title"`
+	Status    int                    `json:"status"`
+	Detail    string                 `json:"detail,omitempty"`
+	Instance  string                 `json:"instance,omitempty"`
+	Code      string                 `json:"code"`
+	RequestID string                 `json:"request_id,omitempty"`
+	Errors    []FieldError           `json:"errors,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+
+	// RetryAfter is the number of seconds to wait before trying again.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+// NewProblem describes err as a problem for the request at instance.
+func NewProblem(err *Error, instance string, requestID string) Problem {
+	return Problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(err.Status),
+		Status:     err.Status,
+		Detail:     err.Message,
+		Instance:   instance,
+		Code:       err.Code,
+		RequestID:  requestID,
+		Errors:     err.Fields,
+		Details:    err.Details,
+		RetryAfter: retryAfterSeconds(err.RetryAfter),
+	}
+}
+
+// retryAfterSeconds rounds d up to whole seconds, as Retry-After counts.
+func retryAfterSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Write renders err as a problem and aborts the request.
+func Write(c *gin.Context, err error) {
+	apiErr := From(err)
+	problem := NewProblem(apiErr, c.Request.URL.Path, logging.RequestID(c.Request.Context()))
+
+	body, marshalErr := json.Marshal(problem)
+	if marshalErr != nil {
+		problem.Details = nil
+		body, _ = json.Marshal(problem)
+	}
+
+	if problem.RetryAfter > 0 {
+		c.Header("Retry-After", strconv.FormatInt(problem.RetryAfter, 10))
+	}
+
+	c.Abort()
+	c.Data(apiErr.Status, ContentType, body)
+}
+
+// Middleware renders the last error a handler attached with c.Error as a
+// problem, unless the handler already wrote a response. Internal errors
+// are logged with their cause, which the response never includes.
+func Middleware(logger *logging.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		last := c.Errors.Last()
+		if last == nil {
+			return
+		}
+
+		apiErr := From(last.Err)
+		if apiErr.Status >= http.StatusInternalServerError && logger != nil {
+			logger.WithContext(c.Request.Context()).Error("Request failed", map[string]interface{}{
+				"code":  apiErr.Code,
+				"error": last.Err.Error(),
+			})
+		}
+
+		if c.Writer.Written() {
+			return
+		}
+
+		Write(c, apiErr)
+	}
+}
@@ -3,36 +3,33 @@ package auth
 import (
 	"context"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator"
+	"github.com/google/uuid"
+	"github.com/similadayo/pkg/apierror"
 	"github.com/similadayo/pkg/logging"
 	"github.com/similadayo/pkg/utils"
-	limit "github.com/yangxikun/gin-limit-by-key"
-	"golang.org/x/time/rate"
 )
 
-var validate *validator.Validate
+var (
+	ErrMissingToken = apierror.Unauthorized("missing_token", "missing access token")
 
-func init() {
-	validate = validator.New()
-}
+	ErrMalformedAuthorization = apierror.Unauthorized("malformed_authorization", "authorization header must be a bearer token")
 
-func ValidateRequest(c *gin.Context, req interface{}) error {
-	err := c.ShouldBindJSON(req)
-	if err != nil {
-		return err
-	}
+	ErrInvalidToken = apierror.Unauthorized("invalid_token", "invalid or expired access token")
 
-	err = validate.Struct(req)
-	if err != nil {
-		return err
-	}
+	ErrEmailNotVerified = apierror.Forbidden("email_not_verified", "email address is not verified")
+)
 
-	return nil
-}
+// What users who have not verified their email address may do.
+const (
+	UnverifiedFull     = "full"
+	UnverifiedReadOnly = "read_only"
+	UnverifiedNone     = "none"
+)
 
 // logger middleware
 func LoggerMiddleWare(logger *logging.Logger) gin.HandlerFunc {
@@ -42,43 +39,95 @@ func LoggerMiddleWare(logger *logging.Logger) gin.HandlerFunc {
 		end := time.Now()
 		latency := end.Sub(start)
 
-		logger.Info("request", map[string]interface{}{
+		logger.WithContext(c.Request.Context()).Info("request", map[string]interface{}{
 			"Method":  c.Request.Method,
-			"URI":     c.Request.RequestURI,
+			"URI":     redactedURI(c.Request.URL),
 			"Status":  c.Writer.Status(),
 			"Latency": latency,
 		})
 	}
 }
 
-// ContextMiddleware adds a context to the request with timeout and request-scoped values.
+// sensitiveQueryParams carry credentials: email verification and password
+// reset links send a token, WebSocket clients their access token, and
+// sign-in flows may send a code.
+var sensitiveQueryParams = []string{"token", "access_token", "code"}
+
+// redactedURI is the request path and query with the values of
+// sensitiveQueryParams masked, so that logs do not hold credentials.
+func redactedURI(u *url.URL) string {
+	query := u.Query()
+	for _, name := range sensitiveQueryParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+
+	uri := u.EscapedPath()
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+
+	return uri
+}
+
+// ContextMiddleware gives the request a deadline, after which the database
+// calls and outgoing requests made with its context are cancelled.
 func ContextMiddleware(timeout time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
 		defer cancel()
 
-		ctx = context.WithValue(ctx, "request_id", c.Writer.Header().Get("X-Request-ID"))
-
 		c.Request = c.Request.WithContext(ctx)
 		c.Next()
 	}
 }
 
-// RateLimiterMiddleware applies rate limiting to the API.
-func RateLimiterMiddleware() gin.HandlerFunc {
+// RequestIDHeader carries the ID correlating a request across services.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the caller-supplied IDs that are accepted.
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware accepts the caller's X-Request-ID, or generates one
+// when it is missing or malformed, echoes it in the response and stores it
+// with the route template in the request context for Logger.WithContext.
+func RequestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		limit.NewRateLimiter(func(c *gin.Context) string {
-			return c.ClientIP()
-		}, func(c *gin.Context) (*rate.Limiter, time.Duration) {
-			return rate.NewLimiter(rate.Every(time.Second), 1), time.Hour
-		}, func(c *gin.Context) {
-			c.AbortWithStatusJSON(429, gin.H{
-				"error": "too many requests",
-			})
-		})
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+
+		c.Header(RequestIDHeader, requestID)
+		c.Set("request_id", requestID)
+
+		ctx := logging.WithRequestID(c.Request.Context(), requestID)
+		if route := c.FullPath(); route != "" {
+			ctx = logging.WithRoute(ctx, route)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
 	}
 }
 
+// validRequestID accepts short IDs of visible ASCII characters, so a caller
+// cannot inject line breaks or control characters into the logs.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	for _, r := range requestID {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
 // SecurityHeadersMiddleware sets security headers in the response.
 func SecurityHeadersMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -99,16 +148,14 @@ func AuthMiddleware() gin.HandlerFunc {
 		//Extract token from the authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
-			c.Abort()
+			apierror.Write(c, ErrMissingToken)
 			return
 		}
 
 		// Check if the token is in the correct format
 		parts := strings.Fields(authHeader)
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid Authorization header format"})
-			c.Abort()
+			apierror.Write(c, ErrMalformedAuthorization)
 			return
 		}
 
@@ -117,17 +164,48 @@ func AuthMiddleware() gin.HandlerFunc {
 		//Validate token
 		claims, err := utils.ValidateToken(tokenString)
 		if err != nil {
-			c.JSON(401, gin.H{
-				"errors": err.Error(),
-			})
-			c.Abort()
-
+			apierror.Write(c, ErrInvalidToken.Wrap(err))
 			return
 		}
 
 		//Attach UserID to the context for further Processing
 		c.Set("user_id", claims.UserID)
+		c.Set("token_id", claims.Id)
+		c.Set("token_expires_at", claims.ExpiresAt)
+		c.Set("email_verified", !claims.Unverified)
+		c.Request = c.Request.WithContext(logging.WithUserID(c.Request.Context(), claims.UserID))
 
 		c.Next()
 	}
 }
+
+// VerifiedEmailMiddleware limits what users who have not verified their
+// email address may do, following access: UnverifiedFull lets them through,
+// UnverifiedReadOnly lets them make only GET, HEAD and OPTIONS requests and
+// UnverifiedNone turns them away. It must run after AuthMiddleware.
+func VerifiedEmailMiddleware(access string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if access == UnverifiedFull || c.GetBool("email_verified") {
+			c.Next()
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if access == UnverifiedReadOnly {
+				c.Next()
+				return
+			}
+		}
+
+		apierror.Write(c, ErrEmailNotVerified)
+	}
+}
+
+// JWKSHandler publishes the key ring's public keys so other services can verify tokens.
+func JWKSHandler(ring *utils.KeyRing) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Cache-Control", "public, max-age=300")
+		c.JSON(http.StatusOK, utils.NewJSONWebKeySet(ring.VerificationKeys()))
+	}
+}
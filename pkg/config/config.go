@@ -0,0 +1,481 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Config is the configuration shared by the services. Each field is named
+// by its dotted config key, which is also its flag name, and may be set
+// from the environment variables listed in its env tag, first set wins.
+type Config struct {
+	Server    ServerConfig    `config:"server"`
+	Database  DatabaseConfig  `config:"database"`
+	Auth      AuthConfig      `config:"auth"`
+	Log       LogConfig       `config:"log"`
+	RateLimit RateLimitConfig `config:"rate_limit"`
+	WebSocket WebSocketConfig `config:"websocket"`
+	Tracing   TracingConfig   `config:"tracing"`
+	Mail      MailConfig      `config:"mail"`
+
+	Verification  VerificationConfig  `config:"verification"`
+	PasswordReset PasswordResetConfig `config:"password_reset"`
+	MFA           MFAConfig           `config:"mfa"`
+	Lockout       LockoutConfig       `config:"lockout"`
+}
+
+type ServerConfig struct {
+	Addr         string        `config:"addr" env:"HTTP_ADDR"`
+	ReadTimeout  time.Duration `config:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout time.Duration `config:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `config:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+
+	// ShutdownTimeout bounds how long in-flight requests and connections
+	// are drained for after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+
+	// DrainDelay is how long /readyz reports unready before the server stops
+	// accepting requests, giving load balancers time to notice.
+	DrainDelay time.Duration `config:"drain_delay" env:"DRAIN_DELAY"`
+
+	// TrustedProxies are the addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For header is believed. Empty trusts none, so the
+	// client address is the peer address.
+	TrustedProxies []string `config:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+type DatabaseConfig struct {
+	// Driver is sqlite, postgres or memory.
+	Driver string `config:"driver" env:"STORAGE_DRIVER"`
+
+	// URL is the sqlite file or the postgres connection string.
+	URL string `config:"url" env:"DATABASE_URL,DB_PATH" secret:"true"`
+
+	MigrateOnStart bool `config:"migrate_on_start" env:"MIGRATE_ON_START"`
+
+	// MinFreeDiskMB is the free space below which a sqlite database reports unready.
+	MinFreeDiskMB int `config:"min_free_disk_mb" env:"DB_MIN_FREE_DISK_MB"`
+}
+
+type AuthConfig struct {
+	// SecretKey signs HS256 tokens, which are only issued when no key ring is configured.
+	SecretKey string `config:"secret_key" env:"SECRET_KEY" secret:"true"`
+
+	SigningAlgorithm    string        `config:"signing_algorithm" env:"JWT_SIGNING_ALG"`
+	KeyDir              string        `config:"key_dir" env:"JWT_KEY_DIR"`
+	KeyRotationInterval time.Duration `config:"key_rotation_interval" env:"JWT_KEY_ROTATION_INTERVAL"`
+	JWKSURL             string        `config:"jwks_url" env:"JWKS_URL"`
+	AccessTokenTTL      time.Duration `config:"access_token_ttl" env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL     time.Duration `config:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+	BcryptCost          int           `config:"bcrypt_cost" env:"BCRYPT_COST"`
+
+	// Admins are the IDs of users allowed to manage other users' accounts,
+	// such as turning off their two-factor authentication.
+	Admins []string `config:"admins" env:"AUTH_ADMINS"`
+}
+
+type LogConfig struct {
+	Level string `config:"level" env:"LOG_LEVEL" reload:"true"`
+}
+
+// RateLimitConfig bounds how often a single client may call the API. Each
+// client has a bucket of Burst requests, refilled at RequestsPerSecond;
+// Routes give some routes limits of their own.
+type RateLimitConfig struct {
+	Enabled bool `config:"enabled" env:"RATE_LIMIT_ENABLED" reload:"true"`
+
+	RequestsPerSecond float64 `config:"requests_per_second" env:"RATE_LIMIT_RPS" reload:"true"`
+	Burst             int     `config:"burst" env:"RATE_LIMIT_BURST" reload:"true"`
+
+	// Key is what requests are counted against: ip, user (the signed-in
+	// user, or the address of anonymous requests) or api_key (the value
+	// of the APIKeyHeader header, or the address when it is missing).
+	Key string `config:"key" env:"RATE_LIMIT_KEY" reload:"true"`
+
+	APIKeyHeader string `config:"api_key_header" env:"RATE_LIMIT_API_KEY_HEADER" reload:"true"`
+
+	// Routes are per-route limits in place of the one above, each written
+	// as a method (or * for any), the route as registered and options:
+	// "POST /api/users/login rate=10/1m burst=5 key=ip". burst defaults to
+	// the count in rate and key to Key.
+	Routes []string `config:"routes" env:"RATE_LIMIT_ROUTES" reload:"true"`
+
+	// MaxKeys bounds how many clients the in-memory store tracks; the least
+	// recently seen are forgotten first.
+	MaxKeys int `config:"max_keys" env:"RATE_LIMIT_MAX_KEYS"`
+}
+
+// RateLimitRoute is a parsed rate_limit.routes entry.
+type RateLimitRoute struct {
+	Method string
+	Path   string
+
+	RequestsPerSecond float64
+	Burst             int
+	Key               string
+}
+
+// ParseRoutes parses Routes, reporting every invalid entry at once.
+func (c RateLimitConfig) ParseRoutes() ([]RateLimitRoute, error) {
+	var routes []RateLimitRoute
+	var errs []error
+	for _, spec := range c.Routes {
+		route, err := parseRateLimitRoute(spec, c.Key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%q: %w", spec, err))
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	return routes, errors.Join(errs...)
+}
+
+func parseRateLimitRoute(spec string, key string) (RateLimitRoute, error) {
+	parts := strings.Fields(spec)
+	if len(parts) < 3 || !strings.HasPrefix(parts[1], "/") {
+		return RateLimitRoute{}, errors.New("want a method, a path and options")
+	}
+
+	route := RateLimitRoute{Method: strings.ToUpper(parts[0]), Path: parts[1], Key: key}
+	for _, option := range parts[2:] {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "rate":
+			count, period, ok := strings.Cut(value, "/")
+			n, err := strconv.Atoi(count)
+			if !ok || err != nil || n < 1 {
+				return RateLimitRoute{}, fmt.Errorf("rate must be a count per duration, such as 10/1m, got %q", value)
+			}
+			d, err := time.ParseDuration(period)
+			if err != nil || d <= 0 {
+				return RateLimitRoute{}, fmt.Errorf("rate must be a count per duration, such as 10/1m, got %q", value)
+			}
+
+			route.RequestsPerSecond = float64(n) / d.Seconds()
+			if route.Burst == 0 {
+				route.Burst = n
+			}
+		case "burst":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return RateLimitRoute{}, fmt.Errorf("burst must be at least 1, got %q", value)
+			}
+			route.Burst = n
+		case "key":
+			route.Key = value
+		default:
+			return RateLimitRoute{}, fmt.Errorf("unknown option %q", name)
+		}
+	}
+
+	if route.RequestsPerSecond == 0 {
+		return RateLimitRoute{}, errors.New("rate must be set")
+	}
+	if !validRateLimitKey(route.Key) {
+		return RateLimitRoute{}, fmt.Errorf("key must be ip, user or api_key, got %q", route.Key)
+	}
+
+	return route, nil
+}
+
+func validRateLimitKey(key string) bool {
+	return key == "ip" || key == "user" || key == "api_key"
+}
+
+type WebSocketConfig struct {
+	// AllowedOrigins lists the origins browsers may open sockets from; empty
+	// allows only same-origin requests.
+	AllowedOrigins []string `config:"allowed_origins" env:"WS_ALLOWED_ORIGINS"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, stdout, file or otlp.
+	Exporter string `config:"exporter" env:"TRACING_EXPORTER"`
+
+	// Endpoint is the OTLP/HTTP collector the otlp exporter sends spans to.
+	Endpoint string `config:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+
+	// File receives spans as JSON lines when the exporter is file.
+	File string `config:"file" env:"TRACING_FILE"`
+
+	// SampleRatio is the fraction of new traces recorded; requests that
+	// arrive with a traceparent follow the caller's decision.
+	SampleRatio float64 `config:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+type MailConfig struct {
+	// Driver is smtp, file or memory. file writes each message to OutboxDir
+	// and memory keeps them in the process, for local use and tests.
+	Driver string `config:"driver" env:"MAIL_DRIVER"`
+
+	From string `config:"from" env:"MAIL_FROM"`
+
+	// SMTPAddr is the host:port of the relay used by the smtp driver.
+	SMTPAddr     string `config:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername string `config:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `config:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+
+	OutboxDir string `config:"outbox_dir" env:"MAIL_OUTBOX_DIR"`
+}
+
+type VerificationConfig struct {
+	// Enabled makes new accounts verify their email address. When it is
+	// off, accounts are usable as soon as they are created.
+	Enabled bool `config:"enabled" env:"EMAIL_VERIFICATION_ENABLED"`
+
+	// Secret signs verification links. When empty a random secret is used,
+	// so links stop working when the service restarts.
+	Secret string `config:"secret" env:"VERIFICATION_SECRET" secret:"true"`
+
+	// LinkURL is where verification links point; the token is added as
+	// the token query parameter.
+	LinkURL string `config:"link_url" env:"VERIFICATION_LINK_URL"`
+
+	TokenTTL time.Duration `config:"token_ttl" env:"VERIFICATION_TOKEN_TTL"`
+
+	// ResendInterval is the least time between two verification emails to
+	// the same account.
+	ResendInterval time.Duration `config:"resend_interval" env:"VERIFICATION_RESEND_INTERVAL"`
+
+	// UnverifiedAccess is what users may do before verifying: full,
+	// read_only (sign in and read, but change nothing) or none (not even
+	// sign in).
+	UnverifiedAccess string `config:"unverified_access" env:"UNVERIFIED_ACCESS"`
+}
+
+type PasswordResetConfig struct {
+	// LinkURL is the page where users choose a new password; the reset
+	// token is added as the token query parameter.
+	LinkURL string `config:"link_url" env:"PASSWORD_RESET_LINK_URL"`
+
+	TokenTTL time.Duration `config:"token_ttl" env:"PASSWORD_RESET_TOKEN_TTL"`
+}
+
+type MFAConfig struct {
+	// Issuer names the service in authenticator apps.
+	Issuer string `config:"issuer" env:"MFA_ISSUER"`
+
+	// ChallengeSecret signs the token that carries a login from the
+	// password step to the code step. When empty a random secret is used,
+	// so logins in progress fail when the service restarts.
+	ChallengeSecret string `config:"challenge_secret" env:"MFA_CHALLENGE_SECRET" secret:"true"`
+
+	ChallengeTTL time.Duration `config:"challenge_ttl" env:"MFA_CHALLENGE_TTL"`
+}
+
+// LockoutConfig slows down password guessing. Each failed login makes the
+// account and the client address wait twice as long as before, from
+// BaseDelay up to MaxDelay, and too many failures lock them for Duration.
+type LockoutConfig struct {
+	// MaxFailures is how many failed logins in Window lock an account.
+	MaxFailures int `config:"max_failures" env:"LOCKOUT_MAX_FAILURES"`
+
+	// MaxIPFailures is how many failed logins in Window lock a client
+	// address, whichever accounts they were for.
+	MaxIPFailures int `config:"max_ip_failures" env:"LOCKOUT_MAX_IP_FAILURES"`
+
+	BaseDelay time.Duration `config:"base_delay" env:"LOCKOUT_BASE_DELAY"`
+	MaxDelay  time.Duration `config:"max_delay" env:"LOCKOUT_MAX_DELAY"`
+	Duration  time.Duration `config:"duration" env:"LOCKOUT_DURATION"`
+
+	// Window is how long a failed login counts for.
+	Window time.Duration `config:"window" env:"LOCKOUT_WINDOW"`
+}
+
+// defaultAddrs are the ports the services listen on unless configured otherwise.
+var defaultAddrs = map[string]string{
+	"user-service":   ":8081",
+	"collab-service": ":8082",
+	"ws-service":     ":8083",
+}
+
+// defaultRateLimitRoutes hold back the routes that are worth guessing at.
+var defaultRateLimitRoutes = map[string][]string{
+	"user-service": {
+		"POST /api/users/ rate=10/1h burst=5 key=ip",
+		"POST /api/users/login rate=30/1m burst=10 key=ip",
+		"POST /api/users/login/mfa rate=30/1m burst=10 key=ip",
+		"POST /api/users/verify/resend rate=5/1h burst=3 key=ip",
+		"POST /api/users/password/forgot rate=5/1h burst=3 key=ip",
+	},
+}
+
+// Defaults returns the configuration a service runs with when nothing is set.
+func Defaults(service string) *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            defaultAddrs[service],
+			ReadTimeout:     15 * time.Second,
+			WriteTimeout:    30 * time.Second,
+			IdleTimeout:     60 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+			DrainDelay:      2 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Driver:         "sqlite",
+			URL:            "User.db",
+			MigrateOnStart: true,
+			MinFreeDiskMB:  100,
+		},
+		Auth: AuthConfig{
+			SigningAlgorithm:    "RS256",
+			KeyRotationInterval: 24 * time.Hour,
+			JWKSURL:             "http://localhost:8081/.well-known/jwks.json",
+			AccessTokenTTL:      15 * time.Minute,
+			RefreshTokenTTL:     30 * 24 * time.Hour,
+			BcryptCost:          10,
+		},
+		Log: LogConfig{
+			Level: "info",
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:           true,
+			RequestsPerSecond: 10,
+			Burst:             20,
+			Key:               "user",
+			APIKeyHeader:      "X-API-Key",
+			Routes:            defaultRateLimitRoutes[service],
+			MaxKeys:           100000,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			Endpoint:    "http://localhost:4318",
+			SampleRatio: 1,
+		},
+		Mail: MailConfig{
+			Driver:    "file",
+			From:      "no-reply@localhost",
+			OutboxDir: "outbox",
+		},
+		Verification: VerificationConfig{
+			Enabled:          true,
+			LinkURL:          "http://localhost:8081/api/users/verify",
+			TokenTTL:         24 * time.Hour,
+			ResendInterval:   time.Minute,
+			UnverifiedAccess: "read_only",
+		},
+		PasswordReset: PasswordResetConfig{
+			LinkURL:  "http://localhost:3000/reset-password",
+			TokenTTL: time.Hour,
+		},
+		MFA: MFAConfig{
+			Issuer:       "Collaboration Platform",
+			ChallengeTTL: 5 * time.Minute,
+		},
+		Lockout: LockoutConfig{
+			MaxFailures:   5,
+			MaxIPFailures: 20,
+			BaseDelay:     time.Second,
+			MaxDelay:      time.Minute,
+			Duration:      15 * time.Minute,
+			Window:        time.Hour,
+		},
+	}
+}
+
+// Validate reports every invalid setting at once, each prefixed by its key.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr", "must be set")
+	check(c.Server.ReadTimeout > 0, "server.read_timeout", "must be positive")
+	check(c.Server.WriteTimeout > 0, "server.write_timeout", "must be positive")
+	check(c.Server.IdleTimeout > 0, "server.idle_timeout", "must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay", "must not be negative")
+
+	switch c.Database.Driver {
+	case "sqlite", "postgres":
+		check(c.Database.URL != "", "database.url", "must be set for the %s driver", c.Database.Driver)
+	case "memory":
+	default:
+		check(false, "database.driver", "must be sqlite, postgres or memory, got %q", c.Database.Driver)
+	}
+	check(c.Database.MinFreeDiskMB >= 0, "database.min_free_disk_mb", "must not be negative")
+
+	check(c.Auth.SigningAlgorithm == "RS256" || c.Auth.SigningAlgorithm == "EdDSA",
+		"auth.signing_algorithm", "must be RS256 or EdDSA, got %q", c.Auth.SigningAlgorithm)
+	check(c.Auth.KeyRotationInterval > 0, "auth.key_rotation_interval", "must be positive")
+	check(c.Auth.AccessTokenTTL > 0, "auth.access_token_ttl", "must be positive")
+	check(c.Auth.RefreshTokenTTL > c.Auth.AccessTokenTTL, "auth.refresh_token_ttl", "must be longer than auth.access_token_ttl")
+	check(c.Auth.BcryptCost >= 4 && c.Auth.BcryptCost <= 31, "auth.bcrypt_cost", "must be between 4 and 31, got %d", c.Auth.BcryptCost)
+
+	_, err := logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level", "unknown level %q", c.Log.Level)
+
+	check(c.RateLimit.RequestsPerSecond > 0, "rate_limit.requests_per_second", "must be positive")
+	check(c.RateLimit.Burst >= 1, "rate_limit.burst", "must be at least 1")
+	check(validRateLimitKey(c.RateLimit.Key), "rate_limit.key", "must be ip, user or api_key, got %q", c.RateLimit.Key)
+	check(c.RateLimit.APIKeyHeader != "", "rate_limit.api_key_header", "must be set")
+	_, err = c.RateLimit.ParseRoutes()
+	check(err == nil, "rate_limit.routes", "%v", err)
+	check(c.RateLimit.MaxKeys >= 1, "rate_limit.max_keys", "must be at least 1")
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		check(c.Tracing.File != "", "tracing.file", "must be set for the file exporter")
+	case "otlp":
+		endpoint, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (endpoint.Scheme == "http" || endpoint.Scheme == "https") && endpoint.Host != "",
+			"tracing.endpoint", "must be an http or https URL, got %q", c.Tracing.Endpoint)
+	default:
+		check(false, "tracing.exporter", "must be none, stdout, file or otlp, got %q", c.Tracing.Exporter)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio", "must be between 0 and 1")
+
+	switch c.Mail.Driver {
+	case "memory":
+	case "file":
+		check(c.Mail.OutboxDir != "", "mail.outbox_dir", "must be set for the file driver")
+	case "smtp":
+		check(c.Mail.SMTPAddr != "", "mail.smtp_addr", "must be set for the smtp driver")
+	default:
+		check(false, "mail.driver", "must be smtp, file or memory, got %q", c.Mail.Driver)
+	}
+	check(c.Mail.From != "", "mail.from", "must be set")
+
+	link, err := url.Parse(c.Verification.LinkURL)
+	check(err == nil && (link.Scheme == "http" || link.Scheme == "https") && link.Host != "",
+		"verification.link_url", "must be an http or https URL, got %q", c.Verification.LinkURL)
+	check(c.Verification.TokenTTL > 0, "verification.token_ttl", "must be positive")
+	check(c.Verification.ResendInterval >= 0, "verification.resend_interval", "must not be negative")
+	switch c.Verification.UnverifiedAccess {
+	case "full", "read_only", "none":
+	default:
+		check(false, "verification.unverified_access", "must be full, read_only or none, got %q", c.Verification.UnverifiedAccess)
+	}
+
+	link, err = url.Parse(c.PasswordReset.LinkURL)
+	check(err == nil && (link.Scheme == "http" || link.Scheme == "https") && link.Host != "",
+		"password_reset.link_url", "must be an http or https URL, got %q", c.PasswordReset.LinkURL)
+	check(c.PasswordReset.TokenTTL > 0, "password_reset.token_ttl", "must be positive")
+	check(c.MFA.Issuer != "" && !strings.Contains(c.MFA.Issuer, ":"), "mfa.issuer", "must be set and must not contain a colon")
+	check(c.MFA.ChallengeTTL > 0, "mfa.challenge_ttl", "must be positive")
+
+	check(c.Lockout.MaxFailures >= 1, "lockout.max_failures", "must be at least 1")
+	check(c.Lockout.MaxIPFailures >= 1, "lockout.max_ip_failures", "must be at least 1")
+	check(c.Lockout.BaseDelay >= 0, "lockout.base_delay", "must not be negative")
+	check(c.Lockout.MaxDelay >= c.Lockout.BaseDelay, "lockout.max_delay", "must not be shorter than lockout.base_delay")
+	check(c.Lockout.Duration > 0, "lockout.duration", "must be positive")
+	check(c.Lockout.Window > 0, "lockout.window", "must be positive")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
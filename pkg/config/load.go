@@ -0,0 +1,330 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// secretFilePrefix marks the value of a secret setting as the path of a file
+// holding it, so secrets can be mounted rather than written into the config.
+const secretFilePrefix = "file:"
+
+var ErrUnknownFormat = errors.New("config file must be .yaml, .yml or .toml")
+
+// Loader builds a Config from, in increasing precedence: the defaults, a
+// YAML or TOML file, environment variables and command line flags.
+type Loader struct {
+	Service string
+
+	// Dir is searched for <Service>.yaml, .yml or .toml when no file is
+	// named by the -config flag or the CONFIG_FILE environment variable.
+	Dir string
+
+	// Args are the command line arguments after the program name.
+	Args []string
+}
+
+// NewLoader returns a Loader for service reading the process's arguments
+// and the configs directory.
+func NewLoader(service string) *Loader {
+	return &Loader{
+		Service: service,
+		Dir:     "configs",
+		Args:    os.Args[1:],
+	}
+}
+
+// Load returns the validated configuration together with the arguments left
+// after the flags, such as a subcommand.
+func (l *Loader) Load() (*Config, []string, error) {
+	cfg := Defaults(l.Service)
+	settings := fields(cfg)
+
+	flagSet := flag.NewFlagSet(l.Service, flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	configFile := flagSet.String("config", "", "path of the configuration file")
+	flags := map[string]string{}
+	for _, s := range settings {
+		key := s.key
+		flagSet.Func(key, "", func(value string) error {
+			flags[key] = value
+			return nil
+		})
+	}
+
+	err := flagSet.Parse(l.Args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, err := l.file(*configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		err = apply(settings, values, "in "+path)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = apply(settings, environment(settings), "from environment")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = apply(settings, flags, "from flag")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = readSecrets(settings)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cfg, flagSet.Args(), nil
+}
+
+// file picks the configuration file: an explicitly named one must exist,
+// while the default is optional.
+func (l *Loader) file(named string) (string, error) {
+	if named == "" {
+		named = os.Getenv("CONFIG_FILE")
+	}
+	if named != "" {
+		_, err := os.Stat(named)
+		return named, err
+	}
+
+	for _, ext := range []string{".yaml", ".yml", ".toml"} {
+		path := filepath.Join(l.Dir, l.Service+ext)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", nil
+}
+
+// setting is a leaf of Config, addressed by its dotted key.
+type setting struct {
+	key    string
+	env    []string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+func fields(cfg *Config) []setting {
+	return walk(reflect.ValueOf(cfg).Elem(), "")
+}
+
+func walk(v reflect.Value, prefix string) []setting {
+	var settings []setting
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := prefix + field.Tag.Get("config")
+
+		if field.Type.Kind() == reflect.Struct {
+			settings = append(settings, walk(v.Field(i), key+".")...)
+			continue
+		}
+
+		var env []string
+		if names := field.Tag.Get("env"); names != "" {
+			env = strings.Split(names, ",")
+		}
+
+		settings = append(settings, setting{
+			key:    key,
+			env:    env,
+			secret: field.Tag.Get("secret") == "true",
+			reload: field.Tag.Get("reload") == "true",
+			value:  v.Field(i),
+		})
+	}
+
+	return settings
+}
+
+func (s setting) set(raw string) error {
+	if s.value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(d))
+		return nil
+	}
+
+	switch s.value.Kind() {
+	case reflect.String:
+		s.value.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		s.value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		s.value.SetFloat(f)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported setting type %s", s.value.Type())
+	}
+
+	return nil
+}
+
+// apply sets each key in values, naming source in errors.
+func apply(settings []setting, values map[string]string, source string) error {
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		s, ok := byKey[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting %s", key, source))
+			continue
+		}
+
+		err := s.set(values[key])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %s: %w", key, source, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// environment collects the settings given as environment variables. A
+// secret may instead be read from the file named by <VARIABLE>_FILE.
+func environment(settings []setting) map[string]string {
+	values := map[string]string{}
+	for _, s := range settings {
+		for _, name := range s.env {
+			if value := os.Getenv(name); value != "" {
+				values[s.key] = value
+				break
+			}
+			if path := os.Getenv(name + "_FILE"); s.secret && path != "" {
+				values[s.key] = secretFilePrefix + path
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+func readSecrets(settings []setting) error {
+	for _, s := range settings {
+		if !s.secret {
+			continue
+		}
+
+		path, ok := strings.CutPrefix(s.value.String(), secretFilePrefix)
+		if !ok {
+			continue
+		}
+
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.key, err)
+		}
+		s.value.SetString(strings.TrimSpace(string(secret)))
+	}
+
+	return nil
+}
+
+// readFile flattens a YAML or TOML document into dotted keys.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	document := map[string]interface{}{}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	flatten(document, "", values)
+	return values, nil
+}
+
+func flatten(document map[string]interface{}, prefix string, values map[string]string) {
+	for key, value := range document {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(v, prefix+key+".", values)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix+key] = strings.Join(items, ",")
+		default:
+			values[prefix+key] = fmt.Sprint(v)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+)
+
+// Reloader re-reads the configuration while a service runs. Only settings
+// tagged reload, such as the log level and rate limits, take effect; the
+// rest are reported so the operator knows a restart is needed.
+type Reloader struct {
+	loader *Loader
+
+	mu       sync.RWMutex
+	current  *Config
+	onReload []func(*Config)
+}
+
+func NewReloader(loader *Loader, current *Config) *Reloader {
+	return &Reloader{
+		loader:  loader,
+		current: current,
+	}
+}
+
+// Current returns the configuration in effect. It must not be modified.
+func (r *Reloader) Current() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.current
+}
+
+// OnReload registers fn to be called with the new configuration after each
+// successful reload.
+func (r *Reloader) OnReload(fn func(*Config)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onReload = append(r.onReload, fn)
+}
+
+// Reload loads the configuration again and applies its reloadable settings.
+// It returns the keys of changed settings that were not applied. An invalid
+// configuration is rejected as a whole and the current one is kept.
+func (r *Reloader) Reload() ([]string, error) {
+	loaded, _, err := r.loader.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	next := *r.current
+	next.WebSocket.AllowedOrigins = append([]string(nil), r.current.WebSocket.AllowedOrigins...)
+
+	var ignored []string
+	nextSettings := fields(&next)
+	for i, s := range fields(loaded) {
+		target := nextSettings[i]
+		if reflect.DeepEqual(s.value.Interface(), target.value.Interface()) {
+			continue
+		}
+
+		if s.reload {
+			target.value.Set(s.value)
+		} else {
+			ignored = append(ignored, s.key)
+		}
+	}
+
+	r.current = &next
+	hooks := append([]func(*Config){}, r.onReload...)
+	r.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(&next)
+	}
+
+	return ignored, nil
+}
+
+// Watch reloads the configuration whenever the process receives SIGHUP,
+// until stop is closed. report is called with the outcome of every reload.
+func (r *Reloader) Watch(stop <-chan struct{}, report func(ignored []string, err error)) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(signals)
+
+		for {
+			select {
+			case <-signals:
+				report(r.Reload())
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,45 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// HTTP checks that a downstream service answers url with a 2xx status.
+func HTTP(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s answered %s", url, resp.Status)
+		}
+
+		return nil
+	}
+}
+
+// DiskSpace checks that the filesystem holding path has at least minFree
+// bytes available, so a database on it can keep growing.
+func DiskSpace(path string, minFree uint64) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		free, err := freeSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < minFree {
+			return fmt.Errorf("%d MiB free, want at least %d MiB", free>>20, minFree>>20)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTimeout bounds a check that does not set its own.
+const DefaultTimeout = 2 * time.Second
+
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+	StatusFailing     = "failing"
+)
+
+var ErrShuttingDown = errors.New("service is shutting down")
+
+// Check is a named probe of something the service depends on. A failing
+// Optional check is reported but does not make the service unready.
+type Check struct {
+	Name     string
+	Run      func(ctx context.Context) error
+	Timeout  time.Duration
+	Optional bool
+}
+
+// CheckResult is the outcome of one check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the readiness of the service and the result of each check.
+type Report struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// Registry holds the checks that decide whether a service is ready.
+type Registry struct {
+	mu       sync.RWMutex
+	checks   []Check
+	stopping <-chan struct{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds a check, replacing any previous one with the same name.
+func (r *Registry) Register(check Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, existing := range r.checks {
+		if existing.Name == check.Name {
+			r.checks[i] = check
+			return
+		}
+	}
+	r.checks = append(r.checks, check)
+}
+
+// ShutdownOn makes the service report unready once stopping is closed, so
+// load balancers stop routing to it while it drains.
+func (r *Registry) ShutdownOn(stopping <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.stopping = stopping
+}
+
+func (r *Registry) shuttingDown() bool {
+	r.mu.RLock()
+	stopping := r.stopping
+	r.mu.RUnlock()
+
+	if stopping == nil {
+		return false
+	}
+
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run executes every check concurrently, each within its own timeout.
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := append([]Check(nil), r.checks...)
+	r.mu.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+
+			result := run(ctx, check)
+			mu.Lock()
+			report.Checks[check.Name] = result
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status == StatusOK:
+		case result.Optional:
+			if report.Status == StatusOK {
+				report.Status = StatusDegraded
+			}
+		default:
+			report.Status = StatusUnavailable
+		}
+	}
+
+	if r.shuttingDown() {
+		report.Status = StatusUnavailable
+		report.Error = ErrShuttingDown.Error()
+	}
+
+	return report
+}
+
+// run executes one check, abandoning it if it overruns its timeout.
+func run(ctx context.Context, check Check) CheckResult {
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("check panicked: %v", p)
+			}
+		}()
+		done <- check.Run(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	result := CheckResult{
+		Status:   StatusOK,
+		Optional: check.Optional,
+		Duration: time.Since(start).Round(time.Microsecond).String(),
+	}
+	if err != nil {
+		result.Status = StatusFailing
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// LivenessHandler reports that the process is up and able to serve. It
+// checks no dependencies, so an orchestrator only restarts a service that
+// has stopped responding altogether.
+func LivenessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": StatusOK})
+	}
+}
+
+// ReadinessHandler runs the registry's checks and answers 503 unless the
+// service can take traffic.
+func (r *Registry) ReadinessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := r.Run(c.Request.Context())
+
+		status := http.StatusOK
+		if report.Status == StatusUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(status, report)
+	}
+}
@@ -0,0 +1,151 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/logging"
+)
+
+// NewServer returns an HTTP server for handler with the configured timeouts,
+// so slow or idle clients cannot hold connections open indefinitely.
+func NewServer(cfg config.ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+type hook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// App runs a service's HTTP server until the process is asked to stop, then
+// drains it and runs the shutdown hooks within a single deadline.
+type App struct {
+	// DrainDelay is waited between the start of shutdown, when Stopping is
+	// closed, and the server refusing new requests.
+	DrainDelay time.Duration
+
+	logger          *logging.Logger
+	shutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	hooks    []hook
+	stopping chan struct{}
+	stopOnce sync.Once
+}
+
+func New(logger *logging.Logger, shutdownTimeout time.Duration) *App {
+	return &App{
+		logger:          logger,
+		shutdownTimeout: shutdownTimeout,
+		stopping:        make(chan struct{}),
+	}
+}
+
+// Stopping is closed when shutdown begins. Pass it as the stop channel of
+// background loops such as key rotation.
+func (a *App) Stopping() <-chan struct{} {
+	return a.stopping
+}
+
+// OnShutdown registers fn to run once the server has drained. Hooks run in
+// the reverse order of registration, like deferred calls, so resources are
+// released after everything registered later that uses them.
+func (a *App) OnShutdown(name string, fn func(ctx context.Context) error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.hooks = append(a.hooks, hook{name: name, fn: fn})
+}
+
+// Run listens on server.Addr and serves until SIGINT, SIGTERM or the end of
+// ctx, then shuts down. It returns the first error serving or an error
+// from shutting down.
+func (a *App) Run(ctx context.Context, server *http.Server) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+
+	return a.Serve(ctx, server, listener)
+}
+
+// Serve is Run on an existing listener.
+func (a *App) Serve(ctx context.Context, server *http.Server, listener net.Listener) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	a.logger.Info("server started", map[string]interface{}{
+		"addr": listener.Addr().String(),
+	})
+
+	var serveErr error
+	select {
+	case serveErr = <-served:
+	case <-ctx.Done():
+		a.logger.Info("shutting down", map[string]interface{}{
+			"timeout": a.shutdownTimeout.String(),
+		})
+	}
+
+	return errors.Join(serveErr, a.shutdown(server))
+}
+
+func (a *App) shutdown(server *http.Server) error {
+	a.stopOnce.Do(func() {
+		close(a.stopping)
+	})
+	time.Sleep(a.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
+
+	// stop accepting requests and wait for those in flight to finish
+	var errs []error
+	err := server.Shutdown(ctx)
+	if err != nil {
+		a.logger.Error("failed to drain http server", map[string]interface{}{
+			"error": err.Error(),
+		})
+		errs = append(errs, err)
+	}
+
+	a.mu.Lock()
+	hooks := append([]hook(nil), a.hooks...)
+	a.mu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		err := hooks[i].fn(ctx)
+		if err != nil {
+			a.logger.Error("shutdown step failed", map[string]interface{}{
+				"step":  hooks[i].name,
+				"error": err.Error(),
+			})
+			errs = append(errs, err)
+		}
+	}
+
+	a.logger.Info("shutdown complete", nil)
+	a.logger.Flush()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,48 @@
+package logging
+
+import "context"
+
+// contextKey keeps the request-scoped values logged by Logger.WithContext
+// from colliding with keys set by other packages.
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	userIDKey
+	routeKey
+)
+
+// WithRequestID returns a copy of ctx carrying the ID that correlates the
+// log lines and calls made while serving one request.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the request ID in ctx, or "" if there is none.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithUserID returns a copy of ctx carrying the authenticated user's ID.
+func WithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey, userID)
+}
+
+// UserID returns the user ID in ctx, or "" if there is none.
+func UserID(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey).(string)
+	return userID
+}
+
+// WithRoute returns a copy of ctx carrying the route template being served,
+// such as /api/collaborations/:id.
+func WithRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, routeKey, route)
+}
+
+// Route returns the route template in ctx, or "" if there is none.
+func Route(ctx context.Context) string {
+	route, _ := ctx.Value(routeKey).(string)
+	return route
+}
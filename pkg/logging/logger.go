@@ -1,14 +1,25 @@
 package logging
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+	"io"
+
+	"github.com/similadayo/pkg/redact"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type Logger struct {
 	logger *logrus.Logger
+
+	// fields are added to every line, such as the trace a request belongs to.
+	fields logrus.Fields
 }
 
 func NewLogger() *Logger {
 	l := logrus.New()
 	l.SetFormatter(&logrus.JSONFormatter{})
+	l.AddHook(redactHook{})
 
 	return &Logger{
 		logger: l,
@@ -16,17 +27,90 @@ func NewLogger() *Logger {
 }
 
 func (l *Logger) Info(message string, fields map[string]interface{}) {
-	l.logger.WithFields(fields).Info(message)
+	l.logger.WithFields(l.fields).WithFields(fields).Info(message)
 }
 
 func (l *Logger) Warn(message string, fields map[string]interface{}) {
-	l.logger.WithFields(fields).Warn(message)
+	l.logger.WithFields(l.fields).WithFields(fields).Warn(message)
 }
 
 func (l *Logger) Error(message string, fields map[string]interface{}) {
-	l.logger.WithFields(fields).Error(message)
+	l.logger.WithFields(l.fields).WithFields(fields).Error(message)
 }
 
 func (l *Logger) Fatal(message string, fields map[string]interface{}) {
-	l.logger.WithFields(fields).Fatal(message)
+	l.logger.WithFields(l.fields).WithFields(fields).Fatal(message)
+}
+
+// WithContext returns a logger whose lines carry the request ID, user ID
+// and route stored in ctx, and the trace and span IDs of the span in it, so
+// every line written while serving a request can be matched to it. It
+// returns l itself when ctx carries none of them.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	fields := logrus.Fields{}
+	if requestID := RequestID(ctx); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if userID := UserID(ctx); userID != "" {
+		fields["user_id"] = userID
+	}
+	if route := Route(ctx); route != "" {
+		fields["route"] = route
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+		fields["span_id"] = span.SpanID().String()
+	}
+
+	if len(fields) == 0 {
+		return l
+	}
+	for key, value := range l.fields {
+		if _, ok := fields[key]; !ok {
+			fields[key] = value
+		}
+	}
+
+	return &Logger{logger: l.logger, fields: fields}
+}
+
+// SetLevel changes the minimum level logged, such as "debug" or "warn".
+func (l *Logger) SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	l.logger.SetLevel(parsed)
+	return nil
+}
+
+// SetOutput sends log lines to w instead of standard error.
+func (l *Logger) SetOutput(w io.Writer) {
+	l.logger.SetOutput(w)
+}
+
+// Flush writes out any log output buffered by the destination, such as a
+// file, before the process exits.
+func (l *Logger) Flush() {
+	if out, ok := l.logger.Out.(interface{ Sync() error }); ok {
+		out.Sync()
+	}
+}
+
+// redactHook masks passwords, tokens, email addresses and credentials in
+// every line before it is written, whatever fields the caller passed.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	for key, value := range entry.Data {
+		entry.Data[key] = redact.Field(key, value)
+	}
+	entry.Message = redact.String(entry.Message)
+
+	return nil
 }
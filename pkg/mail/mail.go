@@ -0,0 +1,181 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/pkg/config"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Implementations fill in the sender.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// New returns the mailer selected by cfg.Driver.
+func New(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return &SMTPMailer{Addr: cfg.SMTPAddr, From: cfg.From, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword}, nil
+	case "file":
+		return NewFileOutbox(cfg.OutboxDir, cfg.From)
+	case "memory":
+		return NewMemoryOutbox(cfg.From), nil
+	}
+
+	return nil, errors.New("mail driver must be smtp, file or memory")
+}
+
+// SMTPMailer sends through an SMTP relay, upgrading to TLS when the relay
+// offers it and authenticating when a username is set.
+type SMTPMailer struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(nil); err != nil {
+			return err
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(Format(m.From, msg, time.Now())); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// FileOutbox writes each message to its own .eml file in Dir, for reading
+// mail locally without a relay.
+type FileOutbox struct {
+	Dir  string
+	From string
+}
+
+func NewFileOutbox(dir string, from string) (*FileOutbox, error) {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileOutbox{Dir: dir, From: from}, nil
+}
+
+func (o *FileOutbox) Send(ctx context.Context, msg Message) error {
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405"), uuid.New().String())
+
+	return os.WriteFile(filepath.Join(o.Dir, name), Format(o.From, msg, now), 0o600)
+}
+
+// MemoryOutbox keeps sent messages in memory. It is meant for tests.
+type MemoryOutbox struct {
+	From string
+
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewMemoryOutbox(from string) *MemoryOutbox {
+	return &MemoryOutbox{From: from}
+}
+
+func (o *MemoryOutbox) Send(ctx context.Context, msg Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+// Messages returns the messages sent so far, oldest first.
+func (o *MemoryOutbox) Messages() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]Message(nil), o.messages...)
+}
+
+// Format renders msg as an RFC 5322 message from from.
+func Format(from string, msg Message, date time.Time) []byte {
+	var b bytes.Buffer
+	header := func(name, value string) {
+		// strip line breaks so a value cannot inject further headers
+		value = strings.NewReplacer("\r", "", "\n", "").Replace(value)
+		fmt.Fprintf(&b, "%s: %s\r\n", name, value)
+	}
+
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return b.Bytes()
+}
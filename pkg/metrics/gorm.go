@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const startKey = "metrics:start"
+
+// GormPlugin records how long each database operation takes. Install it
+// with db.Use.
+type GormPlugin struct {
+	duration *HistogramVec
+	failures *CounterVec
+}
+
+func NewGormPlugin(r *Registry) *GormPlugin {
+	return &GormPlugin{
+		duration: r.Histogram("db_query_duration_seconds",
+			"Time taken by database operations, by operation.",
+			DefaultBuckets, "operation"),
+		failures: r.Counter("db_query_errors_total",
+			"Database operations that failed, by operation. Missing records are not failures.",
+			"operation"),
+	}
+}
+
+func (p *GormPlugin) Name() string {
+	return "metrics"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("metrics:before_create", start),
+		callbacks.Create().After("gorm:create").Register("metrics:after_create", p.observe("create")),
+		callbacks.Query().Before("gorm:query").Register("metrics:before_query", start),
+		callbacks.Query().After("gorm:query").Register("metrics:after_query", p.observe("query")),
+		callbacks.Update().Before("gorm:update").Register("metrics:before_update", start),
+		callbacks.Update().After("gorm:update").Register("metrics:after_update", p.observe("update")),
+		callbacks.Delete().Before("gorm:delete").Register("metrics:before_delete", start),
+		callbacks.Delete().After("gorm:delete").Register("metrics:after_delete", p.observe("delete")),
+		callbacks.Row().Before("gorm:row").Register("metrics:before_row", start),
+		callbacks.Row().After("gorm:row").Register("metrics:after_row", p.observe("row")),
+		callbacks.Raw().Before("gorm:raw").Register("metrics:before_raw", start),
+		callbacks.Raw().After("gorm:raw").Register("metrics:after_raw", p.observe("raw")),
+	)
+}
+
+func start(db *gorm.DB) {
+	db.InstanceSet(startKey, time.Now())
+}
+
+func (p *GormPlugin) observe(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		value, ok := db.InstanceGet(startKey)
+		if !ok {
+			return
+		}
+		started, ok := value.(time.Time)
+		if !ok {
+			return
+		}
+
+		p.duration.With(operation).Observe(time.Since(started).Seconds())
+		if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+			p.failures.With(operation).Inc()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Middleware counts requests and records their latency by method, route
+// template and status. Routes are labelled by template, such as
+// /collaborations/:id, so the number of series stays bounded; requests
+// that match no route share the label "unmatched".
+func Middleware(r *Registry) gin.HandlerFunc {
+	requests := r.Counter("http_requests_total",
+		"HTTP requests handled, by method, route template and status.",
+		"method", "route", "status")
+	latency := r.Histogram("http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by method, route template and status.",
+		DefaultBuckets, "method", "route", "status")
+	inFlight := r.Gauge("http_requests_in_flight", "HTTP requests currently being handled.").With()
+
+	return func(c *gin.Context) {
+		start := time.Now()
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(c.Writer.Status())
+
+		requests.With(c.Request.Method, route, status).Inc()
+		latency.With(c.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the registry in the text exposition format.
+func (r *Registry) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Content-Type", ContentType)
+		c.Header("Cache-Control", "no-store")
+		c.Status(http.StatusOK)
+		r.WriteText(c.Writer)
+	}
+}
@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// DefaultBuckets suit request latencies, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry the services expose on /metrics.
+var Default = NewRegistry()
+
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// Registry holds metric families and writes them in the Prometheus text
+// exposition format.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+// family is every series of one metric, keyed by their label values.
+type family struct {
+	name    string
+	help    string
+	typ     string
+	labels  []string
+	buckets []float64
+
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+
+	// value holds the float64 bits of a counter or gauge.
+	value atomic.Uint64
+
+	mu      sync.Mutex
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+// register returns the family called name, creating it on first use.
+// Registering the same name again with a different shape is a programming
+// error and panics.
+func (r *Registry) register(name, help, typ string, buckets []float64, labels []string) *family {
+	if !metricName.MatchString(name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", name))
+	}
+	for _, label := range labels {
+		if !labelName.MatchString(label) || strings.HasPrefix(label, "__") || (typ == typeHistogram && label == "le") {
+			panic(fmt.Sprintf("metrics: invalid label name %q for %s", label, name))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if existing, ok := r.families[name]; ok {
+		if existing.typ != typ || !equal(existing.labels, labels) || !equal(existing.buckets, buckets) {
+			panic(fmt.Sprintf("metrics: %s registered again with a different type, labels or buckets", name))
+		}
+		return existing
+	}
+
+	f := &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  append([]string(nil), labels...),
+		buckets: append([]float64(nil), buckets...),
+		series:  map[string]*series{},
+	}
+	r.families[name] = f
+	return f
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// with returns the series for the given label values, creating it on first use.
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok = f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if f.typ == typeHistogram {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) add(delta float64) {
+	for {
+		old := s.value.Load()
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if s.value.CompareAndSwap(old, next) {
+			return
+		}
+	}
+}
+
+func (s *series) load() float64 {
+	return math.Float64frombits(s.value.Load())
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	family *family
+}
+
+// Counter registers a counter, or returns the one already registered under name.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{family: r.register(name, help, typeCounter, nil, labels)}
+}
+
+// With returns the counter for the given label values, in the order the
+// labels were registered.
+func (v *CounterVec) With(values ...string) *Counter {
+	return &Counter{series: v.family.with(values)}
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	series *series
+}
+
+func (c *Counter) Inc() {
+	c.series.add(1)
+}
+
+// Add increases the counter by delta, which must not be negative.
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.series.add(delta)
+}
+
+func (c *Counter) Value() float64 {
+	return c.series.load()
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	family *family
+}
+
+// Gauge registers a gauge, or returns the one already registered under name.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{family: r.register(name, help, typeGauge, nil, labels)}
+}
+
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return &Gauge{series: v.family.with(values)}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	series *series
+}
+
+func (g *Gauge) Set(value float64) {
+	g.series.value.Store(math.Float64bits(value))
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.series.add(delta)
+}
+
+func (g *Gauge) Inc() {
+	g.series.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.series.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.series.load()
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	family *family
+}
+
+// Histogram registers a histogram with the given upper bounds, or returns
+// the one already registered under name. Nil buckets means DefaultBuckets.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	if n := len(buckets); n > 0 && math.IsInf(buckets[n-1], 1) {
+		buckets = buckets[:n-1]
+	}
+
+	return &HistogramVec{family: r.register(name, help, typeHistogram, buckets, labels)}
+}
+
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return &Histogram{family: v.family, series: v.family.with(values)}
+}
+
+// Histogram counts observations into buckets and tracks their sum.
+type Histogram struct {
+	family *family
+	series *series
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.family.buckets, value)
+
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	if i < len(h.series.buckets) {
+		h.series.buckets[i]++
+	}
+	h.series.count++
+	h.series.sum += value
+}
+
+// Count is the number of observations so far.
+func (h *Histogram) Count() uint64 {
+	h.series.mu.Lock()
+	defer h.series.mu.Unlock()
+
+	return h.series.count
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// WriteText writes every metric in the Prometheus text exposition format,
+// families sorted by name and series by label values, so the output is
+// stable enough to compare in tests.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].name < families[j].name
+	})
+
+	out := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(out)
+	}
+
+	return out.Flush()
+}
+
+func (f *family) write(out *bufio.Writer) {
+	f.mu.RLock()
+	all := make([]*series, 0, len(f.series))
+	for _, s := range f.series {
+		all = append(all, s)
+	}
+	f.mu.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return strings.Join(all[i].values, "\xff") < strings.Join(all[j].values, "\xff")
+	})
+
+	if f.help != "" {
+		out.WriteString("# HELP " + f.name + " " + helpEscaper.Replace(f.help) + "\n")
+	}
+	out.WriteString("# TYPE " + f.name + " " + f.typ + "\n")
+
+	for _, s := range all {
+		if f.typ != typeHistogram {
+			writeSample(out, f.name, f.labels, s.values, "", s.load())
+			continue
+		}
+
+		s.mu.Lock()
+		buckets := append([]uint64(nil), s.buckets...)
+		count, sum := s.count, s.sum
+		s.mu.Unlock()
+
+		var cumulative uint64
+		for i, bound := range f.buckets {
+			cumulative += buckets[i]
+			writeSample(out, f.name+"_bucket", f.labels, s.values, formatFloat(bound), float64(cumulative))
+		}
+		writeSample(out, f.name+"_bucket", f.labels, s.values, "+Inf", float64(count))
+		writeSample(out, f.name+"_sum", f.labels, s.values, "", sum)
+		writeSample(out, f.name+"_count", f.labels, s.values, "", float64(count))
+	}
+}
+
+// writeSample writes one line; le is the histogram bucket bound, if any.
+func writeSample(out *bufio.Writer, name string, labels []string, values []string, le string, value float64) {
+	out.WriteString(name)
+
+	if len(labels) > 0 || le != "" {
+		out.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(label + `="` + labelEscaper.Replace(values[i]) + `"`)
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				out.WriteByte(',')
+			}
+			out.WriteString(`le="` + le + `"`)
+		}
+		out.WriteByte('}')
+	}
+
+	out.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,64 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var ErrUsage = errors.New("usage: migrate status | up | down | to <version>")
+
+// Run executes a migrate subcommand: status, up, down or to <version>.
+// args are the arguments following "migrate" on the command line.
+func Run(m *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+
+	switch args[0] {
+	case "status":
+		statuses, err := m.Status()
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if s.Modified {
+				state += " (modified)"
+			}
+			fmt.Fprintf(out, "%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+
+		return m.Verify()
+	case "up":
+		return report(out, m.Up)
+	case "down":
+		return report(out, m.Down)
+	case "to":
+		if len(args) != 2 {
+			return ErrUsage
+		}
+
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return ErrUsage
+		}
+
+		return report(out, func() (int, error) {
+			return m.To(version)
+		})
+	}
+
+	return ErrUsage
+}
+
+func report(out io.Writer, step func() (int, error)) error {
+	count, err := step()
+	fmt.Fprintf(out, "%d migration(s) run\n", count)
+	return err
+}
@@ -0,0 +1,378 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migration has been modified")
+
+	ErrUnknownMigration = errors.New("database has a migration this binary does not know")
+
+	ErrIrreversible = errors.New("migration has no down script")
+
+	ErrInvalidVersion = errors.New("no such migration version")
+
+	ErrPendingMigrations = errors.New("database has pending migrations")
+)
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one step of the schema, identified by its version number.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+
+	// Before, when set, runs in the migration's transaction ahead of Up,
+	// for steps SQL cannot express in every dialect, such as adding a column
+	// only if it is missing. It is code, so it is not part of the checksum.
+	Before func(tx *gorm.DB) error
+}
+
+// Checksum fingerprints both scripts so that editing a migration after it
+// has been applied is detected.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up + "\x00" + m.Down))
+	return hex.EncodeToString(sum[:])
+}
+
+// Status describes a migration and whether the database has it.
+type Status struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+	Modified  bool       `json:"modified"`
+}
+
+// SchemaMigration is the schema_migrations row recorded for an applied migration.
+type SchemaMigration struct {
+	Version   int    `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"not null"`
+	Checksum  string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Load reads migrations named <version>_<name>.up.sql and
+// <version>_<name>.down.sql from the root of fsys, ordered by version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+		}
+
+		script, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			m.Up = string(script)
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations, recording what has been
+// applied in the schema_migrations table. Each migration runs in its own
+// transaction.
+type Migrator struct {
+	DB         *gorm.DB
+	Migrations []Migration
+}
+
+func New(db *gorm.DB, migrations []Migration) *Migrator {
+	return &Migrator{
+		DB:         db,
+		Migrations: migrations,
+	}
+}
+
+func (m *Migrator) ensureTable() error {
+	return m.DB.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		checksum varchar(64) NOT NULL,
+		applied_at timestamp
+	)`).Error
+}
+
+func (m *Migrator) applied() (map[int]SchemaMigration, error) {
+	err := m.ensureTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []SchemaMigration
+	err = m.DB.Order("version").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]SchemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+// Status lists every known migration, oldest first.
+func (m *Migrator) Status() ([]Status, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		status := Status{Version: migration.Version, Name: migration.Name}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+			status.Modified = row.Checksum != migration.Checksum()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Current returns the highest applied version, or zero for an empty database.
+func (m *Migrator) Current() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	current := 0
+	for version := range applied {
+		current = max(current, version)
+	}
+
+	return current, nil
+}
+
+// Verify checks that every applied migration is known and unmodified.
+func (m *Migrator) Verify() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	known := make(map[int]Migration, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		known[migration.Version] = migration
+	}
+
+	for version, row := range applied {
+		migration, ok := known[version]
+		if !ok {
+			return fmt.Errorf("%w: %d_%s", ErrUnknownMigration, version, row.Name)
+		}
+		if row.Checksum != migration.Checksum() {
+			return fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, version, row.Name)
+		}
+	}
+
+	return nil
+}
+
+// CheckCurrent verifies the applied migrations and that none are pending,
+// meaning the schema is exactly the one this binary expects.
+func (m *Migrator) CheckCurrent() error {
+	err := m.Verify()
+	if err != nil {
+		return err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending++
+		}
+	}
+	if pending > 0 {
+		return fmt.Errorf("%w: %d not applied", ErrPendingMigrations, pending)
+	}
+
+	return nil
+}
+
+// Up applies every pending migration and returns how many ran.
+func (m *Migrator) Up() (int, error) {
+	if len(m.Migrations) == 0 {
+		return 0, nil
+	}
+
+	return m.To(m.Migrations[len(m.Migrations)-1].Version)
+}
+
+// Down rolls back the most recently applied migration.
+func (m *Migrator) Down() (int, error) {
+	current, err := m.Current()
+	if err != nil || current == 0 {
+		return 0, err
+	}
+
+	target := 0
+	for _, migration := range m.Migrations {
+		if migration.Version < current {
+			target = migration.Version
+		}
+	}
+
+	return m.To(target)
+}
+
+// To migrates up or down until exactly the migrations up to version are
+// applied, and returns how many ran. Version zero rolls everything back.
+func (m *Migrator) To(version int) (int, error) {
+	if version != 0 && !m.known(version) {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidVersion, version)
+	}
+
+	err := m.Verify()
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		migration := m.Migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+
+		err = m.rollback(migration)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	for _, migration := range m.Migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+
+		err = m.apply(migration)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (m *Migrator) known(version int) bool {
+	for _, migration := range m.Migrations {
+		if migration.Version == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *Migrator) apply(migration Migration) error {
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		if migration.Before != nil {
+			err := migration.Before(tx)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+			}
+		}
+
+		err := tx.Exec(migration.Up).Error
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		return tx.Create(&SchemaMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Checksum:  migration.Checksum(),
+			AppliedAt: time.Now(),
+		}).Error
+	})
+}
+
+func (m *Migrator) rollback(migration Migration) error {
+	if migration.Down == "" {
+		return fmt.Errorf("%w: %d_%s", ErrIrreversible, migration.Version, migration.Name)
+	}
+
+	return m.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec(migration.Down).Error
+		if err != nil {
+			return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+
+		return tx.Delete(&SchemaMigration{}, migration.Version).Error
+	})
+}
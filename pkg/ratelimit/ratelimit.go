@@ -0,0 +1,186 @@
+// Package ratelimit limits how often clients may call the API, with token
+// buckets kept in a Store. Requests are counted against the client address,
+// the signed-in user or an API key, under a default policy or one for the
+// route, and every response says where the client stands in RateLimit-*
+// headers.
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/logging"
+)
+
+// What requests are counted against.
+const (
+	KeyIP     = "ip"
+	KeyUser   = "user"
+	KeyAPIKey = "api_key"
+)
+
+var ErrTooManyRequests = apierror.TooManyRequests("rate_limited", "too many requests, slow down")
+
+// Policy is the limit for a set of requests and what they are counted
+// against.
+type Policy struct {
+	// Name keeps the buckets of different policies apart.
+	Name  string
+	Limit Limit
+	Key   string
+}
+
+// Limiter is the middleware state. Its policies can be replaced while it
+// serves requests, when the configuration is reloaded.
+type Limiter struct {
+	Store  Store
+	Logger *logging.Logger
+
+	// Clock tells the time buckets refill by; nil means time.Now.
+	Clock func() time.Time
+
+	mu           sync.RWMutex
+	enabled      bool
+	fallback     Policy
+	routes       map[string]Policy
+	apiKeyHeader string
+}
+
+// New returns a Limiter keeping its buckets in store, configured by cfg.
+func New(store Store, cfg config.RateLimitConfig) (*Limiter, error) {
+	l := &Limiter{Store: store}
+	err := l.Configure(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Configure replaces the limiter's policies with those of cfg. Buckets are
+// kept, so clients do not get a fresh allowance from a reload.
+func (l *Limiter) Configure(cfg config.RateLimitConfig) error {
+	parsed, err := cfg.ParseRoutes()
+	if err != nil {
+		return err
+	}
+
+	routes := make(map[string]Policy, len(parsed))
+	for _, route := range parsed {
+		name := route.Method + " " + route.Path
+		routes[name] = Policy{
+			Name:  name,
+			Limit: Limit{Rate: route.RequestsPerSecond, Burst: route.Burst},
+			Key:   route.Key,
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.enabled = cfg.Enabled
+	l.fallback = Policy{
+		Name:  "default",
+		Limit: Limit{Rate: cfg.RequestsPerSecond, Burst: cfg.Burst},
+		Key:   cfg.Key,
+	}
+	l.routes = routes
+	l.apiKeyHeader = cfg.APIKeyHeader
+	return nil
+}
+
+// Middleware counts each request under its policy and refuses those over
+// the limit with ErrTooManyRequests. To count requests against users it
+// must run after auth.AuthMiddleware; before it, they are counted against
+// the client address. If the store fails, requests are let through.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		policy, apiKeyHeader, ok := l.policy(c)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		key := policy.Name + "|" + subject(c, policy.Key, apiKeyHeader)
+		result, err := l.Store.Take(c.Request.Context(), key, policy.Limit, l.now())
+		if err != nil {
+			if l.Logger != nil {
+				l.Logger.WithContext(c.Request.Context()).Error("rate limit store failed", map[string]interface{}{
+					"error": err.Error(),
+				})
+			}
+			c.Next()
+			return
+		}
+
+		header := c.Writer.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(policy.Limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", strconv.FormatInt(seconds(result.Reset), 10))
+
+		if !result.Allowed {
+			apierror.Write(c, ErrTooManyRequests.WithRetryAfter(result.RetryAfter))
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// policy returns the policy for the request: the one for its route, if
+// any, or the default.
+func (l *Limiter) policy(c *gin.Context) (Policy, string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.enabled {
+		return Policy{}, "", false
+	}
+
+	route := c.FullPath()
+	for _, name := range []string{c.Request.Method + " " + route, "* " + route} {
+		if policy, ok := l.routes[name]; ok && route != "" {
+			return policy, l.apiKeyHeader, true
+		}
+	}
+
+	return l.fallback, l.apiKeyHeader, true
+}
+
+func (l *Limiter) now() time.Time {
+	if l.Clock != nil {
+		return l.Clock()
+	}
+
+	return time.Now()
+}
+
+// subject is who the request is counted against. Requests without a user
+// or an API key fall back to the client address.
+func subject(c *gin.Context, key string, apiKeyHeader string) string {
+	switch key {
+	case KeyUser:
+		if userID := c.GetString("user_id"); userID != "" {
+			return "user:" + userID
+		}
+	case KeyAPIKey:
+		if apiKey := c.GetHeader(apiKeyHeader); apiKey != "" {
+			// the key itself is a secret, and may end up in a shared store
+			sum := sha256.Sum256([]byte(apiKey))
+			return "api_key:" + hex.EncodeToString(sum[:16])
+		}
+	}
+
+	return "ip:" + c.ClientIP()
+}
+
+// seconds rounds d up to whole seconds, as the RateLimit headers count.
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
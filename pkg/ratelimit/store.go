@@ -0,0 +1,142 @@
+package ratelimit
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket: it holds up to Burst requests and refills at
+// Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Result is the outcome of taking a request from a bucket.
+type Result struct {
+	Allowed bool
+
+	// Remaining is how many more requests the bucket would allow now.
+	Remaining int
+
+	// RetryAfter is how long until the next request would be allowed; zero
+	// when one would be now.
+	RetryAfter time.Duration
+
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Store keeps the buckets. Take must be atomic per key, so that replicas
+// sharing a store also share their clients' limits.
+type Store interface {
+	// Take spends one request from the bucket for key at time now, if it
+	// has one, and reports what is left.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+// MemoryStore is a Store held in process memory, for a single replica. It
+// forgets buckets once they have refilled, and the least recently used ones
+// when it holds more than MaxKeys.
+type MemoryStore struct {
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	recent  *list.List
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+
+	// full is when the bucket will have refilled, after which it can be
+	// forgotten: a new bucket would be the same.
+	full time.Time
+}
+
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	return &MemoryStore{
+		MaxKeys: maxKeys,
+		buckets: map[string]*list.Element{},
+		recent:  list.New(),
+	}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evict(now)
+
+	var b *bucket
+	if element, ok := s.buckets[key]; ok {
+		b = element.Value.(*bucket)
+		s.recent.MoveToFront(element)
+	} else {
+		b = &bucket{key: key, tokens: float64(limit.Burst), updated: now}
+		s.buckets[key] = s.recent.PushFront(b)
+	}
+
+	b.tokens, b.updated = refill(b.tokens, b.updated, limit, now), now
+
+	result := Result{Allowed: b.tokens >= 1}
+	if result.Allowed {
+		b.tokens--
+	} else {
+		result.RetryAfter = wait(1-b.tokens, limit.Rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = wait(float64(limit.Burst)-b.tokens, limit.Rate)
+	b.full = now.Add(result.Reset)
+
+	return result, nil
+}
+
+// Len returns how many buckets the store holds.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.recent.Len()
+}
+
+// evict forgets buckets that have refilled by now, oldest first, and the
+// least recently used ones beyond MaxKeys.
+func (s *MemoryStore) evict(now time.Time) {
+	for s.recent.Len() > 0 {
+		oldest := s.recent.Back()
+		b := oldest.Value.(*bucket)
+		if s.recent.Len() < s.MaxKeys || s.MaxKeys <= 0 {
+			if b.full.After(now) {
+				return
+			}
+		}
+
+		s.recent.Remove(oldest)
+		delete(s.buckets, b.key)
+	}
+}
+
+// refill adds the tokens earned since updated, up to the burst.
+func refill(tokens float64, updated time.Time, limit Limit, now time.Time) float64 {
+	elapsed := now.Sub(updated).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	return math.Min(float64(limit.Burst), tokens+elapsed*limit.Rate)
+}
+
+// wait is how long it takes to earn tokens at rate.
+func wait(tokens float64, rate float64) time.Duration {
+	if tokens <= 0 || rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(math.Ceil(tokens / rate * float64(time.Second)))
+}
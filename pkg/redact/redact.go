@@ -0,0 +1,247 @@
+package redact
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Mask replaces a value that must not be written out.
+const Mask = "[REDACTED]"
+
+// Values of the redact struct tag. A secret field, such as a password hash,
+// is always masked; a PII field, such as an email address, is partially
+// masked so logs stay useful for support without identifying anyone.
+const (
+	Secret = "secret"
+	PII    = "pii"
+)
+
+var (
+	bearerToken = regexp.MustCompile(`(?i)\b(bearer|basic)\s+[A-Za-z0-9._~+/=-]+`)
+	jwt         = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	email       = regexp.MustCompile(`[A-Za-z0-9._%+-]+@([A-Za-z0-9-]+\.)+[A-Za-z]{2,}`)
+)
+
+// secretKeys are the parts of a field name that mark its value as secret.
+var secretKeys = []string{"password", "passwd", "secret", "token", "authorization", "cookie", "apikey", "privatekey"}
+
+// sensitiveHeaders are masked wherever an http.Header is logged.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// String masks bearer and basic credentials, JWTs and email addresses
+// wherever they appear in s.
+func String(s string) string {
+	s = bearerToken.ReplaceAllString(s, "$1 "+Mask)
+	s = jwt.ReplaceAllString(s, Mask)
+	return email.ReplaceAllStringFunc(s, Email)
+}
+
+// Email keeps the first character and the domain of an address, so
+// "jane@example.com" becomes "j***@example.com".
+func Email(address string) string {
+	at := strings.LastIndex(address, "@")
+	if at < 1 {
+		return Mask
+	}
+
+	return address[:1] + "***" + address[at:]
+}
+
+// SecretKey reports whether a field named key holds a secret, such as
+// "password", "refresh_token" or "Authorization". Names ending in "id",
+// such as "token_id", identify a secret without revealing it.
+func SecretKey(key string) bool {
+	normalized := strings.NewReplacer("_", "", "-", "", " ", "").Replace(strings.ToLower(key))
+	if strings.HasSuffix(normalized, "id") {
+		return false
+	}
+
+	for _, secret := range secretKeys {
+		if strings.Contains(normalized, secret) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Fields returns a copy of fields safe to log: values under secret keys are
+// masked, email fields are partially masked, and other values go through
+// Value.
+func Fields(fields map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		redacted[key] = Field(key, value)
+	}
+
+	return redacted
+}
+
+// Field redacts one value logged under key.
+func Field(key string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if SecretKey(key) {
+		return Mask
+	}
+	if address, ok := value.(string); ok && strings.Contains(strings.ToLower(key), "email") {
+		return Email(address)
+	}
+
+	return Value(value)
+}
+
+// Value returns v with its sensitive parts masked. Strings are passed
+// through String, header values through their names, and structs with
+// redact tags are converted to maps keyed by their JSON names with the
+// tagged fields masked. Anything else is returned unchanged.
+func Value(v interface{}) interface{} {
+	switch typed := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return String(typed)
+	case error:
+		return String(typed.Error())
+	case http.Header:
+		return header(typed)
+	case map[string]interface{}:
+		return Fields(typed)
+	}
+
+	rv := reflect.ValueOf(v)
+	if !tagged(rv.Type()) {
+		return v
+	}
+
+	return value(rv)
+}
+
+func header(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range sensitiveHeaders {
+		if values, ok := redacted[name]; ok {
+			for i := range values {
+				values[i] = Mask
+			}
+		}
+	}
+
+	for name, values := range redacted {
+		for i := range values {
+			values[i] = String(values[i])
+		}
+		redacted[name] = values
+	}
+
+	return redacted
+}
+
+// value converts rv, whose type has redact tags somewhere within it.
+func value(rv reflect.Value) interface{} {
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return value(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return nil
+		}
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = value(rv.Index(i))
+		}
+		return items
+	case reflect.Struct:
+		if !tagged(rv.Type()) {
+			return rv.Interface()
+		}
+		return structValue(rv)
+	default:
+		return rv.Interface()
+	}
+}
+
+func structValue(rv reflect.Value) map[string]interface{} {
+	t := rv.Type()
+	fields := make(map[string]interface{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, ok := field.Tag.Lookup("json"); ok {
+			tagName, _, _ := strings.Cut(tag, ",")
+			if tagName == "-" {
+				continue
+			}
+			if tagName != "" {
+				name = tagName
+			}
+		}
+
+		fv := rv.Field(i)
+		switch field.Tag.Get("redact") {
+		case Secret:
+			fields[name] = Mask
+		case PII:
+			if s, ok := fv.Interface().(string); ok && strings.Contains(s, "@") {
+				fields[name] = Email(s)
+			} else {
+				fields[name] = Mask
+			}
+		default:
+			fields[name] = value(fv)
+		}
+	}
+
+	return fields
+}
+
+var taggedTypes sync.Map
+
+// tagged reports whether t, or a type it contains, has redact tags.
+func tagged(t reflect.Type) bool {
+	if cached, ok := taggedTypes.Load(t); ok {
+		return cached.(bool)
+	}
+
+	result := hasTags(t, map[reflect.Type]bool{})
+	taggedTypes.Store(t, result)
+
+	return result
+}
+
+// hasTags walks t, skipping types already being visited so recursive
+// types such as a user's collaborations' users terminate.
+func hasTags(t reflect.Type, visiting map[reflect.Type]bool) bool {
+	if visiting[t] {
+		return false
+	}
+	visiting[t] = true
+
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return hasTags(t.Elem(), visiting)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			if field.Tag.Get("redact") != "" || hasTags(field.Type, visiting) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
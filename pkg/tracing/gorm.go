@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "tracing:span"
+
+// GormPlugin records a span for each database operation run with a traced
+// context, as in db.WithContext(ctx). Install it with db.Use.
+type GormPlugin struct {
+	tracer trace.Tracer
+}
+
+func NewGormPlugin() *GormPlugin {
+	return &GormPlugin{tracer: otel.Tracer(instrumentation)}
+}
+
+func (p *GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (p *GormPlugin) Initialize(db *gorm.DB) error {
+	callbacks := db.Callback()
+	return errors.Join(
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", p.start("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", p.end),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", p.start("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", p.end),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", p.start("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", p.end),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", p.start("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", p.end),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", p.start("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", p.end),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", p.start("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", p.end),
+	)
+}
+
+func (p *GormPlugin) start(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx, span := Start(db.Statement.Context, p.tracer, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", db.Dialector.Name()),
+				attribute.String("db.operation", operation),
+			),
+		)
+		if !span.IsRecording() {
+			return
+		}
+
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func (p *GormPlugin) end(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		attribute.String("db.sql.table", db.Statement.Table),
+		attribute.String("db.statement", db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.Statement.RowsAffected),
+	)
+	if !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		Fail(span, db.Error)
+	}
+}
@@ -0,0 +1,104 @@
+package tracing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for each request, continuing the trace
+// named by an incoming traceparent header, and puts it in the request
+// context for handlers and services to build on. Spans are named by route
+// template so requests for different records group together.
+func Middleware() gin.HandlerFunc {
+	tracer := otel.Tracer(instrumentation)
+
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", c.Request.Method),
+				attribute.String("http.route", route),
+				attribute.String("http.target", c.Request.URL.Path),
+			),
+		)
+		defer span.End()
+		if requestID := logging.RequestID(ctx); requestID != "" {
+			span.SetAttributes(attribute.String("http.request_id", requestID))
+		}
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, strconv.Itoa(status)+" "+http.StatusText(status))
+		}
+		for _, err := range c.Errors {
+			span.RecordError(err.Err)
+		}
+	}
+}
+
+// Transport wraps base, http.DefaultTransport if nil, so that requests
+// made with a traced context get a client span and carry its traceparent
+// to the service they call, along with the X-Request-ID of the request
+// being served.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &transport{base: base, tracer: otel.Tracer(instrumentation)}
+}
+
+type transport struct {
+	base   http.RoundTripper
+	tracer trace.Tracer
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := Start(req.Context(), t.tracer, "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", req.Method),
+			attribute.String("http.url", req.URL.Redacted()),
+		),
+	)
+	defer span.End()
+
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if requestID := logging.RequestID(ctx); requestID != "" && req.Header.Get("X-Request-ID") == "" {
+		req.Header.Set("X-Request-ID", requestID)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		Fail(span, err)
+		return nil, err
+	}
+
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,137 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+
+	"github.com/similadayo/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation names the tracer used by this package's middleware,
+// transport and gorm plugin.
+const instrumentation = "github.com/similadayo/pkg/tracing"
+
+// Setup installs the W3C traceparent propagator and, unless the exporter
+// is none, a tracer provider that exports the service's spans. The
+// returned function flushes buffered spans and releases the exporter.
+func Setup(ctx context.Context, cfg config.TracingConfig, service string) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var closeOutput func() error
+	switch cfg.Exporter {
+	case "none":
+		return func(ctx context.Context) error { return nil }, nil
+	case "stdout":
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+		exporter = stdout
+	case "file":
+		file, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		exporter = stdout
+		closeOutput = file.Close
+	case "otlp":
+		otlp, err := otlpExporter(ctx, cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		exporter = otlp
+	default:
+		return nil, errors.New("tracing exporter must be none, stdout, file or otlp")
+	}
+
+	provider := NewProvider(exporter, service, cfg.SampleRatio)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeOutput != nil {
+			err = errors.Join(err, closeOutput())
+		}
+		return err
+	}, nil
+}
+
+// NewProvider returns a tracer provider that batches spans to exporter,
+// sampling ratio of new traces and following the caller's decision for
+// traces that arrive with a traceparent.
+func NewProvider(exporter sdktrace.SpanExporter, service string, ratio float64) *sdktrace.TracerProvider {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", service),
+	))
+	if err != nil {
+		res = resource.Default()
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+}
+
+func otlpExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return otlptracehttp.New(ctx, opts...)
+}
+
+// Start begins a span named name as a child of the span in ctx. Without
+// one it starts nothing and returns a no-op span, so work done outside a
+// traced request, such as background jobs, does not produce stray traces.
+func Start(ctx context.Context, tracer trace.Tracer, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	return tracer.Start(ctx, name, opts...)
+}
+
+// Fail marks span as failed with err, if there is one.
+func Fail(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
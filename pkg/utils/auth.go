@@ -1,50 +1,192 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"os"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
 )
 
-var secretKey = []byte(os.Getenv("SECRET_KEY"))
+var secretKey []byte
+
+var (
+	// AccessTokenTTL is how long an access token stays valid after issue.
+	AccessTokenTTL = 15 * time.Minute
+
+	// RefreshTokenTTL is how long a refresh token can be exchanged for a new pair.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// RevocationChecker reports whether the access token with the given jti has been revoked.
+type RevocationChecker interface {
+	IsTokenRevoked(jti string) (bool, error)
+}
+
+var revocationChecker RevocationChecker
+
+var (
+	signingKeys      *KeyRing
+	verificationKeys KeySource
+)
+
+// SetSecretKey sets the shared secret used for HS256 tokens while no key ring is configured.
+func SetSecretKey(secret string) {
+	secretKey = []byte(secret)
+}
+
+// SetKeyRing switches token signing from the shared HS256 secret to the
+// ring's active asymmetric key. The ring is also used to verify tokens.
+func SetKeyRing(ring *KeyRing) {
+	signingKeys = ring
+	verificationKeys = nil
+	if ring != nil {
+		verificationKeys = ring
+	}
+}
+
+// SetKeySource configures verification against public keys only, for
+// services that accept tokens but do not issue them.
+func SetKeySource(source KeySource) {
+	verificationKeys = source
+}
+
+// SetRevocationChecker installs the store consulted by ValidateToken.
+func SetRevocationChecker(checker RevocationChecker) {
+	revocationChecker = checker
+}
 
 type Claims struct {
 	UserID   string `json:"user_id"`
 	UserName string `json:"user_name"`
+
+	// Unverified marks tokens of users who have not verified their email
+	// address. Tokens issued without it belong to verified users.
+	Unverified bool `json:"unverified,omitempty"`
+
 	jwt.StandardClaims
 }
 
 func GenerateToken(userID string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, Claims{
-		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
-		},
-	})
-
-	tokenString, err := token.SignedString(secretKey)
+	tokenString, _, err := GenerateAccessToken(userID)
+	return tokenString, err
+}
+
+// GenerateAccessToken issues a short-lived access token and returns it with its claims.
+func GenerateAccessToken(userID string) (string, *Claims, error) {
+	return IssueAccessToken(&Claims{UserID: userID})
+}
+
+// IssueAccessToken fills in the registered claims of claims for its user,
+// signs it and returns the token with the completed claims.
+func IssueAccessToken(claims *Claims) (string, *Claims, error) {
+	now := time.Now()
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        uuid.New().String(),
+		Subject:   claims.UserID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+	}
+
+	tokenString, err := signToken(claims)
 	if err != nil {
+		return "", nil, err
+	}
+
+	return tokenString, claims, nil
+}
+
+// GenerateRefreshToken returns an opaque random refresh token.
+func GenerateRefreshToken() (string, error) {
+	return GenerateOpaqueToken()
+}
+
+// GenerateOpaqueToken returns 256 random bits, URL-safe encoded, for tokens
+// that are stored only as their HashToken.
+func GenerateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex-encoded SHA-256 of a token so it can be stored without the raw value.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func signToken(claims *Claims) (string, error) {
+	if signingKeys == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretKey)
+	}
+
+	key := signingKeys.Active()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
+}
+
+// resolveKey picks the verification key for a parsed token. Once asymmetric
+// keys are configured HS256 tokens are rejected, so a leaked shared secret
+// cannot be used to mint tokens.
+func resolveKey(token *jwt.Token) (interface{}, error) {
+	if verificationKeys == nil {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.New("unexpected signing method")
+		}
+		return secretKey, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+
+	key, err := verificationKeys.VerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Method.Alg() != key.Algorithm {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	return key.Key, nil
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
 	//parse token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return secretKey, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, resolveKey)
 	if err != nil {
 		return nil, err
 	}
 
 	//validate token
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+
+	//check revocation
+	if revocationChecker != nil && claims.Id != "" {
+		revoked, err := revocationChecker.IsTokenRevoked(claims.Id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
 	}
 
-	return nil, errors.New("invalid token")
+	return claims, nil
 }
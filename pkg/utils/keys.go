@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+
+	rsaKeyBits = 2048
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown signing key")
+
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+)
+
+// VerificationKey is a public key that tokens carrying its kid are checked against.
+type VerificationKey struct {
+	ID        string
+	Algorithm string
+	Key       crypto.PublicKey
+}
+
+// KeySource resolves the public key for a token's kid header.
+type KeySource interface {
+	VerificationKey(kid string) (VerificationKey, error)
+}
+
+// SigningKey is a private key held by the key ring.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Created   time.Time
+	Retired   time.Time
+}
+
+func (k *SigningKey) verificationKey() VerificationKey {
+	return VerificationKey{
+		ID:        k.ID,
+		Algorithm: k.Algorithm,
+		Key:       k.Private.Public(),
+	}
+}
+
+// KeyRing holds the active signing key plus the keys it replaced. Retired keys
+// remain available for verification until every token they signed has expired.
+type KeyRing struct {
+	mu        sync.RWMutex
+	algorithm string
+	dir       string
+	retention time.Duration
+	active    *SigningKey
+	previous  []*SigningKey
+}
+
+// NewKeyRing creates a key ring for the given algorithm. When dir is not empty
+// keys are persisted there as PKCS#8 PEM files named after their kid, and any
+// keys already present are loaded, the newest becoming the active key.
+func NewKeyRing(algorithm string, dir string) (*KeyRing, error) {
+	if algorithm != AlgorithmRS256 && algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+
+	ring := &KeyRing{
+		algorithm: algorithm,
+		dir:       dir,
+		retention: AccessTokenTTL,
+	}
+
+	if dir != "" {
+		err := ring.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ring.active == nil {
+		err := ring.Rotate()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ring, nil
+}
+
+// Active returns the key new tokens are signed with.
+func (r *KeyRing) Active() *SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.active
+}
+
+// VerificationKey implements KeySource.
+func (r *KeyRing) VerificationKey(kid string) (VerificationKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, key := range r.keys() {
+		if key.ID == kid {
+			return key.verificationKey(), nil
+		}
+	}
+
+	return VerificationKey{}, ErrUnknownKey
+}
+
+// VerificationKeys returns the public half of every key that may still verify a token.
+func (r *KeyRing) VerificationKeys() []VerificationKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var keys []VerificationKey
+	for _, key := range r.keys() {
+		keys = append(keys, key.verificationKey())
+	}
+
+	return keys
+}
+
+func (r *KeyRing) keys() []*SigningKey {
+	keys := make([]*SigningKey, 0, len(r.previous)+1)
+	if r.active != nil {
+		keys = append(keys, r.active)
+	}
+
+	return append(keys, r.previous...)
+}
+
+// Rotate generates a new active key, retires the current one and drops
+// retired keys whose tokens can no longer be valid.
+func (r *KeyRing) Rotate() error {
+	key, err := generateSigningKey(r.algorithm)
+	if err != nil {
+		return err
+	}
+
+	if r.dir != "" {
+		err = writeSigningKey(r.dir, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.active != nil {
+		r.active.Retired = key.Created
+		r.previous = append([]*SigningKey{r.active}, r.previous...)
+	}
+	r.active = key
+
+	r.prune(key.Created)
+
+	return nil
+}
+
+func (r *KeyRing) prune(now time.Time) {
+	kept := r.previous[:0]
+	for _, key := range r.previous {
+		if now.Sub(key.Retired) <= r.retention {
+			kept = append(kept, key)
+			continue
+		}
+
+		if r.dir != "" {
+			os.Remove(filepath.Join(r.dir, key.ID+".pem"))
+		}
+	}
+	r.previous = kept
+}
+
+// StartRotation rotates the key ring every interval until stop is closed.
+func (r *KeyRing) StartRotation(interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := r.Rotate()
+				if err != nil && onError != nil {
+					onError(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *KeyRing) load() error {
+	err := os.MkdirAll(r.dir, 0o700)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	var keys []*SigningKey
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+
+		key, err := readSigningKey(filepath.Join(r.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if key.Algorithm != r.algorithm {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+
+	for i := 1; i < len(keys); i++ {
+		keys[i].Retired = keys[i-1].Created
+	}
+
+	r.active = keys[0]
+	r.previous = keys[1:]
+	r.prune(time.Now())
+
+	return nil
+}
+
+func generateSigningKey(algorithm string) (*SigningKey, error) {
+	var (
+		private crypto.Signer
+		err     error
+	)
+
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:        uuid.New().String(),
+		Algorithm: algorithm,
+		Private:   private,
+		Created:   time.Now(),
+	}, nil
+}
+
+func writeSigningKey(dir string, key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	path := filepath.Join(dir, key.ID+".pem")
+
+	err = os.WriteFile(path, data, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, key.Created, key.Created)
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{
+		ID:      strings.TrimSuffix(filepath.Base(path), ".pem"),
+		Created: info.ModTime(),
+	}
+
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = AlgorithmRS256
+		key.Private = private
+	case ed25519.PrivateKey:
+		key.Algorithm = AlgorithmEdDSA
+		key.Private = private
+	default:
+		return nil, fmt.Errorf("%s: %w", path, ErrUnsupportedAlgorithm)
+	}
+
+	return key, nil
+}
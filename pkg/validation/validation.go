@@ -0,0 +1,137 @@
+package validation
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/similadayo/pkg/apierror"
+)
+
+// Rules added to the binding tags understood by gin's validator.
+const (
+	// Username accepts 3 to 32 letters, digits, dots, dashes and
+	// underscores, starting with a letter or digit.
+	Username = "username"
+
+	// NotReserved rejects names kept for the service itself, such as
+	// "admin", in any case.
+	NotReserved = "notreserved"
+
+	// HTTPURL accepts absolute http and https URLs.
+	HTTPURL = "httpurl"
+)
+
+var username = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{2,31}$`)
+
+// reserved are names no user may register, as they could be mistaken for
+// the service or its staff.
+var reserved = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "system": true,
+	"support": true, "help": true, "security": true, "moderator": true,
+	"api": true, "auth": true, "me": true, "anonymous": true,
+	"null": true, "undefined": true,
+}
+
+// Normalizer is implemented by requests that tidy their fields, such as
+// trimming names or lower-casing email addresses, before they are validated.
+type Normalizer interface {
+	Normalize()
+}
+
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+
+	if err := Register(v); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds this package's rules to v and makes it report fields by
+// their JSON names. It is done for gin's validator when the package is
+// loaded.
+func Register(v *validator.Validate) error {
+	v.RegisterTagNameFunc(jsonName)
+
+	for tag, fn := range map[string]validator.Func{
+		Username:    validUsername,
+		NotReserved: notReserved,
+		HTTPURL:     validHTTPURL,
+	} {
+		if err := v.RegisterValidation(tag, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// BindJSON decodes the request body into req, normalizes it and checks its
+// binding tags. The error, if any, is an *apierror.Error listing every
+// field that failed.
+func BindJSON(c *gin.Context, req interface{}) error {
+	err := json.NewDecoder(c.Request.Body).Decode(req)
+	if err != nil {
+		return apierror.Bind(err)
+	}
+
+	return Struct(req)
+}
+
+// Struct normalizes req and checks its binding tags.
+func Struct(req interface{}) error {
+	if n, ok := req.(Normalizer); ok {
+		n.Normalize()
+	}
+
+	err := binding.Validator.ValidateStruct(req)
+	if err != nil {
+		return apierror.Bind(err)
+	}
+
+	return nil
+}
+
+// NormalizeEmail trims an address and lower-cases it, so the same mailbox
+// is stored and looked up under one spelling. The users table's unique
+// index on lower(email) is what keeps it from being registered twice.
+func NormalizeEmail(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+
+	return name
+}
+
+func validUsername(fl validator.FieldLevel) bool {
+	return username.MatchString(fl.Field().String())
+}
+
+func notReserved(fl validator.FieldLevel) bool {
+	return !reserved[strings.ToLower(fl.Field().String())]
+}
+
+func validHTTPURL(fl validator.FieldLevel) bool {
+	u, err := url.Parse(fl.Field().String())
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,179 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestAPIErrorFrom(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"missing record", gorm.ErrRecordNotFound, http.StatusNotFound, apierror.CodeNotFound},
+		{"unique constraint", fmt.Errorf("insert: %w", gorm.ErrDuplicatedKey), http.StatusConflict, apierror.CodeConflict},
+		{"wrapped sentinel", fmt.Errorf("lookup: %w", user.ErrUserNotFound), http.StatusNotFound, "user_not_found"},
+		{"registered sentinel", fmt.Errorf("apply: %w", ot.ErrRevisionConflict), http.StatusConflict, "revision_conflict"},
+		{"domain error", collaboration.ErrLastOwner, http.StatusConflict, "last_owner"},
+		{"unknown error", errors.New("connection refused"), http.StatusInternalServerError, apierror.CodeInternal},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			apiErr := apierror.From(tc.err)
+			assert.Equal(t, tc.status, apiErr.Status)
+			assert.Equal(t, tc.code, apiErr.Code)
+		})
+	}
+
+	// copies made from a sentinel still match it
+	assert.ErrorIs(t, user.ErrWeakPassword.WithMessage("too short"), user.ErrWeakPassword)
+	assert.NotErrorIs(t, user.ErrWeakPassword, user.ErrInvalidPassword)
+}
+
+func TestAPIErrorDuplicateKey(t *testing.T) {
+	repo := user.NewSQLRepository(newMigratedTestDB(t))
+	u := user.User{ID: uuid.New().String(), UserName: "ada"}
+
+	_, err := repo.Register(u)
+	require.NoError(t, err)
+
+	_, err = repo.Register(u)
+	assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+	assert.Equal(t, http.StatusConflict, apierror.From(err).Status)
+}
+
+func decodeProblem(t *testing.T, resp *httptest.ResponseRecorder) apierror.Problem {
+	assert.Equal(t, apierror.ContentType, resp.Header().Get("Content-Type"))
+
+	var problem apierror.Problem
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &problem))
+	assert.Equal(t, resp.Code, problem.Status)
+	return problem
+}
+
+func TestAPIErrorMiddleware(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger()
+	logger.SetOutput(&out)
+
+	type itemRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+
+	r := gin.New()
+	r.Use(auth.RequestIDMiddleware(), apierror.Middleware(logger))
+	r.POST("/items", func(c *gin.Context) {
+		var req itemRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(apierror.Bind(err))
+			return
+		}
+		c.Error(errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	})
+	r.GET("/items/:id", func(c *gin.Context) {
+		c.Error(user.ErrUserNotFound)
+	})
+	r.GET("/written", func(c *gin.Context) {
+		c.Error(errors.New("already answered"))
+		c.String(http.StatusAccepted, "accepted")
+	})
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(auth.RequestIDHeader, "req-1")
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("domain error", func(t *testing.T) {
+		resp := do(http.MethodGet, "/items/1", "")
+		require.Equal(t, http.StatusNotFound, resp.Code)
+
+		problem := decodeProblem(t, resp)
+		assert.Equal(t, "about:blank", problem.Type)
+		assert.Equal(t, "Not Found", problem.Title)
+		assert.Equal(t, "user_not_found", problem.Code)
+		assert.Equal(t, "user not found", problem.Detail)
+		assert.Equal(t, "/items/1", problem.Instance)
+		assert.Equal(t, "req-1", problem.RequestID)
+	})
+
+	t.Run("validation", func(t *testing.T) {
+		resp := do(http.MethodPost, "/items", `{}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+
+		problem := decodeProblem(t, resp)
+		assert.Equal(t, apierror.CodeValidationFailed, problem.Code)
+		require.Len(t, problem.Errors, 1)
+		assert.Equal(t, "name", problem.Errors[0].Field)
+		assert.Equal(t, "required", problem.Errors[0].Rule)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		resp := do(http.MethodPost, "/items", `{"name":`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, apierror.CodeMalformedRequest, decodeProblem(t, resp).Code)
+	})
+
+	t.Run("internal error", func(t *testing.T) {
+		out.Reset()
+		resp := do(http.MethodPost, "/items", `{"name":"x"}`)
+		require.Equal(t, http.StatusInternalServerError, resp.Code)
+
+		problem := decodeProblem(t, resp)
+		assert.Equal(t, apierror.CodeInternal, problem.Code)
+		assert.NotContains(t, resp.Body.String(), "10.0.0.5")
+
+		// the cause is logged instead, against the request
+		assert.Contains(t, out.String(), "10.0.0.5")
+		assert.Contains(t, out.String(), `"request_id":"req-1"`)
+	})
+
+	t.Run("response already written", func(t *testing.T) {
+		resp := do(http.MethodGet, "/written", "")
+		assert.Equal(t, http.StatusAccepted, resp.Code)
+		assert.Equal(t, "accepted", resp.Body.String())
+	})
+}
+
+func TestLoginErrors(t *testing.T) {
+	repo := user.NewMemoryRepository()
+	service := user.NewService(repo, logging.NewLogger())
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// an unknown user and a wrong password are indistinguishable
+	_, err = service.AuthenticateUser("nobody", "Passw0rd!")
+	assert.ErrorIs(t, err, user.ErrInvalidPassword)
+	_, err = service.AuthenticateUser("ada", "wrong")
+	assert.ErrorIs(t, err, user.ErrInvalidPassword)
+
+	_, err = service.CreateUser("weak", "short", "", "", "", "")
+	assert.ErrorIs(t, err, user.ErrWeakPassword)
+	assert.Equal(t, http.StatusBadRequest, apierror.From(err).Status)
+
+	_, err = service.GetUserByID("missing")
+	assert.ErrorIs(t, err, user.ErrUserNotFound)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
@@ -0,0 +1,338 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/crdt"
+	"github.com/similadayo/internal/textdiff"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCollaborationTestRouter(t *testing.T, userIDs ...string) *gin.Engine {
+	db := newMigratedTestDB(t)
+
+	for _, id := range userIDs {
+		err := db.Create(&user.User{ID: id, UserName: id, Created: time.Now(), Updated: time.Now()}).Error
+		assert.NoError(t, err)
+	}
+
+	collabHandler := collaboration.NewHandler(collaboration.NewService(collaboration.NewSQLRepository(db)))
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.Use(func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-Test-User"))
+		c.Next()
+	})
+	r.POST("/api/collaborations", collabHandler.CreateCollaborationHandler)
+	r.GET("/api/collaborations", collabHandler.GetMyCollaborationsHandler)
+	r.GET("/api/collaborations/:id", collabHandler.GetCollaborationByIDHandler)
+	r.POST("/api/collaborations/:id/users", collabHandler.InviteUserHandler)
+	r.PUT("/api/collaborations/:id/users/:userId", collabHandler.ChangeRoleHandler)
+	r.DELETE("/api/collaborations/:id/users/:userId", collabHandler.RemoveUserHandler)
+	r.POST("/api/collaborations/:id/transfer", collabHandler.TransferOwnershipHandler)
+	r.POST("/api/collaborations/:id/documents", collabHandler.CreateDocumentHandler)
+	r.PUT("/api/collaborations/:id/documents/:documentId", collabHandler.UpdateDocumentHandler)
+	r.GET("/api/collaborations/:id/documents/:documentId/versions", collabHandler.ListDocumentVersionsHandler)
+	r.GET("/api/collaborations/:id/documents/:documentId/versions/:version", collabHandler.GetDocumentVersionHandler)
+	r.POST("/api/collaborations/:id/documents/:documentId/versions/:version/restore", collabHandler.RestoreDocumentVersionHandler)
+	r.GET("/api/collaborations/:id/documents/:documentId/diff", collabHandler.DiffDocumentVersionsHandler)
+	r.POST("/api/collaborations/:id/crdt-documents", collabHandler.CreateCRDTDocumentHandler)
+	r.GET("/api/collaborations/:id/crdt-documents/:documentId", collabHandler.GetCRDTDocumentHandler)
+	r.POST("/api/collaborations/:id/crdt-documents/:documentId/sync", collabHandler.SyncCRDTDocumentHandler)
+
+	return r
+}
+
+func doCollaborationRequest(r *gin.Engine, method, path, userID, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-Test-User", userID)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestCollaborationHandlers(t *testing.T) {
+	r := newCollaborationTestRouter(t, "alice", "bob", "carol")
+
+	resp := doCollaborationRequest(r, "POST", "/api/collaborations", "alice", `{"projectId": 7, "name": "design"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var created struct {
+		Data user.Collaboration `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	assert.Equal(t, "alice", created.Data.CreatedBy)
+	assert.Len(t, created.Data.Users, 1)
+
+	path := "/api/collaborations/" + created.Data.ID
+
+	t.Run("invite and list", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/users", "alice", `{"userId": "bob"}`)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+
+		resp = doCollaborationRequest(r, "GET", "/api/collaborations", "bob", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), created.Data.ID)
+	})
+
+	t.Run("create document", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/documents", "alice", `{"name": "notes", "title": "Notes"}`)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var document struct {
+			Data user.Document `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &document))
+
+		resp = doCollaborationRequest(r, "GET", path, "alice", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"name":"notes"`)
+
+		resp = doCollaborationRequest(r, "PUT", path+"/documents/"+document.Data.ID, "alice", `{"title": "Notes", "content": "draft"}`)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &document))
+		assert.Equal(t, "draft", document.Data.Content)
+		assert.Equal(t, 1, document.Data.Revision)
+	})
+
+	t.Run("version history", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/documents", "alice", `{"name": "history", "content": "one\ntwo\n"}`)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var document struct {
+			Data user.Document `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &document))
+		docPath := path + "/documents/" + document.Data.ID
+
+		resp = doCollaborationRequest(r, "PUT", docPath, "alice", `{"content": "one\nthree\n"}`)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		resp = doCollaborationRequest(r, "PUT", docPath, "bob", `{"content": "one\nthree\nfour\n"}`)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var versions struct {
+			Data []user.DocumentVersion `json:"data"`
+		}
+		resp = doCollaborationRequest(r, "GET", docPath+"/versions", "bob", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &versions))
+		assert.Len(t, versions.Data, 3)
+		assert.Equal(t, 3, versions.Data[0].Number)
+		assert.Equal(t, "bob", versions.Data[0].AuthorID)
+		assert.Equal(t, versions.Data[1].ID, versions.Data[0].ParentID)
+
+		var version struct {
+			Data collaboration.DocumentVersionDetail `json:"data"`
+		}
+		resp = doCollaborationRequest(r, "GET", docPath+"/versions/2", "bob", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &version))
+		assert.Equal(t, "one\nthree\n", version.Data.Content)
+
+		var diff struct {
+			Data collaboration.VersionDiff `json:"data"`
+		}
+		resp = doCollaborationRequest(r, "GET", docPath+"/diff?from=1&to=3", "bob", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &diff))
+		assert.Equal(t, []textdiff.Edit{
+			{Op: textdiff.OpEqual, Text: "one\n"},
+			{Op: textdiff.OpDelete, Text: "two\n"},
+			{Op: textdiff.OpInsert, Text: "three\nfour\n"},
+		}, diff.Data.Edits)
+
+		resp = doCollaborationRequest(r, "GET", docPath+"/diff?from=1&to=3&mode=word", "bob", "")
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+		resp = doCollaborationRequest(r, "POST", docPath+"/versions/1/restore", "bob", "")
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"number":4`)
+		assert.Contains(t, resp.Body.String(), `"restoredFrom":1`)
+
+		resp = doCollaborationRequest(r, "GET", docPath+"/versions/4", "bob", "")
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &version))
+		assert.Equal(t, "one\ntwo\n", version.Data.Content)
+
+		resp = doCollaborationRequest(r, "GET", docPath+"/versions/9", "bob", "")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("crdt sync over http", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/crdt-documents", "alice", `{"name": "offline"}`)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var document struct {
+			Data user.CRDTDocument `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &document))
+		syncPath := path + "/crdt-documents/" + document.Data.ID + "/sync"
+
+		aliceDoc := crdt.NewDoc(1)
+		update, err := aliceDoc.Insert(0, "written offline")
+		assert.NoError(t, err)
+
+		body, _ := json.Marshal(collaboration.SyncCRDTRequest{StateVector: aliceDoc.StateVector(), Update: update})
+		resp = doCollaborationRequest(r, "POST", syncPath, "alice", string(body))
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		bobDoc := crdt.NewDoc(2)
+		body, _ = json.Marshal(collaboration.SyncCRDTRequest{StateVector: bobDoc.StateVector()})
+		resp = doCollaborationRequest(r, "POST", syncPath, "bob", string(body))
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var result struct {
+			Data collaboration.CRDTSyncResult `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &result))
+		assert.NoError(t, bobDoc.ApplyUpdate(result.Data.Update))
+		assert.Equal(t, "written offline", bobDoc.String())
+
+		resp = doCollaborationRequest(r, "GET", path+"/crdt-documents/"+document.Data.ID, "bob", "")
+		assert.Contains(t, resp.Body.String(), `"content":"written offline"`)
+	})
+
+	t.Run("crdt update with invalid clock", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/crdt-documents", "alice", `{"name": "forged"}`)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		var document struct {
+			Data user.CRDTDocument `json:"data"`
+		}
+		assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &document))
+		syncPath := path + "/crdt-documents/" + document.Data.ID + "/sync"
+
+		invalid := crdt.EncodeUpdate([]crdt.Op{
+			{Kind: 1, ID: crdt.ID{Client: 42, Seq: 1}, Clock: 5, Value: 'a'},
+			{Kind: 1, ID: crdt.ID{Client: 42, Seq: 2}, Clock: 5, Origin: crdt.ID{Client: 42, Seq: 1}, Value: 'b'},
+		})
+		body, _ := json.Marshal(collaboration.SyncCRDTRequest{Update: invalid})
+		resp = doCollaborationRequest(r, "POST", syncPath, "alice", string(body))
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, "invalid_update", decodeProblem(t, resp).Code)
+	})
+
+	t.Run("non members are forbidden", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "GET", path, "carol", "")
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+
+	t.Run("invalid payload", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/users", "alice", `{}`)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestCollaborationRoles(t *testing.T) {
+	r := newCollaborationTestRouter(t, "alice", "bob", "carol")
+
+	resp := doCollaborationRequest(r, "POST", "/api/collaborations", "alice", `{"name": "roles"}`)
+	assert.Equal(t, http.StatusCreated, resp.Code)
+
+	var created struct {
+		Data user.Collaboration `json:"data"`
+	}
+	assert.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+	path := "/api/collaborations/" + created.Data.ID
+
+	resp = doCollaborationRequest(r, "POST", path+"/users", "alice", `{"userId": "bob", "role": "viewer"}`)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	t.Run("viewer cannot invite or add documents", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/users", "bob", `{"userId": "carol"}`)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+
+		resp = doCollaborationRequest(r, "POST", path+"/documents", "bob", `{"name": "notes"}`)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+
+	t.Run("invalid role", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "PUT", path+"/users/bob", "alice", `{"role": "admin"}`)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("last owner cannot leave or be demoted", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "DELETE", path+"/users/alice", "alice", "")
+		assert.Equal(t, http.StatusConflict, resp.Code)
+
+		resp = doCollaborationRequest(r, "PUT", path+"/users/alice", "alice", `{"role": "editor"}`)
+		assert.Equal(t, http.StatusConflict, resp.Code)
+
+		// re-inviting the owner must not demote them either
+		resp = doCollaborationRequest(r, "POST", path+"/users", "alice", `{"userId": "alice", "role": "viewer"}`)
+		assert.Equal(t, http.StatusConflict, resp.Code)
+		assert.Equal(t, "already_member", decodeProblem(t, resp).Code)
+
+		resp = doCollaborationRequest(r, "DELETE", path+"/users/alice", "alice", "")
+		assert.Equal(t, http.StatusConflict, resp.Code)
+	})
+
+	t.Run("ownership transfer", func(t *testing.T) {
+		resp := doCollaborationRequest(r, "POST", path+"/transfer", "alice", `{"userId": "bob"}`)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+
+		resp = doCollaborationRequest(r, "POST", path+"/users", "alice", `{"userId": "carol"}`)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+
+		resp = doCollaborationRequest(r, "DELETE", path+"/users/alice", "alice", "")
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+	})
+}
+
+// slowCRDTRepository widens the window between reading a CRDT document's
+// updates and appending to it.
+type slowCRDTRepository struct {
+	collaboration.Repository
+}
+
+func (r slowCRDTRepository) GetCRDTUpdates(documentID string) ([]user.CRDTUpdate, error) {
+	updates, err := r.Repository.GetCRDTUpdates(documentID)
+	time.Sleep(10 * time.Millisecond)
+	return updates, err
+}
+
+func TestCRDTSyncsAreSerialised(t *testing.T) {
+	users := user.NewMemoryRepository()
+	_, err := users.Register(user.User{ID: "alice", UserName: "alice"})
+	assert.NoError(t, err)
+	service := collaboration.NewService(slowCRDTRepository{collaboration.NewMemoryRepository(users)})
+
+	created, err := service.CreateCollaboration("alice", 1, "busy", nil)
+	assert.NoError(t, err)
+	document, err := service.CreateCRDTDocument("alice", created.ID, "notes", "")
+	assert.NoError(t, err)
+
+	merged := crdt.NewDoc(99)
+	var wg sync.WaitGroup
+	for client := uint64(1); client <= 8; client++ {
+		update, err := crdt.NewDoc(client).Insert(0, "edit ")
+		assert.NoError(t, err)
+		assert.NoError(t, merged.ApplyUpdate(update))
+
+		wg.Add(1)
+		go func(update []byte) {
+			defer wg.Done()
+			_, err := service.SyncCRDTDocument("alice", created.ID, document.ID, nil, update)
+			assert.NoError(t, err)
+		}(update)
+	}
+	wg.Wait()
+
+	// the cached content must include every update, whatever the interleaving
+	stored, err := service.GetCRDTDocument("alice", created.ID, document.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, merged.String(), stored.Content)
+}
@@ -0,0 +1,171 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/similadayo/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestConfigDefaults(t *testing.T) {
+	loader := &config.Loader{Service: "collab-service", Dir: t.TempDir()}
+	cfg, args, err := loader.Load()
+	require.NoError(t, err)
+
+	assert.Empty(t, args)
+	assert.Equal(t, ":8082", cfg.Server.Addr)
+	assert.Equal(t, "sqlite", cfg.Database.Driver)
+	assert.Equal(t, 15*time.Minute, cfg.Auth.AccessTokenTTL)
+	assert.Equal(t, "info", cfg.Log.Level)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, "user-service.yaml", `
+server:
+  addr: ":9000"
+database:
+  driver: memory
+log:
+  level: warn
+auth:
+  bcrypt_cost: 12
+  access_token_ttl: 5m
+websocket:
+  allowed_origins: [https://a.example, https://b.example]
+`)
+
+	t.Setenv("LOG_LEVEL", "debug")
+	t.Setenv("BCRYPT_COST", "11")
+
+	loader := &config.Loader{
+		Service: "user-service",
+		Dir:     dir,
+		Args:    []string{"-auth.bcrypt_cost=13", "migrate", "up"},
+	}
+	cfg, args, err := loader.Load()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"migrate", "up"}, args)
+	assert.Equal(t, ":9000", cfg.Server.Addr)
+	assert.Equal(t, "memory", cfg.Database.Driver)
+	assert.Equal(t, 5*time.Minute, cfg.Auth.AccessTokenTTL)
+	assert.Equal(t, []string{"https://a.example", "https://b.example"}, cfg.WebSocket.AllowedOrigins)
+
+	// the environment beats the file and flags beat both
+	assert.Equal(t, "debug", cfg.Log.Level)
+	assert.Equal(t, 13, cfg.Auth.BcryptCost)
+}
+
+func TestConfigTOMLAndSecrets(t *testing.T) {
+	dir := t.TempDir()
+	secret := writeConfigFile(t, dir, "secret", "s3cret\n")
+	path := writeConfigFile(t, dir, "custom.toml", `
+[database]
+driver = "postgres"
+url = "file:`+secret+`"
+
+[rate_limit]
+requests_per_second = 2.5
+burst = 5
+`)
+
+	jwtSecret := writeConfigFile(t, dir, "jwt", "signing-secret")
+	t.Setenv("SECRET_KEY_FILE", jwtSecret)
+
+	loader := &config.Loader{Service: "user-service", Dir: dir, Args: []string{"-config", path}}
+	cfg, _, err := loader.Load()
+	require.NoError(t, err)
+
+	assert.Equal(t, "s3cret", cfg.Database.URL)
+	assert.Equal(t, "signing-secret", cfg.Auth.SecretKey)
+	assert.Equal(t, 2.5, cfg.RateLimit.RequestsPerSecond)
+	assert.Equal(t, 5, cfg.RateLimit.Burst)
+}
+
+func TestConfigValidation(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, "user-service.yaml", `
+database:
+  driver: mongo
+auth:
+  bcrypt_cost: 2
+log:
+  level: loud
+tracing:
+  exporter: otlp
+  endpoint: localhost:4318
+`)
+
+	loader := &config.Loader{Service: "user-service", Dir: dir}
+	_, _, err := loader.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "database.driver")
+	assert.Contains(t, err.Error(), "auth.bcrypt_cost")
+	assert.Contains(t, err.Error(), "log.level")
+	assert.Contains(t, err.Error(), "tracing.endpoint")
+
+	writeConfigFile(t, dir, "user-service.yaml", "server:\n  adr: \":1\"\n")
+	_, _, err = loader.Load()
+	assert.ErrorContains(t, err, "server.adr: unknown setting")
+
+	t.Setenv("ACCESS_TOKEN_TTL", "soon")
+	loader.Dir = t.TempDir()
+	_, _, err = loader.Load()
+	assert.ErrorContains(t, err, "auth.access_token_ttl: invalid value from environment")
+
+	loader.Args = []string{"-config", filepath.Join(dir, "missing.yaml")}
+	_, _, err = loader.Load()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestConfigReload(t *testing.T) {
+	dir := t.TempDir()
+	writeConfigFile(t, dir, "user-service.yaml", "log:\n  level: info\n")
+
+	loader := &config.Loader{Service: "user-service", Dir: dir}
+	cfg, _, err := loader.Load()
+	require.NoError(t, err)
+
+	reloader := config.NewReloader(loader, cfg)
+	var reloaded *config.Config
+	reloader.OnReload(func(cfg *config.Config) {
+		reloaded = cfg
+	})
+
+	writeConfigFile(t, dir, "user-service.yaml", `
+server:
+  addr: ":9999"
+log:
+  level: debug
+rate_limit:
+  burst: 50
+`)
+	ignored, err := reloader.Reload()
+	require.NoError(t, err)
+
+	// the listen address cannot change while running
+	assert.Equal(t, []string{"server.addr"}, ignored)
+	require.NotNil(t, reloaded)
+	assert.Equal(t, "debug", reloaded.Log.Level)
+	assert.Equal(t, 50, reloaded.RateLimit.Burst)
+	assert.Equal(t, ":8081", reloaded.Server.Addr)
+	assert.Same(t, reloaded, reloader.Current())
+	assert.Equal(t, "info", cfg.Log.Level)
+
+	// an invalid file is rejected and the running configuration kept
+	writeConfigFile(t, dir, "user-service.yaml", "log:\n  level: loud\n")
+	_, err = reloader.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "debug", reloader.Current().Log.Level)
+}
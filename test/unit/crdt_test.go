@@ -0,0 +1,173 @@
+package unit
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/similadayo/internal/crdt"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomEdit(r *rand.Rand, doc *crdt.Doc) []byte {
+	length := len([]rune(doc.String()))
+
+	if length > 0 && r.Intn(3) == 0 {
+		pos := r.Intn(length)
+		update, err := doc.Delete(pos, r.Intn(length-pos)+1)
+		if err != nil {
+			panic(err)
+		}
+		return update
+	}
+
+	update, err := doc.Insert(r.Intn(length+1), randomString(r, r.Intn(4)+1))
+	if err != nil {
+		panic(err)
+	}
+	return update
+}
+
+func TestCRDTConvergence(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+
+	for round := 0; round < 50; round++ {
+		replicas := []*crdt.Doc{crdt.NewDoc(1), crdt.NewDoc(2), crdt.NewDoc(3)}
+		var updates [][]byte
+
+		// replicas edit offline, occasionally seeing some of each other's work
+		for step := 0; step < 20; step++ {
+			doc := replicas[r.Intn(len(replicas))]
+			if len(updates) > 0 && r.Intn(4) == 0 {
+				assert.NoError(t, doc.ApplyUpdate(updates[r.Intn(len(updates))]))
+				continue
+			}
+			updates = append(updates, randomEdit(r, doc))
+		}
+
+		// deliver everything in a different shuffled order, with duplicates
+		for _, doc := range replicas {
+			order := r.Perm(len(updates))
+			for _, i := range order {
+				assert.NoError(t, doc.ApplyUpdate(updates[i]))
+			}
+			assert.NoError(t, doc.ApplyUpdate(updates[order[0]]))
+		}
+
+		assert.Equal(t, replicas[0].String(), replicas[1].String())
+		assert.Equal(t, replicas[0].String(), replicas[2].String())
+	}
+}
+
+func TestCRDTMergeUpdates(t *testing.T) {
+	a := crdt.NewDoc(1)
+	b := crdt.NewDoc(2)
+
+	u1, err := a.Insert(0, "hello")
+	assert.NoError(t, err)
+	u2, err := b.Insert(0, "world")
+	assert.NoError(t, err)
+	u3, err := a.Delete(0, 1)
+	assert.NoError(t, err)
+
+	forward, err := crdt.MergeUpdates(u1, u2, u3)
+	assert.NoError(t, err)
+	backward, err := crdt.MergeUpdates(u3, u2, u1, u2)
+	assert.NoError(t, err)
+	assert.Equal(t, forward, backward)
+
+	twice, err := crdt.MergeUpdates(forward, forward)
+	assert.NoError(t, err)
+	assert.Equal(t, forward, twice)
+
+	fromMerged := crdt.NewDoc(3)
+	assert.NoError(t, fromMerged.ApplyUpdate(forward))
+
+	sequential := crdt.NewDoc(4)
+	for _, u := range [][]byte{u1, u2, u3} {
+		assert.NoError(t, sequential.ApplyUpdate(u))
+	}
+	assert.Equal(t, sequential.String(), fromMerged.String())
+}
+
+func TestCRDTStateVectorSync(t *testing.T) {
+	a := crdt.NewDoc(1)
+	b := crdt.NewDoc(2)
+
+	_, err := a.Insert(0, "shared ")
+	assert.NoError(t, err)
+	initial, err := a.EncodeStateAsUpdate(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, b.ApplyUpdate(initial))
+
+	_, err = a.Insert(7, "offline A")
+	assert.NoError(t, err)
+	_, err = b.Insert(0, "B: ")
+	assert.NoError(t, err)
+
+	// exchange state vectors, then send only what the other side lacks
+	forB, err := a.EncodeStateAsUpdate(b.StateVector())
+	assert.NoError(t, err)
+	forA, err := b.EncodeStateAsUpdate(a.StateVector())
+	assert.NoError(t, err)
+
+	ops, err := crdt.DecodeUpdate(forA)
+	assert.NoError(t, err)
+	assert.Len(t, ops, 3)
+
+	assert.NoError(t, a.ApplyUpdate(forA))
+	assert.NoError(t, b.ApplyUpdate(forB))
+
+	assert.Equal(t, "B: shared offline A", a.String())
+	assert.Equal(t, a.String(), b.String())
+	assert.Equal(t, a.StateVector(), b.StateVector())
+}
+
+func TestCRDTRejectsMalformedUpdates(t *testing.T) {
+	doc := crdt.NewDoc(1)
+
+	assert.ErrorIs(t, doc.ApplyUpdate([]byte{9, 9}), crdt.ErrMalformed)
+	assert.ErrorIs(t, doc.ApplyUpdate([]byte{1, 1, 1}), crdt.ErrMalformed)
+
+	_, err := crdt.DecodeStateVector(nil)
+	assert.ErrorIs(t, err, crdt.ErrMalformed)
+}
+
+func TestCRDTRejectsClocksNotAfterTheirOrigin(t *testing.T) {
+	doc := crdt.NewDoc(1)
+	update, err := doc.Insert(0, "a")
+	assert.NoError(t, err)
+
+	remote := crdt.NewDoc(2)
+	assert.NoError(t, remote.ApplyUpdate(update))
+
+	invalid := crdt.EncodeUpdate([]crdt.Op{
+		{Kind: 1, ID: crdt.ID{Client: 3, Seq: 1}, Clock: 1, Origin: crdt.ID{Client: 1, Seq: 1}, Value: 'x'},
+	})
+	assert.ErrorIs(t, remote.ApplyUpdate(invalid), crdt.ErrInvalidClock)
+	assert.Equal(t, "a", remote.String())
+
+	// an invalid insert waiting for its origin is dropped when it arrives
+	late := crdt.NewDoc(4)
+	assert.NoError(t, late.ApplyUpdate(invalid))
+	assert.NoError(t, late.ApplyUpdate(update))
+	assert.Equal(t, "a", late.String())
+}
+
+func TestCRDTLargeDocument(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	doc := crdt.NewDoc(1)
+
+	// type in bursts at random places, as an editor does
+	for i := 0; i < 500; i++ {
+		length := len([]rune(doc.String()))
+		_, err := doc.Insert(r.Intn(length+1), randomString(r, 50))
+		assert.NoError(t, err)
+	}
+
+	update, err := doc.EncodeStateAsUpdate(nil)
+	assert.NoError(t, err)
+
+	replica := crdt.NewDoc(2)
+	assert.NoError(t, replica.ApplyUpdate(update))
+	assert.Equal(t, doc.String(), replica.String())
+}
@@ -0,0 +1,136 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/storage"
+	"github.com/similadayo/pkg/health"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probeReadiness(t *testing.T, registry *health.Registry) (int, health.Report) {
+	r := gin.New()
+	r.GET("/readyz", registry.ReadinessHandler())
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var report health.Report
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &report))
+	return resp.Code, report
+}
+
+func TestReadiness(t *testing.T) {
+	registry := health.NewRegistry()
+	registry.Register(health.Check{Name: "database", Run: func(ctx context.Context) error { return nil }})
+
+	code, report := probeReadiness(t, registry)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Equal(t, health.StatusOK, report.Checks["database"].Status)
+
+	t.Run("optional failure degrades", func(t *testing.T) {
+		registry.Register(health.Check{
+			Name:     "user-service",
+			Run:      func(ctx context.Context) error { return errors.New("connection refused") },
+			Optional: true,
+		})
+
+		code, report := probeReadiness(t, registry)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, health.StatusDegraded, report.Status)
+		assert.Equal(t, "connection refused", report.Checks["user-service"].Error)
+	})
+
+	t.Run("slow check times out", func(t *testing.T) {
+		registry.Register(health.Check{
+			Name:    "database",
+			Timeout: 20 * time.Millisecond,
+			Run: func(ctx context.Context) error {
+				time.Sleep(time.Second)
+				return nil
+			},
+		})
+
+		start := time.Now()
+		code, report := probeReadiness(t, registry)
+		assert.Less(t, time.Since(start), 500*time.Millisecond)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, health.StatusUnavailable, report.Status)
+		assert.Equal(t, health.StatusFailing, report.Checks["database"].Status)
+		assert.Contains(t, report.Checks["database"].Error, "timed out")
+	})
+
+	t.Run("unready during shutdown", func(t *testing.T) {
+		stopping := make(chan struct{})
+		registry := health.NewRegistry()
+		registry.ShutdownOn(stopping)
+
+		code, _ := probeReadiness(t, registry)
+		assert.Equal(t, http.StatusOK, code)
+
+		close(stopping)
+		code, report := probeReadiness(t, registry)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, health.ErrShuttingDown.Error(), report.Error)
+	})
+}
+
+func TestLiveness(t *testing.T) {
+	r := gin.New()
+	r.GET("/healthz", health.LivenessHandler())
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
+
+func TestStorageHealthChecks(t *testing.T) {
+	runChecks := func(backend *storage.Backend) health.Report {
+		registry := health.NewRegistry()
+		for _, check := range backend.HealthChecks(0) {
+			registry.Register(check)
+		}
+		return registry.Run(context.Background())
+	}
+
+	report := runChecks(storage.FromDB(newMigratedTestDB(t)))
+	assert.Equal(t, health.StatusOK, report.Status)
+	assert.Contains(t, report.Checks, "database")
+	assert.Contains(t, report.Checks, "migrations")
+
+	// a database behind the binary's migrations is not ready
+	report = runChecks(storage.FromDB(newTestDB(t)))
+	assert.Equal(t, health.StatusUnavailable, report.Status)
+	assert.Equal(t, health.StatusOK, report.Checks["database"].Status)
+	assert.Contains(t, report.Checks["migrations"].Error, "pending migrations")
+
+	memory, err := storage.Open(storage.DriverMemory, "")
+	require.NoError(t, err)
+	assert.Empty(t, memory.HealthChecks(0))
+}
+
+func TestDependencyChecks(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, health.DiskSpace(dir, 1)(context.Background()))
+	assert.ErrorContains(t, health.DiskSpace(dir, math.MaxUint64)(context.Background()), "MiB free")
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/jwks.json" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer up.Close()
+
+	assert.NoError(t, health.HTTP(up.Client(), up.URL+"/.well-known/jwks.json")(context.Background()))
+	assert.ErrorContains(t, health.HTTP(up.Client(), up.URL+"/missing")(context.Background()), "404")
+}
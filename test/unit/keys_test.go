@@ -0,0 +1,87 @@
+package unit
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRingSigning(t *testing.T) {
+	for _, alg := range []string{utils.AlgorithmRS256, utils.AlgorithmEdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			ring, err := utils.NewKeyRing(alg, t.TempDir())
+			assert.NoError(t, err)
+
+			utils.SetKeyRing(ring)
+			t.Cleanup(func() { utils.SetKeyRing(nil) })
+
+			oldToken, err := utils.GenerateToken("user-1")
+			assert.NoError(t, err)
+
+			err = ring.Rotate()
+			assert.NoError(t, err)
+
+			newToken, err := utils.GenerateToken("user-1")
+			assert.NoError(t, err)
+
+			for _, token := range []string{oldToken, newToken} {
+				claims, err := utils.ValidateToken(token)
+				assert.NoError(t, err)
+				assert.Equal(t, "user-1", claims.UserID)
+			}
+
+			assert.Len(t, ring.VerificationKeys(), 2)
+		})
+	}
+}
+
+func TestKeyRingRejectsSharedSecretTokens(t *testing.T) {
+	hsToken, err := utils.GenerateToken("user-1")
+	assert.NoError(t, err)
+
+	ring, err := utils.NewKeyRing(utils.AlgorithmEdDSA, "")
+	assert.NoError(t, err)
+
+	utils.SetKeyRing(ring)
+	t.Cleanup(func() { utils.SetKeyRing(nil) })
+
+	_, err = utils.ValidateToken(hsToken)
+	assert.Error(t, err)
+}
+
+func TestKeyRingReloadsFromDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	ring, err := utils.NewKeyRing(utils.AlgorithmEdDSA, dir)
+	assert.NoError(t, err)
+
+	reloaded, err := utils.NewKeyRing(utils.AlgorithmEdDSA, dir)
+	assert.NoError(t, err)
+	assert.Equal(t, ring.Active().ID, reloaded.Active().ID)
+}
+
+func TestRemoteKeySetVerifiesWithPublicKeys(t *testing.T) {
+	ring, err := utils.NewKeyRing(utils.AlgorithmRS256, "")
+	assert.NoError(t, err)
+
+	r := gin.New()
+	r.GET("/.well-known/jwks.json", auth.JWKSHandler(ring))
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	utils.SetKeyRing(ring)
+	token, err := utils.GenerateToken("user-2")
+	assert.NoError(t, err)
+
+	utils.SetKeyRing(nil)
+	utils.SetKeySource(utils.NewRemoteKeySet(server.URL + "/.well-known/jwks.json"))
+	t.Cleanup(func() { utils.SetKeySource(nil) })
+
+	claims, err := utils.ValidateToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-2", claims.UserID)
+}
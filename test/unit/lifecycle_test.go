@@ -0,0 +1,120 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/lifecycle"
+	"github.com/similadayo/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycleDrainsRequests(t *testing.T) {
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	app := lifecycle.New(logging.NewLogger(), 2*time.Second)
+	server := lifecycle.NewServer(config.Defaults("user-service").Server, handler)
+
+	var mu sync.Mutex
+	var order []string
+	for _, name := range []string{"database", "websocket rooms"} {
+		name := name
+		app.OnShutdown(name, func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, name)
+			return nil
+		})
+	}
+	app.OnShutdown("failing", func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- app.Serve(ctx, server, listener)
+	}()
+
+	url := "http://" + listener.Addr().String()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		responses <- resp
+	}()
+
+	<-started
+	cancel()
+
+	// the request in flight when shutdown began still completes
+	resp := <-responses
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	select {
+	case err = <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server did not stop")
+	}
+	assert.ErrorContains(t, err, "boom")
+
+	// hooks run in reverse order of registration
+	assert.Equal(t, []string{"websocket rooms", "database"}, order)
+
+	select {
+	case <-app.Stopping():
+	default:
+		t.Fatal("stopping channel not closed")
+	}
+
+	_, err = http.Get(url)
+	assert.Error(t, err)
+}
+
+func TestHubShutdownClosesRooms(t *testing.T) {
+	hub, server := newRealtimeTestServer(t, fakeAuthorizer{
+		"room-1/alice": collaboration.RoleOwner,
+	})
+
+	alice, _, err := dialRealtime(t, server, "room-1", "alice")
+	require.NoError(t, err)
+	defer alice.Close()
+	readEnvelope(t, alice)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, hub.Shutdown(ctx))
+
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = alice.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+	assert.Empty(t, hub.Clients("room-1"))
+
+	// connections arriving after shutdown are turned away
+	late, _, err := dialRealtime(t, server, "room-1", "alice")
+	require.NoError(t, err)
+	defer late.Close()
+
+	late.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = late.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+}
@@ -0,0 +1,262 @@
+package unit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newLockoutTestService(t *testing.T) (*user.Service, *fakeClock, *mail.MemoryOutbox) {
+	outbox := mail.NewMemoryOutbox("no-reply@example.com")
+
+	service, clock := newMFATestService(t)
+	service.BcryptCost = 4
+	service.Lockout = &user.Lockout{
+		MaxFailures:   3,
+		MaxIPFailures: 5,
+		Duration:      15 * time.Minute,
+		Window:        time.Hour,
+		BaseDelay:     time.Second,
+		MaxDelay:      4 * time.Second,
+		Mailer:        outbox,
+	}
+
+	return service, clock, outbox
+}
+
+// retryAfter is how long err asks clients to wait before trying again.
+func retryAfter(err error) time.Duration {
+	return apierror.From(err).RetryAfter
+}
+
+func TestLoginBackoff(t *testing.T) {
+	service, clock, outbox := newLockoutTestService(t)
+	client := service.WithClientIP("192.0.2.1")
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// each failure doubles the wait
+	for _, wait := range []time.Duration{time.Second, 2 * time.Second} {
+		_, err = client.AuthenticateUser("ada", "wrong")
+		assert.ErrorIs(t, err, user.ErrInvalidPassword)
+
+		_, err = client.AuthenticateUser("ada", "Passw0rd!")
+		assert.ErrorIs(t, err, user.ErrLoginThrottled)
+		assert.Equal(t, wait, retryAfter(err))
+
+		clock.Advance(wait)
+	}
+
+	_, err = client.AuthenticateUser("ada", "wrong")
+	assert.ErrorIs(t, err, user.ErrInvalidPassword)
+
+	// the third failure locks the account, from every address
+	_, err = service.WithClientIP("198.51.100.7").AuthenticateUser("ada", "Passw0rd!")
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+	assert.Equal(t, 15*time.Minute, retryAfter(err))
+
+	assert.Eventually(t, func() bool { return len(outbox.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "ada@example.com", outbox.Messages()[0].To)
+	assert.Contains(t, outbox.Messages()[0].Body, "15 minutes")
+
+	clock.Advance(15 * time.Minute)
+	result, err := client.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+	assert.NotEmpty(t, result.AccessToken)
+
+	// signing in clears the account's count
+	clock.Advance(4 * time.Second)
+	_, err = service.WithClientIP("198.51.100.7").AuthenticateUser("ada", "wrong")
+	assert.ErrorIs(t, err, user.ErrInvalidPassword)
+	_, err = service.WithClientIP("198.51.100.7").AuthenticateUser("ada", "Passw0rd!")
+	assert.Equal(t, time.Second, retryAfter(err))
+}
+
+func TestLockoutUnknownUser(t *testing.T) {
+	service, clock, outbox := newLockoutTestService(t)
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// an unknown username is answered exactly like a wrong password
+	attempt := func(username string) []error {
+		var errs []error
+		for i := 0; i < 4; i++ {
+			_, err := service.AuthenticateUser(username, "wrong")
+			errs = append(errs, err)
+			clock.Advance(4 * time.Second)
+		}
+		return errs
+	}
+
+	known, unknown := attempt("ada"), attempt("nobody")
+	for i := range known {
+		assert.Equal(t, apierror.From(known[i]).Code, apierror.From(unknown[i]).Code, i)
+		assert.Equal(t, retryAfter(known[i]), retryAfter(unknown[i]), i)
+	}
+	assert.ErrorIs(t, unknown[3], user.ErrAccountLocked)
+
+	assert.Eventually(t, func() bool { return len(outbox.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "ada@example.com", outbox.Messages()[0].To)
+}
+
+func TestLockoutByAddress(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+	client := service.WithClientIP("192.0.2.1")
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// one guess each at many accounts still adds up
+	for _, username := range []string{"a", "b", "c", "d", "e"} {
+		_, err := client.AuthenticateUser(username, "wrong")
+		assert.ErrorIs(t, err, user.ErrInvalidPassword)
+		clock.Advance(4 * time.Second)
+	}
+
+	_, err = client.AuthenticateUser("ada", "Passw0rd!")
+	assert.ErrorIs(t, err, user.ErrLoginThrottled)
+	assert.Equal(t, 15*time.Minute-4*time.Second, retryAfter(err))
+
+	_, err = service.WithClientIP("198.51.100.7").AuthenticateUser("ada", "Passw0rd!")
+	assert.NoError(t, err)
+}
+
+func TestLockoutSecondFactor(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	secret, _ := enrollTOTP(t, service, clock, created.ID)
+
+	result, err := service.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = service.CompleteMFALogin(result.MFAToken, "000000")
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+		clock.Advance(4 * time.Second)
+	}
+
+	clock.Advance(totp.Period)
+	code, err := totp.Code(secret, clock.Now())
+	require.NoError(t, err)
+	_, err = service.CompleteMFALogin(result.MFAToken, code)
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+}
+
+func TestLockoutSecondFactorAlternation(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	enrollTOTP(t, service, clock, created.ID)
+
+	// signing in with the password again before each guess at the code does
+	// not reset the count
+	for i := 0; i < 3; i++ {
+		result, err := service.AuthenticateUser("ada", "Passw0rd!")
+		require.NoError(t, err)
+		require.NotEmpty(t, result.MFAToken)
+
+		_, err = service.CompleteMFALogin(result.MFAToken, "000000")
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+		clock.Advance(4 * time.Second)
+	}
+
+	_, err = service.AuthenticateUser("ada", "Passw0rd!")
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+}
+
+func TestLockoutTwoFactorSettings(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	secret, _ := enrollTOTP(t, service, clock, created.ID)
+
+	// a signed-in session guesses codes no faster than a login
+	_, err = service.RegenerateRecoveryCodes(created.ID, "000000")
+	assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+	err = service.DisableTOTP(created.ID, "000000")
+	assert.ErrorIs(t, err, user.ErrLoginThrottled)
+	clock.Advance(time.Second)
+
+	for i := 0; i < 2; i++ {
+		err = service.DisableTOTP(created.ID, "000000")
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+		clock.Advance(4 * time.Second)
+	}
+
+	clock.Advance(totp.Period)
+	code, err := totp.Code(secret, clock.Now())
+	require.NoError(t, err)
+	err = service.DisableTOTP(created.ID, code)
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+	_, err = service.RegenerateRecoveryCodes(created.ID, code)
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+
+	got, err := service.GetUserByID(created.ID)
+	require.NoError(t, err)
+	assert.True(t, got.TOTPEnabled)
+}
+
+func TestLockoutChangePassword(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = service.ChangePassword(created.ID, "wrong", "N3w-Passw0rd")
+		assert.ErrorIs(t, err, user.ErrIncorrectPassword)
+		clock.Advance(4 * time.Second)
+	}
+
+	_, err = service.ChangePassword(created.ID, "Passw0rd!", "N3w-Passw0rd")
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+	_, err = service.AuthenticateUser("ada", "Passw0rd!")
+	assert.ErrorIs(t, err, user.ErrAccountLocked)
+}
+
+func TestAdminUnlockUser(t *testing.T) {
+	service, clock, _ := newLockoutTestService(t)
+	service.Admins = []string{"admin-id"}
+	handler := user.NewHandler(service)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.POST("/api/users/login", handler.Login)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := service.AuthenticateUser("ada", "wrong")
+		assert.ErrorIs(t, err, user.ErrInvalidPassword)
+		clock.Advance(4 * time.Second)
+	}
+
+	resp := postJSON(r, "/api/users/login", `{"userName":"ada","password":"Passw0rd!"}`)
+	require.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Equal(t, "896", resp.Header().Get("Retry-After"))
+	problem := decodeProblem(t, resp)
+	assert.Equal(t, "account_locked", problem.Code)
+	assert.Equal(t, int64(896), problem.RetryAfter)
+
+	err = service.AdminUnlockUser(created.ID, created.ID)
+	assert.ErrorIs(t, err, user.ErrNotAdmin)
+	require.NoError(t, service.AdminUnlockUser("admin-id", created.ID))
+
+	resp = postJSON(r, "/api/users/login", `{"userName":"ada","password":"Passw0rd!"}`)
+	assert.Equal(t, http.StatusOK, resp.Code)
+}
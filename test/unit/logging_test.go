@@ -0,0 +1,86 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	r := gin.New()
+	r.Use(auth.RequestIDMiddleware())
+	r.GET("/items/:id", func(c *gin.Context) {
+		c.String(http.StatusOK, logging.RequestID(c.Request.Context()))
+	})
+
+	get := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+		if requestID != "" {
+			req.Header.Set(auth.RequestIDHeader, requestID)
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	resp := get("client-chosen-id")
+	assert.Equal(t, "client-chosen-id", resp.Header().Get(auth.RequestIDHeader))
+	assert.Equal(t, "client-chosen-id", resp.Body.String())
+
+	// missing or malformed IDs are replaced with a generated one
+	for _, requestID := range []string{"", "bad\nid", string(bytes.Repeat([]byte("a"), 200))} {
+		resp := get(requestID)
+		generated := resp.Header().Get(auth.RequestIDHeader)
+		assert.Len(t, generated, 36)
+		assert.NotEqual(t, requestID, generated)
+		assert.Equal(t, generated, resp.Body.String())
+	}
+	assert.NotEqual(t, get("").Header().Get(auth.RequestIDHeader), get("").Header().Get(auth.RequestIDHeader))
+}
+
+func TestLoggerWithContext(t *testing.T) {
+	var out bytes.Buffer
+	logger := logging.NewLogger()
+	logger.SetOutput(&out)
+
+	r := gin.New()
+	r.Use(auth.RequestIDMiddleware(), auth.LoggerMiddleWare(logger))
+	r.GET("/items/:id", func(c *gin.Context) {
+		// stands in for AuthMiddleware
+		c.Request = c.Request.WithContext(logging.WithUserID(c.Request.Context(), "alice"))
+		logger.WithContext(c.Request.Context()).Info("handled", map[string]interface{}{"item": c.Param("id")})
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/items/42", nil)
+	req.Header.Set(auth.RequestIDHeader, "req-1")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &entry))
+		assert.Equal(t, "req-1", entry["request_id"])
+		assert.Equal(t, "alice", entry["user_id"])
+		assert.Equal(t, "/items/:id", entry["route"])
+	}
+
+	// credentials in the query string are not logged
+	out.Reset()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items/42?token=secret-1&access_token=secret-2&code=123456&page=2", nil))
+	assert.NotContains(t, out.String(), "secret")
+	assert.NotContains(t, out.String(), "123456")
+	assert.Contains(t, out.String(), `/items/42?access_token=REDACTED\u0026code=REDACTED\u0026page=2\u0026token=REDACTED`)
+
+	// a context without request values adds nothing
+	assert.Same(t, logger, logger.WithContext(context.Background()))
+}
@@ -0,0 +1,127 @@
+package unit
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scrape(t *testing.T, registry *metrics.Registry) string {
+	var out bytes.Buffer
+	require.NoError(t, registry.WriteText(&out))
+	return out.String()
+}
+
+func TestMetricsTextExposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	logins := registry.Counter("logins_total", "Password logins.\nBy result.", "result")
+	logins.With("success").Add(2)
+	logins.With("failure").Inc()
+
+	registry.Gauge("connections", "").With().Set(3)
+
+	latency := registry.Histogram("latency_seconds", "Request latency.", []float64{1, 0.1}, "route")
+	latency.With(`/a"b`).Observe(0.05)
+	latency.With(`/a"b`).Observe(0.5)
+	latency.With(`/a"b`).Observe(5)
+
+	expected := `# TYPE connections gauge
+connections 3
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a\"b",le="0.1"} 1
+latency_seconds_bucket{route="/a\"b",le="1"} 2
+latency_seconds_bucket{route="/a\"b",le="+Inf"} 3
+latency_seconds_sum{route="/a\"b"} 5.55
+latency_seconds_count{route="/a\"b"} 3
+# HELP logins_total Password logins.\nBy result.
+# TYPE logins_total counter
+logins_total{result="failure"} 1
+logins_total{result="success"} 2
+`
+	assert.Equal(t, expected, scrape(t, registry))
+
+	// registering the same metric again returns the existing one
+	registry.Counter("logins_total", "Password logins.", "result").With("success").Inc()
+	assert.Equal(t, float64(3), logins.With("success").Value())
+
+	assert.Panics(t, func() { registry.Gauge("logins_total", "", "result") })
+	assert.Panics(t, func() { logins.With("success", "extra") })
+	assert.Panics(t, func() { logins.With("failure").Add(-1) })
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	r := gin.New()
+	r.Use(metrics.Middleware(registry))
+	r.GET("/collaborations/:id", func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	r.GET("/metrics", registry.Handler())
+
+	for _, path := range []string{"/collaborations/1", "/collaborations/2", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, metrics.ContentType, resp.Header().Get("Content-Type"))
+
+	body := resp.Body.String()
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/collaborations/:id",status="204"} 2`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/collaborations/:id",status="204"} 2`)
+	assert.Contains(t, body, "http_requests_in_flight 1")
+	assert.NotContains(t, body, "/collaborations/1")
+}
+
+func TestGormMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	db := newMigratedTestDB(t)
+	require.NoError(t, db.Use(metrics.NewGormPlugin(registry)))
+
+	var count int64
+	require.NoError(t, db.Table("users").Count(&count).Error)
+	assert.Error(t, db.Exec("SELECT * FROM no_such_table").Error)
+
+	body := scrape(t, registry)
+	assert.Contains(t, body, `db_query_duration_seconds_count{operation="query"} 1`)
+	assert.Contains(t, body, `db_query_duration_seconds_count{operation="raw"} 1`)
+	assert.Contains(t, body, `db_query_errors_total{operation="raw"} 1`)
+	assert.False(t, strings.Contains(body, `db_query_errors_total{operation="query"}`))
+}
+
+func TestLoginMetrics(t *testing.T) {
+	userService := newTokenTestService(t)
+	_, err := userService.CreateUser("metricsuser", "Passw0rd!", "metrics@example.com", "", "", "")
+	require.NoError(t, err)
+
+	logins := metrics.Default.Counter("user_login_attempts_total", "", "result")
+	hashes := metrics.Default.Histogram("password_hash_duration_seconds", "",
+		[]float64{.01, .025, .05, .1, .25, .5, 1, 2.5}, "operation")
+	successes, failures := logins.With("success").Value(), logins.With("failure").Value()
+	compares := hashes.With("compare").Count()
+
+	_, err = userService.AuthenticateUser("metricsuser", "Passw0rd!")
+	require.NoError(t, err)
+	_, err = userService.AuthenticateUser("metricsuser", "wrong")
+	assert.Error(t, err)
+	_, err = userService.AuthenticateUser("nobody", "Passw0rd!")
+	assert.Error(t, err)
+
+	assert.Equal(t, successes+1, logins.With("success").Value())
+	assert.Equal(t, failures+2, logins.With("failure").Value())
+	// unknown usernames are checked against a dummy hash
+	assert.Equal(t, compares+3, hashes.With("compare").Count())
+}
@@ -0,0 +1,255 @@
+package unit
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/totp"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := totp.Code(secret, time.Unix(unix, 0))
+		require.NoError(t, err)
+		assert.Equal(t, want, code, unix)
+	}
+
+	now := time.Unix(1234567890, 0)
+	counter, ok := totp.Validate(secret, "005924", now.Add(totp.Period), 1)
+	assert.True(t, ok)
+	assert.Equal(t, totp.Counter(now), counter)
+
+	_, ok = totp.Validate(secret, "005924", now.Add(2*totp.Period), 1)
+	assert.False(t, ok)
+	_, ok = totp.Validate("not base32!", "005924", now, 1)
+	assert.False(t, ok)
+
+	uri, err := url.Parse(totp.URI("Collab", "ada", secret))
+	require.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Collab:ada", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, "Collab", uri.Query().Get("issuer"))
+}
+
+// fakeClock is a settable time source for Service.Clock and Signer.Now.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newMFATestService(t *testing.T) (*user.Service, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+
+	signer := utils.NewSigner([]byte("test-secret"))
+	signer.Now = clock.Now
+
+	service := newTokenTestService(t)
+	service.Clock = clock.Now
+	service.MFA = &user.MFA{
+		Issuer:       "Collab",
+		Signer:       signer,
+		ChallengeTTL: 5 * time.Minute,
+	}
+
+	return service, clock
+}
+
+// enrollTOTP turns on two-factor authentication for userID and returns its
+// secret and recovery codes.
+func enrollTOTP(t *testing.T, service *user.Service, clock *fakeClock, userID string) (string, []string) {
+	enrollment, err := service.EnrollTOTP(userID)
+	require.NoError(t, err)
+
+	code, err := totp.Code(enrollment.Secret, clock.Now())
+	require.NoError(t, err)
+
+	codes, err := service.ConfirmTOTP(userID, code)
+	require.NoError(t, err)
+	require.Len(t, codes, 10)
+
+	return enrollment.Secret, codes
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	service, clock := newMFATestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	enrollment, err := service.EnrollTOTP(created.ID)
+	require.NoError(t, err)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/Collab:ada?")
+
+	// until confirmed, logins are unchanged
+	result, err := service.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+	assert.Empty(t, result.MFAToken)
+	assert.NotEmpty(t, result.AccessToken)
+
+	_, err = service.ConfirmTOTP(created.ID, "000000")
+	assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+
+	code, err := totp.Code(enrollment.Secret, clock.Now())
+	require.NoError(t, err)
+	codes, err := service.ConfirmTOTP(created.ID, code)
+	require.NoError(t, err)
+	assert.Len(t, codes, 10)
+
+	_, err = service.EnrollTOTP(created.ID)
+	assert.ErrorIs(t, err, user.ErrMFAAlreadyEnabled)
+
+	enabled, err := service.GetUserByID(created.ID)
+	require.NoError(t, err)
+	assert.True(t, enabled.TOTPEnabled)
+}
+
+func TestMFALogin(t *testing.T) {
+	service, clock := newMFATestService(t)
+	handler := user.NewHandler(service)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.POST("/api/users/login", handler.Login)
+	r.POST("/api/users/login/mfa", handler.LoginMFA)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	secret, recoveryCodes := enrollTOTP(t, service, clock, created.ID)
+
+	login := func() string {
+		result, err := service.AuthenticateUser("ada", "Passw0rd!")
+		require.NoError(t, err)
+		require.NotEmpty(t, result.MFAToken)
+		assert.Empty(t, result.AccessToken)
+		return result.MFAToken
+	}
+
+	t.Run("password step returns a challenge", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/login", `{"userName":"ada","password":"Passw0rd!"}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"mfa_required":true`)
+		assert.NotContains(t, resp.Body.String(), "access_token")
+	})
+
+	t.Run("totp code", func(t *testing.T) {
+		clock.Advance(totp.Period)
+		challenge := login()
+
+		resp := postJSON(r, "/api/users/login/mfa", `{"mfa_token":"`+challenge+`","code":"000000"}`)
+		require.Equal(t, http.StatusUnauthorized, resp.Code)
+		assert.Equal(t, "invalid_mfa_code", decodeProblem(t, resp).Code)
+
+		code, err := totp.Code(secret, clock.Now())
+		require.NoError(t, err)
+		resp = postJSON(r, "/api/users/login/mfa", `{"mfa_token":"`+challenge+`","code":"`+code+`"}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), "access_token")
+
+		// a code works once
+		_, err = service.CompleteMFALogin(challenge, code)
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+	})
+
+	t.Run("recovery code", func(t *testing.T) {
+		challenge := login()
+
+		pair, err := service.CompleteMFALogin(challenge, recoveryCodes[0])
+		require.NoError(t, err)
+		_, err = utils.ValidateToken(pair.AccessToken)
+		assert.NoError(t, err)
+
+		_, err = service.CompleteMFALogin(challenge, recoveryCodes[0])
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+	})
+
+	t.Run("challenge expires", func(t *testing.T) {
+		challenge := login()
+		clock.Advance(6 * time.Minute)
+
+		_, err := service.CompleteMFALogin(challenge, recoveryCodes[1])
+		assert.ErrorIs(t, err, user.ErrInvalidMFAToken)
+	})
+
+	t.Run("challenge is not an access token", func(t *testing.T) {
+		_, err := utils.ValidateToken(login())
+		assert.Error(t, err)
+	})
+}
+
+func TestDisableTOTP(t *testing.T) {
+	service, clock := newMFATestService(t)
+	service.Admins = []string{"admin-id"}
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	_, recoveryCodes := enrollTOTP(t, service, clock, created.ID)
+
+	t.Run("recovery codes can be replaced", func(t *testing.T) {
+		codes, err := service.RegenerateRecoveryCodes(created.ID, recoveryCodes[0])
+		require.NoError(t, err)
+		assert.Len(t, codes, 10)
+
+		// the old codes no longer work
+		err = service.DisableTOTP(created.ID, recoveryCodes[1])
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+
+		recoveryCodes = codes
+	})
+
+	t.Run("self-service", func(t *testing.T) {
+		err := service.DisableTOTP(created.ID, "wrong")
+		assert.ErrorIs(t, err, user.ErrInvalidMFACode)
+
+		// codes are accepted however they are typed
+		err = service.DisableTOTP(created.ID, " "+recoveryCodes[0]+" ")
+		require.NoError(t, err)
+
+		result, err := service.AuthenticateUser("ada", "Passw0rd!")
+		require.NoError(t, err)
+		assert.NotEmpty(t, result.AccessToken)
+
+		err = service.DisableTOTP(created.ID, recoveryCodes[1])
+		assert.ErrorIs(t, err, user.ErrMFANotEnabled)
+	})
+
+	t.Run("administrator", func(t *testing.T) {
+		clock.Advance(totp.Period)
+		enrollTOTP(t, service, clock, created.ID)
+
+		err := service.AdminDisableTOTP(created.ID, created.ID)
+		assert.ErrorIs(t, err, user.ErrNotAdmin)
+		assert.Equal(t, http.StatusForbidden, apierror.From(err).Status)
+
+		require.NoError(t, service.AdminDisableTOTP("admin-id", created.ID))
+
+		disabled, err := service.GetUserByID(created.ID)
+		require.NoError(t, err)
+		assert.False(t, disabled.TOTPEnabled)
+		assert.Empty(t, disabled.TOTPSecret)
+	})
+}
@@ -0,0 +1,172 @@
+package unit
+
+import (
+	"bytes"
+	"testing"
+	"testing/fstest"
+
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/migrations"
+	"github.com/similadayo/pkg/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{TranslateError: true})
+	assert.NoError(t, err)
+
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return db
+}
+
+// newMigratedTestDB returns an in-memory database with the services' schema.
+func newMigratedTestDB(t *testing.T) *gorm.DB {
+	db := newTestDB(t)
+
+	migrator, err := migrations.NewMigrator(db)
+	assert.NoError(t, err)
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+
+	return db
+}
+
+func testMigrations() fstest.MapFS {
+	return fstest.MapFS{
+		"0001_create_notes.up.sql":   {Data: []byte("CREATE TABLE notes (id integer PRIMARY KEY, body text);")},
+		"0001_create_notes.down.sql": {Data: []byte("DROP TABLE notes;")},
+		"0002_add_title.up.sql":      {Data: []byte("ALTER TABLE notes ADD COLUMN title text;")},
+		"0002_add_title.down.sql":    {Data: []byte("ALTER TABLE notes DROP COLUMN title;")},
+		"0003_backfill.up.sql":       {Data: []byte("UPDATE notes SET title = 'untitled' WHERE title IS NULL;")},
+		"README.md":                  {Data: []byte("ignored")},
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	db := newTestDB(t)
+
+	set, err := migrate.Load(testMigrations())
+	assert.NoError(t, err)
+	assert.Len(t, set, 3)
+	assert.Equal(t, "add_title", set[1].Name)
+
+	migrator := migrate.New(db, set)
+
+	t.Run("up applies everything in order", func(t *testing.T) {
+		count, err := migrator.Up()
+		assert.NoError(t, err)
+		assert.Equal(t, 3, count)
+		assert.True(t, db.Migrator().HasColumn("notes", "title"))
+
+		count, err = migrator.Up()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("irreversible migrations block rollback", func(t *testing.T) {
+		_, err := migrator.Down()
+		assert.ErrorIs(t, err, migrate.ErrIrreversible)
+	})
+
+	t.Run("to migrates down and up", func(t *testing.T) {
+		migrator.Migrations[2].Down = "SELECT 1;"
+
+		count, err := migrator.To(1)
+		assert.ErrorIs(t, err, migrate.ErrChecksumMismatch)
+		assert.Equal(t, 0, count)
+
+		// an edited migration is only accepted once its record is fixed
+		db.Model(&migrate.SchemaMigration{}).Where("version = 3").Update("checksum", migrator.Migrations[2].Checksum())
+
+		count, err = migrator.To(1)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+		assert.False(t, db.Migrator().HasColumn("notes", "title"))
+
+		current, err := migrator.Current()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, current)
+
+		_, err = migrator.To(7)
+		assert.ErrorIs(t, err, migrate.ErrInvalidVersion)
+	})
+
+	t.Run("status and command", func(t *testing.T) {
+		var out bytes.Buffer
+		assert.NoError(t, migrate.Run(migrator, []string{"status"}, &out))
+		assert.Contains(t, out.String(), "0001_create_notes\tapplied")
+		assert.Contains(t, out.String(), "0002_add_title\tpending")
+
+		out.Reset()
+		assert.NoError(t, migrate.Run(migrator, []string{"up"}, &out))
+		assert.Equal(t, "2 migration(s) run\n", out.String())
+
+		assert.ErrorIs(t, migrate.Run(migrator, []string{"sideways"}, &out), migrate.ErrUsage)
+		assert.ErrorIs(t, migrate.Run(migrator, []string{"to", "x"}, &out), migrate.ErrUsage)
+	})
+
+	t.Run("unknown applied migrations are reported", func(t *testing.T) {
+		older := migrate.New(db, set[:1])
+		assert.ErrorIs(t, older.Verify(), migrate.ErrUnknownMigration)
+	})
+}
+
+func TestServiceMigrationsRoundTrip(t *testing.T) {
+	db := newMigratedTestDB(t)
+	assert.True(t, db.Migrator().HasTable("crdt_updates"))
+
+	migrator, err := migrations.NewMigrator(db)
+	assert.NoError(t, err)
+
+	_, err = migrator.To(0)
+	assert.NoError(t, err)
+	assert.False(t, db.Migrator().HasTable("users"))
+
+	_, err = migrator.Up()
+	assert.NoError(t, err)
+	assert.True(t, db.Migrator().HasTable("users"))
+}
+
+func TestServiceMigrationsAdoptAutoMigrateSchema(t *testing.T) {
+	db := newTestDB(t)
+
+	// the schema gorm's AutoMigrate created before versioned migrations
+	for _, statement := range []string{
+		"CREATE TABLE `users` (`id` varchar(36),`user_name` text,`password` text,`email` text,`first_name` text,`last_name` text,`avatar_url` text,`created` datetime,`updated` datetime,PRIMARY KEY (`id`))",
+		"CREATE TABLE `collaborations` (`id` text,`project_id` integer,`name` text,`created` datetime,`updated` datetime,PRIMARY KEY (`id`))",
+		"CREATE TABLE `user_collaborations` (`user_id` varchar(36),`collaboration_id` text,PRIMARY KEY (`user_id`,`collaboration_id`),CONSTRAINT `fk_user_collaborations_user` FOREIGN KEY (`user_id`) REFERENCES `users`(`id`),CONSTRAINT `fk_user_collaborations_collaboration` FOREIGN KEY (`collaboration_id`) REFERENCES `collaborations`(`id`))",
+		"INSERT INTO users (id, user_name) VALUES ('alice', 'alice'), ('bob', 'bob')",
+		"INSERT INTO collaborations (id, project_id, name, created) VALUES ('old', 7, 'old', '2023-01-02 03:04:05')",
+		"INSERT INTO user_collaborations (user_id, collaboration_id) VALUES ('alice', 'old')",
+	} {
+		require.NoError(t, db.Exec(statement).Error)
+	}
+
+	migrator, err := migrations.NewMigrator(db)
+	require.NoError(t, err)
+	_, err = migrator.Up()
+	require.NoError(t, err)
+	require.NoError(t, migrator.CheckCurrent())
+
+	repo := collaboration.NewSQLRepository(db)
+	membership, err := repo.GetMembership("old", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, collaboration.RoleOwner, membership.Role)
+	assert.Equal(t, 2023, membership.Created.Year())
+
+	service := collaboration.NewService(repo)
+	created, err := service.CreateCollaboration("bob", 7, "new", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", created.CreatedBy)
+
+	membership, err = repo.GetMembership(created.ID, "bob")
+	require.NoError(t, err)
+	assert.Equal(t, collaboration.RoleOwner, membership.Role)
+}
@@ -0,0 +1,203 @@
+package unit
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomString(r *rand.Rand, n int) string {
+	const alphabet = "abcdefghij äöü日本"
+	runes := []rune(alphabet)
+
+	out := make([]rune, n)
+	for i := range out {
+		out[i] = runes[r.Intn(len(runes))]
+	}
+
+	return string(out)
+}
+
+func randomOperation(r *rand.Rand, doc string) ot.Operation {
+	op := ot.New()
+	remaining := len([]rune(doc))
+
+	for remaining > 0 {
+		n := r.Intn(remaining) + 1
+		switch r.Intn(3) {
+		case 0:
+			op.Retain(n)
+			remaining -= n
+		case 1:
+			op.Insert(randomString(r, r.Intn(5)+1))
+		case 2:
+			op.Delete(n)
+			remaining -= n
+		}
+	}
+
+	if r.Intn(2) == 0 {
+		op.Insert(randomString(r, r.Intn(5)+1))
+	}
+
+	return *op
+}
+
+func TestOperationApply(t *testing.T) {
+	op := ot.New().Retain(6).Delete(5).Insert("gophers")
+
+	result, err := op.Apply("hello world")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello gophers", result)
+
+	_, err = op.Apply("too short")
+	assert.ErrorIs(t, err, ot.ErrBaseLengthMismatch)
+}
+
+func TestOperationCanonicalForm(t *testing.T) {
+	op := ot.New().Retain(1).Retain(2).Delete(1).Insert("a").Insert("b")
+
+	assert.Equal(t, []ot.Component{{Retain: 3}, {Insert: "ab"}, {Delete: 1}}, op.Ops)
+}
+
+func TestOperationJSON(t *testing.T) {
+	op := ot.New().Retain(2).Insert("日本").Delete(3)
+
+	data, err := json.Marshal(op)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[2, "日本", -3]`, string(data))
+
+	var decoded ot.Operation
+	assert.NoError(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, *op, decoded)
+
+	assert.Error(t, json.Unmarshal([]byte(`[0]`), &decoded))
+}
+
+func TestOperationProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 500; i++ {
+		doc := randomString(r, r.Intn(20))
+		a := randomOperation(r, doc)
+		b := randomOperation(r, doc)
+
+		afterA, err := a.Apply(doc)
+		assert.NoError(t, err)
+		afterB, err := b.Apply(doc)
+		assert.NoError(t, err)
+
+		// transform converges
+		aPrime, bPrime, err := ot.Transform(a, b)
+		assert.NoError(t, err)
+
+		left, err := bPrime.Apply(afterA)
+		assert.NoError(t, err)
+		right, err := aPrime.Apply(afterB)
+		assert.NoError(t, err)
+		assert.Equal(t, left, right)
+
+		// compose matches sequential application
+		c := randomOperation(r, afterA)
+		composed, err := ot.Compose(a, c)
+		assert.NoError(t, err)
+
+		sequential, err := c.Apply(afterA)
+		assert.NoError(t, err)
+		direct, err := composed.Apply(doc)
+		assert.NoError(t, err)
+		assert.Equal(t, sequential, direct)
+
+		// invert restores the original
+		inverse, err := a.Invert(doc)
+		assert.NoError(t, err)
+		restored, err := inverse.Apply(afterA)
+		assert.NoError(t, err)
+		assert.Equal(t, doc, restored)
+
+		// diff reproduces the target
+		diffed, err := ot.Diff(doc, afterB).Apply(doc)
+		assert.NoError(t, err)
+		assert.Equal(t, afterB, diffed)
+	}
+}
+
+type memoryOTStore struct {
+	content string
+	ops     []ot.Operation
+}
+
+func (s *memoryOTStore) Snapshot(documentID string) (string, int, error) {
+	return s.content, len(s.ops), nil
+}
+
+func (s *memoryOTStore) OperationsSince(documentID string, revision int) ([]ot.Operation, error) {
+	return append([]ot.Operation(nil), s.ops[revision:]...), nil
+}
+
+func (s *memoryOTStore) Append(documentID string, userID string, revision int, op ot.Operation, content string) error {
+	if revision != len(s.ops) {
+		return ot.ErrRevisionConflict
+	}
+
+	s.ops = append(s.ops, op)
+	s.content = content
+	return nil
+}
+
+func TestServerTransformsConcurrentEdits(t *testing.T) {
+	store := &memoryOTStore{content: "hello"}
+	server := ot.NewServer(store)
+
+	// both clients edit revision 0
+	alice := ot.New().Insert("> ").Retain(5)
+	bob := ot.New().Retain(5).Insert("!")
+
+	_, revision, err := server.Receive("doc", "alice", 0, *alice, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, revision)
+
+	var broadcast ot.Operation
+	applied, revision, err := server.Receive("doc", "bob", 0, *bob, func(op ot.Operation, rev int) {
+		broadcast = op
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, revision)
+	assert.Equal(t, applied, broadcast)
+	assert.Equal(t, "> hello!", store.content)
+
+	_, _, err = server.Receive("doc", "bob", 5, *bob, nil)
+	assert.ErrorIs(t, err, ot.ErrInvalidRevision)
+	assert.Equal(t, http.StatusBadRequest, apierror.From(err).Status)
+}
+
+func TestDocumentLocks(t *testing.T) {
+	var locks ot.DocumentLocks
+
+	var wg sync.WaitGroup
+	counter := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.Lock("doc")
+			counter++
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, counter)
+	assert.Equal(t, 0, locks.Len(), "locks of idle documents are released")
+
+	unlock := locks.Lock("a")
+	assert.Equal(t, 1, locks.Len())
+	unlock()
+	assert.Equal(t, 0, locks.Len())
+}
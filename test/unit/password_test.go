@@ -0,0 +1,146 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPasswordTestService(t *testing.T) (*user.Service, *mail.MemoryOutbox) {
+	outbox := mail.NewMemoryOutbox("no-reply@example.com")
+
+	service := newTokenTestService(t)
+	service.PasswordReset = &user.PasswordReset{
+		Mailer:   outbox,
+		LinkURL:  "https://example.com/reset-password",
+		TokenTTL: time.Hour,
+	}
+
+	return service, outbox
+}
+
+// resetToken returns the token in the link of a password reset email.
+func resetToken(t *testing.T, msg mail.Message) string {
+	start := strings.Index(msg.Body, "https://example.com/reset-password?")
+	require.GreaterOrEqual(t, start, 0, msg.Body)
+
+	link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+	require.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func TestPasswordReset(t *testing.T) {
+	service, outbox := newPasswordTestService(t)
+	handler := user.NewHandler(service)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.POST("/api/users/password/forgot", handler.ForgotPassword)
+	r.POST("/api/users/password/reset", handler.ResetPassword)
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	session, err := service.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+
+	resp := postJSON(r, "/api/users/password/forgot", `{"email":"nobody@example.com"}`)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Empty(t, outbox.Messages())
+
+	resp = postJSON(r, "/api/users/password/forgot", `{"email":" Ada@Example.com "}`)
+	require.Equal(t, http.StatusAccepted, resp.Code)
+	require.Eventually(t, func() bool { return len(outbox.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "ada@example.com", outbox.Messages()[0].To)
+	token := resetToken(t, outbox.Messages()[0])
+
+	t.Run("weak password keeps the token", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/password/reset", `{"token":"`+token+`","password":"password"}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, "weak_password", decodeProblem(t, resp).Code)
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/password/reset", `{"token":"not-a-token","password":"N3w-Passw0rd"}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, "invalid_reset_token", decodeProblem(t, resp).Code)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/password/reset", `{"token":"`+token+`","password":"N3w-Passw0rd"}`)
+		require.Equal(t, http.StatusNoContent, resp.Code)
+
+		_, err := service.AuthenticateUser("ada", "Passw0rd!")
+		assert.ErrorIs(t, err, user.ErrInvalidPassword)
+		_, err = service.AuthenticateUser("ada", "N3w-Passw0rd")
+		assert.NoError(t, err)
+
+		// existing sessions are signed out
+		_, err = utils.ValidateToken(session.AccessToken)
+		assert.ErrorIs(t, err, utils.ErrTokenRevoked)
+		_, err = service.RefreshTokens(session.RefreshToken)
+		assert.Error(t, err)
+
+		// and the token cannot be used again
+		resp = postJSON(r, "/api/users/password/reset", `{"token":"`+token+`","password":"An0ther-Passw0rd"}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, "invalid_reset_token", decodeProblem(t, resp).Code)
+	})
+}
+
+// failingMailer refuses every message, as an unreachable mail server would.
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mail.Message) error {
+	return errors.New("mail server unreachable")
+}
+
+func TestPasswordResetMailFailure(t *testing.T) {
+	service, _ := newPasswordTestService(t)
+	service.PasswordReset.Mailer = failingMailer{}
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// a registered address is answered like an unknown one
+	assert.NoError(t, service.RequestPasswordReset("ada@example.com"))
+	assert.NoError(t, service.RequestPasswordReset("nobody@example.com"))
+}
+
+func TestChangePassword(t *testing.T) {
+	service, _ := newPasswordTestService(t)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	session, err := service.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+
+	_, err = service.ChangePassword(created.ID, "wrong", "N3w-Passw0rd")
+	assert.ErrorIs(t, err, user.ErrIncorrectPassword)
+	assert.Equal(t, http.StatusForbidden, apierror.From(err).Status)
+
+	_, err = service.ChangePassword(created.ID, "Passw0rd!", "weak")
+	assert.ErrorIs(t, err, user.ErrWeakPassword)
+
+	pair, err := service.ChangePassword(created.ID, "Passw0rd!", "N3w-Passw0rd")
+	require.NoError(t, err)
+
+	_, err = utils.ValidateToken(session.AccessToken)
+	assert.ErrorIs(t, err, utils.ErrTokenRevoked)
+	_, err = utils.ValidateToken(pair.AccessToken)
+	assert.NoError(t, err)
+
+	_, err = service.AuthenticateUser("ada", "N3w-Passw0rd")
+	assert.NoError(t, err)
+}
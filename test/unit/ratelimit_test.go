@@ -0,0 +1,193 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := ratelimit.NewMemoryStore(2)
+	limit := ratelimit.Limit{Rate: 1, Burst: 2}
+	now := time.Unix(1700000000, 0)
+	ctx := context.Background()
+
+	take := func(key string) ratelimit.Result {
+		result, err := store.Take(ctx, key, limit, now)
+		require.NoError(t, err)
+		return result
+	}
+
+	result := take("a")
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+	assert.Equal(t, time.Second, result.Reset)
+
+	take("a")
+	result = take("a")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 2*time.Second, result.Reset)
+
+	// buckets refill at the rate
+	now = now.Add(500 * time.Millisecond)
+	result = take("a")
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 500*time.Millisecond, result.RetryAfter)
+
+	now = now.Add(500 * time.Millisecond)
+	assert.True(t, take("a").Allowed)
+
+	// the least recently used bucket goes when there are too many
+	take("b")
+	take("c")
+	assert.Equal(t, 2, store.Len())
+	assert.Equal(t, 1, take("a").Remaining, "a was forgotten, so starts full")
+
+	// and refilled buckets are forgotten
+	now = now.Add(time.Minute)
+	take("d")
+	assert.Equal(t, 1, store.Len())
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	cfg := config.Defaults("collab-service").RateLimit
+	cfg.RequestsPerSecond = 1
+	cfg.Burst = 2
+	cfg.Routes = []string{
+		"POST /login rate=1/1m key=ip",
+		"* /keys rate=1/1m key=api_key",
+	}
+
+	limiter, err := ratelimit.New(ratelimit.NewMemoryStore(100), cfg)
+	require.NoError(t, err)
+	limiter.Clock = clock.Now
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil), func(c *gin.Context) {
+		// stands in for auth.AuthMiddleware
+		if userID := c.GetHeader("X-User"); userID != "" {
+			c.Set("user_id", userID)
+		}
+	}, limiter.Middleware())
+	for _, path := range []string{"/items", "/login", "/keys"} {
+		r.Any(path, func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	}
+
+	request := func(method string, path string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("default policy counts users apart", func(t *testing.T) {
+		resp := request(http.MethodGet, "/items", "X-User", "ada")
+		require.Equal(t, http.StatusNoContent, resp.Code)
+		assert.Equal(t, "2", resp.Header().Get("RateLimit-Limit"))
+		assert.Equal(t, "1", resp.Header().Get("RateLimit-Remaining"))
+		assert.Equal(t, "1", resp.Header().Get("RateLimit-Reset"))
+
+		request(http.MethodGet, "/items", "X-User", "ada")
+		resp = request(http.MethodGet, "/items", "X-User", "ada")
+		require.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.Equal(t, "1", resp.Header().Get("Retry-After"))
+		assert.Equal(t, "rate_limited", decodeProblem(t, resp).Code)
+
+		// another user from the same address is not held back
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/items", "X-User", "grace").Code)
+
+		clock.Advance(time.Second)
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/items", "X-User", "ada").Code)
+	})
+
+	t.Run("route policy", func(t *testing.T) {
+		resp := request(http.MethodPost, "/login")
+		require.Equal(t, http.StatusNoContent, resp.Code)
+		assert.Equal(t, "1", resp.Header().Get("RateLimit-Limit"))
+
+		// counted by address, whoever is signed in
+		resp = request(http.MethodPost, "/login", "X-User", "grace")
+		require.Equal(t, http.StatusTooManyRequests, resp.Code)
+		assert.Equal(t, "60", resp.Header().Get("Retry-After"))
+
+		// other methods fall back to the default policy
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/login").Code)
+	})
+
+	t.Run("api keys", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/keys", "X-API-Key", "one").Code)
+		assert.Equal(t, http.StatusTooManyRequests, request(http.MethodDelete, "/keys", "X-API-Key", "one").Code)
+		assert.Equal(t, http.StatusNoContent, request(http.MethodGet, "/keys", "X-API-Key", "two").Code)
+	})
+
+	t.Run("reconfigure", func(t *testing.T) {
+		cfg.Routes = nil
+		cfg.Burst = 5
+		require.NoError(t, limiter.Configure(cfg))
+
+		resp := request(http.MethodPost, "/login")
+		require.Equal(t, http.StatusNoContent, resp.Code)
+		assert.Equal(t, "5", resp.Header().Get("RateLimit-Limit"))
+
+		cfg.Enabled = false
+		require.NoError(t, limiter.Configure(cfg))
+		for i := 0; i < 10; i++ {
+			resp = request(http.MethodPost, "/login")
+			require.Equal(t, http.StatusNoContent, resp.Code)
+		}
+		assert.Empty(t, resp.Header().Get("RateLimit-Limit"))
+	})
+}
+
+func TestRateLimitRoutes(t *testing.T) {
+	cfg := config.Defaults("user-service")
+	require.NoError(t, cfg.Validate())
+
+	cfg.RateLimit.Routes = []string{"get /items rate=6/1m"}
+	routes, err := cfg.RateLimit.ParseRoutes()
+	require.NoError(t, err)
+	assert.Equal(t, []config.RateLimitRoute{{
+		Method:            "GET",
+		Path:              "/items",
+		RequestsPerSecond: 0.1,
+		Burst:             6,
+		Key:               "user",
+	}}, routes)
+
+	cfg.RateLimit.Routes = []string{
+		"/items rate=1/1s",
+		"GET /items burst=2",
+		"GET /items rate=fast",
+		"GET /items rate=1/1s burst=0",
+		"GET /items rate=1/1s key=session",
+		"GET /items rate=1/1s limit=2",
+	}
+	err = cfg.Validate()
+	require.Error(t, err)
+	for _, want := range []string{
+		"want a method, a path and options",
+		"rate must be set",
+		"rate must be a count per duration",
+		"burst must be at least 1",
+		"key must be ip, user or api_key",
+		`unknown option "limit"`,
+	} {
+		assert.Contains(t, err.Error(), want)
+	}
+}
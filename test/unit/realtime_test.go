@@ -0,0 +1,541 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/realtime"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAuthorizer map[string]string
+
+func (f fakeAuthorizer) Authorize(collaborationID string, userID string, action collaboration.Action) error {
+	role, ok := f[collaborationID+"/"+userID]
+	if !ok {
+		return collaboration.ErrNotMember
+	}
+	if !collaboration.RoleAllows(role, action) {
+		return collaboration.ErrForbidden
+	}
+
+	return nil
+}
+
+func newRealtimeTestServer(t *testing.T, authorizer realtime.Authorizer) (*realtime.Hub, *httptest.Server) {
+	hub := realtime.NewHub(logging.NewLogger())
+	wsHandler := realtime.NewHandler(hub, authorizer, nil)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.GET("/ws/collaborations/:id", wsHandler.ServeWS)
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+
+	return hub, server
+}
+
+func dialRealtime(t *testing.T, server *httptest.Server, room string, userID string) (*websocket.Conn, *http.Response, error) {
+	token, err := utils.GenerateToken(userID)
+	assert.NoError(t, err)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/collaborations/" + room + "?access_token=" + token
+	return websocket.DefaultDialer.Dial(url, nil)
+}
+
+func readEnvelope(t *testing.T, conn *websocket.Conn) realtime.Envelope {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	var env realtime.Envelope
+	assert.NoError(t, conn.ReadJSON(&env))
+
+	return env
+}
+
+func TestRealtimeHub(t *testing.T) {
+	_, server := newRealtimeTestServer(t, fakeAuthorizer{
+		"room-1/alice": collaboration.RoleOwner,
+		"room-1/bob":   collaboration.RoleViewer,
+	})
+
+	alice, _, err := dialRealtime(t, server, "room-1", "alice")
+	assert.NoError(t, err)
+	defer alice.Close()
+	assert.Equal(t, realtime.TypeWelcome, readEnvelope(t, alice).Type)
+
+	bob, _, err := dialRealtime(t, server, "room-1", "bob")
+	assert.NoError(t, err)
+	defer bob.Close()
+
+	welcome := readEnvelope(t, bob)
+	assert.Equal(t, realtime.TypeWelcome, welcome.Type)
+	assert.Contains(t, string(welcome.Payload), "alice")
+
+	joined := readEnvelope(t, alice)
+	assert.Equal(t, realtime.TypeJoin, joined.Type)
+	assert.Equal(t, "bob", joined.Sender)
+
+	t.Run("messages are broadcast with sequence numbers", func(t *testing.T) {
+		env, err := realtime.NewEnvelope(realtime.TypeMessage, "room-1", map[string]string{"text": "hi"})
+		assert.NoError(t, err)
+		assert.NoError(t, alice.WriteJSON(env))
+
+		received := readEnvelope(t, bob)
+		assert.Equal(t, realtime.TypeMessage, received.Type)
+		assert.Equal(t, "alice", received.Sender)
+		assert.Equal(t, joined.Seq+1, received.Seq)
+		assert.JSONEq(t, `{"text":"hi"}`, string(received.Payload))
+	})
+
+	t.Run("unsupported version is rejected", func(t *testing.T) {
+		data, _ := json.Marshal(map[string]interface{}{"v": 99, "type": realtime.TypeMessage})
+		assert.NoError(t, bob.WriteMessage(websocket.TextMessage, data))
+
+		assert.Equal(t, realtime.TypeError, readEnvelope(t, bob).Type)
+	})
+
+	t.Run("leave is broadcast", func(t *testing.T) {
+		bob.Close()
+
+		left := readEnvelope(t, alice)
+		assert.Equal(t, realtime.TypeLeave, left.Type)
+		assert.Equal(t, "bob", left.Sender)
+	})
+}
+
+func TestRealtimeRejectsNonMembers(t *testing.T) {
+	_, server := newRealtimeTestServer(t, fakeAuthorizer{})
+
+	_, resp, err := dialRealtime(t, server, "room-1", "mallory")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// readEnvelopeOfType skips envelopes until one of msgType arrives.
+func readEnvelopeOfType(t *testing.T, conn *websocket.Conn, msgType string) realtime.Envelope {
+	for {
+		env := readEnvelope(t, conn)
+		if env.Type == msgType || t.Failed() {
+			return env
+		}
+	}
+}
+
+type fakeEditor struct {
+	server *ot.Server
+	store  *memoryOTStore
+}
+
+func (f *fakeEditor) OpenDocument(actorID string, collaborationID string, documentID string) (*user.Document, error) {
+	content, revision, _ := f.store.Snapshot(documentID)
+	return &user.Document{ID: documentID, Content: content, Revision: revision}, nil
+}
+
+func (f *fakeEditor) ApplyOperation(actorID string, collaborationID string, documentID string, revision int, op ot.Operation, applied func(ot.Operation, int)) (ot.Operation, int, error) {
+	return f.server.Receive(documentID, actorID, revision, op, applied)
+}
+
+func TestRealtimeOrigins(t *testing.T) {
+	_, server := newRealtimeTestServer(t, fakeAuthorizer{"room-1/alice": collaboration.RoleOwner})
+
+	token, err := utils.GenerateToken("alice")
+	assert.NoError(t, err)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/collaborations/room-1?access_token=" + token
+
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+		}
+		return resp, err
+	}
+
+	// with no allowed origins, only pages from the same host may connect
+	_, err = dial(server.URL)
+	assert.NoError(t, err)
+
+	_, err = dial("")
+	assert.NoError(t, err)
+
+	resp, err := dial("https://evil.example")
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+type fakeSyncer struct{}
+
+func (fakeSyncer) SyncCRDTDocument(actorID string, collaborationID string, documentID string, stateVector []byte, update []byte) (*collaboration.CRDTSyncResult, error) {
+	return &collaboration.CRDTSyncResult{DocumentID: documentID}, nil
+}
+
+func TestRealtimeUnverifiedAccess(t *testing.T) {
+	store := &memoryOTStore{content: "hello"}
+	hub := realtime.NewHub(logging.NewLogger())
+	realtime.RegisterDocumentHandlers(hub, &fakeEditor{server: ot.NewServer(store), store: store})
+	realtime.RegisterCRDTHandlers(hub, fakeSyncer{})
+	wsHandler := realtime.NewHandler(hub, fakeAuthorizer{"room-1/alice": collaboration.RoleOwner}, nil)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.GET("/ws/collaborations/:id", wsHandler.ServeWS)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	token, _, err := utils.IssueAccessToken(&utils.Claims{UserID: "alice", Unverified: true})
+	require.NoError(t, err)
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/collaborations/room-1?access_token=" + token
+
+	t.Run("none", func(t *testing.T) {
+		wsHandler.UnverifiedAccess = auth.UnverifiedNone
+
+		_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+		assert.Error(t, err)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		wsHandler.UnverifiedAccess = auth.UnverifiedReadOnly
+
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		readEnvelopeOfType(t, conn, realtime.TypeWelcome)
+
+		send := func(msgType string, payload interface{}) {
+			env, err := realtime.NewEnvelope(msgType, "room-1", payload)
+			require.NoError(t, err)
+			require.NoError(t, conn.WriteJSON(env))
+		}
+
+		// following the collaboration is allowed
+		send(realtime.TypeOpen, realtime.OpenPayload{DocumentID: "doc"})
+		assert.Equal(t, realtime.TypeSnapshot, readEnvelope(t, conn).Type)
+		send(realtime.TypeCRDTSync, realtime.CRDTSyncPayload{DocumentID: "doc"})
+		assert.Equal(t, realtime.TypeCRDTSync, readEnvelope(t, conn).Type)
+
+		// changing it is not
+		send(realtime.TypeOperation, realtime.OperationPayload{DocumentID: "doc", Operation: *ot.New().Insert("x").Retain(5)})
+		send(realtime.TypeCRDTSync, realtime.CRDTSyncPayload{DocumentID: "doc", Update: []byte("update")})
+		send(realtime.TypeMessage, map[string]string{"text": "hi"})
+		for i := 0; i < 3; i++ {
+			env := readEnvelope(t, conn)
+			assert.Equal(t, realtime.TypeError, env.Type)
+			assert.Contains(t, string(env.Payload), "not verified")
+		}
+
+		content, _, _ := store.Snapshot("doc")
+		assert.Equal(t, "hello", content)
+	})
+}
+
+// memberList is a fakeAuthorizer whose members can be removed while clients are connected.
+type memberList struct {
+	mu      sync.Mutex
+	members fakeAuthorizer
+}
+
+func (m *memberList) Authorize(collaborationID string, userID string, action collaboration.Action) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.members.Authorize(collaborationID, userID, action)
+}
+
+func (m *memberList) remove(collaborationID string, userID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.members, collaborationID+"/"+userID)
+}
+
+// revokedTokens is a utils.RevocationChecker holding the revoked jtis.
+type revokedTokens struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func (r *revokedTokens) IsTokenRevoked(jti string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ids[jti], nil
+}
+
+func (r *revokedTokens) revoke(jti string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ids[jti] = true
+}
+
+// readCloseCode reads until the server closes the connection and returns the close code.
+func readCloseCode(t *testing.T, conn *websocket.Conn) int {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+
+		var closeErr *websocket.CloseError
+		if assert.ErrorAs(t, err, &closeErr) {
+			return closeErr.Code
+		}
+		return 0
+	}
+}
+
+func TestRealtimeSessionChecks(t *testing.T) {
+	members := &memberList{members: fakeAuthorizer{
+		"room-1/alice": collaboration.RoleOwner,
+		"room-1/bob":   collaboration.RoleViewer,
+		"room-1/carol": collaboration.RoleCommenter,
+	}}
+	hub, server := newRealtimeTestServer(t, members)
+
+	revoked := &revokedTokens{ids: map[string]bool{}}
+	utils.SetRevocationChecker(revoked)
+	t.Cleanup(func() { utils.SetRevocationChecker(nil) })
+
+	dial := func(userID string) (*websocket.Conn, *utils.Claims) {
+		token, claims, err := utils.IssueAccessToken(&utils.Claims{UserID: userID})
+		require.NoError(t, err)
+
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws/collaborations/room-1?access_token=" + token
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		readEnvelopeOfType(t, conn, realtime.TypeWelcome)
+
+		return conn, claims
+	}
+	chat := func(conn *websocket.Conn, text string) {
+		env, err := realtime.NewEnvelope(realtime.TypeMessage, "room-1", map[string]string{"text": text})
+		require.NoError(t, err)
+		require.NoError(t, conn.WriteJSON(env))
+	}
+
+	t.Run("viewers may not chat", func(t *testing.T) {
+		bob, _ := dial("bob")
+		chat(bob, "hi")
+
+		env := readEnvelope(t, bob)
+		assert.Equal(t, realtime.TypeError, env.Type)
+		assert.Contains(t, string(env.Payload), "insufficient role")
+	})
+
+	t.Run("commenters may chat", func(t *testing.T) {
+		alice, _ := dial("alice")
+		carol, _ := dial("carol")
+		chat(carol, "hi")
+
+		received := readEnvelopeOfType(t, alice, realtime.TypeMessage)
+		assert.Equal(t, "carol", received.Sender)
+	})
+
+	t.Run("revoked tokens are disconnected", func(t *testing.T) {
+		alice, claims := dial("alice")
+		revoked.revoke(claims.Id)
+		chat(alice, "still here?")
+
+		assert.Equal(t, websocket.ClosePolicyViolation, readCloseCode(t, alice))
+	})
+
+	t.Run("removed members are disconnected", func(t *testing.T) {
+		carol, _ := dial("carol")
+		members.remove("room-1", "carol")
+		chat(carol, "still here?")
+
+		assert.Equal(t, websocket.ClosePolicyViolation, readCloseCode(t, carol))
+	})
+
+	t.Run("expired tokens are disconnected", func(t *testing.T) {
+		ttl := utils.AccessTokenTTL
+		utils.AccessTokenTTL = 2 * time.Second
+		defer func() { utils.AccessTokenTTL = ttl }()
+
+		alice, _ := dial("alice")
+		assert.Equal(t, websocket.ClosePolicyViolation, readCloseCode(t, alice))
+	})
+
+	t.Run("queued frames are sent before closing", func(t *testing.T) {
+		alice, _ := dial("alice")
+
+		for i := 0; i < 100; i++ {
+			hub.Broadcast("room-1", realtime.TypeMessage, "server", map[string]int{"n": i}, nil)
+		}
+		assert.NoError(t, hub.Shutdown(context.Background()))
+
+		received := 0
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var env realtime.Envelope
+			err := alice.ReadJSON(&env)
+			if err != nil {
+				assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+				break
+			}
+			if env.Type == realtime.TypeMessage {
+				received++
+			}
+		}
+		assert.Equal(t, 100, received)
+	})
+}
+
+func TestRealtimePresence(t *testing.T) {
+	authorizer := fakeAuthorizer{
+		"room-1/alice": collaboration.RoleOwner,
+		"room-1/bob":   collaboration.RoleEditor,
+	}
+	store := &memoryOTStore{content: "hello"}
+
+	hub := realtime.NewHub(logging.NewLogger())
+	presence := realtime.NewPresence(hub, nil)
+	realtime.RegisterDocumentHandlers(hub, &fakeEditor{server: ot.NewServer(store), store: store}, presence)
+
+	wsHandler := realtime.NewHandler(hub, authorizer, nil)
+	wsHandler.Presence = presence
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.GET("/ws/collaborations/:id", wsHandler.ServeWS)
+	r.GET("/api/collaborations/:id/presence", func(c *gin.Context) {
+		c.Set("user_id", c.GetHeader("X-Test-User"))
+	}, wsHandler.PresenceHandler)
+
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	listPresence := func(userID string) (int, []realtime.Participant) {
+		req := httptest.NewRequest("GET", "/api/collaborations/room-1/presence", nil)
+		req.Header.Set("X-Test-User", userID)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		var body struct {
+			Data []realtime.Participant `json:"data"`
+		}
+		json.Unmarshal(resp.Body.Bytes(), &body)
+		return resp.Code, body.Data
+	}
+
+	alice, _, err := dialRealtime(t, server, "room-1", "alice")
+	assert.NoError(t, err)
+	defer alice.Close()
+
+	snapshot := readEnvelopeOfType(t, alice, realtime.TypePresenceSnapshot)
+	assert.Contains(t, string(snapshot.Payload), `"userId":"alice"`)
+
+	bob, _, err := dialRealtime(t, server, "room-1", "bob")
+	assert.NoError(t, err)
+	defer bob.Close()
+	readEnvelopeOfType(t, bob, realtime.TypePresenceSnapshot)
+
+	var joined realtime.Participant
+	assert.NoError(t, json.Unmarshal(readEnvelopeOfType(t, alice, realtime.TypePresence).Payload, &joined))
+	assert.Equal(t, "bob", joined.UserID)
+	assert.Equal(t, realtime.StateActive, joined.State)
+	assert.Equal(t, realtime.ColorFor(user.User{ID: "bob"}), joined.Color)
+
+	t.Run("cursor updates are broadcast", func(t *testing.T) {
+		cursor := 3
+		env, err := realtime.NewEnvelope(realtime.TypePresenceUpdate, "room-1", realtime.PresenceUpdatePayload{
+			DocumentID: "doc",
+			Cursor:     &cursor,
+			Selections: []realtime.Range{{Anchor: 1, Head: 3}},
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, bob.WriteJSON(env))
+
+		var update realtime.Participant
+		assert.NoError(t, json.Unmarshal(readEnvelopeOfType(t, alice, realtime.TypePresence).Payload, &update))
+		assert.Equal(t, 3, *update.Cursor)
+	})
+
+	t.Run("cursors follow edits", func(t *testing.T) {
+		env, err := realtime.NewEnvelope(realtime.TypeOperation, "room-1", realtime.OperationPayload{
+			DocumentID: "doc",
+			Operation:  *ot.New().Insert("ab").Retain(5),
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, alice.WriteJSON(env))
+		readEnvelopeOfType(t, alice, realtime.TypeAck)
+
+		code, participants := listPresence("alice")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Len(t, participants, 2)
+		assert.Equal(t, "bob", participants[1].UserID)
+		assert.Equal(t, 5, *participants[1].Cursor)
+		assert.Equal(t, []realtime.Range{{Anchor: 3, Head: 5}}, participants[1].Selections)
+	})
+
+	t.Run("non members cannot list presence", func(t *testing.T) {
+		code, _ := listPresence("mallory")
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("quiet sessions go idle", func(t *testing.T) {
+		presence.IdleAfter = 20 * time.Millisecond
+		presence.AwayAfter = time.Hour
+
+		stop := make(chan struct{})
+		defer close(stop)
+		go presence.Run(10*time.Millisecond, stop)
+
+		for {
+			var update realtime.Participant
+			assert.NoError(t, json.Unmarshal(readEnvelopeOfType(t, alice, realtime.TypePresence).Payload, &update))
+			if update.UserID == "bob" || t.Failed() {
+				assert.Equal(t, realtime.StateIdle, update.State)
+				break
+			}
+		}
+	})
+
+	t.Run("leaving is broadcast", func(t *testing.T) {
+		bob.Close()
+
+		var left realtime.PresenceLeavePayload
+		assert.NoError(t, json.Unmarshal(readEnvelopeOfType(t, alice, realtime.TypePresenceLeave).Payload, &left))
+		assert.Equal(t, "bob", left.UserID)
+
+		_, participants := listPresence("alice")
+		assert.Len(t, participants, 1)
+	})
+}
+
+func TestTransformIndex(t *testing.T) {
+	op := ot.New().Retain(2).Insert("xy").Delete(2).Retain(3)
+
+	assert.Equal(t, 0, op.TransformIndex(0))
+	assert.Equal(t, 4, op.TransformIndex(2))
+	assert.Equal(t, 4, op.TransformIndex(3))
+	assert.Equal(t, 5, op.TransformIndex(5))
+}
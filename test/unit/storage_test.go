@@ -0,0 +1,628 @@
+package unit
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/similadayo/internal/collaboration"
+	"github.com/similadayo/internal/ot"
+	"github.com/similadayo/internal/storage"
+	"github.com/similadayo/internal/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// storageBackends returns a fresh instance of every backend under test.
+// PostgreSQL is included when TEST_POSTGRES_DSN points at a database the
+// suite may wipe.
+func storageBackends(t *testing.T) map[string]func(t *testing.T) *storage.Backend {
+	backends := map[string]func(t *testing.T) *storage.Backend{
+		storage.DriverSQLite: func(t *testing.T) *storage.Backend {
+			return storage.FromDB(newMigratedTestDB(t))
+		},
+		storage.DriverMemory: func(t *testing.T) *storage.Backend {
+			backend, err := storage.Open(storage.DriverMemory, "")
+			require.NoError(t, err)
+			return backend
+		},
+	}
+
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Log("TEST_POSTGRES_DSN not set, skipping postgres backend")
+		return backends
+	}
+
+	backends[storage.DriverPostgres] = func(t *testing.T) *storage.Backend {
+		backend, err := storage.Open(storage.DriverPostgres, dsn)
+		require.NoError(t, err)
+
+		migrator, err := backend.Migrator()
+		require.NoError(t, err)
+		_, err = migrator.To(0)
+		require.NoError(t, err)
+		require.NoError(t, backend.Prepare(true))
+
+		sqlDB, err := backend.DB.DB()
+		require.NoError(t, err)
+		t.Cleanup(func() { sqlDB.Close() })
+
+		return backend
+	}
+
+	return backends
+}
+
+func TestUserRepositoryConformance(t *testing.T) {
+	for name, open := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			testUserRepository(t, open(t).Users)
+		})
+	}
+}
+
+func TestCollaborationRepositoryConformance(t *testing.T) {
+	for name, open := range storageBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			backend := open(t)
+			testCollaborationRepository(t, backend.Users, backend.Collaborations)
+		})
+	}
+}
+
+func TestOpenUnknownDriver(t *testing.T) {
+	_, err := storage.Open("mysql", "")
+	assert.ErrorIs(t, err, storage.ErrUnknownDriver)
+
+	backend, err := storage.Open(storage.DriverMemory, "")
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Prepare(true))
+
+	_, err = backend.Migrator()
+	assert.ErrorIs(t, err, storage.ErrNoSchema)
+}
+
+func registerTestUser(t *testing.T, repo user.Repository, userName string, created time.Time) user.User {
+	u, err := repo.Register(user.User{
+		ID:       uuid.New().String(),
+		UserName: userName,
+		Password: "hashed-" + userName,
+		Email:    userName + "@example.com",
+		Created:  created,
+		Updated:  created,
+	})
+	require.NoError(t, err)
+	return u
+}
+
+func testUserRepository(t *testing.T, repo user.Repository) {
+	base := time.Now().Truncate(time.Second)
+	ada := registerTestUser(t, repo, "ada", base)
+	grace := registerTestUser(t, repo, "Grace", base.Add(time.Second))
+	linus := registerTestUser(t, repo, "linus", base.Add(2*time.Second))
+
+	t.Run("lookups", func(t *testing.T) {
+		got, err := repo.GetUserByID(ada.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "ada", got.UserName)
+
+		got, err = repo.GetUserByUserName("Grace")
+		assert.NoError(t, err)
+		assert.Equal(t, grace.ID, got.ID)
+
+		// addresses stored before they were normalized are still found
+		got, err = repo.GetUserByEmail("grace@example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, grace.ID, got.ID)
+
+		got, err = repo.GetUser(user.User{Email: "linus@example.com", Password: "hashed-linus"})
+		assert.NoError(t, err)
+		assert.Equal(t, linus.ID, got.ID)
+
+		_, err = repo.GetUser(user.User{Email: "linus@example.com", Password: "wrong"})
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		_, err = repo.GetUserByID(uuid.New().String())
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("duplicate id", func(t *testing.T) {
+		_, err := repo.Register(user.User{ID: ada.ID, UserName: "imposter"})
+		assert.Error(t, err)
+	})
+
+	t.Run("duplicate username or email", func(t *testing.T) {
+		_, err := repo.Register(user.User{ID: uuid.New().String(), UserName: "ada", Email: "other@example.com"})
+		assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+
+		_, err = repo.Register(user.User{ID: uuid.New().String(), UserName: "ada2", Email: "ADA@example.com"})
+		assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+
+		_, err = repo.UpdateUser(user.User{ID: linus.ID, UserName: "Grace"})
+		assert.ErrorIs(t, err, gorm.ErrDuplicatedKey)
+	})
+
+	t.Run("update keeps unset fields", func(t *testing.T) {
+		_, err := repo.UpdateUser(user.User{ID: ada.ID, FirstName: "Ada"})
+		assert.NoError(t, err)
+
+		got, err := repo.GetUserByID(ada.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Ada", got.FirstName)
+		assert.Equal(t, "ada@example.com", got.Email)
+	})
+
+	t.Run("filter and paginate", func(t *testing.T) {
+		users, err := repo.FilterUserByName("A")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Grace", "ada"}, userNames(users))
+
+		page, err := repo.PaginationUser(1, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ada", "Grace"}, userNames(page))
+
+		page, err = repo.PaginationUser(2, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"linus"}, userNames(page))
+
+		page, err = repo.PaginationUser(3, 2)
+		assert.NoError(t, err)
+		assert.Empty(t, page)
+	})
+
+	t.Run("refresh tokens", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour)
+		first := user.RefreshToken{
+			ID:        uuid.New().String(),
+			UserID:    grace.ID,
+			FamilyID:  uuid.New().String(),
+			TokenHash: uuid.New().String(),
+			AccessJTI: uuid.New().String(),
+			ExpiresAt: expires,
+			Created:   time.Now(),
+		}
+		require.NoError(t, repo.CreateRefreshToken(first))
+		assert.Error(t, repo.CreateRefreshToken(first))
+
+		got, err := repo.GetRefreshTokenByHash(first.TokenHash)
+		assert.NoError(t, err)
+		assert.Equal(t, first.ID, got.ID)
+		assert.False(t, got.Revoked)
+
+		_, err = repo.GetRefreshTokenByHash("unknown")
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		second := first
+		second.ID = uuid.New().String()
+		second.TokenHash = uuid.New().String()
+		second.AccessJTI = uuid.New().String()
+		assert.NoError(t, repo.RotateRefreshToken(first, second))
+
+		got, err = repo.GetRefreshTokenByHash(first.TokenHash)
+		assert.NoError(t, err)
+		assert.True(t, got.Revoked)
+		assert.Equal(t, second.ID, got.ReplacedBy)
+
+		third := second
+		third.ID = uuid.New().String()
+		third.TokenHash = uuid.New().String()
+		assert.ErrorIs(t, repo.RotateRefreshToken(first, third), user.ErrTokenAlreadyRotated)
+
+		assert.NoError(t, repo.RevokeTokenFamily(first.FamilyID))
+		got, err = repo.GetRefreshTokenByHash(second.TokenHash)
+		assert.NoError(t, err)
+		assert.True(t, got.Revoked)
+
+		revoked, err := repo.IsTokenRevoked(second.AccessJTI)
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+	})
+
+	t.Run("access token revocation", func(t *testing.T) {
+		jti := uuid.New().String()
+		revoked, err := repo.IsTokenRevoked(jti)
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+
+		assert.NoError(t, repo.RevokeAccessToken(jti, time.Now().Add(-time.Minute)))
+		assert.NoError(t, repo.RevokeAccessToken(jti, time.Now().Add(time.Hour)))
+		revoked, err = repo.IsTokenRevoked(jti)
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+
+		// the first revocation is kept, so the record has already expired
+		assert.NoError(t, repo.DeleteExpiredTokens(time.Now()))
+		revoked, err = repo.IsTokenRevoked(jti)
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	})
+
+	t.Run("revoke user tokens", func(t *testing.T) {
+		token := user.RefreshToken{
+			ID:        uuid.New().String(),
+			UserID:    linus.ID,
+			FamilyID:  uuid.New().String(),
+			TokenHash: uuid.New().String(),
+			AccessJTI: uuid.New().String(),
+			ExpiresAt: time.Now().Add(time.Hour),
+			Created:   time.Now(),
+		}
+		require.NoError(t, repo.CreateRefreshToken(token))
+		assert.NoError(t, repo.RevokeUserTokens(linus.ID))
+
+		got, err := repo.GetRefreshTokenByHash(token.TokenHash)
+		assert.NoError(t, err)
+		assert.True(t, got.Revoked)
+
+		revoked, err := repo.IsTokenRevoked(token.AccessJTI)
+		assert.NoError(t, err)
+		assert.True(t, revoked)
+	})
+
+	t.Run("password reset tokens", func(t *testing.T) {
+		now := time.Now()
+		newToken := func(expiresAt time.Time) user.PasswordResetToken {
+			return user.PasswordResetToken{
+				ID:        uuid.New().String(),
+				UserID:    linus.ID,
+				TokenHash: uuid.New().String(),
+				ExpiresAt: expiresAt,
+				Created:   now,
+			}
+		}
+
+		replaced := newToken(now.Add(time.Hour))
+		require.NoError(t, repo.CreatePasswordResetToken(replaced))
+		current := newToken(now.Add(time.Hour))
+		require.NoError(t, repo.CreatePasswordResetToken(current))
+
+		// a newer token replaces the unused ones
+		_, err := repo.ConsumePasswordResetToken(replaced.TokenHash, now)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		got, err := repo.ConsumePasswordResetToken(current.TokenHash, now)
+		require.NoError(t, err)
+		assert.Equal(t, linus.ID, got.UserID)
+		assert.NotNil(t, got.UsedAt)
+
+		// each token works once
+		_, err = repo.ConsumePasswordResetToken(current.TokenHash, now)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		expired := newToken(now.Add(-time.Minute))
+		require.NoError(t, repo.CreatePasswordResetToken(expired))
+		_, err = repo.ConsumePasswordResetToken(expired.TokenHash, now)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		assert.NoError(t, repo.UpdatePassword(linus.ID, "new-hash", now))
+		updated, err := repo.GetUserByID(linus.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "new-hash", updated.Password)
+		assert.ErrorIs(t, repo.UpdatePassword("missing", "new-hash", now), gorm.ErrRecordNotFound)
+	})
+
+	t.Run("two-factor authentication", func(t *testing.T) {
+		now := time.Now()
+		code := func(hash string) user.RecoveryCode {
+			return user.RecoveryCode{ID: uuid.New().String(), UserID: linus.ID, CodeHash: hash, Created: now}
+		}
+
+		require.NoError(t, repo.SetTOTPSecret(linus.ID, "SECRET"))
+		got, err := repo.GetUserByID(linus.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "SECRET", got.TOTPSecret)
+		assert.False(t, got.TOTPEnabled)
+
+		require.NoError(t, repo.EnableTOTP(linus.ID, 10, []user.RecoveryCode{code("a"), code("b")}))
+		got, err = repo.GetUserByID(linus.ID)
+		require.NoError(t, err)
+		assert.True(t, got.TOTPEnabled)
+		assert.Equal(t, int64(10), got.TOTPLastCounter)
+
+		// steps must move forward
+		assert.ErrorIs(t, repo.UseTOTPCounter(linus.ID, 10), user.ErrTOTPCodeReused)
+		assert.NoError(t, repo.UseTOTPCounter(linus.ID, 11))
+		assert.ErrorIs(t, repo.UseTOTPCounter(linus.ID, 11), user.ErrTOTPCodeReused)
+
+		assert.NoError(t, repo.ConsumeRecoveryCode(linus.ID, "a", now))
+		assert.ErrorIs(t, repo.ConsumeRecoveryCode(linus.ID, "a", now), gorm.ErrRecordNotFound)
+		assert.ErrorIs(t, repo.ConsumeRecoveryCode(grace.ID, "b", now), gorm.ErrRecordNotFound)
+
+		require.NoError(t, repo.ReplaceRecoveryCodes(linus.ID, []user.RecoveryCode{code("c")}))
+		assert.ErrorIs(t, repo.ConsumeRecoveryCode(linus.ID, "b", now), gorm.ErrRecordNotFound)
+
+		require.NoError(t, repo.DisableTOTP(linus.ID))
+		got, err = repo.GetUserByID(linus.ID)
+		require.NoError(t, err)
+		assert.False(t, got.TOTPEnabled)
+		assert.Empty(t, got.TOTPSecret)
+		assert.ErrorIs(t, repo.ConsumeRecoveryCode(linus.ID, "c", now), gorm.ErrRecordNotFound)
+	})
+
+	t.Run("login throttles", func(t *testing.T) {
+		now := time.Now()
+		_, err := repo.GetLoginThrottle("account:linus")
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		assert.ErrorIs(t, repo.LockLogin("account:linus", now), gorm.ErrRecordNotFound)
+
+		for i := 1; i <= 3; i++ {
+			throttle, err := repo.RecordLoginFailure("account:linus", now.Add(time.Duration(i)*time.Second), time.Hour)
+			require.NoError(t, err)
+			assert.Equal(t, i, throttle.Failures)
+		}
+
+		// other keys are counted apart
+		throttle, err := repo.RecordLoginFailure("ip:192.0.2.1", now, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, throttle.Failures)
+
+		require.NoError(t, repo.LockLogin("account:linus", now.Add(time.Minute)))
+		throttle, err = repo.GetLoginThrottle("account:linus")
+		require.NoError(t, err)
+		assert.Equal(t, 3, throttle.Failures)
+		assert.WithinDuration(t, now.Add(time.Minute), throttle.LockedUntil, time.Millisecond)
+		assert.WithinDuration(t, now.Add(3*time.Second), throttle.LastFailure, time.Millisecond)
+
+		// failures older than the window are forgotten
+		throttle, err = repo.RecordLoginFailure("account:linus", now.Add(2*time.Hour), time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 1, throttle.Failures)
+
+		require.NoError(t, repo.ClearLoginThrottle("account:linus"))
+		_, err = repo.GetLoginThrottle("account:linus")
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		_, err = repo.GetLoginThrottle("ip:192.0.2.1")
+		assert.NoError(t, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		assert.NoError(t, repo.DeleteUser(linus.ID))
+		_, err := repo.GetUserByID(linus.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+		assert.ErrorIs(t, repo.DeleteUser(linus.ID), gorm.ErrRecordNotFound)
+	})
+}
+
+func userNames(users []user.User) []string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.UserName
+	}
+	return names
+}
+
+func testCollaborationRepository(t *testing.T, users user.Repository, repo collaboration.Repository) {
+	now := time.Now().Truncate(time.Second)
+	owner := registerTestUser(t, users, "owner", now)
+	editor := registerTestUser(t, users, "editor", now)
+	outsider := registerTestUser(t, users, "outsider", now)
+
+	collab := &user.Collaboration{ID: uuid.New().String(), ProjectID: 42, Name: "Specs", CreatedBy: owner.ID, Created: now, Updated: now}
+	require.NoError(t, repo.CreateCollaboration(collab))
+	other := &user.Collaboration{ID: uuid.New().String(), ProjectID: 7, Name: "Other", CreatedBy: outsider.ID, Created: now, Updated: now}
+	require.NoError(t, repo.CreateCollaboration(other))
+
+	t.Run("members", func(t *testing.T) {
+		require.NoError(t, repo.AddUserToCollaboration(collab.ID, owner.ID, collaboration.RoleOwner))
+		require.NoError(t, repo.AddUserToCollaboration(collab.ID, editor.ID, collaboration.RoleViewer))
+		require.NoError(t, repo.AddUserToCollaboration(other.ID, outsider.ID, collaboration.RoleOwner))
+
+		// adding an existing member leaves their role alone
+		assert.ErrorIs(t, repo.AddUserToCollaboration(collab.ID, editor.ID, collaboration.RoleOwner), collaboration.ErrAlreadyMember)
+		membership, err := repo.GetMembership(collab.ID, editor.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, collaboration.RoleViewer, membership.Role)
+		require.NoError(t, repo.UpdateMemberRole(collab.ID, editor.ID, collaboration.RoleEditor))
+
+		assert.ErrorIs(t, repo.AddUserToCollaboration(collab.ID, uuid.New().String(), collaboration.RoleViewer), gorm.ErrRecordNotFound)
+		assert.ErrorIs(t, repo.AddUserToCollaboration(uuid.New().String(), editor.ID, collaboration.RoleViewer), gorm.ErrRecordNotFound)
+
+		_, err = repo.GetMembership(collab.ID, outsider.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		members, err := repo.GetMembers(collab.ID)
+		assert.NoError(t, err)
+		assert.Len(t, members, 2)
+	})
+
+	t.Run("queries", func(t *testing.T) {
+		got, err := repo.GetCollaborationByID(collab.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "Specs", got.Name)
+		assert.ElementsMatch(t, []string{"owner", "editor"}, userNames(got.Users))
+
+		_, err = repo.GetCollaborationByID(uuid.New().String())
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		byUser, err := repo.GetCollaborationsByUserID(editor.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{collab.ID}, collaborationIDs(byUser))
+
+		byProject, err := repo.GetCollaborationsByProjectID("7", outsider.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{other.ID}, collaborationIDs(byProject))
+
+		// only the caller's own collaborations are listed
+		byProject, err = repo.GetCollaborationsByProjectID("7", editor.ID)
+		assert.NoError(t, err)
+		assert.Empty(t, byProject)
+
+		byUsers, err := repo.GetCollaborationsByUsers([]string{owner.ID, editor.ID, outsider.ID})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{collab.ID, other.ID}, collaborationIDs(byUsers))
+	})
+
+	t.Run("ownership", func(t *testing.T) {
+		assert.ErrorIs(t, repo.UpdateMemberRole(collab.ID, owner.ID, collaboration.RoleEditor), collaboration.ErrLastOwner)
+		assert.ErrorIs(t, repo.RemoveUserFromCollaboration(collab.ID, owner.ID), collaboration.ErrLastOwner)
+		assert.ErrorIs(t, repo.UpdateMemberRole(collab.ID, outsider.ID, collaboration.RoleEditor), gorm.ErrRecordNotFound)
+
+		membership, err := repo.GetMembership(collab.ID, owner.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, collaboration.RoleOwner, membership.Role)
+
+		require.NoError(t, repo.TransferOwnership(collab.ID, owner.ID, editor.ID))
+		membership, err = repo.GetMembership(collab.ID, editor.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, collaboration.RoleOwner, membership.Role)
+		membership, err = repo.GetMembership(collab.ID, owner.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, collaboration.RoleEditor, membership.Role)
+
+		assert.NoError(t, repo.RemoveUserFromCollaboration(collab.ID, owner.ID))
+		assert.ErrorIs(t, repo.RemoveUserFromCollaboration(collab.ID, owner.ID), gorm.ErrRecordNotFound)
+	})
+
+	t.Run("concurrent demotions keep an owner", func(t *testing.T) {
+		shared := &user.Collaboration{ID: uuid.New().String(), ProjectID: 42, Name: "Shared", CreatedBy: owner.ID, Created: now, Updated: now}
+		require.NoError(t, repo.CreateCollaboration(shared))
+		require.NoError(t, repo.AddUserToCollaboration(shared.ID, owner.ID, collaboration.RoleOwner))
+		require.NoError(t, repo.AddUserToCollaboration(shared.ID, editor.ID, collaboration.RoleOwner))
+
+		// each demotion alone is allowed, but not both
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i, id := range []string{owner.ID, editor.ID} {
+			wg.Add(1)
+			go func(i int, id string) {
+				defer wg.Done()
+				errs[i] = repo.UpdateMemberRole(shared.ID, id, collaboration.RoleEditor)
+			}(i, id)
+		}
+		wg.Wait()
+
+		failed := 0
+		for _, err := range errs {
+			if err != nil {
+				assert.ErrorIs(t, err, collaboration.ErrLastOwner)
+				failed++
+			}
+		}
+		assert.Equal(t, 1, failed)
+
+		members, err := repo.GetMembers(shared.ID)
+		assert.NoError(t, err)
+		owners := 0
+		for _, member := range members {
+			if member.Role == collaboration.RoleOwner {
+				owners++
+			}
+		}
+		assert.Equal(t, 1, owners)
+	})
+
+	document := &user.Document{Name: "readme", Title: "Readme", Content: "hello", Created: now, Updated: now}
+
+	t.Run("documents", func(t *testing.T) {
+		require.NoError(t, repo.AddDocumentToCollaboration(collab.ID, document))
+		assert.NotEmpty(t, document.ID)
+
+		got, err := repo.GetDocumentInCollaboration(collab.ID, document.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello", got.Content)
+
+		_, err = repo.GetDocumentInCollaboration(other.ID, document.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		document.Title = "Read me"
+		assert.NoError(t, repo.UpdateDocumentTitle(document))
+		loaded, err := repo.GetCollaborationByID(collab.ID)
+		assert.NoError(t, err)
+		require.Len(t, loaded.Documents, 1)
+		assert.Equal(t, "Read me", loaded.Documents[0].Title)
+	})
+
+	t.Run("operation log", func(t *testing.T) {
+		require.NoError(t, repo.EnsureDocumentSnapshot(document.ID))
+
+		content, revision, err := repo.Snapshot(document.ID)
+		require.NoError(t, err)
+		assert.Equal(t, 0, revision)
+
+		for _, word := range []string{" there", " and", " welcome"} {
+			op := ot.Diff(content, content+word)
+			content += word
+			require.NoError(t, repo.Append(document.ID, editor.ID, revision, op, content))
+			revision++
+		}
+
+		assert.ErrorIs(t, repo.Append(document.ID, editor.ID, 1, ot.Diff(content, content+"!"), content+"!"), ot.ErrRevisionConflict)
+
+		current, currentRevision, err := repo.Snapshot(document.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello there and welcome", current)
+		assert.Equal(t, 3, currentRevision)
+
+		ops, err := repo.OperationsSince(document.ID, 1)
+		assert.NoError(t, err)
+		assert.Len(t, ops, 2)
+
+		old, err := repo.ContentAt(document.ID, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello there and", old)
+
+		_, _, err = repo.Snapshot(uuid.New().String())
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("versions", func(t *testing.T) {
+		first := &user.DocumentVersion{ID: uuid.New().String(), DocumentID: document.ID, Revision: 1, AuthorID: editor.ID, Created: now}
+		second := &user.DocumentVersion{ID: uuid.New().String(), DocumentID: document.ID, Revision: 3, AuthorID: editor.ID, Created: now}
+		require.NoError(t, repo.CreateDocumentVersion(first))
+		require.NoError(t, repo.CreateDocumentVersion(second))
+		assert.Equal(t, 1, first.Number)
+		assert.Equal(t, 2, second.Number)
+		assert.Equal(t, first.ID, second.ParentID)
+
+		versions, err := repo.GetDocumentVersions(document.ID)
+		assert.NoError(t, err)
+		require.Len(t, versions, 2)
+		assert.Equal(t, 2, versions[0].Number)
+
+		got, err := repo.GetDocumentVersion(document.ID, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, first.ID, got.ID)
+
+		_, err = repo.GetDocumentVersion(document.ID, 3)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	})
+
+	t.Run("crdt updates", func(t *testing.T) {
+		crdtDocument := &user.CRDTDocument{ID: uuid.New().String(), CollaborationID: collab.ID, Name: "notes", Created: now, Updated: now}
+		require.NoError(t, repo.CreateCRDTDocument(crdtDocument))
+
+		_, err := repo.GetCRDTDocument(other.ID, crdtDocument.ID)
+		assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+		require.NoError(t, repo.AppendCRDTUpdate(crdtDocument.ID, []byte{1}, "a"))
+		require.NoError(t, repo.AppendCRDTUpdate(crdtDocument.ID, []byte{2}, "ab"))
+		require.NoError(t, repo.AppendCRDTUpdate(crdtDocument.ID, []byte{3}, "abc"))
+
+		got, err := repo.GetCRDTDocument(collab.ID, crdtDocument.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, "abc", got.Content)
+
+		updates, err := repo.GetCRDTUpdates(crdtDocument.ID)
+		require.NoError(t, err)
+		require.Len(t, updates, 3)
+
+		require.NoError(t, repo.CompactCRDTUpdates(crdtDocument.ID, []uint{updates[0].ID, updates[1].ID}, []byte{1, 2}))
+		updates, err = repo.GetCRDTUpdates(crdtDocument.ID)
+		require.NoError(t, err)
+		require.Len(t, updates, 2)
+		assert.Equal(t, []byte{3}, updates[0].Update)
+		assert.Equal(t, []byte{1, 2}, updates[1].Update)
+	})
+}
+
+func collaborationIDs(collaborations []*user.Collaboration) []string {
+	ids := make([]string, len(collaborations))
+	for i, c := range collaborations {
+		ids[i] = c.ID
+	}
+	return ids
+}
@@ -0,0 +1,60 @@
+package unit
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/similadayo/internal/textdiff"
+	"github.com/stretchr/testify/assert"
+)
+
+// rebuild returns the old and new texts described by a list of edits.
+func rebuild(edits []textdiff.Edit) (string, string) {
+	var from, to strings.Builder
+	for _, e := range edits {
+		if e.Op != textdiff.OpInsert {
+			from.WriteString(e.Text)
+		}
+		if e.Op != textdiff.OpDelete {
+			to.WriteString(e.Text)
+		}
+	}
+
+	return from.String(), to.String()
+}
+
+func TestRuneDiff(t *testing.T) {
+	edits := textdiff.Runes("kitten", "sitting")
+	assert.Equal(t, []textdiff.Edit{
+		{Op: textdiff.OpDelete, Text: "k"},
+		{Op: textdiff.OpInsert, Text: "s"},
+		{Op: textdiff.OpEqual, Text: "itt"},
+		{Op: textdiff.OpDelete, Text: "e"},
+		{Op: textdiff.OpInsert, Text: "i"},
+		{Op: textdiff.OpEqual, Text: "n"},
+		{Op: textdiff.OpInsert, Text: "g"},
+	}, edits)
+
+	assert.Empty(t, textdiff.Runes("same", "same")[1:])
+	assert.Nil(t, textdiff.Runes("", ""))
+}
+
+func TestDiffReproducesBothTexts(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+
+	for i := 0; i < 200; i++ {
+		a := randomString(r, r.Intn(30))
+		b := randomString(r, r.Intn(30))
+
+		from, to := rebuild(textdiff.Runes(a, b))
+		assert.Equal(t, a, from)
+		assert.Equal(t, b, to)
+
+		a = strings.ReplaceAll(a, " ", "\n")
+		b = strings.ReplaceAll(b, " ", "\n")
+		from, to = rebuild(textdiff.Lines(a, b))
+		assert.Equal(t, a, from)
+		assert.Equal(t, b, to)
+	}
+}
@@ -0,0 +1,79 @@
+package unit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTokenTestService(t *testing.T) *user.Service {
+	db := newMigratedTestDB(t)
+
+	userRepo := user.NewSQLRepository(db)
+	utils.SetRevocationChecker(userRepo)
+	t.Cleanup(func() { utils.SetRevocationChecker(nil) })
+
+	return user.NewService(userRepo, logging.NewLogger())
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	userService := newTokenTestService(t)
+
+	_, err := userService.CreateUser("tokenuser", "Passw0rd!", "token@example.com", "", "", "")
+	assert.NoError(t, err)
+
+	pair, err := userService.AuthenticateUser("tokenuser", "Passw0rd!")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, pair.RefreshToken)
+
+	t.Run("rotation issues a new pair", func(t *testing.T) {
+		next, err := userService.RefreshTokens(pair.RefreshToken)
+		assert.NoError(t, err)
+		assert.NotEqual(t, pair.RefreshToken, next.RefreshToken)
+
+		_, err = utils.ValidateToken(next.AccessToken)
+		assert.NoError(t, err)
+
+		t.Run("reuse revokes the family", func(t *testing.T) {
+			_, err := userService.RefreshTokens(pair.RefreshToken)
+			assert.ErrorIs(t, err, user.ErrRefreshTokenReused)
+
+			_, err = userService.RefreshTokens(next.RefreshToken)
+			assert.ErrorIs(t, err, user.ErrRefreshTokenReused)
+
+			_, err = utils.ValidateToken(next.AccessToken)
+			assert.ErrorIs(t, err, utils.ErrTokenRevoked)
+		})
+	})
+
+	t.Run("unknown token", func(t *testing.T) {
+		_, err := userService.RefreshTokens("not-a-token")
+		assert.ErrorIs(t, err, user.ErrInvalidRefreshToken)
+	})
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	userService := newTokenTestService(t)
+
+	created, err := userService.CreateUser("logoutuser", "Passw0rd!", "logout@example.com", "", "", "")
+	assert.NoError(t, err)
+
+	pair, err := userService.AuthenticateUser("logoutuser", "Passw0rd!")
+	assert.NoError(t, err)
+
+	claims, err := utils.ValidateToken(pair.AccessToken)
+	assert.NoError(t, err)
+
+	err = userService.Logout(created.ID, claims.Id, time.Unix(claims.ExpiresAt, 0), pair.RefreshToken)
+	assert.NoError(t, err)
+
+	_, err = utils.ValidateToken(pair.AccessToken)
+	assert.ErrorIs(t, err, utils.ErrTokenRevoked)
+
+	_, err = userService.RefreshTokens(pair.RefreshToken)
+	assert.Error(t, err)
+}
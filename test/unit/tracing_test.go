@@ -0,0 +1,158 @@
+package unit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/config"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recordSpans installs a tracer provider that keeps finished spans in memory
+// for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	_, err := tracing.Setup(context.Background(), config.TracingConfig{Exporter: "none"}, "test")
+	require.NoError(t, err)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+
+	return exporter
+}
+
+func spansByName(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+	named := map[string]tracetest.SpanStub{}
+	for _, span := range spans {
+		named[span.Name] = span
+	}
+	return named
+}
+
+func TestTracingLogin(t *testing.T) {
+	exporter := recordSpans(t)
+
+	db := newMigratedTestDB(t)
+	require.NoError(t, db.Use(tracing.NewGormPlugin()))
+
+	userService := user.NewService(user.NewTracedRepository(user.NewSQLRepository(db)), logging.NewLogger())
+	_, err := userService.CreateUser("traceuser", "Passw0rd!", "trace@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// nothing is recorded outside a traced request
+	assert.Empty(t, exporter.GetSpans())
+
+	r := gin.New()
+	r.Use(tracing.Middleware())
+	r.POST("/api/users/login", user.NewHandler(userService).Login)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/users/login",
+		strings.NewReader(`{"userName":"traceuser","password":"Passw0rd!"}`))
+	req.Header.Set("traceparent", testTraceParent)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+
+	spans := spansByName(exporter.GetSpans())
+	server, ok := spans["POST /api/users/login"]
+	require.True(t, ok, "no server span in %v", spans)
+
+	// the request continues the caller's trace
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent.SpanID().String())
+
+	parents := map[string]string{
+		"user.Service/AuthenticateUser":      "POST /api/users/login",
+		"user.Repository/GetUserByUserName":  "user.Service/AuthenticateUser",
+		"bcrypt.compare":                     "user.Service/AuthenticateUser",
+		"user.Repository/CreateRefreshToken": "user.Service/AuthenticateUser",
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if assert.True(t, ok, "missing span %s", name) {
+			assert.Equal(t, spans[parent].SpanContext.SpanID(), span.Parent.SpanID(), "parent of %s", name)
+		}
+	}
+
+	var queries int
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "gorm.query" && span.Parent.SpanID() == spans["user.Repository/GetUserByUserName"].SpanContext.SpanID() {
+			queries++
+		}
+	}
+	assert.Equal(t, 1, queries)
+}
+
+func TestTracingTransportPropagates(t *testing.T) {
+	exporter := recordSpans(t)
+
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer upstream.Close()
+
+	r := gin.New()
+	r.Use(tracing.Middleware())
+	r.GET("/proxy", func(c *gin.Context) {
+		client := &http.Client{Transport: tracing.Transport(nil)}
+		req, _ := http.NewRequestWithContext(c.Request.Context(), http.MethodGet, upstream.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/proxy", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	header := <-received
+	assert.True(t, strings.HasPrefix(header, "00-4bf92f3577b34da6a3ce929d0e0e4736-"), "traceparent %q", header)
+
+	client := spansByName(exporter.GetSpans())["HTTP GET"]
+	assert.Contains(t, header, client.SpanContext.SpanID().String())
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	shutdown, err := tracing.Setup(context.Background(), config.TracingConfig{
+		Exporter:    "file",
+		File:        path,
+		SampleRatio: 1,
+	}, "user-service")
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "exported span")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"Name":"exported span"`)
+	assert.Contains(t, string(data), "user-service")
+}
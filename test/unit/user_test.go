@@ -8,12 +8,14 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestCreateUserHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.POST("/api/users", userHandler.Register)
@@ -37,6 +39,21 @@ func TestCreateUserHandler(t *testing.T) {
 		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest)
 	})
 
+	t.Run("duplicate username or email", func(t *testing.T) {
+		payload := `{"username": "ada", "password": "Passw0rd!", "email": "ada@example.com"}`
+		resp := postJSON(r, "/api/users", payload)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		for _, payload := range []string{
+			`{"username": "ada", "password": "Passw0rd!", "email": "other@example.com"}`,
+			`{"username": "ada2", "password": "Passw0rd!", "email": " ADA@example.com"}`,
+		} {
+			resp := postJSON(r, "/api/users", payload)
+			assert.Equal(t, http.StatusConflict, resp.Code)
+			assert.Equal(t, "user_exists", decodeProblem(t, resp).Code)
+		}
+	})
+
 	//invalid payload
 	t.Run("Invalid Payload", func(t *testing.T) {
 		invalidPayload := `{
@@ -56,7 +73,8 @@ func TestCreateUserHandler(t *testing.T) {
 
 func TestLoginHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.POST("/api/login", userHandler.Login)
@@ -79,7 +97,7 @@ func TestLoginHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusUnauthorized)
 	})
 
 	t.Run("invalid login credentials", func(t *testing.T) {
@@ -94,13 +112,14 @@ func TestLoginHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
 	})
 }
 
 func TestGetUserByUserNameHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.GET("/api/auth/users/user/:username", userHandler.GetUserByUserNameHandler)
@@ -118,7 +137,7 @@ func TestGetUserByUserNameHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
 	})
 
 	t.Run("invalid username", func(t *testing.T) {
@@ -128,13 +147,14 @@ func TestGetUserByUserNameHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
 	})
 }
 
 func TestGetUserByIDHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.GET("/api/auth/users/:id", userHandler.GetUserByIDHandler)
@@ -152,7 +172,7 @@ func TestGetUserByIDHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
 	})
 
 	t.Run("invalid id", func(t *testing.T) {
@@ -162,16 +182,20 @@ func TestGetUserByIDHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
 	})
 }
 
 func TestUpdateUserHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
-	r.PUT("/api/auth/users/:id", userHandler.UpdateUserHandler)
+	r.PUT("/api/auth/users/:id", func(c *gin.Context) {
+		// stands in for AuthMiddleware
+		c.Set("user_id", c.GetHeader("X-User"))
+	}, userHandler.UpdateUserHandler)
 
 	t.Run("successful update user", func(t *testing.T) {
 		registeredUser := &user.User{
@@ -195,7 +219,23 @@ func TestUpdateUserHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
+	})
+
+	t.Run("response shows the stored user", func(t *testing.T) {
+		created, err := userService.CreateUser("ada", "Passw0rd!", "ada@example.com", "Ada", "Lovelace", "")
+		assert.NoError(t, err)
+
+		req := httptest.NewRequest("PUT", "/api/auth/users/"+created.ID, strings.NewReader(`{"avatarURL": "https://example.com/ada.png"}`))
+		req.Header.Set("X-User", created.ID)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"avatarURL":"https://example.com/ada.png"`)
+		assert.Contains(t, resp.Body.String(), `"firstName":"Ada"`)
+		assert.Contains(t, resp.Body.String(), `"emailVerified":true`)
+		assert.Contains(t, resp.Body.String(), `"totpEnabled":false`)
 	})
 
 	t.Run("invalid update payload", func(t *testing.T) {
@@ -210,13 +250,14 @@ func TestUpdateUserHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
 	})
 }
 
 func TestDeleteUserHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.DELETE("/api/auth/users/:id", userHandler.DeleteUserHandler)
@@ -234,7 +275,7 @@ func TestDeleteUserHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
 	})
 
 	t.Run("invalid id", func(t *testing.T) {
@@ -244,13 +285,14 @@ func TestDeleteUserHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
 	})
 }
 
 func TestGetUserProfileHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.GET("/api/auth/users/profile", userHandler.GetUserProfileHandler)
@@ -268,13 +310,14 @@ func TestGetUserProfileHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
 	})
 }
 
 func TestFilterUserByNameHandler(t *testing.T) {
 	r := gin.Default()
-	userRepo := &user.Repository{}
+	r.Use(apierror.Middleware(nil))
+	userRepo := user.NewMemoryRepository()
 	userService := &user.Service{Repository: userRepo}
 	userHandler := user.NewHandler(userService)
 	r.GET("/api/auth/users/filter/:user", userHandler.FilterUserByNameHandler)
@@ -292,6 +335,6 @@ func TestFilterUserByNameHandler(t *testing.T) {
 		resp := httptest.NewRecorder()
 		r.ServeHTTP(resp, req)
 
-		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusInternalServerError)
+		assert.True(t, resp.Code == http.StatusOK || resp.Code == http.StatusBadRequest || resp.Code == http.StatusNotFound)
 	})
 }
@@ -0,0 +1,136 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newValidationTestRouter() *gin.Engine {
+	handler := user.NewHandler(user.NewService(user.NewMemoryRepository(), logging.NewLogger()))
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.POST("/api/users/register", handler.Register)
+	r.POST("/api/users/login", handler.Login)
+
+	return r
+}
+
+func postJSON(r *gin.Engine, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	return resp
+}
+
+// failedRules maps each failing field of a problem to its rule.
+func failedRules(t *testing.T, resp *httptest.ResponseRecorder) map[string]string {
+	problem := decodeProblem(t, resp)
+	assert.Equal(t, apierror.CodeValidationFailed, problem.Code)
+
+	rules := map[string]string{}
+	for _, fe := range problem.Errors {
+		rules[fe.Field] = fe.Rule
+		assert.NotEmpty(t, fe.Message)
+	}
+	return rules
+}
+
+func TestRegisterValidation(t *testing.T) {
+	r := newValidationTestRouter()
+
+	t.Run("every failing field is reported", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/register", `{
+			"userName": "a b",
+			"password": "short",
+			"email": "not-an-email",
+			"avatarURL": "javascript:alert(1)"
+		}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+
+		assert.Equal(t, map[string]string{
+			"userName":  "username",
+			"password":  "min",
+			"email":     "email",
+			"avatarURL": "httpurl",
+		}, failedRules(t, resp))
+	})
+
+	t.Run("reserved names", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/register", `{"userName":"Admin","password":"Passw0rd!","email":"a@example.com"}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, map[string]string{"userName": "notreserved"}, failedRules(t, resp))
+	})
+
+	t.Run("missing fields", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/register", `{}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, map[string]string{
+			"userName": "required",
+			"password": "required",
+			"email":    "required",
+		}, failedRules(t, resp))
+	})
+
+	t.Run("input is normalized", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/register", `{
+			"userName": "  ada.lovelace ",
+			"password": "Passw0rd!",
+			"email": " Ada@Example.COM ",
+			"avatarURL": "https://example.com/ada.png"
+		}`)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var body struct {
+			Data user.UserResponse `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &body))
+		assert.Equal(t, "ada.lovelace", body.Data.UserName)
+		assert.Equal(t, "ada@example.com", body.Data.Email)
+
+		resp = postJSON(r, "/api/users/login", `{"userName":"ada.lovelace ","password":"Passw0rd!"}`)
+		assert.Equal(t, http.StatusOK, resp.Code)
+	})
+
+	t.Run("malformed body", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/register", `{"userName": 7}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, apierror.CodeMalformedRequest, decodeProblem(t, resp).Code)
+	})
+}
+
+func TestCollaborationValidation(t *testing.T) {
+	r := newCollaborationTestRouter(t, "alice", "bob")
+
+	resp := doCollaborationRequest(r, "POST", "/api/collaborations", "alice", `{"name": "   "}`)
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, map[string]string{"name": "required"}, failedRules(t, resp))
+
+	resp = doCollaborationRequest(r, "POST", "/api/collaborations", "alice", `{"name": "roles", "userIds": [""]}`)
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, map[string]string{"userIds[0]": "required"}, failedRules(t, resp))
+
+	resp = doCollaborationRequest(r, "POST", "/api/collaborations", "alice", `{"name": "roles"}`)
+	require.Equal(t, http.StatusCreated, resp.Code)
+	var created struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(resp.Body.Bytes(), &created))
+
+	resp = doCollaborationRequest(r, "POST", "/api/collaborations/"+created.Data.ID+"/users", "alice", `{"userId": "bob", "role": "admin"}`)
+	require.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, map[string]string{"role": "oneof"}, failedRules(t, resp))
+}
@@ -0,0 +1,242 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/similadayo/internal/user"
+	"github.com/similadayo/pkg/apierror"
+	"github.com/similadayo/pkg/auth"
+	"github.com/similadayo/pkg/logging"
+	"github.com/similadayo/pkg/mail"
+	"github.com/similadayo/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSigner(t *testing.T) {
+	signer := utils.NewSigner([]byte("test-secret"))
+	token := signer.Sign("email-verification", "user-1", "ada@example.com", time.Hour)
+
+	subject, err := signer.Verify(token, "email-verification", "ada@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", subject)
+
+	_, err = signer.Verify(token, "email-verification", "eve@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenInvalid)
+
+	_, err = signer.Verify(token, "password-reset", "ada@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenInvalid)
+
+	_, err = utils.NewSigner([]byte("other-secret")).Verify(token, "email-verification", "ada@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenInvalid)
+
+	forged := utils.NewSigner([]byte("other-secret")).Sign("email-verification", "user-2", "ada@example.com", time.Hour)
+	_, signature, _ := strings.Cut(token, ".")
+	payload, _, _ := strings.Cut(forged, ".")
+	_, err = signer.Verify(payload+"."+signature, "email-verification", "ada@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenInvalid)
+
+	expired := signer.Sign("email-verification", "user-1", "ada@example.com", -time.Second)
+	_, err = signer.Verify(expired, "email-verification", "ada@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenExpired)
+
+	_, err = signer.Verify("garbage", "email-verification", "ada@example.com")
+	assert.ErrorIs(t, err, utils.ErrSignedTokenInvalid)
+}
+
+func TestMailFormat(t *testing.T) {
+	msg := mail.Format("no-reply@example.com", mail.Message{
+		To:      "ada@example.com\r\nBcc: eve@example.com",
+		Subject: "Hello",
+		Body:    "line one\nline two",
+	}, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	assert.Contains(t, string(msg), "To: ada@example.comBcc: eve@example.com\r\n")
+	assert.NotContains(t, string(msg), "\r\nBcc:")
+	assert.Contains(t, string(msg), "\r\n\r\nline one\r\nline two")
+}
+
+func newVerificationTestService(t *testing.T, access string) (*user.Service, *mail.MemoryOutbox) {
+	outbox := mail.NewMemoryOutbox("no-reply@example.com")
+
+	service := user.NewService(user.NewSQLRepository(newMigratedTestDB(t)), logging.NewLogger())
+	service.Verification = &user.Verification{
+		Mailer:         outbox,
+		Signer:         utils.NewSigner([]byte("test-secret")),
+		LinkURL:        "https://example.com/api/users/verify",
+		TokenTTL:       time.Hour,
+		ResendInterval: time.Minute,
+		Access:         access,
+	}
+
+	return service, outbox
+}
+
+// verificationToken returns the token in the link of a verification email.
+func verificationToken(t *testing.T, msg mail.Message) string {
+	start := strings.Index(msg.Body, "https://example.com/api/users/verify?")
+	require.GreaterOrEqual(t, start, 0, msg.Body)
+
+	link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+	require.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func TestEmailVerification(t *testing.T) {
+	service, outbox := newVerificationTestService(t, auth.UnverifiedReadOnly)
+	handler := user.NewHandler(service)
+
+	r := gin.New()
+	r.Use(apierror.Middleware(nil))
+	r.GET("/api/users/verify", handler.VerifyEmail)
+	r.POST("/api/users/verify", handler.VerifyEmail)
+	r.POST("/api/users/verify/resend", handler.ResendVerification)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	assert.False(t, created.EmailVerified)
+
+	require.Len(t, outbox.Messages(), 1)
+	msg := outbox.Messages()[0]
+	assert.Equal(t, "ada@example.com", msg.To)
+	token := verificationToken(t, msg)
+
+	// unverified users may sign in, but their tokens say so
+	pair, err := service.AuthenticateUser("ada", "Passw0rd!")
+	require.NoError(t, err)
+	claims, err := utils.ValidateToken(pair.AccessToken)
+	require.NoError(t, err)
+	assert.True(t, claims.Unverified)
+
+	t.Run("resend is throttled", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/verify/resend", `{"email":"ada@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, resp.Code)
+		assert.Len(t, outbox.Messages(), 1)
+	})
+
+	t.Run("resend to an unknown address", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/verify/resend", `{"email":"nobody@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, resp.Code)
+		assert.Len(t, outbox.Messages(), 1)
+	})
+
+	t.Run("tampered token", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/users/verify?token="+url.QueryEscape(token+"x"), nil))
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, "invalid_verification_token", decodeProblem(t, resp).Code)
+	})
+
+	t.Run("missing token", func(t *testing.T) {
+		resp := postJSON(r, "/api/users/verify", `{}`)
+		require.Equal(t, http.StatusBadRequest, resp.Code)
+		assert.Equal(t, map[string]string{"token": "required"}, failedRules(t, resp))
+	})
+
+	t.Run("link verifies the address", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/api/users/verify?token="+url.QueryEscape(token), nil))
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"emailVerified":true`)
+
+		verified, err := service.GetUserByID(created.ID)
+		require.NoError(t, err)
+		assert.True(t, verified.EmailVerified)
+		assert.NotNil(t, verified.EmailVerifiedAt)
+
+		// refreshed access tokens pick up the change
+		next, err := service.RefreshTokens(pair.RefreshToken)
+		require.NoError(t, err)
+		claims, err := utils.ValidateToken(next.AccessToken)
+		require.NoError(t, err)
+		assert.False(t, claims.Unverified)
+
+		resp = postJSON(r, "/api/users/verify/resend", `{"email":"ada@example.com"}`)
+		assert.Equal(t, http.StatusAccepted, resp.Code)
+		assert.Len(t, outbox.Messages(), 1)
+	})
+}
+
+func TestResendVerificationMailFailure(t *testing.T) {
+	service, _ := newVerificationTestService(t, auth.UnverifiedReadOnly)
+	service.Verification.Mailer = failingMailer{}
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	// a registered address is answered like an unknown one
+	assert.NoError(t, service.ResendVerification("ada@example.com"))
+	assert.NoError(t, service.ResendVerification("nobody@example.com"))
+}
+
+func TestEmailVerificationBoundToAddress(t *testing.T) {
+	service, outbox := newVerificationTestService(t, auth.UnverifiedReadOnly)
+
+	created, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+	token := verificationToken(t, outbox.Messages()[0])
+
+	_, err = service.UpdateUser(user.User{ID: created.ID, Email: "eve@example.com"})
+	require.NoError(t, err)
+
+	_, err = service.VerifyEmail(token)
+	assert.ErrorIs(t, err, user.ErrInvalidVerificationToken)
+}
+
+func TestUnverifiedLoginRefused(t *testing.T) {
+	service, _ := newVerificationTestService(t, auth.UnverifiedNone)
+
+	_, err := service.CreateUser("ada", "Passw0rd!", "ada@example.com", "", "", "")
+	require.NoError(t, err)
+
+	_, err = service.AuthenticateUser("ada", "Passw0rd!")
+	assert.ErrorIs(t, err, auth.ErrEmailNotVerified)
+
+	// the password is still checked first
+	_, err = service.AuthenticateUser("ada", "wrong")
+	assert.ErrorIs(t, err, user.ErrInvalidPassword)
+}
+
+func TestVerifiedEmailMiddleware(t *testing.T) {
+	unverified, _, err := utils.IssueAccessToken(&utils.Claims{UserID: "ada", Unverified: true})
+	require.NoError(t, err)
+	verified, _, err := utils.IssueAccessToken(&utils.Claims{UserID: "bob"})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		access string
+		token  string
+		method string
+		status int
+	}{
+		{auth.UnverifiedReadOnly, unverified, http.MethodGet, http.StatusOK},
+		{auth.UnverifiedReadOnly, unverified, http.MethodPut, http.StatusForbidden},
+		{auth.UnverifiedReadOnly, verified, http.MethodPut, http.StatusOK},
+		{auth.UnverifiedNone, unverified, http.MethodGet, http.StatusForbidden},
+		{auth.UnverifiedFull, unverified, http.MethodPut, http.StatusOK},
+	} {
+		t.Run(tc.access+" "+tc.method, func(t *testing.T) {
+			r := gin.New()
+			r.Use(apierror.Middleware(nil), auth.AuthMiddleware(), auth.VerifiedEmailMiddleware(tc.access))
+			r.Handle(tc.method, "/items", func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(tc.method, "/items", nil)
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+
+			require.Equal(t, tc.status, resp.Code)
+			if tc.status == http.StatusForbidden {
+				assert.Equal(t, "email_not_verified", decodeProblem(t, resp).Code)
+			}
+		})
+	}
+}